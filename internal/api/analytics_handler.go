@@ -0,0 +1,58 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+const (
+	defaultStatsWeeks = 12
+	maxStatsWeeks     = 104
+)
+
+type AnalyticsHandler struct {
+	analyticsStore store.AnalyticsStore
+	logger         *log.Logger
+}
+
+func NewAnalyticsHandler(analyticsStore store.AnalyticsStore, logger *log.Logger) *AnalyticsHandler {
+	return &AnalyticsHandler{
+		analyticsStore: analyticsStore,
+		logger:         logger,
+	}
+}
+
+// HandleGetWeeklyStats returns the user's totals for each of the last
+// ?weeks= weeks they worked out in. The totals are refreshed every 15
+// minutes, so the latest workouts may be missing.
+func (h *AnalyticsHandler) HandleGetWeeklyStats(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	weeks := defaultStatsWeeks
+
+	if raw := r.URL.Query().Get("weeks"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxStatsWeeks {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "weeks must be between 1 and 104"})
+			return
+		}
+		weeks = n
+	}
+
+	since := time.Now().UTC().AddDate(0, 0, -7*weeks)
+
+	stats, err := h.analyticsStore.GetWeeklyStatsHistory(currentUser.ID, since)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getWeeklyStatsHistory: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"weeks": stats})
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/tokens"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+type APIKeyHandler struct {
+	apiKeyStore store.APIKeyStore
+	logger      *log.Logger
+}
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func NewAPIKeyHandler(apiKeyStore store.APIKeyStore, logger *log.Logger) *APIKeyHandler {
+	return &APIKeyHandler{
+		apiKeyStore: apiKeyStore,
+		logger:      logger,
+	}
+}
+
+func validateAPIKeyRequest(req *createAPIKeyRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+
+	if req.Name == "" {
+		return errors.New("name is required")
+	}
+
+	if len(req.Name) > 100 {
+		return errors.New("name too long")
+	}
+
+	if len(req.Scopes) == 0 {
+		return errors.New("scopes is required")
+	}
+
+	for _, scope := range req.Scopes {
+		if !slices.Contains(tokens.APIScopes, scope) {
+			return errors.New("unknown scope " + strconv.Quote(scope))
+		}
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
+
+	return nil
+}
+
+// HandleCreateAPIKey creates a key and returns it. This is the only time
+// the key is shown.
+func (h *APIKeyHandler) HandleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if err := validateAPIKeyRequest(&req); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	secret, err := tokens.GenerateAPIKey()
+
+	if err != nil {
+		h.logger.Printf("ERROR: generating api key: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	slices.Sort(req.Scopes)
+
+	key := &store.APIKey{
+		UserID:    middleware.GetUser(r).ID,
+		Name:      req.Name,
+		Scopes:    slices.Compact(req.Scopes),
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	err = h.apiKeyStore.CreateAPIKey(key, secret)
+
+	if err != nil {
+		h.logger.Printf("ERROR: createAPIKey: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"api_key": key, "key": secret.Plaintext})
+}
+
+func (h *APIKeyHandler) HandleGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.apiKeyStore.GetAPIKeys(middleware.GetUser(r).ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getAPIKeys: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"api_keys": keys})
+}
+
+func (h *APIKeyHandler) HandleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid api key id"})
+		return
+	}
+
+	err = h.apiKeyStore.DeleteAPIKey(middleware.GetUser(r).ID, keyID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "api key not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: deleteAPIKey: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
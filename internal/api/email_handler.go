@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/rpstvs/fm-goapp/internal/mail"
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+type EmailHandler struct {
+	preferenceStore   store.EmailPreferenceStore
+	unsubscribeSecret []byte
+	logger            *log.Logger
+}
+
+func NewEmailHandler(preferenceStore store.EmailPreferenceStore, unsubscribeSecret []byte, logger *log.Logger) *EmailHandler {
+	return &EmailHandler{
+		preferenceStore:   preferenceStore,
+		unsubscribeSecret: unsubscribeSecret,
+		logger:            logger,
+	}
+}
+
+// emailPreferences maps every category to whether the user gets it.
+func (h *EmailHandler) emailPreferences(userID int) (map[string]bool, error) {
+	optOuts, err := h.preferenceStore.GetEmailOptOuts(userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	preferences := make(map[string]bool, len(mail.Categories))
+	for _, category := range mail.Categories {
+		preferences[category] = !slices.Contains(optOuts, category)
+	}
+
+	return preferences, nil
+}
+
+func (h *EmailHandler) HandleGetPreferences(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	preferences, err := h.emailPreferences(currentUser.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getEmailOptOuts: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"preferences": preferences})
+}
+
+// HandleUpdatePreferences takes a map of categories to whether the user
+// wants them; categories left out are unchanged.
+func (h *EmailHandler) HandleUpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	var req map[string]bool
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	for category := range req {
+		if !slices.Contains(mail.Categories, category) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown email category " + strconv.Quote(category)})
+			return
+		}
+	}
+
+	for category, enabled := range req {
+		err = h.preferenceStore.SetEmailOptOut(currentUser.ID, category, !enabled)
+
+		if err != nil {
+			h.logger.Printf("ERROR: setEmailOptOut: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	preferences, err := h.emailPreferences(currentUser.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getEmailOptOuts: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"preferences": preferences})
+}
+
+func (h *EmailHandler) readUnsubscribeToken(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	userID, category, err := mail.ParseUnsubscribeToken(h.unsubscribeSecret, r.URL.Query().Get("token"))
+
+	if err != nil || !slices.Contains(mail.Categories, category) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid unsubscribe link"})
+		return 0, "", false
+	}
+
+	return userID, category, true
+}
+
+// HandleGetUnsubscribe describes the unsubscribe link without acting on it,
+// since mail scanners follow links in email. The page it backs confirms
+// with a POST.
+func (h *EmailHandler) HandleGetUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	userID, category, ok := h.readUnsubscribeToken(w, r)
+
+	if !ok {
+		return
+	}
+
+	optedOut, err := h.preferenceStore.IsOptedOut(userID, category)
+
+	if err != nil {
+		h.logger.Printf("ERROR: isOptedOut: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"category": category, "subscribed": !optedOut})
+}
+
+// HandleUnsubscribe opts the user in the link out of its category. It is
+// also the RFC 8058 one-click target, so it needs nothing but the token.
+func (h *EmailHandler) HandleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	userID, category, ok := h.readUnsubscribeToken(w, r)
+
+	if !ok {
+		return
+	}
+
+	err := h.preferenceStore.SetEmailOptOut(userID, category, true)
+
+	if err != nil {
+		h.logger.Printf("ERROR: setEmailOptOut: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"category": category, "subscribed": false})
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/live"
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+const (
+	eventBatchSize      = 100
+	eventHeartbeat      = 15 * time.Second
+	eventRetryMillis    = 3000
+	eventResetEventType = "reset"
+)
+
+type EventHandler struct {
+	eventStore store.AccountEventStore
+	broker     *live.Broker
+	logger     *log.Logger
+}
+
+func NewEventHandler(eventStore store.AccountEventStore, broker *live.Broker, logger *log.Logger) *EventHandler {
+	return &EventHandler{
+		eventStore: eventStore,
+		broker:     broker,
+		logger:     logger,
+	}
+}
+
+// lastEventID reads where a stream resumes from. Browsers send the
+// Last-Event-ID header when they reconnect; clients that cannot set
+// headers on the first request can pass last_event_id instead.
+func lastEventID(r *http.Request) (int64, bool, error) {
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("last_event_id")
+	}
+
+	if raw == "" {
+		return 0, false, nil
+	}
+
+	seq, err := strconv.ParseInt(raw, 10, 64)
+
+	if err != nil || seq < 0 {
+		return 0, false, errors.New("invalid Last-Event-ID")
+	}
+
+	return seq, true, nil
+}
+
+// HandleEvents streams the user's account events as Server-Sent Events.
+// Each event's id is its seq, so a reconnecting client picks up right
+// after the last event it received. A client that has been away longer
+// than the log is kept gets a reset event and should reload its data.
+//
+// EventSource can't send an Authorization header, so browsers connect with
+// a stream ticket instead. A ticket only works once: rather than letting
+// EventSource retry with the same url, a browser gets a new ticket and
+// reconnects with it and last_event_id.
+func (h *EventHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	after, resuming, err := lastEventID(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	// subscribe before reading the log so nothing recorded in between is
+	// missed
+	wake, unsubscribe := h.broker.Subscribe(currentUser.ID)
+	defer unsubscribe()
+
+	if !resuming {
+		after, err = h.eventStore.GetLatestEventSeq(currentUser.ID)
+
+		if err != nil {
+			h.logger.Printf("ERROR: getLatestEventSeq: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+
+	// the stream outlives the server's write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		h.logger.Printf("ERROR: events: clearing write deadline: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetryMillis)
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		after, err = h.sendEventsSince(w, currentUser.ID, after)
+
+		if err != nil {
+			h.logger.Printf("ERROR: events: %v", err)
+			return
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wake:
+		case <-heartbeat.C:
+			// keeps proxies from closing an idle stream, and the log is
+			// read again in case a notification was lost while the
+			// listener reconnected
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sendEventsSince writes every logged event after seq after and returns
+// the seq of the last one written.
+func (h *EventHandler) sendEventsSince(w http.ResponseWriter, userID int, after int64) (int64, error) {
+	for {
+		events, err := h.eventStore.GetEventsSince(userID, after, eventBatchSize)
+
+		if errors.Is(err, store.ErrEventLogTruncated) {
+			latest, err := h.eventStore.GetLatestEventSeq(userID)
+
+			if err != nil {
+				return after, err
+			}
+
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: {}\n\n", latest, eventResetEventType)
+			return latest, err
+		}
+
+		if err != nil {
+			return after, err
+		}
+
+		for _, event := range events {
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, event.Data)
+
+			if err != nil {
+				return after, err
+			}
+
+			after = event.Seq
+		}
+
+		if len(events) < eventBatchSize {
+			return after, nil
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+const (
+	defaultJobLimit = 50
+	maxJobLimit     = 500
+)
+
+type JobHandler struct {
+	jobStore store.JobStore
+	logger   *log.Logger
+}
+
+func NewJobHandler(jobStore store.JobStore, logger *log.Logger) *JobHandler {
+	return &JobHandler{
+		jobStore: jobStore,
+		logger:   logger,
+	}
+}
+
+// HandleGetJobs lists recent jobs, filtered by ?status= and ?kind=, along
+// with a count of all jobs by kind and status.
+func (h *JobHandler) HandleGetJobs(w http.ResponseWriter, r *http.Request) {
+	filter := store.JobFilter{
+		Status: r.URL.Query().Get("status"),
+		Kind:   r.URL.Query().Get("kind"),
+		Limit:  defaultJobLimit,
+	}
+
+	switch filter.Status {
+	case "", store.JobQueued, store.JobRunning, store.JobSucceeded, store.JobFailed:
+	default:
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "status must be queued, running, succeeded or failed"})
+		return
+	}
+
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxJobLimit {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit must be between 1 and 500"})
+			return
+		}
+		filter.Limit = n
+	}
+
+	jobs, err := h.jobStore.GetJobs(filter)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getJobs: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	counts, err := h.jobStore.CountJobs()
+
+	if err != nil {
+		h.logger.Printf("ERROR: countJobs: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"jobs": jobs, "counts": counts})
+}
+
+func (h *JobHandler) HandleGetJob(w http.ResponseWriter, r *http.Request) {
+	jobID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid job id"})
+		return
+	}
+
+	job, err := h.jobStore.GetJob(jobID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getJob: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if job == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "job not found"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"job": job})
+}
+
+func (h *JobHandler) HandleRetryJob(w http.ResponseWriter, r *http.Request) {
+	jobID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid job id"})
+		return
+	}
+
+	err = h.jobStore.RetryJob(jobID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "no failed job with that id"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: retryJob: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"message": "job queued"})
+}
+
+func (h *JobHandler) HandleGetWorkers(w http.ResponseWriter, r *http.Request) {
+	workers, err := h.jobStore.GetWorkers()
+
+	if err != nil {
+		h.logger.Printf("ERROR: getWorkers: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workers": workers})
+}
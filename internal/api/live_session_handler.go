@@ -0,0 +1,535 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/gorilla/websocket"
+	"github.com/rpstvs/fm-goapp/internal/live"
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+
+	maxRestSeconds = 60 * 60
+
+	// a set goes out whole in a NOTIFY payload, which Postgres caps at 8000
+	// bytes; these leave room for JSON escaping every character
+	maxSetExerciseNameLength = 255
+	maxSetNotesLength        = 1000
+)
+
+type LiveSessionHandler struct {
+	sessionStore store.LiveSessionStore
+	userStore    store.UserStore
+	hub          *live.Hub
+	upgrader     websocket.Upgrader
+	logger       *log.Logger
+}
+
+type startSessionRequest struct {
+	Title string `json:"title"`
+}
+
+type addViewerRequest struct {
+	Username string `json:"username"`
+}
+
+type restTimerRequest struct {
+	Seconds int `json:"seconds"`
+}
+
+// NewLiveSessionHandler serves live sessions for the site at baseURL; only
+// pages from that origin may open a viewer's WebSocket.
+func NewLiveSessionHandler(sessionStore store.LiveSessionStore, userStore store.UserStore, hub *live.Hub, baseURL string, logger *log.Logger) *LiveSessionHandler {
+	return &LiveSessionHandler{
+		sessionStore: sessionStore,
+		userStore:    userStore,
+		hub:          hub,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     sameOrigin(baseURL),
+		},
+		logger: logger,
+	}
+}
+
+// sameOrigin accepts WebSocket upgrades from pages served at baseURL.
+// Requests without an Origin header don't come from a browser and can't be
+// forged by another site, so they are let through.
+func sameOrigin(baseURL string) func(r *http.Request) bool {
+	site, err := url.Parse(baseURL)
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+
+		if origin == "" {
+			return true
+		}
+
+		u, parseErr := url.Parse(origin)
+
+		if err != nil || parseErr != nil {
+			return false
+		}
+
+		return strings.EqualFold(u.Scheme, site.Scheme) && strings.EqualFold(u.Host, site.Host)
+	}
+}
+
+// loadOwnSession fetches the session in the url and checks that the
+// current user is running it. It writes the error response itself.
+func (h *LiveSessionHandler) loadOwnSession(w http.ResponseWriter, r *http.Request) (*store.LiveSession, bool) {
+	sessionID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid session id"})
+		return nil, false
+	}
+
+	session, err := h.sessionStore.GetSession(sessionID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getSession: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil, false
+	}
+
+	if session == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "session not found"})
+		return nil, false
+	}
+
+	if session.UserID != middleware.GetUser(r).ID {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "only the athlete can change this session"})
+		return nil, false
+	}
+
+	return session, true
+}
+
+func (h *LiveSessionHandler) HandleStartSession(w http.ResponseWriter, r *http.Request) {
+	var req startSessionRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || strings.TrimSpace(req.Title) == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "title is required"})
+		return
+	}
+
+	session := &store.LiveSession{
+		UserID: middleware.GetUser(r).ID,
+		Title:  req.Title,
+		Sets:   []store.LiveSessionSet{},
+	}
+
+	err = h.sessionStore.CreateSession(session)
+
+	if err != nil {
+		h.logger.Printf("ERROR: createSession: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"session": session})
+}
+
+func (h *LiveSessionHandler) HandleGetSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid session id"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	allowed, err := h.sessionStore.CanViewSession(sessionID, currentUser.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: canViewSession: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !allowed {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "session not found"})
+		return
+	}
+
+	session, err := h.sessionStore.GetSession(sessionID)
+
+	if err != nil || session == nil {
+		h.logger.Printf("ERROR: getSession: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"session": session})
+}
+
+func (h *LiveSessionHandler) HandleAddViewer(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.loadOwnSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req addViewerRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || req.Username == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "username is required"})
+		return
+	}
+
+	viewer, err := h.userStore.GetUserByUsername(req.Username)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getUserByUsername: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if viewer == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	err = h.sessionStore.AddViewer(session.ID, viewer.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: addViewer: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"viewer": viewer.Username})
+}
+
+func (h *LiveSessionHandler) HandleRemoveViewer(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.loadOwnSession(w, r)
+	if !ok {
+		return
+	}
+
+	viewerID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid user id"})
+		return
+	}
+
+	err = h.sessionStore.RemoveViewer(session.ID, viewerID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "viewer not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: removeViewer: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *LiveSessionHandler) HandleAddSet(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.loadOwnSession(w, r)
+	if !ok {
+		return
+	}
+
+	var set store.LiveSessionSet
+
+	err := json.NewDecoder(r.Body).Decode(&set)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid set"})
+		return
+	}
+
+	if strings.TrimSpace(set.ExerciseName) == "" || (set.Reps == nil) == (set.DurationSeconds == nil) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "a set needs an exercise_name and exactly one of reps or duration_seconds"})
+		return
+	}
+
+	if len(set.ExerciseName) > maxSetExerciseNameLength || len(set.Notes) > maxSetNotesLength {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "exercise_name or notes is too long"})
+		return
+	}
+
+	err = h.sessionStore.AddSet(session.ID, &set)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "session is finished"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: addSet: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"set": set})
+}
+
+func (h *LiveSessionHandler) HandleStartRest(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.loadOwnSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req restTimerRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || req.Seconds <= 0 || req.Seconds > maxRestSeconds {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "seconds must be between 1 and 3600"})
+		return
+	}
+
+	endsAt := time.Now().Add(time.Duration(req.Seconds) * time.Second).UTC()
+
+	err = h.sessionStore.SetRestTimer(session.ID, &endsAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "session is finished"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: setRestTimer: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"rest_ends_at": endsAt})
+}
+
+func (h *LiveSessionHandler) HandleCancelRest(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.loadOwnSession(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.sessionStore.SetRestTimer(session.ID, nil)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "session is finished"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: setRestTimer: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionWorkout turns the completed sets into a workout. Consecutive sets
+// of the same exercise with the same reps or duration and weight become a
+// single entry.
+func sessionWorkout(session *store.LiveSession, finishedAt time.Time) *store.Workout {
+	workout := &store.Workout{
+		UserID:          session.UserID,
+		Title:           session.Title,
+		DurationMinutes: max(1, int(math.Ceil(finishedAt.Sub(session.StartedAt).Minutes()))),
+		Entries:         []store.WorkoutEntry{},
+	}
+
+	for _, set := range session.Sets {
+		if n := len(workout.Entries); n > 0 {
+			last := &workout.Entries[n-1]
+			if last.ExerciseName == set.ExerciseName &&
+				equalIntPtr(last.Reps, set.Reps) &&
+				equalIntPtr(last.DurationSeconds, set.DurationSeconds) &&
+				equalFloatPtr(last.Weight, set.Weight) {
+				last.Sets++
+				if set.Notes != "" {
+					last.Notes = strings.TrimSpace(last.Notes + "\n" + set.Notes)
+				}
+				continue
+			}
+		}
+
+		workout.Entries = append(workout.Entries, store.WorkoutEntry{
+			ExerciseName:    set.ExerciseName,
+			Sets:            1,
+			Reps:            set.Reps,
+			DurationSeconds: set.DurationSeconds,
+			Weight:          set.Weight,
+			Notes:           set.Notes,
+			OrderIndex:      len(workout.Entries),
+		})
+	}
+
+	return workout
+}
+
+func equalIntPtr(a, b *int) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func equalFloatPtr(a, b *float64) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func (h *LiveSessionHandler) HandleFinishSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.loadOwnSession(w, r)
+	if !ok {
+		return
+	}
+
+	if session.FinishedAt != nil {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "session is already finished"})
+		return
+	}
+
+	if len(session.Sets) == 0 {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "session has no completed sets"})
+		return
+	}
+
+	workout, err := h.sessionStore.FinishSession(session.ID, sessionWorkout)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "session is already finished"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: finishSession: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workout": workout})
+}
+
+// HandleSubscribe upgrades to a WebSocket that first receives a snapshot of
+// the session and then every event as it happens.
+func (h *LiveSessionHandler) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid session id"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	allowed, err := h.sessionStore.CanViewSession(sessionID, currentUser.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: canViewSession: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !allowed {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "session not found"})
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		// the upgrader has already answered the client
+		return
+	}
+
+	defer conn.Close()
+
+	// subscribe before the snapshot so nothing falls in between; viewers
+	// dedupe sets by id
+	events, unsubscribe := h.hub.Subscribe(sessionID, currentUser.ID)
+	defer unsubscribe()
+
+	session, err := h.sessionStore.GetSession(sessionID)
+
+	if err != nil || session == nil {
+		h.logger.Printf("ERROR: getSession: %v", err)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""), time.Now().Add(wsWriteWait))
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	err = conn.WriteJSON(store.LiveSessionEvent{Type: "snapshot", SessionID: sessionID, Data: session})
+
+	if err != nil {
+		return
+	}
+
+	// viewers only listen, but reading is what processes pongs and notices
+	// the client going away
+	closed := make(chan struct{})
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case payload, ok := <-events:
+			if !ok {
+				// the hub drops viewers that fall behind and viewers that
+				// lost access; only the first should reconnect
+				msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "fell behind")
+				if allowed, err := h.sessionStore.CanViewSession(sessionID, currentUser.ID); err == nil && !allowed {
+					msg = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "access removed")
+				}
+
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+				return
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+
+		case <-closed:
+			return
+		}
+	}
+}
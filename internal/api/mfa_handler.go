@@ -0,0 +1,325 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/tokens"
+	"github.com/rpstvs/fm-goapp/internal/totp"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+const (
+	totpIssuer = "FM Workouts"
+	// codes from one step either side of now are accepted, to allow for
+	// a phone's clock being a little off
+	totpSkew = 1
+	// after this many wrong codes in a row, logins waiting on a second
+	// factor are revoked and have to start again from the password
+	mfaAttemptLimit = 5
+)
+
+type MFAHandler struct {
+	mfaStore store.MFAStore
+	logger   *log.Logger
+}
+
+// secondFactorRequest carries either a code from the user's authenticator
+// or one of their recovery codes.
+type secondFactorRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func NewMFAHandler(mfaStore store.MFAStore, logger *log.Logger) *MFAHandler {
+	return &MFAHandler{
+		mfaStore: mfaStore,
+		logger:   logger,
+	}
+}
+
+// checkSecondFactor reports whether req proves the user holds their
+// authenticator or a recovery code, spending the code if so.
+func checkSecondFactor(mfaStore store.MFAStore, enrollment *store.TOTP, req *secondFactorRequest) (bool, error) {
+	if req.Code != "" {
+		step, ok := totp.Validate(enrollment.Secret, req.Code, time.Now(), totpSkew)
+
+		if !ok {
+			return false, nil
+		}
+
+		return mfaStore.UseTOTPStep(enrollment.UserID, step)
+	}
+
+	if req.RecoveryCode != "" {
+		return mfaStore.UseRecoveryCode(enrollment.UserID, req.RecoveryCode)
+	}
+
+	return false, nil
+}
+
+// verifySecondFactor checks req for a user with 2FA on and answers the
+// request if it fails. It reports whether the caller should go on.
+func verifySecondFactor(w http.ResponseWriter, mfaStore store.MFAStore, logger *log.Logger, enrollment *store.TOTP, req *secondFactorRequest) bool {
+	if req.Code == "" && req.RecoveryCode == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "code or recovery_code is required"})
+		return false
+	}
+
+	ok, err := checkSecondFactor(mfaStore, enrollment, req)
+
+	if err != nil {
+		logger.Printf("ERROR: checkSecondFactor: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return false
+	}
+
+	if ok {
+		return true
+	}
+
+	locked, err := mfaStore.RecordMFAFailure(enrollment.UserID, mfaAttemptLimit)
+
+	if err != nil {
+		logger.Printf("ERROR: recordMFAFailure: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return false
+	}
+
+	if locked {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "too many invalid codes, log in again"})
+		return false
+	}
+
+	utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid code"})
+	return false
+}
+
+func (h *MFAHandler) HandleGetMFA(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	enrollment, err := h.mfaStore.GetTOTP(currentUser.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getTOTP: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	remaining, err := h.mfaStore.CountRecoveryCodes(currentUser.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: countRecoveryCodes: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"totp_enabled":             enrollment.Enabled(),
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// HandleEnrollTOTP starts setting up an authenticator. 2FA isn't on until
+// the user confirms it with a code from the authenticator.
+func (h *MFAHandler) HandleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	secret, err := totp.GenerateSecret()
+
+	if err != nil {
+		h.logger.Printf("ERROR: generating totp secret: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.mfaStore.StartTOTPEnrollment(currentUser.ID, secret)
+
+	if errors.Is(err, store.ErrTOTPEnabled) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: startTOTPEnrollment: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(secret, totpIssuer, currentUser.Username),
+	})
+}
+
+// HandleConfirmTOTP turns 2FA on and returns the recovery codes. This is
+// the only time they are shown.
+func (h *MFAHandler) HandleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	var req secondFactorRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || req.Code == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "code is required"})
+		return
+	}
+
+	enrollment, err := h.mfaStore.GetTOTP(currentUser.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getTOTP: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if enrollment == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "no two-factor enrollment to confirm"})
+		return
+	}
+
+	if enrollment.Enabled() {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	step, ok := totp.Validate(enrollment.Secret, req.Code, time.Now(), totpSkew)
+
+	if !ok {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid code"})
+		return
+	}
+
+	recoveryCodes, err := tokens.GenerateRecoveryCodes(tokens.RecoveryCodeCount)
+
+	if err != nil {
+		h.logger.Printf("ERROR: generating recovery codes: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.mfaStore.ConfirmTOTP(currentUser.ID, step, recoveryCodes)
+
+	// confirmed by a racing request, or enrolled again in the meantime
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "enrollment changed, start again"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: confirmTOTP: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"recovery_codes": recoveryCodes})
+}
+
+// enabledTOTP returns the user's confirmed enrollment, answering the
+// request itself if there isn't one.
+func (h *MFAHandler) enabledTOTP(w http.ResponseWriter, userID int) *store.TOTP {
+	enrollment, err := h.mfaStore.GetTOTP(userID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getTOTP: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil
+	}
+
+	if !enrollment.Enabled() {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "two-factor authentication is not enabled"})
+		return nil
+	}
+
+	return enrollment
+}
+
+// HandleDisableTOTP turns 2FA off. It takes a code, so a stolen session
+// alone can't do it.
+func (h *MFAHandler) HandleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	var req secondFactorRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	enrollment := h.enabledTOTP(w, currentUser.ID)
+
+	if enrollment == nil {
+		return
+	}
+
+	if !verifySecondFactor(w, h.mfaStore, h.logger, enrollment, &req) {
+		return
+	}
+
+	err = h.mfaStore.DisableTOTP(currentUser.ID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "two-factor authentication is not enabled"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: disableTOTP: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRegenerateRecoveryCodes replaces the user's recovery codes, for
+// when they have used up or lost them.
+func (h *MFAHandler) HandleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	var req secondFactorRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	enrollment := h.enabledTOTP(w, currentUser.ID)
+
+	if enrollment == nil {
+		return
+	}
+
+	if !verifySecondFactor(w, h.mfaStore, h.logger, enrollment, &req) {
+		return
+	}
+
+	recoveryCodes, err := tokens.GenerateRecoveryCodes(tokens.RecoveryCodeCount)
+
+	if err != nil {
+		h.logger.Printf("ERROR: generating recovery codes: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.mfaStore.ReplaceRecoveryCodes(currentUser.ID, recoveryCodes)
+
+	if err != nil {
+		h.logger.Printf("ERROR: replaceRecoveryCodes: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"recovery_codes": recoveryCodes})
+}
@@ -0,0 +1,677 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/tokens"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+const (
+	// how long a user has to answer the consent screen
+	oauthRequestTTL      = 10 * time.Minute
+	authorizationCodeTTL = time.Minute
+	oauthAccessTokenTTL  = time.Hour
+	oauthRefreshTokenTTL = 90 * 24 * time.Hour
+)
+
+// oauthScopeDescriptions are shown on the consent screen.
+var oauthScopeDescriptions = map[string]string{
+	tokens.OAuthScopeOpenID:      "Know who you are on FM Workouts",
+	tokens.OAuthScopeProfile:     "See your username",
+	tokens.OAuthScopeEmail:       "See your email address",
+	tokens.APIScopeWorkoutsRead:  "See your workouts",
+	tokens.APIScopeWorkoutsWrite: "Create, change and delete your workouts",
+	tokens.APIScopeAnalyticsRead: "See your training statistics",
+}
+
+// OAuthHandler is the OAuth 2.0 authorization server (RFC 6749), with
+// PKCE (RFC 7636) required for every client, and the OpenID Connect
+// endpoints on top of it.
+type OAuthHandler struct {
+	oauthStore      store.OAuthStore
+	signingKeyStore store.SigningKeyStore
+	userStore       store.UserStore
+	// issuer is the server's base URL, which its endpoints hang off
+	issuer string
+	logger *log.Logger
+}
+
+type createOAuthClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+	// Confidential clients run on a server and get a secret; public ones,
+	// like mobile apps, can't keep one.
+	Confidential bool `json:"confidential"`
+}
+
+type consentRequest struct {
+	Approve bool `json:"approve"`
+}
+
+type oauthScope struct {
+	Scope       string `json:"scope"`
+	Description string `json:"description"`
+}
+
+func NewOAuthHandler(oauthStore store.OAuthStore, signingKeyStore store.SigningKeyStore, userStore store.UserStore, issuer string, logger *log.Logger) *OAuthHandler {
+	return &OAuthHandler{
+		oauthStore:      oauthStore,
+		signingKeyStore: signingKeyStore,
+		userStore:       userStore,
+		issuer:          issuer,
+		logger:          logger,
+	}
+}
+
+// validRedirectURI accepts https URIs, http ones on the loopback interface
+// for apps listening locally, and private schemes for native apps.
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	case "javascript", "data", "file":
+		return false
+	}
+
+	// a private scheme, such as com.example.app:/callback
+	return strings.Contains(u.Scheme, ".")
+}
+
+func validateOAuthClientRequest(req *createOAuthClientRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+
+	if req.Name == "" {
+		return errors.New("name is required")
+	}
+
+	if len(req.Name) > 100 {
+		return errors.New("name too long")
+	}
+
+	if len(req.RedirectURIs) == 0 {
+		return errors.New("redirect_uris is required")
+	}
+
+	for _, uri := range req.RedirectURIs {
+		if !validRedirectURI(uri) {
+			return errors.New("invalid redirect uri " + strconv.Quote(uri))
+		}
+	}
+
+	if len(req.Scopes) == 0 {
+		return errors.New("scopes is required")
+	}
+
+	for _, scope := range req.Scopes {
+		if !slices.Contains(tokens.OAuthScopes, scope) {
+			return errors.New("unknown scope " + strconv.Quote(scope))
+		}
+	}
+
+	return nil
+}
+
+// HandleCreateClient registers an app. A confidential client's secret is
+// only shown now.
+func (h *OAuthHandler) HandleCreateClient(w http.ResponseWriter, r *http.Request) {
+	var req createOAuthClientRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if err := validateOAuthClientRequest(&req); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	clientID, err := tokens.GenerateClientID()
+
+	if err != nil {
+		h.logger.Printf("ERROR: generating client id: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	client := &store.OAuthClient{
+		ClientID:     clientID,
+		UserID:       middleware.GetUser(r).ID,
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		Scopes:       req.Scopes,
+	}
+
+	var secret string
+
+	if req.Confidential {
+		secret, client.SecretHash, err = tokens.GenerateOAuthSecret(tokens.OAuthClientSecretPrefix)
+
+		if err != nil {
+			h.logger.Printf("ERROR: generating client secret: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	err = h.oauthStore.CreateOAuthClient(client)
+
+	if err != nil {
+		h.logger.Printf("ERROR: createOAuthClient: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	response := utils.Envelope{"client": client}
+	if secret != "" {
+		response["client_secret"] = secret
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, response)
+}
+
+func (h *OAuthHandler) HandleGetClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := h.oauthStore.GetOAuthClients(middleware.GetUser(r).ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getOAuthClients: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"clients": clients})
+}
+
+func (h *OAuthHandler) HandleDeleteClient(w http.ResponseWriter, r *http.Request) {
+	id, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid client id"})
+		return
+	}
+
+	err = h.oauthStore.DeleteOAuthClient(middleware.GetUser(r).ID, id)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "client not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: deleteOAuthClient: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redirectURL adds params to a client's redirect URI, along with the
+// issuer so the client can tell which server answered (RFC 9207).
+func (h *OAuthHandler) redirectURL(redirectURI string, params url.Values) string {
+	u, _ := url.Parse(redirectURI)
+
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	query.Set("iss", h.issuer)
+
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (h *OAuthHandler) redirectError(w http.ResponseWriter, r *http.Request, redirectURI, state, code, description string) {
+	params := url.Values{"error": {code}, "error_description": {description}}
+	if state != "" {
+		params.Set("state", state)
+	}
+
+	http.Redirect(w, r, h.redirectURL(redirectURI, params), http.StatusFound)
+}
+
+// HandleAuthorize is the authorization endpoint. It checks the request and
+// sends the user to the consent screen, which the web app renders from
+// HandleGetAuthorizationRequest.
+func (h *OAuthHandler) HandleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	client, err := h.oauthStore.GetOAuthClient(query.Get("client_id"))
+
+	if err != nil {
+		h.logger.Printf("ERROR: getOAuthClient: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	// without a known client and one of its redirect URIs there is nowhere
+	// safe to send an error, so the user sees it instead
+	if client == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid_request", "error_description": "unknown client_id"})
+		return
+	}
+
+	redirectURI := query.Get("redirect_uri")
+
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+
+	if !client.HasRedirectURI(redirectURI) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid_request", "error_description": "redirect_uri is not registered for this client"})
+		return
+	}
+
+	state := query.Get("state")
+	scopes := strings.Fields(query.Get("scope"))
+
+	switch {
+	case query.Get("response_type") != "code":
+		h.redirectError(w, r, redirectURI, state, "unsupported_response_type", "only the code response type is supported")
+		return
+	case query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256":
+		h.redirectError(w, r, redirectURI, state, "invalid_request", "PKCE with the S256 method is required")
+		return
+	case len(scopes) == 0 || !client.AllowsScopes(scopes):
+		h.redirectError(w, r, redirectURI, state, "invalid_scope", "scope is missing or not allowed for this client")
+		return
+	case query.Get("prompt") == "none":
+		// consent always needs the user
+		h.redirectError(w, r, redirectURI, state, "consent_required", "the user has to consent")
+		return
+	}
+
+	id, err := tokens.GenerateOAuthRequestID()
+
+	if err == nil {
+		err = h.oauthStore.CreateOAuthRequest(&store.OAuthRequest{
+			ID:            id,
+			ClientID:      client.ClientID,
+			RedirectURI:   redirectURI,
+			Scopes:        scopes,
+			State:         state,
+			CodeChallenge: query.Get("code_challenge"),
+			Nonce:         query.Get("nonce"),
+			ExpiresAt:     time.Now().Add(oauthRequestTTL),
+		})
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: createOAuthRequest: %v", err)
+		h.redirectError(w, r, redirectURI, state, "server_error", "internal server error")
+		return
+	}
+
+	http.Redirect(w, r, h.issuer+"/oauth/consent?request_id="+url.QueryEscape(id), http.StatusFound)
+}
+
+// HandleGetAuthorizationRequest describes a pending authorization request
+// for the consent screen.
+func (h *OAuthHandler) HandleGetAuthorizationRequest(w http.ResponseWriter, r *http.Request) {
+	req, err := h.oauthStore.GetOAuthRequest(chi.URLParam(r, "id"))
+
+	if err != nil {
+		h.logger.Printf("ERROR: getOAuthRequest: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if req == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "authorization request not found or expired"})
+		return
+	}
+
+	client, err := h.oauthStore.GetOAuthClient(req.ClientID)
+
+	if err != nil || client == nil {
+		h.logger.Printf("ERROR: getOAuthClient: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	scopes := make([]oauthScope, len(req.Scopes))
+	for i, scope := range req.Scopes {
+		scopes[i] = oauthScope{Scope: scope, Description: oauthScopeDescriptions[scope]}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"request": map[string]any{
+		"id":           req.ID,
+		"client":       map[string]string{"client_id": client.ClientID, "name": client.Name},
+		"scopes":       scopes,
+		"redirect_uri": req.RedirectURI,
+		"expires_at":   req.ExpiresAt,
+	}})
+}
+
+// HandleAnswerAuthorizationRequest records the user's answer on the consent
+// screen and returns where to send the browser: back to the client, with
+// an authorization code if the user approved.
+func (h *OAuthHandler) HandleAnswerAuthorizationRequest(w http.ResponseWriter, r *http.Request) {
+	var answer consentRequest
+
+	err := json.NewDecoder(r.Body).Decode(&answer)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	req, err := h.oauthStore.ConsumeOAuthRequest(chi.URLParam(r, "id"))
+
+	if err != nil {
+		h.logger.Printf("ERROR: consumeOAuthRequest: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if req == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "authorization request not found or expired"})
+		return
+	}
+
+	params := url.Values{}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+
+	if !answer.Approve {
+		params.Set("error", "access_denied")
+		params.Set("error_description", "the user declined")
+		utils.WriteJSON(w, http.StatusOK, utils.Envelope{"redirect_to": h.redirectURL(req.RedirectURI, params)})
+		return
+	}
+
+	code, hash, err := tokens.GenerateOAuthSecret("")
+
+	if err != nil {
+		h.logger.Printf("ERROR: generating authorization code: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	authTime := time.Now()
+	if session := middleware.GetSession(r); session != nil {
+		authTime = session.CreatedAt
+	}
+
+	err = h.oauthStore.CreateAuthorizationCode(&store.AuthorizationCode{
+		ClientID:      req.ClientID,
+		UserID:        middleware.GetUser(r).ID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        req.Scopes,
+		CodeChallenge: req.CodeChallenge,
+		Nonce:         req.Nonce,
+		AuthTime:      authTime,
+		ExpiresAt:     time.Now().Add(authorizationCodeTTL),
+	}, hash)
+
+	if err != nil {
+		h.logger.Printf("ERROR: createAuthorizationCode: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	params.Set("code", code)
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"redirect_to": h.redirectURL(req.RedirectURI, params)})
+}
+
+// oauthError answers a token, introspection or revocation request with an
+// error in the RFC 6749 §5.2 format.
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	utils.WriteJSON(w, status, utils.Envelope{"error": code, "error_description": description})
+}
+
+// authenticateClient identifies the client making a back channel request,
+// by HTTP Basic or by client_id and client_secret in the form. Public
+// clients only send their client_id. It answers the request itself and
+// returns nil if that fails.
+func (h *OAuthHandler) authenticateClient(w http.ResponseWriter, r *http.Request) *store.OAuthClient {
+	clientID, secret, basic := r.BasicAuth()
+
+	if basic {
+		// RFC 6749 §2.3.1 form-encodes both before Basic encoding them
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := h.oauthStore.GetOAuthClient(clientID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getOAuthClient: %v", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "internal server error")
+		return nil
+	}
+
+	if client == nil || (client.Confidential && !tokens.VerifyOAuthSecret(secret, client.SecretHash)) {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil
+	}
+
+	return client
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// HandleToken is the token endpoint, for the authorization_code and
+// refresh_token grants.
+func (h *OAuthHandler) HandleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "the body must be form encoded")
+		return
+	}
+
+	client := h.authenticateClient(w, r)
+
+	if client == nil {
+		return
+	}
+
+	var pair *store.OAuthTokenPair
+	var code *store.AuthorizationCode
+	var err error
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, err = h.oauthStore.RedeemAuthorizationCode(tokens.HashOAuthSecret(r.PostForm.Get("code")))
+
+		if errors.Is(err, store.ErrAuthorizationCodeReused) {
+			h.logger.Printf("authorization code reused by client %s, grant revoked", client.ClientID)
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "authorization code was already used")
+			return
+		}
+
+		if err != nil {
+			break
+		}
+
+		if code == nil || code.ClientID != client.ClientID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+			return
+		}
+
+		if !tokens.VerifyPKCE(code.CodeChallenge, r.PostForm.Get("code_verifier")) {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match the code challenge")
+			return
+		}
+
+		pair, err = h.oauthStore.IssueOAuthTokens(code, oauthAccessTokenTTL, oauthRefreshTokenTTL)
+
+	case "refresh_token":
+		pair, err = h.oauthStore.RefreshOAuthTokens(r.PostForm.Get("refresh_token"), client.ClientID, strings.Fields(r.PostForm.Get("scope")), oauthAccessTokenTTL, oauthRefreshTokenTTL)
+
+		switch {
+		case errors.Is(err, store.ErrInvalidRefreshToken):
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "invalid or expired refresh token")
+			return
+		case errors.Is(err, store.ErrRefreshTokenReused):
+			h.logger.Printf("refresh token reused by client %s, grant revoked", client.ClientID)
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "refresh token was already used")
+			return
+		case errors.Is(err, store.ErrInvalidScope):
+			oauthError(w, http.StatusBadRequest, "invalid_scope", "scope exceeds what was granted")
+			return
+		}
+
+	default:
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: oauth token: %v", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "internal server error")
+		return
+	}
+
+	response := oauthTokenResponse{
+		AccessToken:  pair.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(pair.AccessExpiry).Round(time.Second).Seconds()),
+		RefreshToken: pair.RefreshToken,
+		Scope:        strings.Join(pair.Scopes, " "),
+	}
+
+	// an ID token is issued with the code; a refresh keeps the one the
+	// client has
+	if code != nil && slices.Contains(pair.Scopes, tokens.OAuthScopeOpenID) {
+		response.IDToken, err = h.idToken(code)
+
+		if err != nil {
+			h.logger.Printf("ERROR: signing id token: %v", err)
+			oauthError(w, http.StatusInternalServerError, "server_error", "internal server error")
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleIntrospect tells a client about one of its tokens (RFC 7662).
+// Other clients' tokens are reported inactive.
+func (h *OAuthHandler) HandleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "the body must be form encoded")
+		return
+	}
+
+	client := h.authenticateClient(w, r)
+
+	if client == nil {
+		return
+	}
+
+	// public clients can't prove who they are, so they can't introspect
+	if !client.Confidential {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "only confidential clients can introspect tokens")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	token, err := h.oauthStore.GetOAuthToken(r.PostForm.Get("token"))
+
+	if err != nil {
+		h.logger.Printf("ERROR: getOAuthToken: %v", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "internal server error")
+		return
+	}
+
+	if token == nil || token.ClientID != client.ClientID {
+		utils.WriteJSON(w, http.StatusOK, utils.Envelope{"active": false})
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(token.UserID)
+
+	if err != nil || user == nil {
+		h.logger.Printf("ERROR: getUserByID: %v", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "internal server error")
+		return
+	}
+
+	tokenType := "Bearer"
+	if token.Kind == store.OAuthRefreshToken {
+		tokenType = "refresh_token"
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"active":     true,
+		"scope":      strings.Join(token.Scopes, " "),
+		"client_id":  token.ClientID,
+		"username":   user.Username,
+		"sub":        strconv.Itoa(token.UserID),
+		"aud":        token.ClientID,
+		"iss":        h.issuer,
+		"token_type": tokenType,
+		"exp":        token.ExpiresAt.Unix(),
+		"iat":        token.CreatedAt.Unix(),
+	})
+}
+
+// HandleRevoke revokes one of a client's tokens (RFC 7009). It succeeds
+// for unknown tokens too, so it can't be used to probe for valid ones.
+func (h *OAuthHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "the body must be form encoded")
+		return
+	}
+
+	client := h.authenticateClient(w, r)
+
+	if client == nil {
+		return
+	}
+
+	err := h.oauthStore.RevokeOAuthToken(r.PostForm.Get("token"), client.ClientID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: revokeOAuthToken: %v", err)
+		oauthError(w, http.StatusServiceUnavailable, "temporarily_unavailable", "try again later")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/jose"
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/tokens"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+const (
+	idTokenTTL = time.Hour
+	// keyPublishDelay is how long a new signing key is published in the
+	// key set before ID tokens are signed with it, so clients that cache
+	// the key set already know it.
+	keyPublishDelay = time.Hour
+	jwksMaxAge      = 15 * time.Minute
+)
+
+// idTokenClaims are the claims of an OpenID Connect ID token.
+type idTokenClaims struct {
+	Issuer            string `json:"iss"`
+	Subject           string `json:"sub"`
+	Audience          string `json:"aud"`
+	ExpiresAt         int64  `json:"exp"`
+	IssuedAt          int64  `json:"iat"`
+	AuthTime          int64  `json:"auth_time"`
+	Nonce             string `json:"nonce,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     *bool  `json:"email_verified,omitempty"`
+}
+
+// userClaims fills in the claims about the user the scopes allow.
+func userClaims(claims *idTokenClaims, user *store.User, scopes []string) {
+	if slices.Contains(scopes, tokens.OAuthScopeProfile) {
+		claims.PreferredUsername = user.Username
+	}
+
+	if slices.Contains(scopes, tokens.OAuthScopeEmail) {
+		verified := user.EmailVerified()
+		claims.Email = user.Email
+		claims.EmailVerified = &verified
+	}
+}
+
+// signingKey picks the key to sign with: the newest one that has been
+// published for keyPublishDelay, or the newest one if none has.
+func signingKey(keys []store.SigningKey, now time.Time) *store.SigningKey {
+	for i := range keys {
+		if now.Sub(keys[i].CreatedAt) >= keyPublishDelay {
+			return &keys[i]
+		}
+	}
+
+	if len(keys) > 0 {
+		return &keys[0]
+	}
+
+	return nil
+}
+
+func (h *OAuthHandler) idToken(code *store.AuthorizationCode) (string, error) {
+	now := time.Now()
+
+	keys, err := h.signingKeyStore.GetSigningKeys(now)
+
+	if err != nil {
+		return "", err
+	}
+
+	key := signingKey(keys, now)
+
+	if key == nil {
+		return "", errors.New("no signing key")
+	}
+
+	user, err := h.userStore.GetUserByID(code.UserID)
+
+	if err != nil {
+		return "", err
+	}
+
+	if user == nil {
+		return "", errors.New("user " + strconv.Itoa(code.UserID) + " not found")
+	}
+
+	claims := idTokenClaims{
+		Issuer:    h.issuer,
+		Subject:   strconv.Itoa(code.UserID),
+		Audience:  code.ClientID,
+		ExpiresAt: now.Add(idTokenTTL).Unix(),
+		IssuedAt:  now.Unix(),
+		AuthTime:  code.AuthTime.Unix(),
+		Nonce:     code.Nonce,
+	}
+	userClaims(&claims, user, code.Scopes)
+
+	return jose.SignRS256(key.Key, key.KID, claims)
+}
+
+// HandleUserInfo returns the claims about the user the access token's
+// scopes allow.
+func (h *OAuthHandler) HandleUserInfo(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	claims := idTokenClaims{Subject: strconv.Itoa(user.ID)}
+
+	if token := middleware.GetOAuthToken(r); token != nil {
+		userClaims(&claims, user, token.Scopes)
+	} else {
+		userClaims(&claims, user, tokens.OAuthScopes)
+	}
+
+	response := utils.Envelope{"sub": claims.Subject}
+	if claims.PreferredUsername != "" {
+		response["preferred_username"] = claims.PreferredUsername
+	}
+	if claims.EmailVerified != nil {
+		response["email"] = claims.Email
+		response["email_verified"] = *claims.EmailVerified
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// HandleDiscovery serves the OpenID Provider metadata, which clients
+// configure themselves from.
+func (h *OAuthHandler) HandleDiscovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(jwksMaxAge.Seconds())))
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"issuer":                                         h.issuer,
+		"authorization_endpoint":                         h.issuer + "/oauth/authorize",
+		"token_endpoint":                                 h.issuer + "/oauth/token",
+		"userinfo_endpoint":                              h.issuer + "/oauth/userinfo",
+		"jwks_uri":                                       h.issuer + "/.well-known/jwks.json",
+		"introspection_endpoint":                         h.issuer + "/oauth/introspect",
+		"revocation_endpoint":                            h.issuer + "/oauth/revoke",
+		"scopes_supported":                               tokens.OAuthScopes,
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":                        []string{"public"},
+		"id_token_signing_alg_values_supported":          []string{jose.AlgRS256},
+		"code_challenge_methods_supported":               []string{"S256"},
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+		"claims_supported":                               []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username", "email", "email_verified"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+// HandleJWKS publishes the public halves of the signing keys, including
+// ones not signed with yet and retired ones whose tokens may still be in
+// use.
+func (h *OAuthHandler) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.signingKeyStore.GetSigningKeys(time.Now())
+
+	if err != nil {
+		h.logger.Printf("ERROR: getSigningKeys: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	set := jose.JWKS{Keys: make([]jose.JWK, len(keys))}
+	for i, key := range keys {
+		set.Keys[i] = jose.RSAPublicJWK(key.KID, &key.Key.PublicKey)
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(jwksMaxAge.Seconds())))
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"keys": set.Keys})
+}
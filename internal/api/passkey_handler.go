@@ -0,0 +1,333 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+	"github.com/rpstvs/fm-goapp/internal/webauthn"
+)
+
+type PasskeyHandler struct {
+	passkeyStore store.PasskeyStore
+	tokenStore   store.TokenStore
+	webauthn     *webauthn.Config
+	logger       *log.Logger
+}
+
+// attestationCredential is a PublicKeyCredential from
+// navigator.credentials.create(), as its toJSON() encodes it.
+type attestationCredential struct {
+	ID       string         `json:"id"`
+	RawID    webauthn.Bytes `json:"rawId"`
+	Type     string         `json:"type"`
+	Response struct {
+		ClientDataJSON    webauthn.Bytes `json:"clientDataJSON"`
+		AttestationObject webauthn.Bytes `json:"attestationObject"`
+		Transports        []string       `json:"transports"`
+	} `json:"response"`
+}
+
+// assertionCredential is a PublicKeyCredential from
+// navigator.credentials.get(), as its toJSON() encodes it.
+type assertionCredential struct {
+	ID       string         `json:"id"`
+	RawID    webauthn.Bytes `json:"rawId"`
+	Type     string         `json:"type"`
+	Response struct {
+		ClientDataJSON    webauthn.Bytes `json:"clientDataJSON"`
+		AuthenticatorData webauthn.Bytes `json:"authenticatorData"`
+		Signature         webauthn.Bytes `json:"signature"`
+		UserHandle        webauthn.Bytes `json:"userHandle"`
+	} `json:"response"`
+}
+
+type registerPasskeyRequest struct {
+	Name       string                `json:"name"`
+	Credential attestationCredential `json:"credential"`
+}
+
+func NewPasskeyHandler(passkeyStore store.PasskeyStore, tokenStore store.TokenStore, config *webauthn.Config, logger *log.Logger) *PasskeyHandler {
+	return &PasskeyHandler{
+		passkeyStore: passkeyStore,
+		tokenStore:   tokenStore,
+		webauthn:     config,
+		logger:       logger,
+	}
+}
+
+// userHandle is the id authenticators store a passkey's user under. It is
+// handed back on login, so it must not be the username or email.
+func userHandle(userID int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(userID))
+}
+
+// newChallenge creates and stores a challenge, answering the request
+// itself if that fails.
+func (h *PasskeyHandler) newChallenge(w http.ResponseWriter, ceremony string, userID int) []byte {
+	challenge, err := webauthn.NewChallenge()
+
+	if err == nil {
+		err = h.passkeyStore.CreateChallenge(challenge, ceremony, userID, webauthn.Timeout)
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: creating webauthn challenge: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil
+	}
+
+	return challenge
+}
+
+// HandleBeginRegistration returns the options to pass to
+// navigator.credentials.create() to add a passkey.
+func (h *PasskeyHandler) HandleBeginRegistration(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	passkeys, err := h.passkeyStore.GetPasskeys(currentUser.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getPasskeys: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	challenge := h.newChallenge(w, store.CeremonyRegistration, currentUser.ID)
+
+	if challenge == nil {
+		return
+	}
+
+	exclude := make([]webauthn.CredentialDescriptor, len(passkeys))
+	for i, passkey := range passkeys {
+		exclude[i] = webauthn.CredentialDescriptor{Type: "public-key", ID: passkey.CredentialID, Transports: passkey.Transports}
+	}
+
+	options := h.webauthn.CreationOptions(challenge, webauthn.User{
+		ID:          userHandle(currentUser.ID),
+		Name:        currentUser.Username,
+		DisplayName: currentUser.Username,
+	}, exclude)
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"options": options})
+}
+
+// HandleFinishRegistration checks the authenticator's response to the
+// options from HandleBeginRegistration and saves the new passkey.
+func (h *PasskeyHandler) HandleFinishRegistration(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	var req registerPasskeyRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+
+	if req.Name == "" {
+		req.Name = "Passkey"
+	}
+
+	if len(req.Name) > 100 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "name too long"})
+		return
+	}
+
+	challenge, err := webauthn.ChallengeOf(req.Credential.Response.ClientDataJSON)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid credential"})
+		return
+	}
+
+	userID, found, err := h.passkeyStore.ConsumeChallenge(challenge, store.CeremonyRegistration)
+
+	if err != nil {
+		h.logger.Printf("ERROR: consumeChallenge: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !found || userID != currentUser.ID {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown or expired challenge"})
+		return
+	}
+
+	credential, err := h.webauthn.VerifyRegistration(challenge, &webauthn.AttestationResponse{
+		ClientDataJSON:    req.Credential.Response.ClientDataJSON,
+		AttestationObject: req.Credential.Response.AttestationObject,
+	})
+
+	if err != nil {
+		h.logger.Printf("passkey registration rejected: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid credential"})
+		return
+	}
+
+	passkey := &store.Passkey{
+		UserID:            currentUser.ID,
+		Name:              req.Name,
+		CredentialID:      credential.ID,
+		PublicKey:         credential.PublicKey,
+		SignCount:         credential.SignCount,
+		AAGUID:            credential.AAGUID,
+		AttestationFormat: credential.AttestationFormat,
+		Transports:        req.Credential.Response.Transports,
+	}
+
+	err = h.passkeyStore.CreatePasskey(passkey)
+
+	if errors.Is(err, store.ErrPasskeyExists) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "passkey is already registered"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: createPasskey: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"passkey": passkey})
+}
+
+func (h *PasskeyHandler) HandleGetPasskeys(w http.ResponseWriter, r *http.Request) {
+	passkeys, err := h.passkeyStore.GetPasskeys(middleware.GetUser(r).ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getPasskeys: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"passkeys": passkeys})
+}
+
+func (h *PasskeyHandler) HandleDeletePasskey(w http.ResponseWriter, r *http.Request) {
+	passkeyID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid passkey id"})
+		return
+	}
+
+	err = h.passkeyStore.DeletePasskey(middleware.GetUser(r).ID, passkeyID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "passkey not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: deletePasskey: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleBeginLogin returns the options to pass to
+// navigator.credentials.get() to log in with a passkey.
+func (h *PasskeyHandler) HandleBeginLogin(w http.ResponseWriter, r *http.Request) {
+	challenge := h.newChallenge(w, store.CeremonyAuthentication, 0)
+
+	if challenge == nil {
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"options": h.webauthn.RequestOptions(challenge)})
+}
+
+// HandleFinishLogin checks the authenticator's response to the options
+// from HandleBeginLogin and logs the passkey's owner in. The passkey
+// proves possession and, with user verification, a PIN or biometric, so
+// it stands in for both the password and the second factor.
+func (h *PasskeyHandler) HandleFinishLogin(w http.ResponseWriter, r *http.Request) {
+	var req assertionCredential
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || len(req.RawID) == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	challenge, err := webauthn.ChallengeOf(req.Response.ClientDataJSON)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid credential"})
+		return
+	}
+
+	_, found, err := h.passkeyStore.ConsumeChallenge(challenge, store.CeremonyAuthentication)
+
+	if err != nil {
+		h.logger.Printf("ERROR: consumeChallenge: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !found {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "unknown or expired challenge"})
+		return
+	}
+
+	passkey, err := h.passkeyStore.GetPasskeyByCredentialID(req.RawID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getPasskeyByCredentialID: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if passkey == nil || (len(req.Response.UserHandle) > 0 && !bytes.Equal(req.Response.UserHandle, userHandle(passkey.UserID))) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid credentials"})
+		return
+	}
+
+	signCount, err := h.webauthn.VerifyAssertion(challenge, passkey.PublicKey, passkey.SignCount, &webauthn.AssertionResponse{
+		ClientDataJSON:    req.Response.ClientDataJSON,
+		AuthenticatorData: req.Response.AuthenticatorData,
+		Signature:         req.Response.Signature,
+		UserHandle:        req.Response.UserHandle,
+	})
+
+	if errors.Is(err, webauthn.ErrSignCountRegress) {
+		h.logger.Printf("WARNING: passkey %d of user %d: %v", passkey.ID, passkey.UserID, err)
+	}
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid credentials"})
+		return
+	}
+
+	used, err := h.passkeyStore.UsePasskey(passkey.ID, passkey.SignCount, signCount, time.Now())
+
+	if err != nil {
+		h.logger.Printf("ERROR: usePasskey: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !used {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid credentials"})
+		return
+	}
+
+	createSession(w, r, h.tokenStore, h.logger, passkey.UserID)
+}
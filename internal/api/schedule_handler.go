@@ -0,0 +1,85 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/rpstvs/fm-goapp/internal/scheduler"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+const (
+	defaultScheduledRunLimit = 50
+	maxScheduledRunLimit     = 500
+)
+
+type ScheduleHandler struct {
+	scheduleStore store.ScheduleStore
+	scheduler     *scheduler.Scheduler
+	logger        *log.Logger
+}
+
+func NewScheduleHandler(scheduleStore store.ScheduleStore, scheduler *scheduler.Scheduler, logger *log.Logger) *ScheduleHandler {
+	return &ScheduleHandler{
+		scheduleStore: scheduleStore,
+		scheduler:     scheduler,
+		logger:        logger,
+	}
+}
+
+type scheduleStatus struct {
+	scheduler.EntryStatus
+	LastRun *store.ScheduledRun `json:"last_run"`
+}
+
+// HandleGetSchedules lists the scheduled jobs with their next and last
+// runs. Whether a job is running is only known to the leader; leader in
+// the response says if that is the replica answering.
+func (h *ScheduleHandler) HandleGetSchedules(w http.ResponseWriter, r *http.Request) {
+	runs, err := h.scheduleStore.GetLatestScheduledRuns()
+
+	if err != nil {
+		h.logger.Printf("ERROR: getLatestScheduledRuns: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	lastRuns := make(map[string]*store.ScheduledRun, len(runs))
+	for i := range runs {
+		lastRuns[runs[i].Name] = &runs[i]
+	}
+
+	schedules := []scheduleStatus{}
+	for _, entry := range h.scheduler.Entries() {
+		schedules = append(schedules, scheduleStatus{EntryStatus: entry, LastRun: lastRuns[entry.Name]})
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"schedules": schedules, "leader": h.scheduler.Leader()})
+}
+
+func (h *ScheduleHandler) HandleGetScheduledRuns(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	limit := defaultScheduledRunLimit
+
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxScheduledRunLimit {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit must be between 1 and 500"})
+			return
+		}
+		limit = n
+	}
+
+	runs, err := h.scheduleStore.GetScheduledRuns(name, limit)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getScheduledRuns: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"runs": runs})
+}
@@ -0,0 +1,383 @@
+package api
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/oidc"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+const (
+	// how long a user has to log in at the provider and come back
+	ssoLoginTTL = 10 * time.Minute
+	// ssoStateCookie binds a login to the browser that started it, so a
+	// code from someone else's login can't be slipped into it
+	ssoStateCookie = "sso_state"
+	ssoCookiePath  = "/tokens/sso"
+	// how many usernames to try when provisioning a user
+	ssoUsernameAttempts = 5
+)
+
+// SSOHandler logs users in with external OpenID Connect providers.
+type SSOHandler struct {
+	providers     map[string]*oidc.Provider
+	identityStore store.IdentityStore
+	userStore     store.UserStore
+	tokenStore    store.TokenStore
+	mfaStore      store.MFAStore
+	secureCookies bool
+	logger        *log.Logger
+}
+
+type ssoCallbackRequest struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+func NewSSOHandler(providers []*oidc.Provider, identityStore store.IdentityStore, userStore store.UserStore, tokenStore store.TokenStore, mfaStore store.MFAStore, secureCookies bool, logger *log.Logger) *SSOHandler {
+	byName := make(map[string]*oidc.Provider, len(providers))
+	for _, provider := range providers {
+		byName[provider.Name()] = provider
+	}
+
+	return &SSOHandler{
+		providers:     byName,
+		identityStore: identityStore,
+		userStore:     userStore,
+		tokenStore:    tokenStore,
+		mfaStore:      mfaStore,
+		secureCookies: secureCookies,
+		logger:        logger,
+	}
+}
+
+// HandleGetProviders lists the providers users can log in with.
+func (h *SSOHandler) HandleGetProviders(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(h.providers))
+	for name := range h.providers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"providers": names})
+}
+
+// HandleBeginLogin starts a login with a provider and returns the URL to
+// send the user to.
+func (h *SSOHandler) HandleBeginLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.providers[chi.URLParam(r, "provider")]
+
+	if !ok {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "unknown identity provider"})
+		return
+	}
+
+	state, err := oidc.RandomString()
+
+	var nonce, verifier, challenge string
+
+	if err == nil {
+		nonce, err = oidc.RandomString()
+	}
+
+	if err == nil {
+		verifier, challenge, err = oidc.NewPKCE()
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: generating sso login: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	authorizationURL, err := provider.AuthCodeURL(r.Context(), state, nonce, challenge)
+
+	if err != nil {
+		h.logger.Printf("ERROR: sso provider %s: %v", provider.Name(), err)
+		utils.WriteJSON(w, http.StatusBadGateway, utils.Envelope{"error": "identity provider is unavailable"})
+		return
+	}
+
+	err = h.identityStore.CreateSSOLogin(&store.SSOLogin{
+		State:        state,
+		Provider:     provider.Name(),
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(ssoLoginTTL),
+	})
+
+	if err != nil {
+		h.logger.Printf("ERROR: createSSOLogin: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    state,
+		Path:     ssoCookiePath,
+		MaxAge:   int(ssoLoginTTL / time.Second),
+		HttpOnly: true,
+		Secure:   h.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"authorization_url": authorizationURL})
+}
+
+// HandleFinishLogin takes the code the provider sent the user back with,
+// and logs in the user the identity is linked to, linking or provisioning
+// one first if there is none.
+func (h *SSOHandler) HandleFinishLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.providers[chi.URLParam(r, "provider")]
+
+	if !ok {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "unknown identity provider"})
+		return
+	}
+
+	var req ssoCallbackRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || req.Code == "" || req.State == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "code and state are required"})
+		return
+	}
+
+	cookie, err := r.Cookie(ssoStateCookie)
+
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(req.State)) != 1 {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "login was started in another browser"})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: ssoStateCookie, Path: ssoCookiePath, MaxAge: -1})
+
+	login, err := h.identityStore.ConsumeSSOLogin(req.State)
+
+	if err != nil {
+		h.logger.Printf("ERROR: consumeSSOLogin: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if login == nil || login.Provider != provider.Name() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "unknown or expired login"})
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), req.Code, login.CodeVerifier, login.Nonce)
+
+	if errors.Is(err, oidc.ErrExchange) || errors.Is(err, oidc.ErrIDToken) {
+		h.logger.Printf("sso login with %s rejected: %v", provider.Name(), err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "login with the identity provider failed"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: sso provider %s: %v", provider.Name(), err)
+		utils.WriteJSON(w, http.StatusBadGateway, utils.Envelope{"error": "identity provider is unavailable"})
+		return
+	}
+
+	userID, err := h.identityStore.UseIdentity(provider.Issuer(), claims.Subject, claims.Email, time.Now())
+
+	if err != nil {
+		h.logger.Printf("ERROR: useIdentity: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if userID == 0 {
+		userID = h.linkIdentity(w, provider, claims)
+
+		if userID == 0 {
+			return
+		}
+	}
+
+	logIn(w, r, h.tokenStore, h.mfaStore, h.logger, userID)
+}
+
+// linkIdentity links a new identity to the user with its email, or to a
+// user provisioned for it if there is none, and returns the user's id. It
+// answers the request itself and returns 0 if it can't.
+func (h *SSOHandler) linkIdentity(w http.ResponseWriter, provider *oidc.Provider, claims *oidc.Claims) int {
+	// an address the provider hasn't checked could be anyone's
+	if claims.Email == "" || !claims.EmailVerified {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "the identity provider didn't share a verified email address"})
+		return 0
+	}
+
+	identity := &store.Identity{
+		Provider: provider.Name(),
+		Issuer:   provider.Issuer(),
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	now := time.Now()
+	identity.LastLoginAt = &now
+
+	user, err := h.userStore.GetUserByEmail(claims.Email)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getUserByEmail: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return 0
+	}
+
+	if user == nil {
+		return h.provisionUser(w, identity, claims)
+	}
+
+	// whoever registered an unverified address may not own it, and
+	// linking would let them back into the real owner's account
+	if !user.EmailVerified() {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "an account with this email address exists; log in and verify the address to use this provider"})
+		return 0
+	}
+
+	identity.UserID = user.ID
+
+	err = h.identityStore.LinkIdentity(identity)
+
+	if errors.Is(err, store.ErrIdentityLinked) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "the account is linked to another identity at this provider"})
+		return 0
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: linkIdentity: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return 0
+	}
+
+	return user.ID
+}
+
+// provisionUser creates a user for an identity, named after it. The user
+// has no usable password until they reset it.
+func (h *SSOHandler) provisionUser(w http.ResponseWriter, identity *store.Identity, claims *oidc.Claims) int {
+	password, err := oidc.RandomString()
+
+	user := &store.User{Email: claims.Email}
+
+	if err == nil {
+		err = user.PasswordHash.Set(password)
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: hashing password %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return 0
+	}
+
+	base := ssoUsername(claims)
+
+	for attempt := range ssoUsernameAttempts {
+		user.Username = base
+		if attempt > 0 {
+			user.Username = fmt.Sprintf("%s%04d", base, rand.IntN(10000))
+		}
+
+		err = h.identityStore.CreateUserWithIdentity(user, identity)
+
+		if !errors.Is(err, store.ErrUserExists) {
+			break
+		}
+	}
+
+	// a concurrent login may have provisioned one already
+	if errors.Is(err, store.ErrUserExists) || errors.Is(err, store.ErrIdentityLinked) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "couldn't create an account for this identity"})
+		return 0
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: createUserWithIdentity: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return 0
+	}
+
+	return user.ID
+}
+
+// ssoUsername derives a username from the one the provider suggests, or
+// the email address.
+func ssoUsername(claims *oidc.Claims) string {
+	name := claims.PreferredUsername
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	name = strings.Map(func(c rune) rune {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '_', c == '.', c == '-':
+			return c
+		case 'A' <= c && c <= 'Z':
+			return c + 'a' - 'A'
+		}
+		return -1
+	}, name)
+
+	// room for the suffix within the 50 characters allowed
+	if len(name) > 40 {
+		name = name[:40]
+	}
+
+	if name == "" {
+		name = "user"
+	}
+
+	return name
+}
+
+func (h *SSOHandler) HandleGetIdentities(w http.ResponseWriter, r *http.Request) {
+	identities, err := h.identityStore.GetIdentities(middleware.GetUser(r).ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getIdentities: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"identities": identities})
+}
+
+func (h *SSOHandler) HandleDeleteIdentity(w http.ResponseWriter, r *http.Request) {
+	identityID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid identity id"})
+		return
+	}
+
+	err = h.identityStore.DeleteIdentity(middleware.GetUser(r).ID, identityID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "identity not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: deleteIdentity: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/rpstvs/fm-goapp/internal/oidc"
+	"github.com/rpstvs/fm-goapp/internal/oidc/oidctest"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/tokens"
+)
+
+type fakeIdentityStore struct {
+	store.IdentityStore
+
+	linked      []*store.Identity
+	provisioned []*store.User
+}
+
+func (s *fakeIdentityStore) ConsumeSSOLogin(state string) (*store.SSOLogin, error) {
+	return &store.SSOLogin{State: state, Provider: "mock", Nonce: "nonce-1", CodeVerifier: "verifier"}, nil
+}
+
+func (s *fakeIdentityStore) UseIdentity(issuer, subject, email string, usedAt time.Time) (int, error) {
+	return 0, nil
+}
+
+func (s *fakeIdentityStore) LinkIdentity(identity *store.Identity) error {
+	s.linked = append(s.linked, identity)
+	return nil
+}
+
+func (s *fakeIdentityStore) CreateUserWithIdentity(user *store.User, identity *store.Identity) error {
+	user.ID = 99
+	s.provisioned = append(s.provisioned, user)
+	return nil
+}
+
+type fakeUserStore struct {
+	store.UserStore
+
+	users map[string]*store.User
+}
+
+func (s *fakeUserStore) GetUserByEmail(email string) (*store.User, error) {
+	return s.users[email], nil
+}
+
+// fakeMFAStore has every user enrolled in 2FA, so a login ends in an MFA
+// token rather than a session.
+type fakeMFAStore struct {
+	store.MFAStore
+}
+
+func (s *fakeMFAStore) GetTOTP(userID int) (*store.TOTP, error) {
+	now := time.Now()
+	return &store.TOTP{UserID: userID, ConfirmedAt: &now}, nil
+}
+
+type fakeTokenStore struct {
+	store.TokenStore
+
+	users []int
+}
+
+func (s *fakeTokenStore) CreateNewToken(userID int, ttl time.Duration, scope string) (*tokens.Token, error) {
+	s.users = append(s.users, userID)
+	return &tokens.Token{Plaintext: "mfa-token", UserID: userID, Scope: scope}, nil
+}
+
+func TestSSOFinishLoginLinking(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	provider, err := oidc.NewProvider(oidc.Config{
+		Name:         "mock",
+		Issuer:       idp.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.example/login/sso/mock",
+		HTTPClient:   idp.Client(),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified := time.Now()
+
+	tests := []struct {
+		name          string
+		emailVerified bool
+		user          *store.User
+		status        int
+		wantUser      int
+	}{
+		{
+			name:          "address the provider hasn't verified",
+			emailVerified: false,
+			status:        http.StatusForbidden,
+		},
+		{
+			name:          "account whose address isn't verified",
+			emailVerified: true,
+			user:          &store.User{ID: 7, Email: "alice@example.com"},
+			status:        http.StatusConflict,
+		},
+		{
+			name:          "account with a verified address",
+			emailVerified: true,
+			user:          &store.User{ID: 7, Email: "alice@example.com", EmailVerifiedAt: &verified},
+			status:        http.StatusOK,
+			wantUser:      7,
+		},
+		{
+			name:          "no account",
+			emailVerified: true,
+			status:        http.StatusOK,
+			wantUser:      99,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identities := &fakeIdentityStore{}
+			users := &fakeUserStore{users: map[string]*store.User{}}
+			tokenStore := &fakeTokenStore{}
+
+			if tt.user != nil {
+				users.users[tt.user.Email] = tt.user
+			}
+
+			h := NewSSOHandler([]*oidc.Provider{provider}, identities, users, tokenStore, &fakeMFAStore{}, false, log.New(io.Discard, "", 0))
+
+			claims := idp.Claims("alice", "nonce-1")
+			claims["email_verified"] = tt.emailVerified
+			code := idp.Code(idp.Sign(claims))
+
+			r := httptest.NewRequest(http.MethodPost, "/tokens/sso/mock/callback", strings.NewReader(`{"code":"`+code+`","state":"state-1"}`))
+			r.AddCookie(&http.Cookie{Name: ssoStateCookie, Value: "state-1"})
+
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("provider", "mock")
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+			w := httptest.NewRecorder()
+			h.HandleFinishLogin(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			if tt.wantUser == 0 {
+				if len(identities.linked)+len(identities.provisioned)+len(tokenStore.users) > 0 {
+					t.Errorf("identity linked or user logged in after a rejected login")
+				}
+				return
+			}
+
+			if len(tokenStore.users) != 1 || tokenStore.users[0] != tt.wantUser {
+				t.Errorf("logged in %v, want user %d", tokenStore.users, tt.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+type SyncHandler struct {
+	syncStore store.SyncStore
+	logger    *log.Logger
+}
+
+type syncRequest struct {
+	Token     string               `json:"token"`
+	Mutations []store.SyncMutation `json:"mutations"`
+}
+
+func NewSyncHandler(syncStore store.SyncStore, logger *log.Logger) *SyncHandler {
+	return &SyncHandler{
+		syncStore: syncStore,
+		logger:    logger,
+	}
+}
+
+// change tokens are opaque to clients, they wrap the last sequence number
+// the client has seen
+func encodeChangeToken(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(seq, 10)))
+}
+
+func decodeChangeToken(token string) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+
+	if err != nil {
+		return 0, errors.New("invalid change token")
+	}
+
+	seq, err := strconv.ParseInt(string(raw), 10, 64)
+
+	if err != nil || seq < 0 {
+		return 0, errors.New("invalid change token")
+	}
+
+	return seq, nil
+}
+
+// a token from the future means the client has state we never issued, the
+// only safe thing is a full resync
+func writeFutureChangeToken(w http.ResponseWriter) {
+	utils.WriteJSON(w, http.StatusGone, utils.Envelope{"error": "change token is no longer valid, sync again without a token"})
+}
+
+func (h *SyncHandler) HandleSync(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	if currentUser == nil || currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	var req syncRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid sync request"})
+		return
+	}
+
+	since, err := decodeChangeToken(req.Token)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	result := &store.SyncResult{
+		Conflicts: []store.SyncConflict{},
+		IDs:       []store.SyncIDMapping{},
+	}
+
+	if len(req.Mutations) > 0 {
+		result, err = h.syncStore.ApplyMutations(currentUser.ID, since, req.Mutations, validateWorkout)
+
+		if errors.Is(err, store.ErrFutureChangeToken) {
+			writeFutureChangeToken(w)
+			return
+		}
+
+		if errors.Is(err, store.ErrInvalidMutation) {
+			utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": err.Error()})
+			return
+		}
+
+		if err != nil {
+			h.logger.Printf("ERROR: applying sync mutations: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	changes, err := h.syncStore.GetChangesSince(currentUser.ID, since)
+
+	if errors.Is(err, store.ErrFutureChangeToken) {
+		writeFutureChangeToken(w)
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: getting sync changes: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"token":     encodeChangeToken(changes.Seq),
+		"changes":   changes,
+		"conflicts": result.Conflicts,
+		"ids":       result.IDs,
+	})
+}
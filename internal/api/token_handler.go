@@ -1,68 +1,540 @@
 package api
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"github.com/rpstvs/fm-goapp/internal/jobs"
+	"github.com/rpstvs/fm-goapp/internal/mail"
+	"github.com/rpstvs/fm-goapp/internal/middleware"
 	"github.com/rpstvs/fm-goapp/internal/store"
 	"github.com/rpstvs/fm-goapp/internal/tokens"
 	"github.com/rpstvs/fm-goapp/internal/utils"
 )
 
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	// how long a user has to enter their second factor after the password
+	mfaPendingTTL = 5 * time.Minute
+
+	passwordResetTTL      = 30 * time.Minute
+	passwordResetsPerHour = 5
+
+	magicLinkTTL      = 15 * time.Minute
+	magicLinksPerHour = 5
+	// magicLinkNonceCookie holds the nonce a magic link bound to the
+	// browser that asked for it has to be used with
+	magicLinkNonceCookie = "magic_link_nonce"
+
+	// a stream ticket only has to last until the client connects with it
+	streamTicketTTL = time.Minute
+)
+
 type TokenHandler struct {
 	tokenStore store.TokenStore
 	userStore  store.UserStore
+	mfaStore   store.MFAStore
+	notifier   *mail.Notifier
 	logger     *log.Logger
 }
 
-type createTokenRequest struct{
+type createTokenRequest struct {
 	Username string
 	Password string
+}
 
+type mfaTokenRequest struct {
+	MFAToken string `json:"mfa_token"`
+	secondFactorRequest
 }
 
-func NewTokenHandler(tokenStore store.TokenStore, userStore store.UserStore, logger *log.Logger) *TokenHandler {
-	return &TokenHandler{
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type passwordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type magicLinkRequest struct {
+	Email string `json:"email"`
+	// BindDevice makes the link only work in the browser that asked for
+	// it, not, say, on the phone the email is read on.
+	BindDevice bool `json:"bind_device"`
+}
+
+type consumeMagicLinkRequest struct {
+	Token string `json:"token"`
+}
+
+// magicLinkArgs is the job that looks up the account behind a magic link
+// request and emails it the link.
+type magicLinkArgs struct {
+	Email     string `json:"email"`
+	NonceHash []byte `json:"nonce_hash,omitempty"`
+}
+
+func (magicLinkArgs) Kind() string { return "magic_link_email" }
+
+// passwordResetArgs is the job that looks up the account behind a reset
+// request and emails it a link.
+type passwordResetArgs struct {
+	Email string `json:"email"`
+}
+
+func (passwordResetArgs) Kind() string { return "password_reset_email" }
+
+// NewTokenHandler returns a TokenHandler and registers the password reset
+// and magic link jobs on the notifier's queue.
+func NewTokenHandler(tokenStore store.TokenStore, userStore store.UserStore, mfaStore store.MFAStore, notifier *mail.Notifier, logger *log.Logger) *TokenHandler {
+	h := &TokenHandler{
 		tokenStore: tokenStore,
 		userStore:  userStore,
+		mfaStore:   mfaStore,
+		notifier:   notifier,
 		logger:     logger,
 	}
+
+	jobs.Register(notifier.Queue, h.sendPasswordReset, jobs.HandlerOptions{Timeout: time.Minute})
+	jobs.Register(notifier.Queue, h.sendMagicLink, jobs.HandlerOptions{Timeout: time.Minute})
+
+	return h
 }
 
-func (h *TokenHandler) HandleCreateToken(w http.ResponseWriter, r *http.Request){
+// HandleCreateToken logs a user in with their password. A user with 2FA on
+// gets a short-lived MFA token instead, to exchange at HandleVerifyMFA.
+func (h *TokenHandler) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
 	var req createTokenRequest
 
-	err := json.NewDecoder(r.Body).Decode(&req)~
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	user, err := h.userStore.GetUserByUsername(req.Username)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getUserByUsername: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid credentials"})
+		return
+	}
+
+	passwordsMatch, err := user.PasswordHash.Matches(req.Password)
+
+	if err != nil {
+		h.logger.Printf("ERROR: matching password: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !passwordsMatch {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid credentials"})
+		return
+	}
+
+	logIn(w, r, h.tokenStore, h.mfaStore, h.logger, user.ID)
+}
+
+// logIn finishes the first step of a login: users with 2FA on get an MFA
+// token to exchange at HandleVerifyMFA, the rest are logged in.
+func logIn(w http.ResponseWriter, r *http.Request, tokenStore store.TokenStore, mfaStore store.MFAStore, logger *log.Logger, userID int) {
+	enrollment, err := mfaStore.GetTOTP(userID)
+
+	if err != nil {
+		logger.Printf("ERROR: getTOTP: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if enrollment.Enabled() {
+		pending, err := tokenStore.CreateNewToken(userID, mfaPendingTTL, tokens.ScopeMFAPending)
+
+		if err != nil {
+			logger.Printf("ERROR: creating mfa token: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, utils.Envelope{"mfa_required": true, "mfa_token": pending})
+		return
+	}
+
+	createSession(w, r, tokenStore, logger, userID)
+}
+
+// HandleVerifyMFA finishes a login with 2FA: it exchanges the MFA token
+// from HandleCreateToken and a code for an auth token.
+func (h *TokenHandler) HandleVerifyMFA(w http.ResponseWriter, r *http.Request) {
+	var req mfaTokenRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || req.MFAToken == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "mfa_token is required"})
+		return
+	}
+
+	user, err := h.userStore.GetUserToken(tokens.ScopeMFAPending, req.MFAToken)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getUserToken: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired mfa token"})
+		return
+	}
+
+	enrollment, err := h.mfaStore.GetTOTP(user.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getTOTP: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	// turning 2FA off revokes pending logins, so this only happens in a race
+	if !enrollment.Enabled() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired mfa token"})
+		return
+	}
+
+	if !verifySecondFactor(w, h.mfaStore, h.logger, enrollment, &req.secondFactorRequest) {
+		return
+	}
+
+	consumed, err := h.tokenStore.ConsumeToken(tokens.ScopeMFAPending, req.MFAToken)
+
+	if err != nil {
+		h.logger.Printf("ERROR: consumeToken: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !consumed {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired mfa token"})
+		return
+	}
+
+	createSession(w, r, h.tokenStore, h.logger, user.ID)
+}
+
+// createSession logs userID in, answering with an access token and a
+// refresh token. Every way of logging in ends here.
+func createSession(w http.ResponseWriter, r *http.Request, tokenStore store.TokenStore, logger *log.Logger, userID int) {
+	access, refresh, err := tokenStore.CreateSession(userID, accessTokenTTL, refreshTokenTTL, r.UserAgent(), clientIP(r))
+
+	if err != nil {
+		logger.Printf("ERROR: createSession: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"auth_token": access, "refresh_token": refresh})
+}
+
+// HandleRefreshToken trades a refresh token for a new access token and a
+// new refresh token; the old refresh token can't be used again.
+func (h *TokenHandler) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || req.RefreshToken == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "refresh_token is required"})
+		return
+	}
+
+	access, refresh, err := h.tokenStore.RefreshSession(req.RefreshToken, accessTokenTTL, refreshTokenTTL, r.UserAgent(), clientIP(r))
+
+	if errors.Is(err, store.ErrInvalidRefreshToken) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired refresh token"})
+		return
+	}
+
+	if errors.Is(err, store.ErrRefreshTokenReused) {
+		h.logger.Printf("refresh token reused, session revoked")
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "refresh token was already used, log in again"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: refreshSession: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"auth_token": access, "refresh_token": refresh})
+}
+
+// clientIP is the address the request came from. The server isn't set up
+// to trust forwarding headers, so they are ignored.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// HandleLogout revokes the token the request was made with, along with
+// the rest of its session.
+func (h *TokenHandler) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	h.revokeSession(w, r, middleware.GetSession(r).ID)
+}
+
+// HandleCreateStreamTicket issues a single-use ticket that opens one
+// WebSocket or event stream. Browsers can't set the Authorization header
+// on either, so they pass the ticket in the url instead of the auth token.
+func (h *TokenHandler) HandleCreateStreamTicket(w http.ResponseWriter, r *http.Request) {
+	ticket, err := h.tokenStore.CreateNewToken(middleware.GetUser(r).ID, streamTicketTTL, tokens.ScopeStreamTicket)
+
+	if err != nil {
+		h.logger.Printf("ERROR: createStreamTicket: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"stream_ticket": ticket})
+}
+
+func (h *TokenHandler) HandleGetSessions(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	sessions, err := h.tokenStore.GetSessions(currentUser.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getSessions: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	current := middleware.GetSession(r)
+	for i := range sessions {
+		sessions[i].Current = current != nil && sessions[i].ID == current.ID
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"sessions": sessions})
+}
+
+func (h *TokenHandler) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid session id"})
+		return
+	}
+
+	h.revokeSession(w, r, sessionID)
+}
+
+func (h *TokenHandler) revokeSession(w http.ResponseWriter, r *http.Request, sessionID int64) {
+	err := h.tokenStore.DeleteSession(middleware.GetUser(r).ID, sessionID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "session not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: deleteSession: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRequestPasswordReset answers the same way, and as fast, whether or
+// not an account has the email: the lookup happens in a job.
+func (h *TokenHandler) HandleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || strings.TrimSpace(req.Email) == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "email is required"})
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
 
-	if err!= nil {
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{})
+	_, err = jobs.Enqueue(h.notifier.Queue, passwordResetArgs{Email: email}, jobs.EnqueueOptions{UniqueKey: email})
+
+	if err != nil && !errors.Is(err, jobs.ErrDuplicate) {
+		h.logger.Printf("ERROR: enqueue password reset: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	user , err := h.userStore.GetUserByUsername(req.Username)
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"message": "if an account uses that email, a link to reset its password is on the way"})
+}
+
+func (h *TokenHandler) sendPasswordReset(ctx context.Context, job *jobs.Job[passwordResetArgs]) error {
+	user, err := h.userStore.GetUserByEmail(job.Args.Email)
 
 	if err != nil || user == nil {
-		//handle error
+		return err
+	}
+
+	// stops the endpoint being used to flood someone's inbox
+	sent, _, err := h.tokenStore.GetRecentTokens(user.ID, tokens.ScopePasswordReset, passwordResetTTL, time.Hour)
+
+	if err != nil || sent >= passwordResetsPerHour {
+		return err
+	}
+
+	token, err := h.tokenStore.CreateNewToken(user.ID, passwordResetTTL, tokens.ScopePasswordReset)
+
+	if err != nil {
+		return err
+	}
+
+	// sent from this job so the link is never stored in one
+	return h.notifier.Send(ctx, user.ID, mail.TemplatePasswordReset, map[string]string{
+		"url":        h.notifier.BaseURL + "/reset-password?token=" + url.QueryEscape(token.Plaintext),
+		"expires_in": "30 minutes",
+	})
+}
+
+// HandleRequestMagicLink emails a one-time login link. Like a password
+// reset, it answers the same way whether or not an account has the email.
+func (h *TokenHandler) HandleRequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req magicLinkRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || strings.TrimSpace(req.Email) == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "email is required"})
+		return
+	}
+
+	args := magicLinkArgs{Email: strings.ToLower(strings.TrimSpace(req.Email))}
+
+	var nonce string
+
+	if req.BindDevice {
+		nonce, args.NonceHash, err = tokens.GenerateNonce()
+
+		if err != nil {
+			h.logger.Printf("ERROR: generating magic link nonce: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	_, err = jobs.Enqueue(h.notifier.Queue, args, jobs.EnqueueOptions{UniqueKey: args.Email})
+
+	if err != nil && !errors.Is(err, jobs.ErrDuplicate) {
+		h.logger.Printf("ERROR: enqueue magic link: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	passwordsMatch , err := user.PasswordHash.Matches(req.Password)
+	// a duplicate means a link is already on its way, bound to the nonce
+	// in the cookie set when it was requested, so that cookie is kept
+	if req.BindDevice && err == nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     magicLinkNonceCookie,
+			Value:    nonce,
+			Path:     "/tokens/magic-link",
+			MaxAge:   int(magicLinkTTL / time.Second),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(h.notifier.BaseURL, "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"message": "if an account uses that email, a login link is on the way"})
+}
+
+func (h *TokenHandler) sendMagicLink(ctx context.Context, job *jobs.Job[magicLinkArgs]) error {
+	user, err := h.userStore.GetUserByEmail(job.Args.Email)
+
+	if err != nil || user == nil {
+		return err
+	}
+
+	sent, _, err := h.tokenStore.GetRecentTokens(user.ID, tokens.ScopeMagicLink, magicLinkTTL, time.Hour)
+
+	if err != nil || sent >= magicLinksPerHour {
+		return err
+	}
+
+	token, err := tokens.GenerateToken(user.ID, magicLinkTTL, tokens.ScopeMagicLink)
 
 	if err != nil {
-		return 
+		return err
 	}
 
-	if !passwordsMatch{
+	token.NonceHash = job.Args.NonceHash
+
+	err = h.tokenStore.Insert(token)
+
+	if err != nil {
+		return err
+	}
+
+	return h.notifier.Send(ctx, user.ID, mail.TemplateMagicLink, map[string]string{
+		"url":        h.notifier.BaseURL + "/magic-link?token=" + url.QueryEscape(token.Plaintext),
+		"expires_in": "15 minutes",
+	})
+}
+
+// HandleConsumeMagicLink logs in with a magic link. The link only works
+// once; 2FA, if the user has it on, still applies.
+func (h *TokenHandler) HandleConsumeMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req consumeMagicLinkRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"})
 		return
 	}
 
-	token, err := h.tokenStore.CreateNewToken(user.ID, 24*time.Hour, tokens.ScopeAuth)
+	var nonce string
+	if cookie, err := r.Cookie(magicLinkNonceCookie); err == nil {
+		nonce = cookie.Value
+	}
+
+	userID, err := h.tokenStore.ConsumeMagicLink(req.Token, nonce)
 
 	if err != nil {
+		h.logger.Printf("ERROR: consumeMagicLink: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if userID == 0 {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired login link"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"auth_token": token})
+	if nonce != "" {
+		http.SetCookie(w, &http.Cookie{Name: magicLinkNonceCookie, Path: "/tokens/magic-link", MaxAge: -1})
+	}
+
+	logIn(w, r, h.tokenStore, h.mfaStore, h.logger, userID)
 }
@@ -1,16 +1,35 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
-	"regexp"
+	netmail "net/mail"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/rpstvs/fm-goapp/internal/jobs"
+	"github.com/rpstvs/fm-goapp/internal/mail"
+	"github.com/rpstvs/fm-goapp/internal/middleware"
 	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/tokens"
 	"github.com/rpstvs/fm-goapp/internal/utils"
 )
 
+const (
+	emailVerificationTTL = time.Hour
+	// a user can ask for another verification email once a minute, and
+	// for no more than five in an hour
+	verificationResendInterval = time.Minute
+	verificationEmailsPerHour  = 5
+
+	// the size of users.email
+	maxEmailLength = 255
+)
+
 type registerUserRequest struct {
 	Username string
 	Email    string
@@ -18,16 +37,43 @@ type registerUserRequest struct {
 	Bio      string
 }
 
+type verifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// verificationEmailArgs is the job that issues an email verification token
+// and mails the link with it.
+type verificationEmailArgs struct {
+	UserID int `json:"user_id"`
+}
+
+func (verificationEmailArgs) Kind() string { return "verification_email" }
+
 type UserHandler struct {
-	userStore store.UserStore
-	logger    *log.Logger
+	userStore  store.UserStore
+	tokenStore store.TokenStore
+	notifier   *mail.Notifier
+	logger     *log.Logger
 }
 
-func NewUserHandler(user store.UserStore, logger *log.Logger) *UserHandler {
-	return &UserHandler{
-		userStore: user,
-		logger:    logger,
+// NewUserHandler returns a UserHandler and registers the verification
+// email job on the notifier's queue.
+func NewUserHandler(user store.UserStore, tokenStore store.TokenStore, notifier *mail.Notifier, logger *log.Logger) *UserHandler {
+	h := &UserHandler{
+		userStore:  user,
+		tokenStore: tokenStore,
+		notifier:   notifier,
+		logger:     logger,
 	}
+
+	jobs.Register(notifier.Queue, h.sendVerificationEmail, jobs.HandlerOptions{Timeout: time.Minute})
+
+	return h
 }
 
 func (h *UserHandler) validateRegisterRequest(req *registerUserRequest) error {
@@ -39,9 +85,14 @@ func (h *UserHandler) validateRegisterRequest(req *registerUserRequest) error {
 		return errors.New("username too long")
 	}
 
-	emailRegex := regexp.MustCompile(`format email for regex`)
+	if len(req.Email) > maxEmailLength {
+		return errors.New("email too long")
+	}
+
+	// a bare address only, not "Name <address>"
+	addr, err := netmail.ParseAddress(req.Email)
 
-	if !emailRegex.MatchString(req.Email) {
+	if err != nil || addr.Name != "" || addr.Address != req.Email {
 		return errors.New("invalid email format")
 	}
 
@@ -81,7 +132,7 @@ func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request)
 	err = user.PasswordHash.Set(req.Password)
 
 	if err != nil {
-		h.logger.Printf("ERROR: hashing password %v, err")
+		h.logger.Printf("ERROR: hashing password %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
@@ -89,10 +140,142 @@ func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request)
 	err = h.userStore.CreateUser(user)
 
 	if err != nil {
-		h.logger.Printf("ERROR: registering user %v, err")
+		h.logger.Printf("ERROR: registering user %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
 }
+
+// QueueVerificationEmail queues an email with a link to verify userID's
+// address. The token is issued when the email is sent, so the queue never
+// holds it.
+func (h *UserHandler) QueueVerificationEmail(userID int) error {
+	_, err := jobs.Enqueue(h.notifier.Queue, verificationEmailArgs{UserID: userID}, jobs.EnqueueOptions{UniqueKey: strconv.Itoa(userID)})
+
+	if errors.Is(err, jobs.ErrDuplicate) {
+		return nil
+	}
+
+	return err
+}
+
+func (h *UserHandler) sendVerificationEmail(ctx context.Context, job *jobs.Job[verificationEmailArgs]) error {
+	user, err := h.userStore.GetUserByID(job.Args.UserID)
+
+	// the account is gone or was verified while the email waited
+	if err != nil || user == nil || user.EmailVerified() {
+		return err
+	}
+
+	token, err := h.tokenStore.CreateNewToken(user.ID, emailVerificationTTL, tokens.ScopeEmailVerification)
+
+	if err != nil {
+		return err
+	}
+
+	return h.notifier.Send(ctx, user.ID, mail.TemplateVerifyEmail, map[string]string{
+		"url":        h.notifier.BaseURL + "/verify-email?token=" + url.QueryEscape(token.Plaintext),
+		"expires_in": "1 hour",
+	})
+}
+
+func (h *UserHandler) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req verifyEmailRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"})
+		return
+	}
+
+	user, err := h.userStore.VerifyEmail(req.Token)
+
+	if err != nil {
+		h.logger.Printf("ERROR: verifyEmail: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid or expired verification token"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+func (h *UserHandler) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	if currentUser.EmailVerified() {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "email is already verified"})
+		return
+	}
+
+	sent, lastSent, err := h.tokenStore.GetRecentTokens(currentUser.ID, tokens.ScopeEmailVerification, emailVerificationTTL, time.Hour)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getRecentTokens: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	var retryAfter time.Duration
+	if sent >= verificationEmailsPerHour {
+		retryAfter = time.Hour
+	} else if sent > 0 {
+		retryAfter = time.Until(lastSent.Add(verificationResendInterval))
+	}
+
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+		utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "too many verification emails, try again later"})
+		return
+	}
+
+	err = h.QueueVerificationEmail(currentUser.ID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: queueVerificationEmail: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"message": "verification email sent"})
+}
+
+// HandleResetPassword sets a new password with a password reset token and
+// logs the user out everywhere.
+func (h *UserHandler) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"})
+		return
+	}
+
+	if req.Password == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "password is required"})
+		return
+	}
+
+	user, err := h.userStore.ResetPassword(req.Token, req.Password)
+
+	if err != nil {
+		h.logger.Printf("ERROR: resetPassword: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid or expired reset token"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "password updated, log in again with the new password"})
+}
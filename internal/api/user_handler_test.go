@@ -0,0 +1,36 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRegisterRequest(t *testing.T) {
+	tests := []struct {
+		email string
+		ok    bool
+	}{
+		{"alice@example.com", true},
+		{"alice.smith+gym@mail.example.co.uk", true},
+		{strings.Repeat("a", 64) + "@" + strings.Repeat("b", 186) + ".com", true},
+		{"", false},
+		{"alice", false},
+		{"alice@", false},
+		{"@example.com", false},
+		{"alice@@example.com", false},
+		{"alice example@example.com", false},
+		{"Alice <alice@example.com>", false},
+		{" alice@example.com", false},
+		{strings.Repeat("a", 64) + "@" + strings.Repeat("b", 187) + ".com", false},
+	}
+
+	h := &UserHandler{}
+
+	for _, tt := range tests {
+		err := h.validateRegisterRequest(&registerUserRequest{Username: "alice", Email: tt.email, Password: "secret"})
+
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got %v, want ok=%v", tt.email, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+	"github.com/rpstvs/fm-goapp/internal/webhooks"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+)
+
+type WebhookHandler struct {
+	webhookStore store.WebhookStore
+	logger       *log.Logger
+}
+
+type webhookEndpointRequest struct {
+	URL         string   `json:"url"`
+	Description string   `json:"description"`
+	EventTypes  []string `json:"event_types"`
+	Active      *bool    `json:"active"`
+}
+
+func NewWebhookHandler(webhookStore store.WebhookStore, logger *log.Logger) *WebhookHandler {
+	return &WebhookHandler{
+		webhookStore: webhookStore,
+		logger:       logger,
+	}
+}
+
+func validateWebhookEndpoint(req *webhookEndpointRequest) error {
+	u, err := url.Parse(req.URL)
+
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+
+	if len(req.EventTypes) == 0 {
+		return errors.New("event_types is required")
+	}
+
+	for _, eventType := range req.EventTypes {
+		if !slices.Contains(store.WebhookEventTypes, eventType) {
+			return errors.New("unknown event type " + strconv.Quote(eventType))
+		}
+	}
+
+	return nil
+}
+
+func (h *WebhookHandler) getEndpoint(w http.ResponseWriter, r *http.Request) (*store.WebhookEndpoint, bool) {
+	endpointID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid webhook id"})
+		return nil, false
+	}
+
+	endpoint, err := h.webhookStore.GetEndpoint(endpointID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getEndpoint: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil, false
+	}
+
+	if endpoint == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "webhook not found"})
+		return nil, false
+	}
+
+	return endpoint, true
+}
+
+func (h *WebhookHandler) HandleCreateEndpoint(w http.ResponseWriter, r *http.Request) {
+	var req webhookEndpointRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if err := validateWebhookEndpoint(&req); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	secret, err := webhooks.NewSecret()
+
+	if err != nil {
+		h.logger.Printf("ERROR: generating webhook secret: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	endpoint := &store.WebhookEndpoint{
+		URL:         req.URL,
+		Description: req.Description,
+		Secret:      secret,
+		EventTypes:  req.EventTypes,
+		Active:      req.Active == nil || *req.Active,
+	}
+
+	err = h.webhookStore.CreateEndpoint(endpoint)
+
+	if err != nil {
+		h.logger.Printf("ERROR: createEndpoint: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	// the only time the secret is handed out
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"webhook": endpoint, "secret": secret})
+}
+
+func (h *WebhookHandler) HandleGetEndpoints(w http.ResponseWriter, r *http.Request) {
+	endpoints, err := h.webhookStore.GetEndpoints()
+
+	if err != nil {
+		h.logger.Printf("ERROR: getEndpoints: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"webhooks": endpoints})
+}
+
+func (h *WebhookHandler) HandleGetEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := h.getEndpoint(w, r)
+	if !ok {
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"webhook": endpoint})
+}
+
+func (h *WebhookHandler) HandleUpdateEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := h.getEndpoint(w, r)
+	if !ok {
+		return
+	}
+
+	var req webhookEndpointRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if err := validateWebhookEndpoint(&req); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	endpoint.URL = req.URL
+	endpoint.Description = req.Description
+	endpoint.EventTypes = req.EventTypes
+	if req.Active != nil {
+		endpoint.Active = *req.Active
+	}
+
+	err = h.webhookStore.UpdateEndpoint(endpoint)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "webhook not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: updateEndpoint: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"webhook": endpoint})
+}
+
+func (h *WebhookHandler) HandleDeleteEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid webhook id"})
+		return
+	}
+
+	err = h.webhookStore.DeleteEndpoint(endpointID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "webhook not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: deleteEndpoint: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *WebhookHandler) HandleGetDeliveries(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := h.getEndpoint(w, r)
+	if !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+
+	if status != "" && status != store.WebhookPending && status != store.WebhookSucceeded && status != store.WebhookDead {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "status must be pending, succeeded or dead"})
+		return
+	}
+
+	limit := defaultDeliveryLimit
+
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxDeliveryLimit {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit must be between 1 and 200"})
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := h.webhookStore.GetDeliveries(endpoint.ID, status, limit)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getDeliveries: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"deliveries": deliveries})
+}
+
+func readDeliveryID(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "deliveryID"), 10, 64)
+
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid delivery id")
+	}
+
+	return id, nil
+}
+
+func (h *WebhookHandler) HandleGetDelivery(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid webhook id"})
+		return
+	}
+
+	deliveryID, err := readDeliveryID(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	delivery, err := h.webhookStore.GetDelivery(endpointID, deliveryID)
+
+	if err != nil {
+		h.logger.Printf("ERROR: getDelivery: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if delivery == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "delivery not found"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"delivery": delivery})
+}
+
+func (h *WebhookHandler) HandleRedeliver(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid webhook id"})
+		return
+	}
+
+	deliveryID, err := readDeliveryID(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	err = h.webhookStore.Redeliver(endpointID, deliveryID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "delivery not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: redeliver: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"message": "delivery queued"})
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+const (
+	batchModeAtomic     = "atomic"
+	batchModeBestEffort = "best_effort"
+
+	maxBatchOperations = 100
+)
+
+type batchOperation struct {
+	Op      string         `json:"op"`
+	ID      int64          `json:"id"`
+	Version int            `json:"version"`
+	Workout *store.Workout `json:"workout"`
+}
+
+type batchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []batchOperation `json:"operations"`
+}
+
+type batchResult struct {
+	Index   int            `json:"index"`
+	Op      string         `json:"op"`
+	Status  int            `json:"status"`
+	ID      int64          `json:"id,omitempty"`
+	Workout *store.Workout `json:"workout,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// checkBatchOperation applies the same rules as the single workout
+// handlers: a valid body, a version standing in for If-Match, and
+// ownership of the workout being changed.
+func checkBatchOperation(op *batchOperation, userID int, owners map[int64]int) (int, string) {
+	switch op.Op {
+	case store.BatchCreate:
+		if op.Workout == nil {
+			return http.StatusBadRequest, "workout is required"
+		}
+		if err := validateWorkout(op.Workout); err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		op.Workout.UserID = userID
+		return 0, ""
+
+	case store.BatchUpdate, store.BatchDelete:
+		if op.ID <= 0 {
+			return http.StatusBadRequest, "id is required"
+		}
+
+		if op.Version <= 0 {
+			return http.StatusPreconditionRequired, "version is required"
+		}
+
+		owner, ok := owners[op.ID]
+		if !ok {
+			return http.StatusNotFound, "workout not found"
+		}
+
+		if owner != userID {
+			return http.StatusForbidden, "you are not authorized to change this workout"
+		}
+
+		if op.Op == store.BatchDelete {
+			return 0, ""
+		}
+
+		if op.Workout == nil {
+			return http.StatusBadRequest, "workout is required"
+		}
+		if err := validateWorkout(op.Workout); err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		op.Workout.ID = int(op.ID)
+		op.Workout.UserID = userID
+		op.Workout.Version = op.Version
+		return 0, ""
+	}
+
+	return http.StatusBadRequest, "op must be create, update or delete"
+}
+
+func (wh *WorkoutHanlder) HandleBatchWorkouts(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	if currentUser == nil || currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	var req batchRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid batch request"})
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = batchModeAtomic
+	}
+
+	if req.Mode != batchModeAtomic && req.Mode != batchModeBestEffort {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "mode must be atomic or best_effort"})
+		return
+	}
+
+	if len(req.Operations) == 0 || len(req.Operations) > maxBatchOperations {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "a batch needs between 1 and 100 operations"})
+		return
+	}
+
+	atomic := req.Mode == batchModeAtomic
+
+	var ids []int64
+	seen := make(map[int64]bool)
+
+	for _, op := range req.Operations {
+		if op.ID > 0 && !seen[op.ID] {
+			seen[op.ID] = true
+			ids = append(ids, op.ID)
+		}
+	}
+
+	owners, err := wh.workoutStore.GetWorkoutOwners(ids)
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: getWorkoutOwners: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	results := make([]batchResult, len(req.Operations))
+	var ops []store.WorkoutBatchOp
+	var opIndex []int
+	failed := false
+	touched := make(map[int64]bool)
+
+	for i := range req.Operations {
+		op := &req.Operations[i]
+		results[i] = batchResult{Index: i, Op: op.Op, ID: op.ID}
+
+		status, message := checkBatchOperation(op, currentUser.ID, owners)
+
+		if status == 0 && op.ID > 0 {
+			if touched[op.ID] {
+				status, message = http.StatusBadRequest, "workout appears more than once in the batch"
+			}
+			touched[op.ID] = true
+		}
+
+		if status != 0 {
+			results[i].Status = status
+			results[i].Error = message
+			failed = true
+			continue
+		}
+
+		ops = append(ops, store.WorkoutBatchOp{Op: op.Op, Workout: op.Workout, ID: op.ID, Version: op.Version})
+		opIndex = append(opIndex, i)
+	}
+
+	if atomic && failed {
+		markNotApplied(results)
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"results": results})
+		return
+	}
+
+	if len(ops) > 0 {
+		opErrs, err := wh.workoutStore.ApplyWorkoutBatch(ops, atomic)
+
+		if err != nil && !errors.Is(err, store.ErrBatchAborted) {
+			wh.Logger.Printf("ERROR: applyWorkoutBatch: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+
+		for j, opErr := range opErrs {
+			i := opIndex[j]
+			op := req.Operations[i]
+
+			switch {
+			case opErr == nil:
+				if op.Op == store.BatchCreate {
+					results[i].Status = http.StatusCreated
+					results[i].ID = int64(op.Workout.ID)
+				} else {
+					results[i].Status = http.StatusOK
+				}
+				results[i].Workout = op.Workout
+			case errors.Is(opErr, store.ErrVersionConflict):
+				results[i].Status = http.StatusPreconditionFailed
+				results[i].Error = "workout has been modified"
+			case errors.Is(opErr, sql.ErrNoRows):
+				results[i].Status = http.StatusNotFound
+				results[i].Error = "workout not found"
+			default:
+				wh.Logger.Printf("ERROR: batch operation %d: %v", i, opErr)
+				results[i].Status = http.StatusInternalServerError
+				results[i].Error = "internal server error"
+			}
+		}
+
+		if errors.Is(err, store.ErrBatchAborted) {
+			markNotApplied(results)
+			utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"results": results})
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"results": results})
+}
+
+// markNotApplied reports every operation that did not fail on its own as
+// rolled back along with the rest of an atomic batch.
+func markNotApplied(results []batchResult) {
+	for i := range results {
+		if results[i].Error == "" {
+			results[i].Status = http.StatusFailedDependency
+			results[i].Workout = nil
+			if results[i].Op == store.BatchCreate {
+				results[i].ID = 0
+			}
+			results[i].Error = "not applied, another operation in the batch failed"
+		}
+	}
+}
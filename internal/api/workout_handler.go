@@ -5,12 +5,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/patch"
 	"github.com/rpstvs/fm-goapp/internal/store"
 	"github.com/rpstvs/fm-goapp/internal/utils"
 )
@@ -27,19 +32,78 @@ func NewWorkoutHandler(workoutStore store.WorkoutStore, logger *log.Logger) *Wor
 	}
 }
 
+// validateWorkout checks a workout before it is written. It mirrors the
+// table constraints so clients get a readable error instead of a failed
+// insert, in particular that an entry is counted in reps or in seconds but
+// never both.
+func validateWorkout(workout *store.Workout) error {
+	if strings.TrimSpace(workout.Title) == "" {
+		return errors.New("title is required")
+	}
+
+	if len(workout.Title) > 255 {
+		return errors.New("title is too long")
+	}
+
+	if workout.DurationMinutes <= 0 {
+		return errors.New("duration_minutes must be positive")
+	}
+
+	if workout.CaloriesBurned < 0 {
+		return errors.New("calories_burned cannot be negative")
+	}
+
+	for i, entry := range workout.Entries {
+		if strings.TrimSpace(entry.ExerciseName) == "" {
+			return fmt.Errorf("entry %d: exercise_name is required", i)
+		}
+
+		if len(entry.ExerciseName) > 255 {
+			return fmt.Errorf("entry %d: exercise_name is too long", i)
+		}
+
+		if entry.Sets <= 0 {
+			return fmt.Errorf("entry %d: sets must be positive", i)
+		}
+
+		if (entry.Reps == nil) == (entry.DurationSeconds == nil) {
+			return fmt.Errorf("entry %d: exactly one of reps or duration_seconds is required", i)
+		}
+	}
+
+	return nil
+}
+
 func (wh *WorkoutHanlder) HandleGetWorkById(w http.ResponseWriter, r *http.Request) {
 	workoutID, err := utils.ReadIDParams(r)
 
 	if err != nil {
 		wh.Logger.Printf("ERROR: readIDParam: %v", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid workout id"})
+		return
 	}
 
 	workout, err := wh.workoutStore.GetWorkoutById(workoutID)
 
 	if err != nil {
 		wh.Logger.Printf("ERROR: GetWorkoutbyId: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid workout id"})
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	// someone else's workout is answered as if it didn't exist, so ids
+	// can't be probed
+	if workout == nil || workout.UserID != middleware.GetUser(r).ID {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found"})
+		return
+	}
+
+	etag := utils.ETag(workout.Version)
+	w.Header().Set("ETag", etag)
+
+	if match := r.Header.Get("If-None-Match"); match != "" && utils.MatchETagWeak(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workout": workout})
@@ -62,13 +126,22 @@ func (wh *WorkoutHanlder) HandleCreateWorkout(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	err = validateWorkout(&workout)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	workout.UserID = currentUser.ID
 	createdWorkout, err := wh.workoutStore.CreateWorkout(&workout)
 
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "failed to create workout", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("ETag", utils.ETag(createdWorkout.Version))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(createdWorkout)
 }
@@ -88,6 +161,20 @@ func (wh *WorkoutHanlder) HandleUpdateWorkoutById(w http.ResponseWriter, r *http
 		return
 	}
 
+	ifMatch := r.Header.Get("If-Match")
+
+	if ifMatch == "" {
+		http.Error(w, "If-Match header is required", http.StatusPreconditionRequired)
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	if currentUser == nil || currentUser == store.AnonymousUser {
+		http.Error(w, "you must be logged in", http.StatusUnauthorized)
+		return
+	}
+
 	existingWorkout, err := wh.workoutStore.GetWorkoutById(workoutID)
 
 	if err != nil {
@@ -100,6 +187,16 @@ func (wh *WorkoutHanlder) HandleUpdateWorkoutById(w http.ResponseWriter, r *http
 		return
 	}
 
+	if existingWorkout.UserID != currentUser.ID {
+		http.Error(w, "you are not authorized to update this workout", http.StatusForbidden)
+		return
+	}
+
+	if !utils.MatchETag(ifMatch, utils.ETag(existingWorkout.Version)) {
+		http.Error(w, "workout has been modified", http.StatusPreconditionFailed)
+		return
+	}
+
 	var updateWorkoutRequest struct {
 		Title           *string              `json:"title"`
 		Description     *string              `json:"description"`
@@ -135,38 +232,183 @@ func (wh *WorkoutHanlder) HandleUpdateWorkoutById(w http.ResponseWriter, r *http
 		existingWorkout.Entries = updateWorkoutRequest.Entries
 	}
 
-	currentUser := middleware.GetUser(r)
+	err = validateWorkout(existingWorkout)
 
-	if currentUser == nil || currentUser == store.AnonymousUser {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	workoutOwner, err := wh.workoutStore.GetWorkoutOwner(int64(currentUser.ID))
+	err = wh.workoutStore.UpdateWorkout(existingWorkout)
 
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return
-		}
+	if errors.Is(err, store.ErrVersionConflict) {
+		http.Error(w, "workout has been modified", http.StatusPreconditionFailed)
 		return
 	}
 
-	if workoutOwner != currentUser.ID {
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
 		return
 	}
 
-	err = wh.workoutStore.UpdateWorkout(existingWorkout)
-
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "failed to update workout", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("ETag", utils.ETag(existingWorkout.Version))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(existingWorkout)
 }
 
+// workoutPatchKeys lets JSON patches name an entry by id, as in
+// /entries/id:42, as well as by its index.
+var workoutPatchKeys = map[string]string{"/entries": "id"}
+
+// HandlePatchWorkoutById applies a merge patch or a JSON patch to the
+// workout document. Entries are matched by id when stored, so a patch that
+// touches a single entry leaves the others untouched, and their order_index
+// follows their position in the patched entries array. A merge patch
+// replaces the entries array as a whole, so entries that keep their id keep
+// their row.
+func (wh *WorkoutHanlder) HandlePatchWorkoutById(w http.ResponseWriter, r *http.Request) {
+	workoutID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid workout id"})
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if err != nil || (mediaType != patch.MergePatchContentType && mediaType != patch.JSONPatchContentType) {
+		w.Header().Set("Accept-Patch", patch.MergePatchContentType+", "+patch.JSONPatchContentType)
+		utils.WriteJSON(w, http.StatusUnsupportedMediaType, utils.Envelope{"error": "unsupported patch format"})
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+
+	if ifMatch == "" {
+		utils.WriteJSON(w, http.StatusPreconditionRequired, utils.Envelope{"error": "If-Match header is required"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	if currentUser == nil || currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	existingWorkout, err := wh.workoutStore.GetWorkoutById(workoutID)
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: getWorkoutById: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if existingWorkout == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found"})
+		return
+	}
+
+	if existingWorkout.UserID != currentUser.ID {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you are not authorized to update this workout"})
+		return
+	}
+
+	if !utils.MatchETag(ifMatch, utils.ETag(existingWorkout.Version)) {
+		utils.WriteJSON(w, http.StatusPreconditionFailed, utils.Envelope{"error": "workout has been modified"})
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "could not read request body"})
+		return
+	}
+
+	doc, err := json.Marshal(existingWorkout)
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: marshalling workout: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	var patched []byte
+
+	if mediaType == patch.MergePatchContentType {
+		patched, err = patch.MergePatch(doc, body)
+	} else {
+		patched, err = patch.ApplyKeyed(doc, body, workoutPatchKeys)
+	}
+
+	switch {
+	case errors.Is(err, patch.ErrInvalidPatch):
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	case errors.Is(err, patch.ErrTestFailed):
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": err.Error()})
+		return
+	case err != nil:
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	var updated store.Workout
+
+	err = json.Unmarshal(patched, &updated)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "patched workout is invalid"})
+		return
+	}
+
+	// identity and concurrency fields are not patchable
+	updated.ID = existingWorkout.ID
+	updated.UserID = existingWorkout.UserID
+	updated.Version = existingWorkout.Version
+
+	// removing /entries, or setting it to null, leaves it nil, which the
+	// store takes to mean "keep the entries"
+	if updated.Entries == nil {
+		updated.Entries = []store.WorkoutEntry{}
+	}
+
+	for i := range updated.Entries {
+		updated.Entries[i].OrderIndex = i
+	}
+
+	err = validateWorkout(&updated)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	err = wh.workoutStore.UpdateWorkout(&updated)
+
+	if errors.Is(err, store.ErrVersionConflict) {
+		utils.WriteJSON(w, http.StatusPreconditionFailed, utils.Envelope{"error": "workout has been modified"})
+		return
+	}
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: updateWorkout: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.Header().Set("ETag", utils.ETag(updated.Version))
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workout": updated})
+}
+
 func (wh *WorkoutHanlder) HandleDeleteWorkoutById(w http.ResponseWriter, r *http.Request) {
 	paramsWorkoutID := chi.URLParam(r, "id")
 
@@ -182,26 +424,48 @@ func (wh *WorkoutHanlder) HandleDeleteWorkoutById(w http.ResponseWriter, r *http
 		return
 	}
 
+	ifMatch := r.Header.Get("If-Match")
+
+	if ifMatch == "" {
+		http.Error(w, "If-Match header is required", http.StatusPreconditionRequired)
+		return
+	}
+
 	currentUser := middleware.GetUser(r)
 
 	if currentUser == nil || currentUser == store.AnonymousUser {
+		http.Error(w, "you must be logged in", http.StatusUnauthorized)
 		return
 	}
 
-	workoutOwner, err := wh.workoutStore.GetWorkoutOwner(int64(currentUser.ID))
+	existingWorkout, err := wh.workoutStore.GetWorkoutById(workoutID)
 
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return
-		}
+		http.Error(w, "Error deleting workout", http.StatusInternalServerError)
 		return
 	}
 
-	if workoutOwner != currentUser.ID {
+	if existingWorkout == nil {
+		http.Error(w, "workout not found", http.StatusNotFound)
 		return
 	}
 
-	err = wh.workoutStore.DeleteWorkout(workoutID)
+	if existingWorkout.UserID != currentUser.ID {
+		http.Error(w, "you are not authorized to delete this workout", http.StatusForbidden)
+		return
+	}
+
+	if !utils.MatchETag(ifMatch, utils.ETag(existingWorkout.Version)) {
+		http.Error(w, "workout has been modified", http.StatusPreconditionFailed)
+		return
+	}
+
+	err = wh.workoutStore.DeleteWorkout(workoutID, existingWorkout.Version)
+
+	if errors.Is(err, store.ErrVersionConflict) {
+		http.Error(w, "workout has been modified", http.StatusPreconditionFailed)
+		return
+	}
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "workout not found", http.StatusNotFound)
@@ -216,3 +480,126 @@ func (wh *WorkoutHanlder) HandleDeleteWorkoutById(w http.ResponseWriter, r *http
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 }
+
+func (wh *WorkoutHanlder) HandleRestoreWorkoutById(w http.ResponseWriter, r *http.Request) {
+	workoutID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: readIDParam: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid workout id"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	if currentUser == nil || currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	err = wh.workoutStore.RestoreWorkout(workoutID, currentUser.ID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found in trash"})
+		return
+	}
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: restoreWorkout: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	workout, err := wh.workoutStore.GetWorkoutById(workoutID)
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: getWorkoutById: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if workout != nil {
+		w.Header().Set("ETag", utils.ETag(workout.Version))
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workout": workout})
+}
+
+func (wh *WorkoutHanlder) HandleGetTrash(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	if currentUser == nil || currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	trashed, err := wh.workoutStore.GetTrashedWorkouts(currentUser.ID)
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: getTrashedWorkouts: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workouts": trashed})
+}
+
+func (wh *WorkoutHanlder) HandleSearchWorkouts(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	if currentUser == nil || currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	values := r.URL.Query()
+
+	params := store.WorkoutSearchParams{
+		Query: strings.TrimSpace(values.Get("q")),
+		Limit: 20,
+	}
+
+	if params.Query == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "q is required"})
+		return
+	}
+
+	if from := values.Get("from"); from != "" {
+		t, err := time.Parse(time.DateOnly, from)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "from must be YYYY-MM-DD"})
+			return
+		}
+		params.From = &t
+	}
+
+	if to := values.Get("to"); to != "" {
+		t, err := time.Parse(time.DateOnly, to)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "to must be YYYY-MM-DD"})
+			return
+		}
+		// to is inclusive, so search up to the start of the following day
+		t = t.AddDate(0, 0, 1)
+		params.To = &t
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > 100 {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit must be between 1 and 100"})
+			return
+		}
+		params.Limit = n
+	}
+
+	results, err := wh.workoutStore.SearchWorkouts(currentUser.ID, params)
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: searchWorkouts: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"results": results})
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+// requireWorkoutOwner reads the workout id from the url and checks that the
+// current user owns it. It writes the error response itself and returns
+// false when the request should stop.
+func (wh *WorkoutHanlder) requireWorkoutOwner(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	workoutID, err := utils.ReadIDParams(r)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid workout id"})
+		return 0, false
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	if currentUser == nil || currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "you must be logged in"})
+		return 0, false
+	}
+
+	workoutOwner, err := wh.workoutStore.GetWorkoutOwner(workoutID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found"})
+		return 0, false
+	}
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: getWorkoutOwner: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return 0, false
+	}
+
+	if workoutOwner != currentUser.ID {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you are not authorized to access this workout"})
+		return 0, false
+	}
+
+	return workoutID, true
+}
+
+func (wh *WorkoutHanlder) getRevision(w http.ResponseWriter, workoutID int64, param string) (*store.WorkoutRevision, bool) {
+	revisionNumber, err := strconv.Atoi(param)
+
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid revision"})
+		return nil, false
+	}
+
+	revision, err := wh.workoutStore.GetWorkoutRevision(workoutID, revisionNumber)
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: getWorkoutRevision: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil, false
+	}
+
+	if revision == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "revision not found"})
+		return nil, false
+	}
+
+	return revision, true
+}
+
+func (wh *WorkoutHanlder) HandleGetWorkoutRevisions(w http.ResponseWriter, r *http.Request) {
+	workoutID, ok := wh.requireWorkoutOwner(w, r)
+	if !ok {
+		return
+	}
+
+	revisions, err := wh.workoutStore.GetWorkoutRevisions(workoutID)
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: getWorkoutRevisions: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"revisions": revisions})
+}
+
+func (wh *WorkoutHanlder) HandleGetWorkoutRevision(w http.ResponseWriter, r *http.Request) {
+	workoutID, ok := wh.requireWorkoutOwner(w, r)
+	if !ok {
+		return
+	}
+
+	revision, ok := wh.getRevision(w, workoutID, chi.URLParam(r, "revision"))
+	if !ok {
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"revision": revision})
+}
+
+func (wh *WorkoutHanlder) HandleDiffWorkoutRevisions(w http.ResponseWriter, r *http.Request) {
+	workoutID, ok := wh.requireWorkoutOwner(w, r)
+	if !ok {
+		return
+	}
+
+	from, ok := wh.getRevision(w, workoutID, r.URL.Query().Get("from"))
+	if !ok {
+		return
+	}
+
+	to, ok := wh.getRevision(w, workoutID, r.URL.Query().Get("to"))
+	if !ok {
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"diff": store.DiffWorkoutRevisions(from, to)})
+}
+
+func (wh *WorkoutHanlder) HandleRevertWorkout(w http.ResponseWriter, r *http.Request) {
+	ifMatch := r.Header.Get("If-Match")
+
+	if ifMatch == "" {
+		utils.WriteJSON(w, http.StatusPreconditionRequired, utils.Envelope{"error": "If-Match header is required"})
+		return
+	}
+
+	workoutID, ok := wh.requireWorkoutOwner(w, r)
+	if !ok {
+		return
+	}
+
+	revision, ok := wh.getRevision(w, workoutID, chi.URLParam(r, "revision"))
+	if !ok {
+		return
+	}
+
+	workout, err := wh.workoutStore.GetWorkoutById(workoutID)
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: getWorkoutById: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if workout == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found"})
+		return
+	}
+
+	if !utils.MatchETag(ifMatch, utils.ETag(workout.Version)) {
+		utils.WriteJSON(w, http.StatusPreconditionFailed, utils.Envelope{"error": "workout has been modified"})
+		return
+	}
+
+	workout.Title = revision.Snapshot.Title
+	workout.Description = revision.Snapshot.Description
+	workout.DurationMinutes = revision.Snapshot.DurationMinutes
+	workout.CaloriesBurned = revision.Snapshot.CaloriesBurned
+	workout.Entries = revision.Snapshot.Entries
+
+	err = wh.workoutStore.UpdateWorkout(workout)
+
+	if errors.Is(err, store.ErrVersionConflict) {
+		utils.WriteJSON(w, http.StatusPreconditionFailed, utils.Envelope{"error": "workout has been modified"})
+		return
+	}
+
+	if err != nil {
+		wh.Logger.Printf("ERROR: updateWorkout: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.Header().Set("ETag", utils.ETag(workout.Version))
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workout": workout})
+}
@@ -1,27 +1,84 @@
 package app
 
 import (
+	"cmp"
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rpstvs/fm-goapp/internal/api"
+	"github.com/rpstvs/fm-goapp/internal/jobs"
+	"github.com/rpstvs/fm-goapp/internal/live"
+	"github.com/rpstvs/fm-goapp/internal/mail"
 	"github.com/rpstvs/fm-goapp/internal/middleware"
+	"github.com/rpstvs/fm-goapp/internal/outbox"
+	"github.com/rpstvs/fm-goapp/internal/scheduler"
 	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/webauthn"
+	"github.com/rpstvs/fm-goapp/internal/webhooks"
 	"github.com/rpstvs/fm-goapp/migrations"
 )
 
 type Application struct {
-	Logger         *log.Logger
-	WorkoutHandler *api.WorkoutHanlder
-	UserHandler    *api.UserHandler
-	TokenHandler   *api.TokenHandler
-	Middleware     middleware.UserMiddleware
-	DB             *sql.DB
+	Logger           *log.Logger
+	WorkoutHandler   *api.WorkoutHanlder
+	UserHandler      *api.UserHandler
+	TokenHandler     *api.TokenHandler
+	SyncHandler      *api.SyncHandler
+	LiveHandler      *api.LiveSessionHandler
+	LiveHub          *live.Hub
+	EventHandler     *api.EventHandler
+	EventBroker      *live.Broker
+	WebhookHandler   *api.WebhookHandler
+	Webhooks         *webhooks.Dispatcher
+	Outbox           *outbox.Relay
+	JobHandler       *api.JobHandler
+	Jobs             *jobs.Queue
+	ScheduleHandler  *api.ScheduleHandler
+	Scheduler        *scheduler.Scheduler
+	EmailHandler     *api.EmailHandler
+	APIKeyHandler    *api.APIKeyHandler
+	AnalyticsHandler *api.AnalyticsHandler
+	MFAHandler       *api.MFAHandler
+	PasskeyHandler   *api.PasskeyHandler
+	OAuthHandler     *api.OAuthHandler
+	SSOHandler       *api.SSOHandler
+	Notifier         *mail.Notifier
+	Middleware       middleware.UserMiddleware
+	Idempotency      middleware.IdempotencyMiddleware
+	DB               *sql.DB
+
+	workoutStore      store.WorkoutStore
+	accountEventStore store.AccountEventStore
+	outboxStore       store.OutboxStore
+	jobStore          store.JobStore
+	tokenStore        store.TokenStore
+	idempotencyStore  store.IdempotencyStore
+	scheduleStore     store.ScheduleStore
+	analyticsStore    store.AnalyticsStore
+	passkeyStore      store.PasskeyStore
+	oauthStore        store.OAuthStore
+	signingKeyStore   store.SigningKeyStore
+	identityStore     store.IdentityStore
+	trashRetention    time.Duration
 }
 
+const (
+	defaultTrashRetention = 30 * 24 * time.Hour
+	idempotencyKeyTTL     = 24 * time.Hour
+	idempotencyKeyLease   = 2 * time.Minute
+	accountEventRetention = 7 * 24 * time.Hour
+	outboxRetention       = 7 * 24 * time.Hour
+	finishedJobRetention  = 7 * 24 * time.Hour
+)
+
 func NewApplication() (*Application, error) {
 	pgDB, err := store.Open()
 	if err != nil {
@@ -36,33 +93,206 @@ func NewApplication() (*Application, error) {
 
 	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
 
+	trashRetention := defaultTrashRetention
+	if v := os.Getenv("TRASH_RETENTION"); v != "" {
+		trashRetention, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("app: invalid TRASH_RETENTION %w", err)
+		}
+	}
+
+	var jobWorkers int
+	if v := os.Getenv("JOB_WORKERS"); v != "" {
+		jobWorkers, err = strconv.Atoi(v)
+		if err != nil || jobWorkers < 1 {
+			return nil, fmt.Errorf("app: invalid JOB_WORKERS %q", v)
+		}
+	}
+
+	mailer, mailSecret, err := newMailer(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	mailTemplates, err := mail.LoadTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL := strings.TrimSuffix(cmp.Or(os.Getenv("APP_BASE_URL"), defaultBaseURL), "/")
+
+	relyingParty, err := newRelyingParty(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	ssoProviders, err := newSSOProviders(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
 	//stores
 	workoutStore := store.NewPostgresWorkoutStore(pgDB)
 	userStore := store.NewPostgresUserStore(pgDB)
 	tokenStore := store.NewPostgresTokenStore(pgDB)
+	idempotencyStore := store.NewPostgresIdempotencyStore(pgDB)
+	syncStore := store.NewPostgresSyncStore(pgDB)
+	liveSessionStore := store.NewPostgresLiveSessionStore(pgDB)
+	accountEventStore := store.NewPostgresAccountEventStore(pgDB)
+	webhookStore := store.NewPostgresWebhookStore(pgDB)
+	outboxStore := store.NewPostgresOutboxStore(pgDB)
+	jobStore := store.NewPostgresJobStore(pgDB)
+	scheduleStore := store.NewPostgresScheduleStore(pgDB)
+	analyticsStore := store.NewPostgresAnalyticsStore(pgDB)
+	emailPreferenceStore := store.NewPostgresEmailPreferenceStore(pgDB)
+	apiKeyStore := store.NewPostgresAPIKeyStore(pgDB)
+	mfaStore := store.NewPostgresMFAStore(pgDB)
+	passkeyStore := store.NewPostgresPasskeyStore(pgDB)
+	oauthStore := store.NewPostgresOAuthStore(pgDB)
+	signingKeyStore := store.NewPostgresSigningKeyStore(pgDB)
+	identityStore := store.NewPostgresIdentityStore(pgDB)
+
+	jobQueue := jobs.NewQueue(jobStore, logger, jobs.Config{Workers: jobWorkers})
+	notifier := mail.NewNotifier(mailer, mailTemplates, userStore, emailPreferenceStore, jobQueue, baseURL, mailSecret)
+
+	liveHub := live.NewHub(logger)
+	eventBroker := live.NewBroker(logger)
 
 	//handlers
 	workoutHandler := api.NewWorkoutHandler(workoutStore, logger)
-	userHandler := api.NewUserHandler(userStore, logger)
-	tokenHandler := api.NewTokenHandler(tokenStore, userStore, logger)
+	userHandler := api.NewUserHandler(userStore, tokenStore, notifier, logger)
+	tokenHandler := api.NewTokenHandler(tokenStore, userStore, mfaStore, notifier, logger)
+	syncHandler := api.NewSyncHandler(syncStore, logger)
+	liveHandler := api.NewLiveSessionHandler(liveSessionStore, userStore, liveHub, baseURL, logger)
+	eventHandler := api.NewEventHandler(accountEventStore, eventBroker, logger)
+	webhookHandler := api.NewWebhookHandler(webhookStore, logger)
+	jobHandler := api.NewJobHandler(jobStore, logger)
+	cron := scheduler.New(scheduleStore, logger)
+	scheduleHandler := api.NewScheduleHandler(scheduleStore, cron, logger)
+	emailHandler := api.NewEmailHandler(emailPreferenceStore, mailSecret, logger)
+	apiKeyHandler := api.NewAPIKeyHandler(apiKeyStore, logger)
+	analyticsHandler := api.NewAnalyticsHandler(analyticsStore, logger)
+	mfaHandler := api.NewMFAHandler(mfaStore, logger)
+	passkeyHandler := api.NewPasskeyHandler(passkeyStore, tokenStore, relyingParty, logger)
+	oauthHandler := api.NewOAuthHandler(oauthStore, signingKeyStore, userStore, baseURL, logger)
+	ssoHandler := api.NewSSOHandler(ssoProviders, identityStore, userStore, tokenStore, mfaStore, strings.HasPrefix(baseURL, "https://"), logger)
 	middlewareHandler := middleware.UserMiddleware{
-		UserStore: userStore,
+		UserStore:   userStore,
+		TokenStore:  tokenStore,
+		APIKeyStore: apiKeyStore,
+		OAuthStore:  oauthStore,
+		Logger:      logger,
+	}
+	idempotencyMiddleware := middleware.IdempotencyMiddleware{
+		Store:  idempotencyStore,
+		TTL:    idempotencyKeyTTL,
+		Lease:  idempotencyKeyLease,
+		Logger: logger,
 	}
 
 	app := &Application{
-		Logger:         logger,
-		WorkoutHandler: workoutHandler,
-		UserHandler:    userHandler,
-		TokenHandler:   tokenHandler,
-		Middleware:     middlewareHandler,
-		DB:             pgDB,
+		Logger:            logger,
+		WorkoutHandler:    workoutHandler,
+		UserHandler:       userHandler,
+		TokenHandler:      tokenHandler,
+		SyncHandler:       syncHandler,
+		LiveHandler:       liveHandler,
+		LiveHub:           liveHub,
+		EventHandler:      eventHandler,
+		EventBroker:       eventBroker,
+		WebhookHandler:    webhookHandler,
+		Webhooks:          webhooks.NewDispatcher(webhookStore, logger),
+		Outbox:            outbox.NewRelay(outboxStore, logger),
+		JobHandler:        jobHandler,
+		Jobs:              jobQueue,
+		ScheduleHandler:   scheduleHandler,
+		Scheduler:         cron,
+		EmailHandler:      emailHandler,
+		APIKeyHandler:     apiKeyHandler,
+		AnalyticsHandler:  analyticsHandler,
+		MFAHandler:        mfaHandler,
+		PasskeyHandler:    passkeyHandler,
+		OAuthHandler:      oauthHandler,
+		SSOHandler:        ssoHandler,
+		Notifier:          notifier,
+		Middleware:        middlewareHandler,
+		Idempotency:       idempotencyMiddleware,
+		DB:                pgDB,
+		workoutStore:      workoutStore,
+		accountEventStore: accountEventStore,
+		outboxStore:       outboxStore,
+		jobStore:          jobStore,
+		tokenStore:        tokenStore,
+		idempotencyStore:  idempotencyStore,
+		scheduleStore:     scheduleStore,
+		analyticsStore:    analyticsStore,
+		passkeyStore:      passkeyStore,
+		oauthStore:        oauthStore,
+		signingKeyStore:   signingKeyStore,
+		identityStore:     identityStore,
+		trashRetention:    trashRetention,
+	}
+
+	app.Outbox.Subscribe("emails", app.queueEmails)
+
+	err = app.registerSchedules()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// a fresh database has no key to sign ID tokens with until the first
+	// scheduled rotation, so make sure there is one now
+	if _, err := app.rotateSigningKeys(context.Background()); err != nil {
+		return nil, err
 	}
 
 	return app, nil
 }
 
+// newRelyingParty sets up WebAuthn for the site at baseURL: passkeys are
+// scoped to its host and ceremonies must come from its origin.
+func newRelyingParty(baseURL string) (*webauthn.Config, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Scheme == "" || u.Hostname() == "" {
+		return nil, fmt.Errorf("app: invalid APP_BASE_URL %q", baseURL)
+	}
+
+	return &webauthn.Config{
+		RPID:                    u.Hostname(),
+		RPName:                  "FM Workouts",
+		Origins:                 []string{u.Scheme + "://" + u.Host},
+		RequireUserVerification: true,
+	}, nil
+}
+
 func (app *Application) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "OK\n")
 	w.WriteHeader(200)
 
 }
+
+// StartScheduler runs the scheduled jobs in the background while this
+// instance is the scheduler leader.
+func (app *Application) StartScheduler() {
+	go app.Scheduler.Run(context.Background())
+}
+
+// StartLiveHub listens for live session events and account events from
+// Postgres and fans them out to the clients connected to this instance,
+// whichever instance handled the write.
+func (app *Application) StartLiveHub() {
+	go app.LiveHub.Listen(context.Background(), os.Getenv("DATABASE_URL"))
+	go app.EventBroker.Listen(context.Background(), os.Getenv("DATABASE_URL"))
+}
+
+// StartWebhookDispatcher sends queued webhook deliveries in the background.
+func (app *Application) StartWebhookDispatcher() {
+	go app.Webhooks.Run(context.Background())
+}
+
+// StartOutboxRelay publishes domain events from the outbox to the
+// subscribers registered on app.Outbox.
+func (app *Application) StartOutboxRelay() {
+	go app.Outbox.Run(context.Background())
+}
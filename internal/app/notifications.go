@@ -0,0 +1,134 @@
+package app
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/mail"
+	"github.com/rpstvs/fm-goapp/internal/store"
+)
+
+// queueEmails is the outbox subscriber that turns domain events into
+// email. Building on the outbox means an email is only sent for a change
+// that committed. Unique keys stop a redelivered event from queuing the
+// same email twice while the first is still waiting.
+func (app *Application) queueEmails(ctx context.Context, event store.DomainEvent) error {
+	switch event.Type {
+	case store.EventUserRegistered:
+		userID := int(event.AggregateID)
+
+		err := app.Notifier.Notify(userID, mail.TemplateWelcome, nil, fmt.Sprintf("welcome:%d", userID))
+
+		if err != nil {
+			return err
+		}
+
+		// users provisioned by an identity provider start out verified
+		var registered struct {
+			EmailVerifiedAt *time.Time `json:"email_verified_at"`
+		}
+
+		if err := json.Unmarshal(event.Payload, &registered); err != nil {
+			return err
+		}
+
+		if registered.EmailVerifiedAt != nil {
+			return nil
+		}
+
+		return app.UserHandler.QueueVerificationEmail(userID)
+
+	case store.EventWeeklySummary:
+		var stats store.WeeklyStats
+
+		if err := json.Unmarshal(event.Payload, &stats); err != nil {
+			return err
+		}
+
+		data := map[string]any{
+			"week_start":       stats.WeekStart.Format("January 2"),
+			"workouts":         stats.Workouts,
+			"duration_minutes": stats.DurationMinutes,
+			"calories_burned":  stats.CaloriesBurned,
+		}
+
+		return app.Notifier.Notify(stats.UserID, mail.TemplateWeeklySummary, data,
+			fmt.Sprintf("weekly:%d:%s", stats.UserID, stats.WeekStart.Format(time.DateOnly)))
+
+	case store.EventPRAchieved:
+		var achieved struct {
+			WorkoutID int64                  `json:"workout_id"`
+			Records   []store.PersonalRecord `json:"records"`
+		}
+
+		if err := json.Unmarshal(event.Payload, &achieved); err != nil {
+			return err
+		}
+
+		workout, err := app.workoutStore.GetWorkoutById(achieved.WorkoutID)
+
+		// the workout was deleted before the email went out
+		if err != nil || workout == nil {
+			return err
+		}
+
+		data := map[string]any{
+			"workout_title": workout.Title,
+			"records":       achieved.Records,
+		}
+
+		return app.Notifier.Notify(workout.UserID, mail.TemplatePersonalRecord, data, fmt.Sprintf("records:%d", event.ID))
+	}
+
+	return nil
+}
+
+const (
+	defaultMailFrom = "FM Workouts <no-reply@localhost>"
+	defaultMailDir  = "tmp/mail"
+	defaultBaseURL  = "http://localhost:8080"
+	defaultSMTPPort = 587
+)
+
+// newMailer sends through SMTP_HOST when it is set and writes email to
+// MAIL_DIR otherwise. It also returns the secret that signs unsubscribe
+// links, MAIL_SECRET, which a real mail setup has to set so links work on
+// every instance and across restarts.
+func newMailer(logger *log.Logger) (mail.Mailer, []byte, error) {
+	from := cmp.Or(os.Getenv("MAIL_FROM"), defaultMailFrom)
+	secret := []byte(os.Getenv("MAIL_SECRET"))
+	host := os.Getenv("SMTP_HOST")
+
+	if host == "" {
+		if len(secret) == 0 {
+			logger.Println("MAIL_SECRET is not set, unsubscribe links will stop working on restart")
+			secret = make([]byte, 32)
+			rand.Read(secret)
+		}
+
+		return mail.NewFileMailer(cmp.Or(os.Getenv("MAIL_DIR"), defaultMailDir), from), secret, nil
+	}
+
+	if len(secret) == 0 {
+		return nil, nil, errors.New("app: MAIL_SECRET is required with SMTP_HOST")
+	}
+
+	port := defaultSMTPPort
+	if v := os.Getenv("SMTP_PORT"); v != "" {
+		var err error
+		port, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("app: invalid SMTP_PORT %q", v)
+		}
+	}
+
+	return mail.NewSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from), secret, nil
+}
@@ -0,0 +1,246 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/jobs"
+	"github.com/rpstvs/fm-goapp/internal/jose"
+	"github.com/rpstvs/fm-goapp/internal/store"
+)
+
+const (
+	scheduledRunRetention = 30 * 24 * time.Hour
+	signingKeyRotation    = 30 * 24 * time.Hour
+	signingKeyLifetime    = 60 * 24 * time.Hour
+	signingKeyBits        = 2048
+)
+
+// weeklySummaryArgs asks for one user's summary of the week starting on
+// WeekStart.
+type weeklySummaryArgs struct {
+	UserID    int       `json:"user_id"`
+	WeekStart time.Time `json:"week_start"`
+}
+
+func (weeklySummaryArgs) Kind() string { return "weekly_summary" }
+
+// registerSchedules adds the built-in scheduled jobs and the job handlers
+// they depend on.
+func (app *Application) registerSchedules() error {
+	schedules := []struct {
+		name string
+		spec string
+		fn   func(ctx context.Context) (string, error)
+	}{
+		{"purge-expired-tokens", "15 * * * *", app.purgeExpiredTokens},
+		{"purge-trash", "30 * * * *", app.purgeTrash},
+		{"purge-logs", "45 * * * *", app.purgeLogs},
+		{"refresh-analytics", "*/15 * * * *", app.refreshAnalytics},
+		{"weekly-summaries", "0 8 * * 1", app.queueWeeklySummaries},
+		{"rotate-signing-keys", "0 3 * * *", app.rotateSigningKeys},
+	}
+
+	for _, s := range schedules {
+		if err := app.Scheduler.Add(s.name, s.spec, s.fn); err != nil {
+			return err
+		}
+	}
+
+	jobs.Register(app.Jobs, app.sendWeeklySummary, jobs.HandlerOptions{Timeout: time.Minute})
+
+	return nil
+}
+
+func (app *Application) purgeExpiredTokens(ctx context.Context) (string, error) {
+	purged, err := app.tokenStore.DeleteExpiredTokens(time.Now())
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("purged %d expired tokens", purged), nil
+}
+
+// purgeTrash permanently deletes workouts that have sat in the trash for
+// longer than the retention period.
+func (app *Application) purgeTrash(ctx context.Context) (string, error) {
+	purged, err := app.workoutStore.PurgeTrashedWorkouts(time.Now().Add(-app.trashRetention))
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("purged %d trashed workouts", purged), nil
+}
+
+// purgeLogs deletes account events, published outbox events, finished
+// jobs, idempotency keys, scheduled run records, unanswered WebAuthn
+// challenges, expired OAuth requests, codes and tokens, and abandoned SSO
+// logins past their retention.
+func (app *Application) purgeLogs(ctx context.Context) (string, error) {
+	now := time.Now()
+
+	purges := []struct {
+		what  string
+		purge func() (int64, error)
+	}{
+		{"account events", func() (int64, error) {
+			return app.accountEventStore.PurgeAccountEvents(now.Add(-accountEventRetention))
+		}},
+		{"published outbox events", func() (int64, error) {
+			return app.outboxStore.PurgePublishedOutbox(now.Add(-outboxRetention))
+		}},
+		{"finished jobs", func() (int64, error) {
+			return app.jobStore.PurgeFinishedJobs(now.Add(-finishedJobRetention))
+		}},
+		{"idempotency keys", app.idempotencyStore.DeleteExpiredIdempotencyKeys},
+		{"scheduled runs", func() (int64, error) {
+			return app.scheduleStore.PurgeScheduledRuns(now.Add(-scheduledRunRetention))
+		}},
+		{"webauthn challenges", func() (int64, error) {
+			return app.passkeyStore.DeleteExpiredChallenges(now)
+		}},
+		{"oauth codes and tokens", func() (int64, error) {
+			return app.oauthStore.PurgeExpiredOAuth(now)
+		}},
+		{"sso logins", func() (int64, error) {
+			return app.identityStore.DeleteExpiredSSOLogins(now)
+		}},
+	}
+
+	result := ""
+	var errs []error
+
+	// one failing purge shouldn't hold up the others
+	for _, p := range purges {
+		purged, err := p.purge()
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("purging %s: %w", p.what, err))
+			continue
+		}
+
+		if result != "" {
+			result += ", "
+		}
+		result += fmt.Sprintf("%d %s", purged, p.what)
+	}
+
+	if len(errs) > 0 {
+		return "", errors.Join(errs...)
+	}
+
+	return "purged " + result, nil
+}
+
+// rotateSigningKeys adds a new ID token signing key once the newest is
+// signingKeyRotation old, and deletes expired ones. Keys outlive their
+// rotation so ID tokens signed just before it can still be verified.
+func (app *Application) rotateSigningKeys(ctx context.Context) (string, error) {
+	now := time.Now()
+
+	purged, err := app.signingKeyStore.DeleteExpiredSigningKeys(now)
+
+	if err != nil {
+		return "", err
+	}
+
+	keys, err := app.signingKeyStore.GetSigningKeys(now)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(keys) > 0 && now.Sub(keys[0].CreatedAt) < signingKeyRotation {
+		return fmt.Sprintf("purged %d expired signing keys, newest key %s is current", purged, keys[0].KID), nil
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+
+	if err != nil {
+		return "", err
+	}
+
+	signingKey := &store.SigningKey{
+		KID:       jose.Thumbprint(&key.PublicKey),
+		Key:       key,
+		ExpiresAt: now.Add(signingKeyLifetime),
+	}
+
+	err = app.signingKeyStore.CreateSigningKey(signingKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("purged %d expired signing keys, added key %s", purged, signingKey.KID), nil
+}
+
+func (app *Application) refreshAnalytics(ctx context.Context) (string, error) {
+	return "", app.analyticsStore.RefreshAnalytics()
+}
+
+// queueWeeklySummaries queues a summary of last week for every user who
+// worked out in it. The unique key only covers jobs still waiting or
+// running, so a later rerun queues the week again; RecordWeeklySummary is
+// what keeps a user from getting it twice.
+func (app *Application) queueWeeklySummaries(ctx context.Context) (string, error) {
+	// the view may be up to a refresh behind; the week has to be complete
+	err := app.analyticsStore.RefreshAnalytics()
+
+	if err != nil {
+		return "", err
+	}
+
+	weekStart := lastWeekStart(time.Now())
+
+	users, err := app.analyticsStore.GetActiveUsers(weekStart)
+
+	if err != nil {
+		return "", err
+	}
+
+	queued := 0
+
+	for _, userID := range users {
+		_, err := jobs.Enqueue(app.Jobs, weeklySummaryArgs{UserID: userID, WeekStart: weekStart}, jobs.EnqueueOptions{
+			UniqueKey: fmt.Sprintf("user:%d:week:%s", userID, weekStart.Format(time.DateOnly)),
+		})
+
+		if errors.Is(err, jobs.ErrDuplicate) {
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		queued++
+	}
+
+	return fmt.Sprintf("queued %d weekly summaries for the week of %s", queued, weekStart.Format(time.DateOnly)), nil
+}
+
+func (app *Application) sendWeeklySummary(ctx context.Context, job *jobs.Job[weeklySummaryArgs]) error {
+	stats, err := app.analyticsStore.GetWeeklyStats(job.Args.UserID, job.Args.WeekStart)
+
+	if err != nil {
+		return err
+	}
+
+	return app.analyticsStore.RecordWeeklySummary(stats)
+}
+
+// lastWeekStart is the Monday, in UTC, starting the week before the one t
+// falls in.
+func lastWeekStart(t time.Time) time.Time {
+	t = t.UTC()
+	daysSinceMonday := (int(t.Weekday()) + 6) % 7
+	monday := time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, time.UTC)
+	return monday.AddDate(0, 0, -7)
+}
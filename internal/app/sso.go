@@ -0,0 +1,53 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/rpstvs/fm-goapp/internal/oidc"
+)
+
+var providerName = regexp.MustCompile(`^[a-z0-9-]{1,50}$`)
+
+// newSSOProviders sets up the OpenID Connect providers users can log in
+// with. OIDC_PROVIDERS lists their names, comma separated, and each is
+// configured by OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID,
+// OIDC_<NAME>_CLIENT_SECRET and, optionally, a space separated
+// OIDC_<NAME>_SCOPES. Providers send users back to the web app at
+// /login/sso/<name>.
+func newSSOProviders(baseURL string) ([]*oidc.Provider, error) {
+	var providers []*oidc.Provider
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			continue
+		}
+
+		if !providerName.MatchString(name) {
+			return nil, fmt.Errorf("app: invalid OIDC provider name %q", name)
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+
+		provider, err := oidc.NewProvider(oidc.Config{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  baseURL + "/login/sso/" + name,
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("app: OIDC provider %s: %w", name, err)
+		}
+
+		providers = append(providers, provider)
+	}
+
+	return providers, nil
+}
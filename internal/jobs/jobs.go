@@ -0,0 +1,136 @@
+// Package jobs runs work outside the request path on a job queue kept in
+// Postgres. Workers claim jobs with SELECT ... FOR UPDATE SKIP LOCKED, so
+// any number of them can share the queue, and hold a lease they keep
+// renewing; a job whose worker dies is picked up again when the lease
+// runs out.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/store"
+)
+
+const defaultMaxAttempts = 10
+
+// Args is the payload of a job. Its Kind names the handler that runs it and
+// it is stored as JSON.
+type Args interface {
+	Kind() string
+}
+
+// Job is a claimed job with its decoded arguments.
+type Job[T Args] struct {
+	ID        int64
+	Attempt   int
+	Args      T
+	CreatedAt time.Time
+}
+
+type HandlerOptions struct {
+	// MaxAttempts is how often a job is tried before it is marked failed;
+	// 10 when zero.
+	MaxAttempts int
+	// Timeout bounds a single attempt; no limit when zero.
+	Timeout time.Duration
+}
+
+type EnqueueOptions struct {
+	// RunAt delays the job; it runs as soon as possible when zero.
+	RunAt time.Time
+	// UniqueKey makes Enqueue a no-op while a job of the same kind with the
+	// same key is queued or running.
+	UniqueKey string
+}
+
+// ErrDuplicate is returned by Enqueue, together with the existing job's
+// id, when a job with the same unique key is already queued or running.
+var ErrDuplicate = errors.New("jobs: duplicate job")
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks a handler error as not worth retrying; the job is failed
+// straight away.
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+type handler struct {
+	opts HandlerOptions
+	work func(ctx context.Context, job *store.Job) error
+}
+
+// Register makes q run jobs of T's kind with fn. Handlers have to be
+// registered before the queue starts.
+func Register[T Args](q *Queue, fn func(ctx context.Context, job *Job[T]) error, opts HandlerOptions) {
+	var zero T
+
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+
+	q.handlers[zero.Kind()] = handler{
+		opts: opts,
+		work: func(ctx context.Context, job *store.Job) error {
+			var args T
+
+			if err := json.Unmarshal(job.Payload, &args); err != nil {
+				return Permanent(fmt.Errorf("decoding %s args: %w", job.Kind, err))
+			}
+
+			return fn(ctx, &Job[T]{ID: job.ID, Attempt: job.Attempts, Args: args, CreatedAt: job.CreatedAt})
+		},
+	}
+}
+
+// Enqueue adds a job to the queue and returns its id. Jobs of kinds no
+// worker handles wait in the queue until one does.
+func Enqueue[T Args](q *Queue, args T, opts EnqueueOptions) (int64, error) {
+	payload, err := json.Marshal(args)
+
+	if err != nil {
+		return 0, err
+	}
+
+	job := &store.Job{
+		Kind:        args.Kind(),
+		Payload:     payload,
+		MaxAttempts: defaultMaxAttempts,
+		RunAt:       opts.RunAt,
+	}
+
+	if h, ok := q.handlers[job.Kind]; ok {
+		job.MaxAttempts = h.opts.MaxAttempts
+	}
+
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+
+	if opts.UniqueKey != "" {
+		job.UniqueKey = &opts.UniqueKey
+	}
+
+	inserted, err := q.store.InsertJob(job)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !inserted {
+		return job.ID, ErrDuplicate
+	}
+
+	q.wakeUp()
+
+	return job.ID, nil
+}
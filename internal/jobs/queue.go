@@ -0,0 +1,331 @@
+package jobs
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/store"
+)
+
+const (
+	defaultWorkers      = 4
+	defaultPollInterval = time.Second
+	defaultLease        = 5 * time.Minute
+
+	baseRetryDelay = 10 * time.Second
+	maxRetryDelay  = time.Hour
+)
+
+type Config struct {
+	// Workers is how many jobs run at once in this process.
+	Workers      int
+	PollInterval time.Duration
+	// Lease is how long a claimed job is reserved for this process; it is
+	// renewed while the job runs.
+	Lease time.Duration
+}
+
+// Queue enqueues jobs and runs a pool of workers for the registered kinds.
+type Queue struct {
+	store    store.JobStore
+	logger   *log.Logger
+	config   Config
+	handlers map[string]handler
+	workerID string
+
+	wake     chan struct{}
+	stopping chan struct{}
+	stopped  chan struct{}
+	drained  chan struct{}
+	// jobCtx is what handlers run under; it is cancelled only when a drain
+	// runs out of time
+	jobCtx    context.Context
+	cancelJob context.CancelFunc
+
+	mu      sync.Mutex
+	running map[int64]struct{}
+	wg      sync.WaitGroup
+}
+
+func NewQueue(jobStore store.JobStore, logger *log.Logger, config Config) *Queue {
+	if config.Workers <= 0 {
+		config.Workers = defaultWorkers
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if config.Lease <= 0 {
+		config.Lease = defaultLease
+	}
+
+	jobCtx, cancel := context.WithCancel(context.Background())
+
+	return &Queue{
+		store:     jobStore,
+		logger:    logger,
+		config:    config,
+		handlers:  make(map[string]handler),
+		workerID:  newWorkerID(),
+		wake:      make(chan struct{}, 1),
+		stopping:  make(chan struct{}),
+		stopped:   make(chan struct{}),
+		drained:   make(chan struct{}),
+		jobCtx:    jobCtx,
+		cancelJob: cancel,
+		running:   make(map[int64]struct{}),
+	}
+}
+
+func newWorkerID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	crand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+func (q *Queue) kinds() []string {
+	kinds := make([]string, 0, len(q.handlers))
+	for kind := range q.handlers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// wakeUp makes the worker look for jobs now rather than at the next poll.
+func (q *Queue) wakeUp() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start registers this process as a worker and starts claiming jobs.
+func (q *Queue) Start() error {
+	host, _ := os.Hostname()
+
+	err := q.store.RegisterWorker(&store.JobWorker{
+		ID:          q.workerID,
+		Hostname:    host,
+		Concurrency: q.config.Workers,
+		Kinds:       q.kinds(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	go q.claimLoop()
+	go q.heartbeatLoop()
+
+	return nil
+}
+
+func (q *Queue) claimLoop() {
+	defer close(q.stopped)
+
+	ticker := time.NewTicker(q.config.PollInterval)
+	defer ticker.Stop()
+
+	kinds := q.kinds()
+
+	for {
+		q.mu.Lock()
+		free := q.config.Workers - len(q.running)
+		q.mu.Unlock()
+
+		if free > 0 && len(kinds) > 0 {
+			jobs, err := q.store.ClaimJobs(q.workerID, kinds, free, q.config.Lease)
+
+			if err != nil {
+				q.logger.Printf("ERROR: jobs: claiming: %v", err)
+			}
+
+			for i := range jobs {
+				q.start(&jobs[i])
+			}
+		}
+
+		select {
+		case <-q.stopping:
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *Queue) start(job *store.Job) {
+	q.mu.Lock()
+	q.running[job.ID] = struct{}{}
+	q.mu.Unlock()
+
+	q.wg.Add(1)
+
+	go func() {
+		defer q.wg.Done()
+		defer func() {
+			q.mu.Lock()
+			delete(q.running, job.ID)
+			q.mu.Unlock()
+			// a slot is free
+			q.wakeUp()
+		}()
+
+		q.run(job)
+	}()
+}
+
+func (q *Queue) run(job *store.Job) {
+	h := q.handlers[job.Kind]
+
+	ctx := q.jobCtx
+	if h.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.opts.Timeout)
+		defer cancel()
+	}
+
+	err := q.work(ctx, h, job)
+
+	// interrupted by a drain that ran out of time; Shutdown releases it
+	if q.jobCtx.Err() != nil {
+		return
+	}
+
+	if err == nil {
+		if err := q.store.CompleteJob(job.ID, q.workerID); err != nil {
+			q.logger.Printf("ERROR: jobs: completing job %d: %v", job.ID, err)
+		}
+		return
+	}
+
+	var retryAt *time.Time
+	var permanent permanentError
+
+	if job.Attempts < job.MaxAttempts && !errors.As(err, &permanent) {
+		at := time.Now().Add(retryDelay(job.Attempts))
+		retryAt = &at
+	} else {
+		q.logger.Printf("ERROR: jobs: %s job %d failed after %d attempts: %v", job.Kind, job.ID, job.Attempts, err)
+	}
+
+	if err := q.store.FailJob(job.ID, q.workerID, err.Error(), retryAt); err != nil {
+		q.logger.Printf("ERROR: jobs: failing job %d: %v", job.ID, err)
+	}
+}
+
+// work runs the handler, turning a panic into a failed attempt.
+func (q *Queue) work(ctx context.Context, h handler, job *store.Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	return h.work(ctx, job)
+}
+
+// retryDelay is 10s doubling with every attempt up to an hour, with jitter.
+func retryDelay(attempts int) time.Duration {
+	d := maxRetryDelay
+	if attempts < 10 {
+		d = min(baseRetryDelay<<max(attempts-1, 0), maxRetryDelay)
+	}
+
+	return d - d/10 + time.Duration(rand.Int64N(int64(d)/5))
+}
+
+// heartbeatLoop renews the leases of running jobs, reports this worker as
+// alive and recovers jobs whose workers have gone away. It keeps going
+// during a drain so the jobs being finished stay leased.
+func (q *Queue) heartbeatLoop() {
+	ticker := time.NewTicker(q.config.Lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.drained:
+			return
+		case <-ticker.C:
+		}
+
+		ids := q.runningIDs()
+
+		if len(ids) > 0 {
+			if err := q.store.ExtendJobLeases(q.workerID, ids, q.config.Lease); err != nil {
+				q.logger.Printf("ERROR: jobs: extending leases: %v", err)
+			}
+		}
+
+		if err := q.store.HeartbeatWorker(q.workerID, len(ids)); err != nil {
+			q.logger.Printf("ERROR: jobs: heartbeat: %v", err)
+		}
+
+		requeued, err := q.store.RequeueExpiredJobs()
+
+		if err != nil {
+			q.logger.Printf("ERROR: jobs: requeueing expired jobs: %v", err)
+		} else if requeued > 0 {
+			q.logger.Printf("jobs: requeued %d jobs with expired leases", requeued)
+		}
+	}
+}
+
+func (q *Queue) runningIDs() []int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ids := make([]int64, 0, len(q.running))
+	for id := range q.running {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Shutdown stops claiming jobs and waits for the running ones to finish.
+// If ctx ends first, the remaining jobs are cancelled and put back in the
+// queue for another worker without using up an attempt.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	close(q.stopping)
+	<-q.stopped
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		ids := q.runningIDs()
+		q.cancelJob()
+
+		// handlers that ignore cancellation are left behind; their results
+		// are dropped once the jobs are back in the queue
+		if releaseErr := q.store.ReleaseJobs(q.workerID, ids); releaseErr != nil {
+			q.logger.Printf("ERROR: jobs: releasing jobs: %v", releaseErr)
+		}
+	}
+
+	close(q.drained)
+
+	if removeErr := q.store.RemoveWorker(q.workerID); removeErr != nil {
+		q.logger.Printf("ERROR: jobs: removing worker: %v", removeErr)
+	}
+
+	return err
+}
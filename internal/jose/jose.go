@@ -0,0 +1,99 @@
+// Package jose signs JSON Web Tokens (RFC 7519) with RS256 and publishes
+// the keys that verify them as a JSON Web Key Set (RFC 7517). It also
+// verifies tokens signed by others against their key sets.
+package jose
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+var encoding = base64.RawURLEncoding
+
+// JWK is a public key in a key set.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is the document served at a jwks_uri.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func RSAPublicJWK(kid string, pub *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: AlgRS256,
+		Kid: kid,
+		N:   encoding.EncodeToString(pub.N.Bytes()),
+		E:   encoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// Thumbprint is the RFC 7638 thumbprint of an RSA public key, which makes
+// a good key id: it is derived from the key, so it can't collide.
+func Thumbprint(pub *rsa.PublicKey) string {
+	jwk := RSAPublicJWK("", pub)
+	// the members in lexicographic order, without whitespace
+	b, _ := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{jwk.E, jwk.Kty, jwk.N})
+
+	sum := sha256.Sum256(b)
+	return encoding.EncodeToString(sum[:])
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// SignRS256 encodes claims as a compact JWT signed with key.
+func SignRS256(key *rsa.PrivateKey, kid string, claims any) (string, error) {
+	h, err := json.Marshal(header{Alg: AlgRS256, Typ: "JWT", Kid: kid})
+
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + encoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,78 @@
+package live
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// EventsChannel carries the id of a user whose account event log has new
+// entries. The events themselves are read back from the log.
+const EventsChannel = "account_events"
+
+// Broker wakes up the event streams of a user when their event log grows.
+// It only signals; streams read what is new from the log themselves, so a
+// missed or coalesced wake-up never loses an event.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan struct{}]struct{}
+	logger      *log.Logger
+}
+
+func NewBroker(logger *log.Logger) *Broker {
+	return &Broker{
+		subscribers: make(map[int]map[chan struct{}]struct{}),
+		logger:      logger,
+	}
+}
+
+// Subscribe returns a channel that receives a value whenever userID has
+// new events, and a function to stop listening.
+func (b *Broker) Subscribe(userID int) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan struct{}]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subscribers[userID], ch)
+		if len(b.subscribers[userID]) == 0 {
+			delete(b.subscribers, userID)
+		}
+	}
+}
+
+// Notify wakes every stream of the user named in payload.
+func (b *Broker) Notify(payload string) {
+	userID, err := strconv.Atoi(payload)
+
+	if err != nil {
+		b.logger.Printf("ERROR: live: bad event notification payload %q", payload)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers[userID] {
+		// a wake-up already pending covers this one too
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Listen notifies subscribers of every notification on EventsChannel until
+// ctx is cancelled.
+func (b *Broker) Listen(ctx context.Context, databaseURL string) {
+	listen(ctx, databaseURL, EventsChannel, b.logger, b.Notify)
+}
@@ -0,0 +1,118 @@
+// Package live fans out realtime updates, live workout sessions and
+// account events, to the clients connected to this instance. Updates are
+// published through Postgres NOTIFY, so every instance hears every update
+// no matter which one handled the write.
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// Channel is the Postgres notification channel session updates go out on.
+const Channel = "live_sessions"
+
+// EventViewerRemoved is the session event sent when a viewer loses access.
+// The hub closes that viewer's subscriptions after passing it on.
+const EventViewerRemoved = "viewer_removed"
+
+const subscriberBuffer = 32
+
+type Hub struct {
+	mu sync.Mutex
+	// subscribers maps each session to its channels and the user each one
+	// belongs to
+	subscribers map[int64]map[chan []byte]int
+	logger      *log.Logger
+}
+
+func NewHub(logger *log.Logger) *Hub {
+	return &Hub{
+		subscribers: make(map[int64]map[chan []byte]int),
+		logger:      logger,
+	}
+}
+
+// Subscribe returns a channel of raw JSON events for a session and a
+// function to stop listening. The channel is closed when the subscriber
+// falls too far behind, in which case it should reconnect and start from a
+// snapshot, or when userID is removed from the session's viewers.
+func (h *Hub) Subscribe(sessionID int64, userID int) (<-chan []byte, func()) {
+	ch := make(chan []byte, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[sessionID] == nil {
+		h.subscribers[sessionID] = make(map[chan []byte]int)
+	}
+	h.subscribers[sessionID][ch] = userID
+	h.mu.Unlock()
+
+	return ch, func() { h.remove(sessionID, ch) }
+}
+
+func (h *Hub) remove(sessionID int64, ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs := h.subscribers[sessionID]
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+
+	delete(subs, ch)
+	close(ch)
+
+	if len(subs) == 0 {
+		delete(h.subscribers, sessionID)
+	}
+}
+
+// Broadcast hands an event to every local subscriber of its session.
+func (h *Hub) Broadcast(payload []byte) {
+	var event struct {
+		Type      string `json:"type"`
+		SessionID int64  `json:"session_id"`
+		Data      struct {
+			UserID int `json:"user_id"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		h.logger.Printf("ERROR: live: bad notification payload: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs := h.subscribers[event.SessionID]
+
+	for ch, userID := range subs {
+		select {
+		case ch <- payload:
+		default:
+			delete(subs, ch)
+			close(ch)
+			continue
+		}
+
+		// the removed viewer still gets the event, then the stream ends
+		if event.Type == EventViewerRemoved && userID == event.Data.UserID {
+			delete(subs, ch)
+			close(ch)
+		}
+	}
+
+	if len(subs) == 0 {
+		delete(h.subscribers, event.SessionID)
+	}
+}
+
+// Listen broadcasts every notification on Channel until ctx is cancelled.
+func (h *Hub) Listen(ctx context.Context, databaseURL string) {
+	listen(ctx, databaseURL, Channel, h.logger, func(payload string) {
+		h.Broadcast([]byte(payload))
+	})
+}
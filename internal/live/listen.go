@@ -0,0 +1,66 @@
+package live
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// listen holds a dedicated connection LISTENing on channel and hands every
+// notification payload to handle until ctx is cancelled, reconnecting
+// after failures.
+func listen(ctx context.Context, databaseURL, channel string, logger *log.Logger, handle func(payload string)) {
+	backoff := time.Second
+
+	for {
+		started := time.Now()
+		err := listenOnce(ctx, databaseURL, channel, handle)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		// a connection that held up for a while earns a fresh backoff
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+
+		logger.Printf("ERROR: live: %s listener stopped, retrying in %s: %v", channel, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func listenOnce(ctx context.Context, databaseURL, channel string, handle func(payload string)) error {
+	conn, err := pgx.Connect(ctx, databaseURL)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize())
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		handle(notification.Payload)
+	}
+}
@@ -0,0 +1,63 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileMailer writes each message to an .eml file in Dir instead of sending
+// it, for local development.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func NewFileMailer(dir, from string) *FileMailer {
+	return &FileMailer{Dir: dir, From: from}
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg *Message) error {
+	now := time.Now()
+
+	body, err := msg.Bytes(m.From, now)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+
+	to := strings.NewReplacer("/", "_", "\\", "_", "@", "_at_").Replace(msg.To)
+	name := fmt.Sprintf("%d-%s.eml", now.UnixNano(), to)
+
+	return os.WriteFile(filepath.Join(m.Dir, name), body, 0o644)
+}
+
+// MemoryMailer keeps sent messages in memory, for tests.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns the messages sent so far.
+func (m *MemoryMailer) Messages() []*Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]*Message(nil), m.messages...)
+}
@@ -0,0 +1,109 @@
+// Package mail sends transactional email. Messages are rendered from the
+// templates in templates/ and handed to a Mailer, which is SMTP in
+// production and a directory or memory in development and tests.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	// Headers are added to the message as is, e.g. List-Unsubscribe.
+	Headers map[string]string
+}
+
+// Mailer delivers a message.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+var errHeaderInjection = errors.New("mail: header contains a line break")
+
+// Bytes encodes the message as a multipart/alternative MIME message sent
+// from from.
+func (m *Message) Bytes(from string, date time.Time) ([]byte, error) {
+	headers := map[string]string{
+		"From":         from,
+		"To":           m.To,
+		"Subject":      mime.QEncoding.Encode("utf-8", m.Subject),
+		"Date":         date.Format(time.RFC1123Z),
+		"MIME-Version": "1.0",
+	}
+
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	headers["Content-Type"] = `multipart/alternative; boundary="` + w.Boundary() + `"`
+
+	parts := []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	}
+
+	for _, p := range parts {
+		if p.content == "" {
+			continue
+		}
+
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(pw)
+
+		if _, err := qp.Write([]byte(p.content)); err != nil {
+			return nil, err
+		}
+
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		if strings.ContainsAny(k+headers[k], "\r\n") {
+			return nil, fmt.Errorf("%w: %s", errHeaderInjection, k)
+		}
+
+		fmt.Fprintf(&msg, "%s: %s\r\n", k, headers[k])
+	}
+
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
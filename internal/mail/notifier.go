@@ -0,0 +1,153 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/textproto"
+	"net/url"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/jobs"
+	"github.com/rpstvs/fm-goapp/internal/store"
+)
+
+type sendArgs struct {
+	UserID   int             `json:"user_id"`
+	Template string          `json:"template"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+func (sendArgs) Kind() string { return "send_email" }
+
+// Notifier queues email to users and sends it from the job queue, so a
+// slow or failing mail server never holds up a request.
+type Notifier struct {
+	Mailer      Mailer
+	Templates   *Templates
+	Users       store.UserStore
+	Preferences store.EmailPreferenceStore
+	Queue       *jobs.Queue
+	// BaseURL is where links in email point, without a trailing slash.
+	BaseURL string
+	// Secret signs unsubscribe links.
+	Secret []byte
+}
+
+// NewNotifier returns a Notifier and registers its send job on queue, so
+// it has to be called before the queue starts.
+func NewNotifier(mailer Mailer, templates *Templates, users store.UserStore, preferences store.EmailPreferenceStore, queue *jobs.Queue, baseURL string, secret []byte) *Notifier {
+	n := &Notifier{
+		Mailer:      mailer,
+		Templates:   templates,
+		Users:       users,
+		Preferences: preferences,
+		Queue:       queue,
+		BaseURL:     baseURL,
+		Secret:      secret,
+	}
+
+	jobs.Register(queue, n.send, jobs.HandlerOptions{Timeout: time.Minute})
+
+	return n
+}
+
+// Notify queues template to be sent to userID, rendered with data. A
+// non-empty uniqueKey keeps the same email from being queued twice while
+// the first is still waiting. data is kept with the job, where admins can
+// see it, so secrets go through Send instead.
+func (n *Notifier) Notify(userID int, template string, data any, uniqueKey string) error {
+	payload, err := json.Marshal(data)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = jobs.Enqueue(n.Queue, sendArgs{UserID: userID, Template: template, Data: payload}, jobs.EnqueueOptions{UniqueKey: uniqueKey})
+
+	if errors.Is(err, jobs.ErrDuplicate) {
+		return nil
+	}
+
+	return err
+}
+
+// UnsubscribeURL is the one-click unsubscribe link for a user and category.
+func (n *Notifier) UnsubscribeURL(userID int, category string) string {
+	return n.BaseURL + "/email/unsubscribe?token=" + url.QueryEscape(UnsubscribeToken(n.Secret, userID, category))
+}
+
+// send renders and delivers one queued email. The address and opt-outs are
+// read now rather than when it was queued, so they are current.
+func (n *Notifier) send(ctx context.Context, job *jobs.Job[sendArgs]) error {
+	var data any
+
+	if len(job.Args.Data) > 0 {
+		if err := json.Unmarshal(job.Args.Data, &data); err != nil {
+			return jobs.Permanent(err)
+		}
+	}
+
+	return n.Send(ctx, job.Args.UserID, job.Args.Template, data)
+}
+
+// Send renders template with data and delivers it to userID straight away.
+// It is for jobs that mail a secret, such as a one-time link: that has to
+// be made and sent in the same job, as anything queued with Notify is
+// stored with its data.
+func (n *Notifier) Send(ctx context.Context, userID int, template string, templateData any) error {
+	user, err := n.Users.GetUserByID(userID)
+
+	if err != nil {
+		return err
+	}
+
+	// the account is gone
+	if user == nil {
+		return nil
+	}
+
+	data := &TemplateData{Username: user.Username, BaseURL: n.BaseURL, Data: templateData}
+	category := Category(template)
+
+	if category != "" {
+		optedOut, err := n.Preferences.IsOptedOut(user.ID, category)
+
+		if err != nil {
+			return err
+		}
+
+		if optedOut {
+			return nil
+		}
+
+		data.UnsubscribeURL = n.UnsubscribeURL(user.ID, category)
+	}
+
+	msg, err := n.Templates.Render(template, data)
+
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+
+	msg.To = user.Email
+
+	if category != "" {
+		// RFC 8058 one-click unsubscribe, which mail clients show as a
+		// button
+		msg.Headers = map[string]string{
+			"List-Unsubscribe":      "<" + data.UnsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+	}
+
+	err = n.Mailer.Send(ctx, msg)
+
+	// a 5xx reply means the server won't ever take this message
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return jobs.Permanent(err)
+	}
+
+	return err
+}
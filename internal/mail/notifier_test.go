@@ -0,0 +1,203 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/rpstvs/fm-goapp/internal/jobs"
+	"github.com/rpstvs/fm-goapp/internal/store"
+)
+
+type fakeUserStore struct {
+	store.UserStore
+	users map[int]*store.User
+}
+
+func (s *fakeUserStore) GetUserByID(id int) (*store.User, error) {
+	return s.users[id], nil
+}
+
+type fakePreferenceStore struct {
+	store.EmailPreferenceStore
+	optedOut map[string]bool
+}
+
+func (s *fakePreferenceStore) IsOptedOut(userID int, category string) (bool, error) {
+	return s.optedOut[category], nil
+}
+
+var testSecret = []byte("test secret")
+
+func newTestNotifier(t *testing.T, optedOut ...string) (*Notifier, *MemoryMailer) {
+	t.Helper()
+
+	templates, err := LoadTemplates()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefs := &fakePreferenceStore{optedOut: make(map[string]bool)}
+	for _, category := range optedOut {
+		prefs.optedOut[category] = true
+	}
+
+	mailer := &MemoryMailer{}
+
+	return &Notifier{
+		Mailer:      mailer,
+		Templates:   templates,
+		Users:       &fakeUserStore{users: map[int]*store.User{1: {ID: 1, Username: "alice", Email: "alice@example.com"}}},
+		Preferences: prefs,
+		BaseURL:     "https://example.com",
+		Secret:      testSecret,
+	}, mailer
+}
+
+var recordData = map[string]any{
+	"workout_title": "Leg day",
+	"records":       []map[string]any{{"exercise_name": "Squat", "weight": 120, "previous": 110}},
+}
+
+func TestSendUnsubscribeRoundTrip(t *testing.T) {
+	n, mailer := newTestNotifier(t)
+
+	if err := n.Send(context.Background(), 1, TemplatePersonalRecord, recordData); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := mailer.Messages()
+
+	if len(messages) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(messages))
+	}
+
+	msg := messages[0]
+
+	if msg.To != "alice@example.com" {
+		t.Errorf("sent to %q", msg.To)
+	}
+
+	if msg.Headers["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+		t.Errorf("missing one-click header: %v", msg.Headers)
+	}
+
+	header := msg.Headers["List-Unsubscribe"]
+	link := strings.TrimSuffix(strings.TrimPrefix(header, "<"), ">")
+
+	if !strings.Contains(msg.Text, link) {
+		t.Errorf("body doesn't carry the unsubscribe link %q:\n%s", link, msg.Text)
+	}
+
+	u, err := url.Parse(link)
+
+	if err != nil || !strings.HasPrefix(link, "https://example.com/email/unsubscribe?") {
+		t.Fatalf("bad unsubscribe link %q", header)
+	}
+
+	userID, category, err := ParseUnsubscribeToken(testSecret, u.Query().Get("token"))
+
+	if err != nil || userID != 1 || category != CategoryPersonalRecords {
+		t.Errorf("unsubscribe token gave %d, %q, %v", userID, category, err)
+	}
+}
+
+func TestParseUnsubscribeTokenRejects(t *testing.T) {
+	token := UnsubscribeToken(testSecret, 1, CategoryWeeklySummary)
+	payload, sig, _ := strings.Cut(token, ".")
+	forged := UnsubscribeToken(testSecret, 2, CategoryWeeklySummary)
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := []struct {
+		name   string
+		secret []byte
+		token  string
+	}{
+		{"wrong secret", []byte("other"), token},
+		{"other payload", testSecret, forgedPayload + "." + sig},
+		{"no signature", testSecret, payload},
+		{"bad encoding", testSecret, payload + ".!!!"},
+		{"empty", testSecret, ""},
+	}
+
+	for _, tt := range tests {
+		if _, _, err := ParseUnsubscribeToken(tt.secret, tt.token); err != ErrInvalidUnsubscribeToken {
+			t.Errorf("%s: got %v, want ErrInvalidUnsubscribeToken", tt.name, err)
+		}
+	}
+}
+
+func TestSendSkipsOptedOut(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		data     any
+		optedOut []string
+		sent     bool
+	}{
+		{"opted out", TemplatePersonalRecord, recordData, []string{CategoryPersonalRecords}, false},
+		{"other category opted out", TemplatePersonalRecord, recordData, []string{CategoryWeeklySummary}, true},
+		{"account email has no opt-out", TemplateWelcome, nil, []string{CategoryPersonalRecords, CategoryWeeklySummary}, true},
+	}
+
+	for _, tt := range tests {
+		n, mailer := newTestNotifier(t, tt.optedOut...)
+
+		if err := n.Send(context.Background(), 1, tt.template, tt.data); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if sent := len(mailer.Messages()) == 1; sent != tt.sent {
+			t.Errorf("%s: sent=%v, want %v", tt.name, sent, tt.sent)
+		}
+	}
+}
+
+func TestSendAccountEmailHasNoUnsubscribe(t *testing.T) {
+	n, mailer := newTestNotifier(t)
+
+	if err := n.Send(context.Background(), 1, TemplateWelcome, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := mailer.Messages()[0]
+
+	if len(msg.Headers) != 0 || strings.Contains(msg.Text, "Unsubscribe") {
+		t.Errorf("account email offers an unsubscribe: %v\n%s", msg.Headers, msg.Text)
+	}
+}
+
+func TestSendToDeletedUser(t *testing.T) {
+	n, mailer := newTestNotifier(t)
+
+	if err := n.Send(context.Background(), 2, TemplateWelcome, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mailer.Messages()) != 0 {
+		t.Error("sent email to a user that doesn't exist")
+	}
+}
+
+func TestSendJob(t *testing.T) {
+	n, mailer := newTestNotifier(t)
+
+	data, err := json.Marshal(recordData)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.send(context.Background(), &jobs.Job[sendArgs]{Args: sendArgs{UserID: 1, Template: TemplatePersonalRecord, Data: data}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messages := mailer.Messages(); len(messages) != 1 || !strings.Contains(messages[0].Text, "Squat") {
+		t.Errorf("queued email wasn't rendered with its data: %+v", messages)
+	}
+}
@@ -0,0 +1,109 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+const defaultSMTPTimeout = 30 * time.Second
+
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// From is the sender, either an address or "Name <address>".
+	From string
+	// Timeout bounds a whole send when ctx has no deadline.
+	Timeout time.Duration
+}
+
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		From:     from,
+		Timeout:  defaultSMTPTimeout,
+	}
+}
+
+// Send delivers msg over SMTP, upgrading to TLS when the server supports
+// it. Rejections come back as *textproto.Error with the SMTP status code.
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	from, err := netmail.ParseAddress(m.From)
+
+	if err != nil {
+		return err
+	}
+
+	body, err := msg.Bytes(m.From, time.Now())
+
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(m.Host, strconv.Itoa(m.Port)))
+
+	if err != nil {
+		return err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(m.Timeout)
+	}
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, m.Host)
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return err
+		}
+	}
+
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
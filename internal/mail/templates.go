@@ -0,0 +1,125 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+const (
+	TemplateWelcome        = "welcome"
+	TemplateVerifyEmail    = "verify_email"
+	TemplatePasswordReset  = "password_reset"
+	TemplateMagicLink      = "magic_link"
+	TemplateWeeklySummary  = "weekly_summary"
+	TemplatePersonalRecord = "personal_record"
+)
+
+// Categories of email a user can opt out of. Account email, such as
+// verification and password resets, has no category and is always sent.
+const (
+	CategoryWeeklySummary   = "weekly_summary"
+	CategoryPersonalRecords = "personal_records"
+)
+
+var Categories = []string{CategoryWeeklySummary, CategoryPersonalRecords}
+
+var templateCategories = map[string]string{
+	TemplateWeeklySummary:  CategoryWeeklySummary,
+	TemplatePersonalRecord: CategoryPersonalRecords,
+}
+
+var templateNames = []string{
+	TemplateWelcome,
+	TemplateVerifyEmail,
+	TemplatePasswordReset,
+	TemplateMagicLink,
+	TemplateWeeklySummary,
+	TemplatePersonalRecord,
+}
+
+// Category returns the opt-out category of a template, or "" for account
+// email.
+func Category(template string) string {
+	return templateCategories[template]
+}
+
+// TemplateData is what every template is rendered with. Data holds the
+// template's own values.
+type TemplateData struct {
+	Username       string
+	BaseURL        string
+	UnsubscribeURL string
+	Data           any
+}
+
+// Templates renders messages. Each template file defines a subject and a
+// plain text and HTML body, which layout.tmpl wraps.
+type Templates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+func LoadTemplates() (*Templates, error) {
+	t := &Templates{
+		text: map[string]*texttemplate.Template{},
+		html: map[string]*htmltemplate.Template{},
+	}
+
+	for _, name := range templateNames {
+		files := []string{"templates/layout.tmpl", "templates/" + name + ".tmpl"}
+
+		text, err := texttemplate.ParseFS(templateFS, files...)
+
+		if err != nil {
+			return nil, fmt.Errorf("mail: parsing %s: %w", name, err)
+		}
+
+		html, err := htmltemplate.ParseFS(templateFS, files...)
+
+		if err != nil {
+			return nil, fmt.Errorf("mail: parsing %s: %w", name, err)
+		}
+
+		t.text[name] = text
+		t.html[name] = html
+	}
+
+	return t, nil
+}
+
+// Render builds the message for template name. The recipient is left for
+// the caller to fill in.
+func (t *Templates) Render(name string, data *TemplateData) (*Message, error) {
+	text, ok := t.text[name]
+
+	if !ok {
+		return nil, fmt.Errorf("mail: unknown template %q", name)
+	}
+
+	var subject, textBody, htmlBody bytes.Buffer
+
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+
+	if err := text.ExecuteTemplate(&textBody, "text", data); err != nil {
+		return nil, err
+	}
+
+	if err := t.html[name].ExecuteTemplate(&htmlBody, "html", data); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    textBody.String(),
+		HTML:    htmlBody.String(),
+	}, nil
+}
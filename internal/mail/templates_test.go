@@ -0,0 +1,109 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	templates, err := LoadTemplates()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := map[string]any{"url": "https://example.com/verify?token=abc&x=1", "expires_in": "30 minutes"}
+
+	tests := []struct {
+		name    string
+		data    any
+		subject string
+		want    []string
+	}{
+		{TemplateWelcome, nil, "Welcome", nil},
+		{TemplateVerifyEmail, link, "", []string{"30 minutes"}},
+		{TemplatePasswordReset, link, "", []string{"30 minutes"}},
+		{TemplateMagicLink, link, "", []string{"30 minutes"}},
+		{TemplateWeeklySummary, map[string]any{"week_start": "March 4", "workouts": 3, "duration_minutes": 95, "calories_burned": 800}, "March 4", []string{"95", "800"}},
+		{TemplatePersonalRecord, map[string]any{
+			"workout_title": "Leg day",
+			"records":       []map[string]any{{"exercise_name": "Squat", "weight": 120, "previous": 110}},
+		}, "New personal record in Leg day", []string{"Squat", "120", "previous best 110"}},
+		{TemplatePersonalRecord, map[string]any{
+			"workout_title": "Leg day",
+			"records": []map[string]any{
+				{"exercise_name": "Squat", "weight": 120, "previous": 110},
+				{"exercise_name": "Deadlift", "weight": 150, "previous": 140},
+			},
+		}, "New personal records in Leg day", []string{"Squat", "Deadlift", "150"}},
+	}
+
+	for _, tt := range tests {
+		msg, err := templates.Render(tt.name, &TemplateData{Username: "alice", BaseURL: "https://example.com", Data: tt.data})
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if msg.Subject == "" || strings.Contains(msg.Subject, "\n") {
+			t.Errorf("%s: bad subject %q", tt.name, msg.Subject)
+		}
+
+		if tt.subject != "" && !strings.Contains(msg.Subject, tt.subject) {
+			t.Errorf("%s: subject %q, want it to contain %q", tt.name, msg.Subject, tt.subject)
+		}
+
+		for _, body := range []string{msg.Text, msg.HTML} {
+			if !strings.Contains(body, "Hi alice") {
+				t.Errorf("%s: body doesn't greet the user:\n%s", tt.name, body)
+			}
+
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("%s: body doesn't contain %q:\n%s", tt.name, want, body)
+				}
+			}
+		}
+
+		if link, ok := tt.data.(map[string]any); ok && link["url"] != nil {
+			if !strings.Contains(msg.Text, "https://example.com/verify?token=abc&x=1") || !strings.Contains(msg.HTML, "https://example.com/verify?token=abc&amp;x=1") {
+				t.Errorf("%s: link missing or not escaped for HTML:\n%s\n%s", tt.name, msg.Text, msg.HTML)
+			}
+		}
+	}
+}
+
+func TestRenderEscapesHTML(t *testing.T) {
+	templates, err := LoadTemplates()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := templates.Render(TemplateWelcome, &TemplateData{Username: "<script>alert(1)</script>"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(msg.HTML, "<script>") {
+		t.Errorf("username isn't escaped:\n%s", msg.HTML)
+	}
+
+	if !strings.Contains(msg.Text, "<script>") {
+		t.Errorf("plain text body shouldn't be escaped:\n%s", msg.Text)
+	}
+}
+
+func TestRenderUnknownTemplate(t *testing.T) {
+	templates, err := LoadTemplates()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := templates.Render("nope", &TemplateData{}); err == nil {
+		t.Error("rendered an unknown template")
+	}
+}
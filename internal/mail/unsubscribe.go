@@ -0,0 +1,57 @@
+package mail
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidUnsubscribeToken = errors.New("mail: invalid unsubscribe token")
+
+// UnsubscribeToken returns the token of a one-click unsubscribe link for
+// one user and category. It is signed rather than stored, so it never
+// expires and sending mail doesn't write to the database.
+func UnsubscribeToken(secret []byte, userID int, category string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(userID) + ":" + category))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(unsubscribeMAC(secret, payload))
+}
+
+// ParseUnsubscribeToken checks token's signature and returns the user and
+// category it unsubscribes.
+func ParseUnsubscribeToken(secret []byte, token string) (int, string, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+
+	if !ok {
+		return 0, "", ErrInvalidUnsubscribeToken
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+
+	if err != nil || !hmac.Equal(mac, unsubscribeMAC(secret, payload)) {
+		return 0, "", ErrInvalidUnsubscribeToken
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+
+	if err != nil {
+		return 0, "", ErrInvalidUnsubscribeToken
+	}
+
+	id, category, ok := strings.Cut(string(raw), ":")
+	userID, err := strconv.Atoi(id)
+
+	if !ok || err != nil {
+		return 0, "", ErrInvalidUnsubscribeToken
+	}
+
+	return userID, category, nil
+}
+
+func unsubscribeMAC(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("unsubscribe:" + payload))
+	return mac.Sum(nil)
+}
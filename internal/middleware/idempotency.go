@@ -0,0 +1,194 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/store"
+	"github.com/rpstvs/fm-goapp/internal/utils"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	maxIdempotencyKeyLength = 255
+	idempotencyPollInterval = 100 * time.Millisecond
+	idempotencyWaitTimeout  = 10 * time.Second
+)
+
+type IdempotencyMiddleware struct {
+	Store store.IdempotencyStore
+	TTL   time.Duration
+	// Lease is how long a request may hold a key before a retry can take
+	// it over, so a crashed request doesn't lock the key until it expires.
+	// It should outlast the slowest request.
+	Lease  time.Duration
+	Logger *log.Logger
+}
+
+// recordingWriter passes a response through while keeping a copy of it so
+// it can be stored for replay.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Idempotent makes mutating requests that carry an Idempotency-Key safe to
+// retry. The first response for a user and key is stored and replayed
+// verbatim to later requests with the same key. A retry whose body differs
+// from the original is rejected, and a retry that arrives while the
+// original is still running waits for it to finish.
+func (im *IdempotencyMiddleware) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+
+		if key == "" || !isMutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user := GetUser(r)
+
+		if user == nil || user.IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "idempotency key is too long"})
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "could not read request body"})
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hasher := sha256.New()
+		hasher.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+		hasher.Write(body)
+		requestHash := hasher.Sum(nil)
+
+		record, claimed, err := im.Store.ClaimIdempotencyKey(user.ID, key, requestHash, im.TTL, im.Lease)
+
+		if errors.Is(err, store.ErrIdempotencyKeyBusy) {
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "a request with this idempotency key is still in progress"})
+			return
+		}
+
+		if err != nil {
+			im.Logger.Printf("ERROR: claiming idempotency key: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+
+		if !claimed {
+			im.replay(w, r, record, requestHash)
+			return
+		}
+
+		recorder := &recordingWriter{ResponseWriter: w}
+
+		defer func() {
+			// a server error or panic is not a result worth replaying, free
+			// the key so the client can try again
+			if p := recover(); p != nil || recorder.status >= http.StatusInternalServerError || recorder.status == 0 {
+				if err := im.Store.ReleaseIdempotencyKey(record); err != nil {
+					im.Logger.Printf("ERROR: releasing idempotency key: %v", err)
+				}
+				if p != nil {
+					panic(p)
+				}
+				return
+			}
+
+			err := im.Store.CompleteIdempotencyKey(record, recorder.status, recorder.Header(), recorder.body.Bytes())
+			if err != nil {
+				im.Logger.Printf("ERROR: storing idempotent response: %v", err)
+			}
+		}()
+
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+func (im *IdempotencyMiddleware) replay(w http.ResponseWriter, r *http.Request, record *store.IdempotencyRecord, requestHash []byte) {
+	if subtle.ConstantTimeCompare(record.RequestHash, requestHash) != 1 {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "idempotency key was already used with a different request"})
+		return
+	}
+
+	deadline := time.Now().Add(idempotencyWaitTimeout)
+
+	for !record.Completed {
+		if time.Now().After(deadline) {
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "a request with this idempotency key is still in progress"})
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(idempotencyPollInterval):
+		}
+
+		var err error
+		record, err = im.Store.GetIdempotencyKey(record.UserID, record.Key)
+
+		if err != nil {
+			im.Logger.Printf("ERROR: reading idempotency key: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+
+		// the original request failed and released the key
+		if record == nil {
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "the original request failed, please retry"})
+			return
+		}
+	}
+
+	for name, values := range record.ResponseHeaders {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write(record.ResponseBody)
+}
@@ -2,21 +2,37 @@ package middleware
 
 import (
 	"context"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/rpstvs/fm-goapp/internal/store"
 	"github.com/rpstvs/fm-goapp/internal/tokens"
 	"github.com/rpstvs/fm-goapp/internal/utils"
 )
 
+// sessionTouchInterval is how stale a session's last used time may get
+// before a request updates it, so that using a token costs a write at most
+// this often rather than on every request.
+const sessionTouchInterval = 5 * time.Minute
+
 type UserMiddleware struct {
-	UserStore store.UserStore
+	UserStore   store.UserStore
+	TokenStore  store.TokenStore
+	APIKeyStore store.APIKeyStore
+	OAuthStore  store.OAuthStore
+	Logger      *log.Logger
 }
 
 type contextKey string
 
-const UserContextKey = contextKey("user")
+const (
+	UserContextKey    = contextKey("user")
+	SessionContextKey = contextKey("session")
+	APIKeyContextKey  = contextKey("api_key")
+	OAuthContextKey   = contextKey("oauth_token")
+)
 
 func SetUser(r *http.Request, user *store.User) *http.Request {
 	ctx := context.WithValue(r.Context(), UserContextKey, user)
@@ -34,6 +50,42 @@ func GetUser(r *http.Request) *store.User {
 	return user
 }
 
+// GetSession returns the session of the token the request authenticated
+// with, or nil for anonymous requests.
+func GetSession(r *http.Request) *store.Session {
+	session, ok := r.Context().Value(SessionContextKey).(*store.Session)
+
+	if !ok {
+		return nil
+	}
+
+	return session
+}
+
+// GetAPIKey returns the API key the request authenticated with, or nil if
+// it didn't use one.
+func GetAPIKey(r *http.Request) *store.APIKey {
+	key, ok := r.Context().Value(APIKeyContextKey).(*store.APIKey)
+
+	if !ok {
+		return nil
+	}
+
+	return key
+}
+
+// GetOAuthToken returns the OAuth access token the request authenticated
+// with, or nil if it didn't use one.
+func GetOAuthToken(r *http.Request) *store.OAuthToken {
+	token, ok := r.Context().Value(OAuthContextKey).(*store.OAuthToken)
+
+	if !ok {
+		return nil
+	}
+
+	return token
+}
+
 func (um *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
@@ -54,29 +106,207 @@ func (um *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 
 		token := headersParts[1]
 
-		user, err := um.UserStore.GetUserToken(tokens.ScopeAuth, token)
+		if tokens.IsAPIKey(token) {
+			um.authenticateAPIKey(w, r, next, token)
+			return
+		}
+
+		if tokens.IsOAuthAccessToken(token) {
+			um.authenticateOAuthToken(w, r, next, token)
+			return
+		}
+
+		user, session, err := um.UserStore.GetUserSession(token)
 
 		if err != nil {
+			um.Logger.Printf("ERROR: getUserSession: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 			return
 		}
+
 		if user == nil {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired authentication token"})
 			return
 		}
 
+		now := time.Now()
+		if session.LastUsedAt == nil || now.Sub(*session.LastUsedAt) > sessionTouchInterval {
+			// the request doesn't depend on this, so a failure is only logged
+			if err := um.TokenStore.TouchSession(session.TokenID, now); err != nil {
+				um.Logger.Printf("ERROR: touchSession: %v", err)
+			}
+		}
+
 		r = SetUser(r, user)
+		r = r.WithContext(context.WithValue(r.Context(), SessionContextKey, session))
 
 		next.ServeHTTP(w, r)
-		return
 	})
 }
 
-func (um *UserMiddleware) RequireUser(next http.Handler) http.Handler {
+func (um *UserMiddleware) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	user, key, err := um.APIKeyStore.GetUserByAPIKey(token)
+
+	if err != nil {
+		um.Logger.Printf("ERROR: getUserByAPIKey: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired API key"})
+		return
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > sessionTouchInterval {
+		if err := um.APIKeyStore.TouchAPIKey(key.ID, now); err != nil {
+			um.Logger.Printf("ERROR: touchAPIKey: %v", err)
+		}
+	}
+
+	r = SetUser(r, user)
+	r = r.WithContext(context.WithValue(r.Context(), APIKeyContextKey, key))
+
+	next.ServeHTTP(w, r)
+}
+
+func (um *UserMiddleware) authenticateOAuthToken(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	user, oauthToken, err := um.OAuthStore.GetUserByOAuthToken(token)
+
+	if err != nil {
+		um.Logger.Printf("ERROR: getUserByOAuthToken: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired access token"})
+		return
+	}
+
+	r = SetUser(r, user)
+	r = r.WithContext(context.WithValue(r.Context(), OAuthContextKey, oauthToken))
+
+	next.ServeHTTP(w, r)
+}
+
+// RequireUser lets logged in users through. API keys and OAuth access
+// tokens are turned away: routes open to them say so with RequireScope.
+func (um *UserMiddleware) RequireUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			user := GetUser(r)
 
 			if user.IsAnonymous() {
 				utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{})
+				return
+			}
+
+			if GetAPIKey(r) != nil {
+				utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "API keys can't be used for this endpoint"})
+				return
+			}
+
+			if GetOAuthToken(r) != nil {
+				utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "OAuth access tokens can't be used for this endpoint"})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+}
+
+// AcceptStreamTicket authenticates a request that came without an
+// Authorization header by the stream ticket in its ticket query parameter.
+// It is for WebSocket and event stream routes, which browsers open without
+// being able to set headers. Each ticket works once.
+func (um *UserMiddleware) AcceptStreamTicket(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ticket := r.URL.Query().Get("ticket")
+
+			if ticket == "" || !GetUser(r).IsAnonymous() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			userID, err := um.TokenStore.ConsumeTicket(tokens.ScopeStreamTicket, ticket)
+
+			if err != nil {
+				um.Logger.Printf("ERROR: consumeTicket: %v", err)
+				utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+				return
+			}
+
+			if userID == 0 {
+				utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired stream ticket"})
+				return
+			}
+
+			user, err := um.UserStore.GetUserByID(userID)
+
+			if err != nil {
+				um.Logger.Printf("ERROR: getUserByID: %v", err)
+				utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+				return
+			}
+
+			if user == nil {
+				utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired stream ticket"})
+				return
+			}
+
+			next.ServeHTTP(w, SetUser(r, user))
+		})
+}
+
+// RequireScope lets logged in users through, and requests made with an API
+// key or OAuth access token that was granted scope.
+func (um *UserMiddleware) RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if GetUser(r).IsAnonymous() {
+				utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{})
+				return
+			}
+
+			if key := GetAPIKey(r); key != nil && !key.HasScope(scope) {
+				utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "API key is missing the " + scope + " scope"})
+				return
+			}
+
+			if token := GetOAuthToken(r); token != nil && !token.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+				utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "access token is missing the " + scope + " scope"})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+}
+
+func (um *UserMiddleware) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUser(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !GetUser(r).IsAdmin {
+				utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "admin access required"})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+}
+
+// RequireVerifiedEmail only lets users through who have verified their
+// email address, for actions that reach other people.
+func (um *UserMiddleware) RequireVerifiedEmail(next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUser(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !GetUser(r).EmailVerified() {
+				utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you must verify your email address first"})
+				return
 			}
 
 			next.ServeHTTP(w, r)
@@ -0,0 +1,454 @@
+// Package oidc logs users in with an external OpenID Connect provider,
+// using the authorization code flow with PKCE. A provider is configured
+// from its issuer URL alone: endpoints and keys come from its discovery
+// document.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/jose"
+)
+
+const (
+	// how long discovery documents and key sets are trusted before they
+	// are fetched again
+	metadataTTL = time.Hour
+	// keyRefetchInterval limits how often an unknown key id in an ID
+	// token makes the key set be fetched again
+	keyRefetchInterval = time.Minute
+	// allowed difference between our clock and the provider's
+	clockSkew = time.Minute
+	// how much of a provider's response is read
+	maxResponseSize = 1 << 20
+	// how long a request to the provider may take, so a hanging provider
+	// can't hold logins open
+	httpTimeout = 10 * time.Second
+)
+
+// signingAlgorithms are the ID token algorithms accepted, whatever the
+// provider advertises.
+var signingAlgorithms = []string{jose.AlgRS256, jose.AlgES256}
+
+var (
+	ErrDiscovery = errors.New("oidc: discovery failed")
+	ErrExchange  = errors.New("oidc: code exchange failed")
+	ErrIDToken   = errors.New("oidc: invalid ID token")
+)
+
+type Config struct {
+	// Name identifies the provider in URLs and linked identities.
+	Name string
+	// Issuer is the provider's issuer identifier; the discovery document
+	// is at Issuer + "/.well-known/openid-configuration".
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends the user back to, as
+	// registered with it.
+	RedirectURL string
+	// Scopes are asked for on top of openid. Defaults to email and profile.
+	Scopes []string
+
+	// HTTPClient defaults to a client with a 10 second timeout and Now to
+	// time.Now; tests against a mock provider can replace them.
+	HTTPClient *http.Client
+	Now        func() time.Time
+}
+
+// Metadata is the part of a provider's discovery document used here.
+type Metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Claims are the ID token claims used to find or create the user.
+type Claims struct {
+	Issuer            string        `json:"iss"`
+	Subject           string        `json:"sub"`
+	Audience          audience      `json:"aud"`
+	AuthorizedParty   string        `json:"azp"`
+	ExpiresAt         int64         `json:"exp"`
+	IssuedAt          int64         `json:"iat"`
+	Nonce             string        `json:"nonce"`
+	Email             string        `json:"email"`
+	EmailVerified     emailVerified `json:"email_verified"`
+	Name              string        `json:"name"`
+	PreferredUsername string        `json:"preferred_username"`
+}
+
+// audience is the aud claim, a string or an array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// emailVerified is the email_verified claim, which some providers send as
+// a string.
+type emailVerified bool
+
+func (v *emailVerified) UnmarshalJSON(b []byte) error {
+	var verified bool
+	if err := json.Unmarshal(b, &verified); err == nil {
+		*v = emailVerified(verified)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	*v = s == "true"
+	return nil
+}
+
+// Provider is a configured OpenID Connect provider. It is safe for
+// concurrent use.
+type Provider struct {
+	config Config
+
+	mu            sync.Mutex
+	metadata      *Metadata
+	metadataAt    time.Time
+	keys          jose.JWKS
+	keysAt        time.Time
+	keysRefetchAt time.Time
+}
+
+func NewProvider(config Config) (*Provider, error) {
+	u, err := url.Parse(config.Issuer)
+	if err != nil || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("oidc: invalid issuer %q", config.Issuer)
+	}
+
+	// plain http is only good enough for a provider on this machine
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname())) {
+		return nil, fmt.Errorf("oidc: issuer %q must use https", config.Issuer)
+	}
+
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("oidc: client id and redirect url are required")
+	}
+
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"email", "profile"}
+	}
+
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: httpTimeout}
+	}
+
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+
+	return &Provider{config: config}, nil
+}
+
+func isLoopback(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+func (p *Provider) Issuer() string {
+	return p.config.Issuer
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.config.HTTPClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+}
+
+// discover returns the provider's metadata, fetching it if it isn't
+// cached.
+func (p *Provider) discover(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.config.Now()
+
+	if p.metadata != nil && now.Sub(p.metadataAt) < metadataTTL {
+		return p.metadata, nil
+	}
+
+	var metadata Metadata
+
+	err := p.getJSON(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", &metadata)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+
+	// a document claiming another issuer could hand out its tokens as
+	// this one's (OpenID Connect Discovery §4.3)
+	if metadata.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q doesn't match %q", ErrDiscovery, metadata.Issuer, p.config.Issuer)
+	}
+
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: document is missing endpoints", ErrDiscovery)
+	}
+
+	p.metadata = &metadata
+	p.metadataAt = now
+
+	return p.metadata, nil
+}
+
+// signingKeys returns the provider's key set. With refetch it is fetched
+// again even if cached, unless that was done very recently, for when a
+// token names a key the cached set doesn't have.
+func (p *Provider) signingKeys(ctx context.Context, jwksURI string, refetch bool) (jose.JWKS, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.config.Now()
+
+	fresh := now.Sub(p.keysAt) < metadataTTL
+	if refetch {
+		fresh = now.Sub(p.keysRefetchAt) < keyRefetchInterval
+	}
+
+	if len(p.keys.Keys) > 0 && fresh {
+		return p.keys, nil
+	}
+
+	var keys jose.JWKS
+
+	if err := p.getJSON(ctx, jwksURI, &keys); err != nil {
+		return jose.JWKS{}, fmt.Errorf("%w: fetching keys: %v", ErrDiscovery, err)
+	}
+
+	p.keys = keys
+	p.keysAt = now
+	if refetch {
+		p.keysRefetchAt = now
+	}
+
+	return keys, nil
+}
+
+// NewPKCE returns a PKCE code verifier and its S256 challenge.
+func NewPKCE() (verifier, challenge string, err error) {
+	verifier, err = RandomString()
+
+	if err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// RandomString returns 32 random bytes, base64url encoded, for states,
+// nonces and code verifiers.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL is where to send the user to log in at the provider.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	metadata, err := p.discover(ctx)
+
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(metadata.AuthorizationEndpoint)
+
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid authorization endpoint: %v", ErrDiscovery, err)
+	}
+
+	scopes := append([]string{"openid"}, p.config.Scopes...)
+
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange trades an authorization code for the provider's tokens and
+// returns the verified claims of the ID token. nonce is the one the
+// authorization request was made with.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Claims, error) {
+	metadata, err := p.discover(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+
+	// client_secret_basic is the default when a provider doesn't say
+	basic := p.config.ClientSecret != "" && (len(metadata.TokenAuthMethods) == 0 || slices.Contains(metadata.TokenAuthMethods, "client_secret_basic"))
+
+	if !basic {
+		form.Set("client_id", p.config.ClientID)
+		if p.config.ClientSecret != "" {
+			form.Set("client_secret", p.config.ClientSecret)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.config.HTTPClient.Do(req)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+
+	defer resp.Body.Close()
+
+	var tokens tokenResponse
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrExchange, resp.Status, err)
+	}
+
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("%w: %s: %s %s", ErrExchange, resp.Status, tokens.Error, tokens.ErrorDescription)
+	}
+
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: no id_token in response", ErrExchange)
+	}
+
+	return p.verifyIDToken(ctx, metadata, tokens.IDToken, nonce)
+}
+
+// verifyIDToken checks an ID token's signature and claims as OpenID
+// Connect Core §3.1.3.7 asks.
+func (p *Provider) verifyIDToken(ctx context.Context, metadata *Metadata, raw, nonce string) (*Claims, error) {
+	keys, err := p.signingKeys(ctx, metadata.JWKSURI, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+
+	err = jose.Verify(raw, keys, signingAlgorithms, &claims)
+
+	// the provider may have rotated to a key published after the set was
+	// cached
+	if errors.Is(err, jose.ErrUnknownKey) {
+		keys, err = p.signingKeys(ctx, metadata.JWKSURI, true)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = jose.Verify(raw, keys, signingAlgorithms, &claims)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIDToken, err)
+	}
+
+	now := p.config.Now()
+
+	switch {
+	case claims.Issuer != metadata.Issuer:
+		return nil, fmt.Errorf("%w: issuer %q", ErrIDToken, claims.Issuer)
+	case !slices.Contains(claims.Audience, p.config.ClientID):
+		return nil, fmt.Errorf("%w: not issued to this client", ErrIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID:
+		return nil, fmt.Errorf("%w: azp %q", ErrIDToken, claims.AuthorizedParty)
+	case claims.AuthorizedParty != "" && claims.AuthorizedParty != p.config.ClientID:
+		return nil, fmt.Errorf("%w: azp %q", ErrIDToken, claims.AuthorizedParty)
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(clockSkew)):
+		return nil, fmt.Errorf("%w: expired", ErrIDToken)
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrIDToken)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrIDToken)
+	}
+
+	return &claims, nil
+}
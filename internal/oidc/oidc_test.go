@@ -0,0 +1,291 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/oidc/oidctest"
+)
+
+const testNonce = "nonce-1"
+
+func newTestProvider(t *testing.T, idp *oidctest.Server) *Provider {
+	t.Helper()
+
+	provider, err := NewProvider(Config{
+		Name:         "test",
+		Issuer:       idp.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.example/login/sso/test",
+		HTTPClient:   idp.Client(),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+// exchange runs a code exchange that returns the ID token signed from
+// claims.
+func exchange(provider *Provider, idp *oidctest.Server, claims map[string]any) (*Claims, error) {
+	return provider.Exchange(context.Background(), idp.Code(idp.Sign(claims)), "verifier", testNonce)
+}
+
+func TestExchange(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	provider := newTestProvider(t, idp)
+
+	claims := idp.Claims("alice", testNonce)
+	claims["email_verified"] = "true"
+	claims["preferred_username"] = "Alice"
+
+	got, err := exchange(provider, idp, claims)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Subject != "alice" || got.Email != "alice@example.com" || !got.EmailVerified || got.PreferredUsername != "Alice" {
+		t.Errorf("unexpected claims %+v", got)
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	provider := newTestProvider(t, idp)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		adjust func(claims map[string]any)
+		nonce  string
+	}{
+		{"wrong issuer", func(c map[string]any) { c["iss"] = "https://evil.example" }, testNonce},
+		{"wrong audience", func(c map[string]any) { c["aud"] = "other-client" }, testNonce},
+		{"several audiences without azp", func(c map[string]any) { c["aud"] = []string{oidctest.ClientID, "other-client"} }, testNonce},
+		{"azp of another client", func(c map[string]any) { c["azp"] = "other-client" }, testNonce},
+		{"expired", func(c map[string]any) { c["exp"] = now.Add(-2 * clockSkew).Unix() }, testNonce},
+		{"issued in the future", func(c map[string]any) { c["iat"] = now.Add(2 * clockSkew).Unix() }, testNonce},
+		{"no subject", func(c map[string]any) { delete(c, "sub") }, testNonce},
+		{"nonce mismatch", func(c map[string]any) { c["nonce"] = "other-nonce" }, testNonce},
+		{"no nonce", func(c map[string]any) { delete(c, "nonce") }, testNonce},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.Claims("alice", tt.nonce)
+			tt.adjust(claims)
+
+			if _, err := exchange(provider, idp, claims); !errors.Is(err, ErrIDToken) {
+				t.Errorf("got %v, want ErrIDToken", err)
+			}
+		})
+	}
+}
+
+func TestExchangeAcceptsWithinSkew(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	provider := newTestProvider(t, idp)
+	claims := idp.Claims("alice", testNonce)
+	claims["exp"] = time.Now().Add(-clockSkew / 2).Unix()
+	claims["aud"] = []string{oidctest.ClientID, "other-client"}
+	claims["azp"] = oidctest.ClientID
+
+	if _, err := exchange(provider, idp, claims); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExchangeRejectsBadSignature(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	provider := newTestProvider(t, idp)
+	token := idp.Sign(idp.Claims("alice", testNonce))
+
+	// swap in other claims under the original signature
+	forged, _ := json.Marshal(idp.Claims("mallory", testNonce))
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+
+	_, err := provider.Exchange(context.Background(), idp.Code(strings.Join(parts, ".")), "verifier", testNonce)
+
+	if !errors.Is(err, ErrIDToken) {
+		t.Errorf("forged claims: got %v, want ErrIDToken", err)
+	}
+
+	// a token with no signature at all
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	unsigned := header + "." + parts[1] + "."
+
+	_, err = provider.Exchange(context.Background(), idp.Code(unsigned), "verifier", testNonce)
+
+	if !errors.Is(err, ErrIDToken) {
+		t.Errorf("alg none: got %v, want ErrIDToken", err)
+	}
+}
+
+func TestExchangeRejectsUnknownCode(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	provider := newTestProvider(t, idp)
+
+	if _, err := provider.Exchange(context.Background(), "no-such-code", "verifier", testNonce); !errors.Is(err, ErrExchange) {
+		t.Errorf("got %v, want ErrExchange", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	provider := newTestProvider(t, idp)
+
+	if _, err := exchange(provider, idp, idp.Claims("alice", testNonce)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := exchange(provider, idp, idp.Claims("alice", testNonce)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := idp.KeyFetches.Load(); n != 1 {
+		t.Errorf("key set fetched %d times, want it cached after the first", n)
+	}
+
+	// a token signed with a key published after the set was cached makes
+	// it be fetched again
+	idp.RotateKey()
+
+	if _, err := exchange(provider, idp, idp.Claims("alice", testNonce)); err != nil {
+		t.Fatalf("after rotation: %v", err)
+	}
+
+	if n := idp.KeyFetches.Load(); n != 2 {
+		t.Errorf("key set fetched %d times, want 2", n)
+	}
+
+	// but not again straight away, so unknown key ids can't be used to
+	// hammer the provider
+	idp.RotateKey()
+
+	if _, err := exchange(provider, idp, idp.Claims("alice", testNonce)); !errors.Is(err, ErrIDToken) {
+		t.Errorf("second rotation within the refetch interval: got %v, want ErrIDToken", err)
+	}
+
+	if n := idp.KeyFetches.Load(); n != 2 {
+		t.Errorf("key set fetched %d times, want 2", n)
+	}
+}
+
+func TestDiscoveryRejectsOtherIssuer(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	// the same server under another name, so its document names an
+	// issuer other than the one configured
+	provider, err := NewProvider(Config{
+		Issuer:      strings.Replace(idp.Issuer(), "127.0.0.1", "localhost", 1),
+		ClientID:    oidctest.ClientID,
+		RedirectURL: "https://app.example/login/sso/test",
+		HTTPClient:  idp.Client(),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "challenge"); !errors.Is(err, ErrDiscovery) {
+		t.Errorf("got %v, want ErrDiscovery", err)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	provider := newTestProvider(t, idp)
+
+	verifier, challenge, err := NewPKCE()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+
+	if challenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Errorf("challenge isn't the S256 of the verifier")
+	}
+
+	raw, err := provider.AuthCodeURL(context.Background(), "state-1", testNonce, challenge)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(raw)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             oidctest.ClientID,
+		"redirect_uri":          "https://app.example/login/sso/test",
+		"scope":                 "openid email profile",
+		"state":                 "state-1",
+		"nonce":                 testNonce,
+		"code_challenge":        challenge,
+		"code_challenge_method": "S256",
+	}
+
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+	tests := []struct {
+		issuer string
+		ok     bool
+	}{
+		{"https://idp.example", true},
+		{"http://localhost:8080", true},
+		{"http://idp.example", false},
+		{"https://idp.example?tenant=1", false},
+		{"not a url", false},
+	}
+
+	for _, tt := range tests {
+		provider, err := NewProvider(Config{Issuer: tt.issuer, ClientID: "client", RedirectURL: "https://app.example/cb"})
+
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok=%v", tt.issuer, err, tt.ok)
+		}
+
+		if err == nil && provider.config.HTTPClient.Timeout == 0 {
+			t.Errorf("%s: default HTTP client has no timeout", tt.issuer)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package oidctest runs a mock OpenID Connect provider for tests. It
+// serves discovery, a key set and a token endpoint that hands out whatever
+// ID token a test registered for a code.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/jose"
+)
+
+const ClientID = "test-client"
+
+// Server is a mock provider. Its issuer is its URL.
+type Server struct {
+	*httptest.Server
+
+	// KeyFetches counts requests for the key set.
+	KeyFetches atomic.Int64
+
+	mu    sync.Mutex
+	key   *rsa.PrivateKey
+	kid   string
+	keys  int
+	codes map[string]string
+	next  int
+}
+
+// NewServer starts a provider with one signing key. Close it when done.
+func NewServer() *Server {
+	s := &Server{codes: make(map[string]string)}
+	s.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.handleDiscovery)
+	mux.HandleFunc("GET /jwks", s.handleJWKS)
+	mux.HandleFunc("POST /token", s.handleToken)
+
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Issuer is the provider's issuer identifier.
+func (s *Server) Issuer() string {
+	return s.URL
+}
+
+// RotateKey replaces the signing key with a new one under a new key id.
+// The old key is no longer published.
+func (s *Server) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys++
+	s.key = key
+	s.kid = fmt.Sprintf("key-%d", s.keys)
+}
+
+// Claims returns the claims of a valid ID token for ClientID, to adjust
+// before signing.
+func (s *Server) Claims(subject, nonce string) map[string]any {
+	now := time.Now()
+
+	return map[string]any{
+		"iss":            s.Issuer(),
+		"sub":            subject,
+		"aud":            ClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          subject + "@example.com",
+		"email_verified": true,
+	}
+}
+
+// Sign signs claims as an ID token with the current key.
+func (s *Server) Sign(claims map[string]any) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, err := jose.SignRS256(s.key, s.kid, claims)
+	if err != nil {
+		panic(err)
+	}
+
+	return token
+}
+
+// Code registers idToken as the token the code is exchanged for, and
+// returns the code.
+func (s *Server) Code(idToken string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.next++
+	code := fmt.Sprintf("code-%d", s.next)
+	s.codes[code] = idToken
+
+	return code
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                s.Issuer(),
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/jwks",
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+	})
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	s.KeyFetches.Add(1)
+
+	s.mu.Lock()
+	jwk := jose.RSAPublicJWK(s.kid, &s.key.PublicKey)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, jose.JWKS{Keys: []jose.JWK{jwk}})
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code_verifier") == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	if id, _, ok := r.BasicAuth(); !ok || id != ClientID {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	s.mu.Lock()
+	idToken, ok := s.codes[r.PostForm.Get("code")]
+	delete(s.codes, r.PostForm.Get("code"))
+	s.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"token_type": "Bearer", "access_token": "access", "id_token": idToken})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,135 @@
+// Package outbox publishes the domain events the stores write to the
+// outbox table to subscribers in this process. Events are only ever
+// written by the transaction that made the change, so a rolled back change
+// never produces one.
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/store"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultBatchSize    = 100
+	defaultMaxAttempts  = 10
+
+	baseBackoff = 5 * time.Second
+	maxBackoff  = 10 * time.Minute
+)
+
+// Handler receives a published event. Delivery is at least once: an event
+// is handed out again if any handler fails or the process dies before it
+// is marked published, so handlers should dedupe on event.ID or be
+// idempotent. Events of one aggregate arrive in order, and a later one is
+// not delivered until every handler has accepted the earlier ones or the
+// relay has given up on them after MaxAttempts.
+type Handler func(ctx context.Context, event store.DomainEvent) error
+
+type subscription struct {
+	name    string
+	handler Handler
+}
+
+type Relay struct {
+	Store        store.OutboxStore
+	Logger       *log.Logger
+	PollInterval time.Duration
+	BatchSize    int
+	// MaxAttempts is how often an event is tried before it is left dead
+	// in the outbox, with the last error, for someone to look at.
+	MaxAttempts int
+
+	mu            sync.RWMutex
+	subscriptions []subscription
+}
+
+func NewRelay(outboxStore store.OutboxStore, logger *log.Logger) *Relay {
+	return &Relay{
+		Store:        outboxStore,
+		Logger:       logger,
+		PollInterval: defaultPollInterval,
+		BatchSize:    defaultBatchSize,
+		MaxAttempts:  defaultMaxAttempts,
+	}
+}
+
+// retry waits 5s after the first failure, doubling up to 10m, and gives up
+// after MaxAttempts.
+func (r *Relay) retry(attempts int) (time.Duration, bool) {
+	if attempts >= r.MaxAttempts {
+		return 0, false
+	}
+
+	return min(baseBackoff<<min(attempts-1, 16), maxBackoff), true
+}
+
+// Subscribe registers handler for every event. name identifies it in logs
+// and in the outbox's last_error.
+func (r *Relay) Subscribe(name string, handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.subscriptions = append(r.subscriptions, subscription{name: name, handler: handler})
+}
+
+// Run publishes events until ctx is cancelled. Several instances can run
+// it; only one publishes at a time.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			published, err := r.Store.PublishOutbox(r.BatchSize, func(event store.DomainEvent) error {
+				return r.publish(ctx, event)
+			}, r.retry)
+
+			if err != nil {
+				r.Logger.Printf("ERROR: outbox: %v", err)
+			}
+
+			if err != nil || published < r.BatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Relay) publish(ctx context.Context, event store.DomainEvent) error {
+	r.mu.RLock()
+	subscriptions := r.subscriptions
+	r.mu.RUnlock()
+
+	for _, sub := range subscriptions {
+		if err := r.deliver(ctx, sub, event); err != nil {
+			r.Logger.Printf("ERROR: outbox: %s failed on event %d (%s): %v", sub.name, event.ID, event.Type, err)
+			return fmt.Errorf("%s: %w", sub.name, err)
+		}
+	}
+
+	return nil
+}
+
+// deliver turns a panicking handler into a failed delivery, which is
+// retried, instead of taking down the relay.
+func (r *Relay) deliver(ctx context.Context, sub subscription, event store.DomainEvent) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	return sub.handler(ctx, event)
+}
@@ -0,0 +1,33 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	r := &Relay{MaxAttempts: 10}
+
+	tests := []struct {
+		attempts int
+		wait     time.Duration
+		ok       bool
+	}{
+		{1, baseBackoff, true},
+		{2, 2 * baseBackoff, true},
+		{3, 4 * baseBackoff, true},
+		{7, 64 * baseBackoff, true},
+		{8, maxBackoff, true},
+		{9, maxBackoff, true},
+		{10, 0, false},
+		{11, 0, false},
+	}
+
+	for _, tt := range tests {
+		wait, ok := r.retry(tt.attempts)
+
+		if wait != tt.wait || ok != tt.ok {
+			t.Errorf("retry(%d) = %v, %v, want %v, %v", tt.attempts, wait, ok, tt.wait, tt.ok)
+		}
+	}
+}
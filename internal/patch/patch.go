@@ -0,0 +1,497 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch
+// (RFC 6902) documents to raw JSON.
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	MergePatchContentType = "application/merge-patch+json"
+	JSONPatchContentType  = "application/json-patch+json"
+)
+
+var (
+	ErrInvalidPatch = errors.New("patch: invalid patch document")
+	ErrTestFailed   = errors.New("patch: test operation failed")
+)
+
+// Operation is one operation of a JSON Patch. Path and From are pointers
+// so that a missing member can be told apart from "", the whole document.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func decode(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// MergePatch applies an RFC 7396 merge patch to doc.
+func MergePatch(doc, mergePatch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := decode(mergePatch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	return json.Marshal(merge(target, p))
+}
+
+func merge(target, p interface{}) interface{} {
+	patchObj, ok := p.(map[string]interface{})
+	if !ok {
+		return p
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+			continue
+		}
+		targetObj[name] = merge(targetObj[name], value)
+	}
+
+	return targetObj
+}
+
+// Apply runs the operations of an RFC 6902 JSON Patch against doc. The
+// patch is applied atomically: if any operation fails, nothing is returned.
+func Apply(doc, jsonPatch []byte) ([]byte, error) {
+	return ApplyKeyed(doc, jsonPatch, nil)
+}
+
+// ApplyKeyed is Apply with some arrays addressable by a member of their
+// elements as well as by index. keys maps the pointer of such an array to
+// the member, and a reference token "<member>:<value>" then names the
+// element whose member has that value: with keys {"/entries": "id"},
+// "/entries/id:42/notes" is the notes of the entry with id 42, wherever it
+// is in the array. Keys are looked up again for every operation, so they
+// keep naming the same element as others are added or removed.
+func ApplyKeyed(doc, jsonPatch []byte, keys map[string]string) ([]byte, error) {
+	var ops []Operation
+	if err := json.Unmarshal(jsonPatch, &ops); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	root, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		root, err = applyOperation(root, op, keys)
+		if err != nil {
+			var path string
+			if op.Path != nil {
+				path = *op.Path
+			}
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, path, err)
+		}
+	}
+
+	return json.Marshal(root)
+}
+
+// resolvePointer parses pointer and replaces keyed references to array
+// elements with their current index.
+func resolvePointer(root interface{}, pointer *string, member string, keys map[string]string) ([]string, error) {
+	if pointer == nil {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidPatch, member)
+	}
+
+	path, err := parsePointer(*pointer)
+	if err != nil || len(keys) == 0 {
+		return path, err
+	}
+
+	node := root
+	prefix := ""
+
+	for i, token := range path {
+		arr, isArray := node.([]interface{})
+
+		if key, ok := keys[prefix]; ok && isArray && strings.HasPrefix(token, key+":") {
+			idx, err := keyIndex(arr, key, strings.TrimPrefix(token, key+":"))
+			if err != nil {
+				return nil, err
+			}
+			path[i] = strconv.Itoa(idx)
+		}
+
+		prefix += "/" + strings.ReplaceAll(strings.ReplaceAll(path[i], "~", "~0"), "/", "~1")
+
+		// the rest of the path is checked when the operation runs
+		node, err = get(node, path[i:i+1])
+		if err != nil {
+			break
+		}
+	}
+
+	return path, nil
+}
+
+// keyIndex returns the index of the element of arr whose member key has
+// value.
+func keyIndex(arr []interface{}, key, value string) (int, error) {
+	for i, elem := range arr {
+		obj, ok := elem.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch v := obj[key].(type) {
+		case json.Number:
+			if v.String() == value {
+				return i, nil
+			}
+		case string:
+			if v == value {
+				return i, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("no element with %s %s", key, value)
+}
+
+// isPrefix reports whether prefix is a proper prefix of path.
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) >= len(path) {
+		return false
+	}
+
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func applyOperation(root interface{}, op Operation, keys map[string]string) (interface{}, error) {
+	path, err := resolvePointer(root, op.Path, "path", keys)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("%w: missing value", ErrInvalidPatch)
+		}
+
+		value, err := decode(op.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+
+		switch op.Op {
+		case "add":
+			return add(root, path, value)
+		case "replace":
+			// the root always exists, so it is simply swapped out
+			if len(path) == 0 {
+				return value, nil
+			}
+			root, _, err = remove(root, path)
+			if err != nil {
+				return nil, err
+			}
+			return add(root, path, value)
+		default:
+			current, err := get(root, path)
+			if err != nil {
+				return nil, err
+			}
+			if !equal(current, value) {
+				return nil, ErrTestFailed
+			}
+			return root, nil
+		}
+
+	case "remove":
+		root, _, err = remove(root, path)
+		return root, err
+
+	case "move", "copy":
+		from, err := resolvePointer(root, op.From, "from", keys)
+		if err != nil {
+			return nil, err
+		}
+
+		if op.Op == "move" {
+			if slices.Equal(from, path) {
+				return root, nil
+			}
+			if isPrefix(from, path) {
+				return nil, fmt.Errorf("%w: cannot move a value into one of its children", ErrInvalidPatch)
+			}
+
+			var value interface{}
+			root, value, err = remove(root, from)
+			if err != nil {
+				return nil, err
+			}
+			return add(root, path, value)
+		}
+
+		value, err := get(root, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(root, path, deepCopy(value))
+	}
+
+	return nil, fmt.Errorf("%w: unknown op %q", ErrInvalidPatch, op.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: pointer %q must start with /", ErrInvalidPatch, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+
+	idx, err := strconv.Atoi(token)
+	if err != nil {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+
+	if idx < 0 || idx > max {
+		return 0, fmt.Errorf("array index %d out of range", idx)
+	}
+
+	return idx, nil
+}
+
+func get(node interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("path member %q does not exist", token)
+			}
+			node = child
+		case []interface{}:
+			idx, err := arrayIndex(token, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			node = n[idx]
+		default:
+			return nil, fmt.Errorf("cannot traverse into %q", token)
+		}
+	}
+	return node, nil
+}
+
+// add returns node with value added at path. Containers are modified in
+// place where possible, but slices may be reallocated, so callers must
+// always use the returned node.
+func add(node interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	token, rest := path[0], path[1:]
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if len(rest) == 0 {
+			n[token] = value
+			return n, nil
+		}
+		child, ok := n[token]
+		if !ok {
+			return nil, fmt.Errorf("path member %q does not exist", token)
+		}
+		updated, err := add(child, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		n[token] = updated
+		return n, nil
+
+	case []interface{}:
+		if len(rest) == 0 {
+			idx, err := arrayIndex(token, len(n), true)
+			if err != nil {
+				return nil, err
+			}
+			n = append(n, nil)
+			copy(n[idx+1:], n[idx:])
+			n[idx] = value
+			return n, nil
+		}
+		idx, err := arrayIndex(token, len(n), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := add(n[idx], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		n[idx] = updated
+		return n, nil
+	}
+
+	return nil, fmt.Errorf("cannot add into %q", token)
+}
+
+// remove returns node without the value at path, along with the removed
+// value.
+func remove(node interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: cannot remove the document root", ErrInvalidPatch)
+	}
+
+	token, rest := path[0], path[1:]
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("path member %q does not exist", token)
+		}
+		if len(rest) == 0 {
+			delete(n, token)
+			return n, child, nil
+		}
+		updated, removed, err := remove(child, rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		n[token] = updated
+		return n, removed, nil
+
+	case []interface{}:
+		idx, err := arrayIndex(token, len(n), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			removed := n[idx]
+			return append(n[:idx:idx], n[idx+1:]...), removed, nil
+		}
+		updated, removed, err := remove(n[idx], rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		n[idx] = updated
+		return n, removed, nil
+	}
+
+	return nil, nil, fmt.Errorf("cannot remove from %q", token)
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(n))
+		for k, child := range n {
+			out[k] = deepCopy(child)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(n))
+		for i, child := range n {
+			out[i] = deepCopy(child)
+		}
+		return out
+	}
+	return v
+}
+
+// equal compares two decoded JSON values, treating numbers by value so
+// that 1 and 1.0 are the same.
+func equal(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			other, ok := y[k]
+			if !ok || !equal(v, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if x == y {
+			return true
+		}
+		fx, errX := x.Float64()
+		fy, errY := y.Float64()
+		return errX == nil && errY == nil && fx == fy
+	}
+	return a == b
+}
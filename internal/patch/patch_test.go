@@ -0,0 +1,500 @@
+package patch
+
+import (
+	"errors"
+	"testing"
+)
+
+// jsonEqual reports whether two JSON documents hold the same value.
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+
+	x, err := decode(a)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", a, err)
+	}
+
+	y, err := decode(b)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", b, err)
+	}
+
+	return equal(x, y)
+}
+
+// The examples of RFC 6902, appendix A, and some cases around them.
+var applyTests = []struct {
+	name  string
+	doc   string
+	patch string
+	want  string // empty when the patch must fail
+}{
+	{
+		name:  "A.1 adding an object member",
+		doc:   `{"foo":"bar"}`,
+		patch: `[{"op":"add","path":"/baz","value":"qux"}]`,
+		want:  `{"baz":"qux","foo":"bar"}`,
+	},
+	{
+		name:  "A.2 adding an array element",
+		doc:   `{"foo":["bar","baz"]}`,
+		patch: `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+		want:  `{"foo":["bar","qux","baz"]}`,
+	},
+	{
+		name:  "A.3 removing an object member",
+		doc:   `{"baz":"qux","foo":"bar"}`,
+		patch: `[{"op":"remove","path":"/baz"}]`,
+		want:  `{"foo":"bar"}`,
+	},
+	{
+		name:  "A.4 removing an array element",
+		doc:   `{"foo":["bar","qux","baz"]}`,
+		patch: `[{"op":"remove","path":"/foo/1"}]`,
+		want:  `{"foo":["bar","baz"]}`,
+	},
+	{
+		name:  "A.5 replacing a value",
+		doc:   `{"baz":"qux","foo":"bar"}`,
+		patch: `[{"op":"replace","path":"/baz","value":"boo"}]`,
+		want:  `{"baz":"boo","foo":"bar"}`,
+	},
+	{
+		name:  "A.6 moving a value",
+		doc:   `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+		patch: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+		want:  `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+	},
+	{
+		name:  "A.7 moving an array element",
+		doc:   `{"foo":["all","grass","cows","eat"]}`,
+		patch: `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+		want:  `{"foo":["all","cows","eat","grass"]}`,
+	},
+	{
+		name: "A.8 testing a value: success",
+		doc:  `{"baz":"qux","foo":["a",2,"c"]}`,
+		patch: `[
+			{"op":"test","path":"/baz","value":"qux"},
+			{"op":"test","path":"/foo/1","value":2}
+		]`,
+		want: `{"baz":"qux","foo":["a",2,"c"]}`,
+	},
+	{
+		name:  "A.9 testing a value: error",
+		doc:   `{"baz":"qux"}`,
+		patch: `[{"op":"test","path":"/baz","value":"bar"}]`,
+	},
+	{
+		name:  "A.10 adding a nested member object",
+		doc:   `{"foo":"bar"}`,
+		patch: `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+		want:  `{"foo":"bar","child":{"grandchild":{}}}`,
+	},
+	{
+		name:  "A.11 ignoring unrecognized elements",
+		doc:   `{"foo":"bar"}`,
+		patch: `[{"op":"add","path":"/baz","value":"qux","xyz":123}]`,
+		want:  `{"foo":"bar","baz":"qux"}`,
+	},
+	{
+		name:  "A.12 adding to a nonexistent target",
+		doc:   `{"foo":"bar"}`,
+		patch: `[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+	},
+	{
+		name: "A.14 ~ escape ordering",
+		doc:  `{"/":9,"~1":10}`,
+		patch: `[
+			{"op":"test","path":"/~01","value":10},
+			{"op":"test","path":"/~1","value":9}
+		]`,
+		want: `{"/":9,"~1":10}`,
+	},
+	{
+		name:  "A.15 comparing strings and numbers",
+		doc:   `{"/":9,"~1":10}`,
+		patch: `[{"op":"test","path":"/~01","value":"10"}]`,
+	},
+	{
+		name:  "A.16 adding an array value",
+		doc:   `{"foo":["bar"]}`,
+		patch: `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+		want:  `{"foo":["bar",["abc","def"]]}`,
+	},
+
+	// test
+	{
+		name: "test compares objects regardless of member order",
+		doc:  `{"a":{"x":1,"y":[1,2]}}`,
+		patch: `[
+			{"op":"test","path":"/a","value":{"y":[1,2],"x":1}},
+			{"op":"test","path":"","value":{"a":{"x":1,"y":[1,2]}}}
+		]`,
+		want: `{"a":{"x":1,"y":[1,2]}}`,
+	},
+	{
+		name:  "test compares numbers by value",
+		doc:   `{"a":1}`,
+		patch: `[{"op":"test","path":"/a","value":1.0}]`,
+		want:  `{"a":1}`,
+	},
+	{
+		name:  "test compares arrays in order",
+		doc:   `{"a":[1,2]}`,
+		patch: `[{"op":"test","path":"/a","value":[2,1]}]`,
+	},
+	{
+		name:  "test of null",
+		doc:   `{"a":null}`,
+		patch: `[{"op":"test","path":"/a","value":null}]`,
+		want:  `{"a":null}`,
+	},
+	{
+		name:  "test of a missing member",
+		doc:   `{}`,
+		patch: `[{"op":"test","path":"/a","value":null}]`,
+	},
+	{
+		name:  "test with the end of an array",
+		doc:   `{"a":[1]}`,
+		patch: `[{"op":"test","path":"/a/-","value":1}]`,
+	},
+	{
+		name:  "test without a value",
+		doc:   `{"a":1}`,
+		patch: `[{"op":"test","path":"/a"}]`,
+	},
+	{
+		name: "failed test undoes earlier operations",
+		doc:  `{"a":1}`,
+		patch: `[
+			{"op":"replace","path":"/a","value":2},
+			{"op":"test","path":"/a","value":1}
+		]`,
+	},
+
+	// move
+	{
+		name:  "move into a child",
+		doc:   `{"a":{"b":{}}}`,
+		patch: `[{"op":"move","from":"/a","path":"/a/b/c"}]`,
+	},
+	{
+		name:  "move into a direct child",
+		doc:   `{"a":{}}`,
+		patch: `[{"op":"move","from":"/a","path":"/a/b"}]`,
+	},
+	{
+		name:  "move to a sibling sharing a prefix",
+		doc:   `{"a":1}`,
+		patch: `[{"op":"move","from":"/a","path":"/ab"}]`,
+		want:  `{"ab":1}`,
+	},
+	{
+		name:  "move onto itself",
+		doc:   `{"a":{"b":1}}`,
+		patch: `[{"op":"move","from":"/a","path":"/a"}]`,
+		want:  `{"a":{"b":1}}`,
+	},
+	{
+		name:  "move from a missing member",
+		doc:   `{"a":1}`,
+		patch: `[{"op":"move","from":"/b","path":"/c"}]`,
+	},
+	{
+		name:  "move to the end of an array",
+		doc:   `{"a":[1,2,3]}`,
+		patch: `[{"op":"move","from":"/a/0","path":"/a/-"}]`,
+		want:  `{"a":[2,3,1]}`,
+	},
+
+	// arrays
+	{
+		name:  "add to the end of an array",
+		doc:   `{"a":[]}`,
+		patch: `[{"op":"add","path":"/a/-","value":1},{"op":"add","path":"/a/-","value":2}]`,
+		want:  `{"a":[1,2]}`,
+	},
+	{
+		name:  "add at the length of an array",
+		doc:   `{"a":[1]}`,
+		patch: `[{"op":"add","path":"/a/1","value":2}]`,
+		want:  `{"a":[1,2]}`,
+	},
+	{
+		name:  "add past the end of an array",
+		doc:   `{"a":[1]}`,
+		patch: `[{"op":"add","path":"/a/2","value":2}]`,
+	},
+	{
+		name:  "remove the end of an array",
+		doc:   `{"a":[1]}`,
+		patch: `[{"op":"remove","path":"/a/-"}]`,
+	},
+	{
+		name:  "replace the end of an array",
+		doc:   `{"a":[1]}`,
+		patch: `[{"op":"replace","path":"/a/-","value":2}]`,
+	},
+	{
+		name:  "traverse through the end of an array",
+		doc:   `{"a":[{"b":1}]}`,
+		patch: `[{"op":"add","path":"/a/-/b","value":2}]`,
+	},
+	{
+		name:  "index with a leading zero",
+		doc:   `{"a":[1,2]}`,
+		patch: `[{"op":"remove","path":"/a/01"}]`,
+	},
+	{
+		name:  "negative index",
+		doc:   `{"a":[1,2]}`,
+		patch: `[{"op":"remove","path":"/a/-1"}]`,
+	},
+	{
+		name:  "copy leaves the original alone",
+		doc:   `{"a":{"b":1}}`,
+		patch: `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`,
+		want:  `{"a":{"b":1},"c":{"b":2}}`,
+	},
+
+	// the root
+	{
+		name:  "replace the root",
+		doc:   `{"a":1}`,
+		patch: `[{"op":"replace","path":"","value":[1]}]`,
+		want:  `[1]`,
+	},
+	{
+		name:  "add at the root",
+		doc:   `{"a":1}`,
+		patch: `[{"op":"add","path":"","value":{"b":2}}]`,
+		want:  `{"b":2}`,
+	},
+	{
+		name:  "remove the root",
+		doc:   `{"a":1}`,
+		patch: `[{"op":"remove","path":""}]`,
+	},
+
+	// malformed patches
+	{
+		name:  "add null",
+		doc:   `{}`,
+		patch: `[{"op":"add","path":"/a","value":null}]`,
+		want:  `{"a":null}`,
+	},
+	{
+		name:  "missing path",
+		doc:   `{"a":1}`,
+		patch: `[{"op":"replace","value":2}]`,
+	},
+	{
+		name:  "missing from",
+		doc:   `{"a":1}`,
+		patch: `[{"op":"move","path":"/b"}]`,
+	},
+	{
+		name:  "unknown op",
+		doc:   `{}`,
+		patch: `[{"op":"frobnicate","path":"/a"}]`,
+	},
+	{
+		name:  "pointer without a leading slash",
+		doc:   `{"a":1}`,
+		patch: `[{"op":"remove","path":"a"}]`,
+	},
+	{
+		name:  "not an array",
+		doc:   `{}`,
+		patch: `{"op":"add","path":"/a","value":1}`,
+	},
+}
+
+func TestApply(t *testing.T) {
+	for _, tt := range applyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply([]byte(tt.doc), []byte(tt.patch))
+
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("got %s, want an error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !jsonEqual(t, got, []byte(tt.want)) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	_, err := Apply([]byte(`{"a":1}`), []byte(`[{"op":"test","path":"/a","value":2}]`))
+
+	if !errors.Is(err, ErrTestFailed) {
+		t.Errorf("failed test: got %v, want ErrTestFailed", err)
+	}
+
+	_, err = Apply([]byte(`{"a":{}}`), []byte(`[{"op":"move","from":"/a","path":"/a/b"}]`))
+
+	if !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("move into a child: got %v, want ErrInvalidPatch", err)
+	}
+
+	_, err = Apply([]byte(`{"a":1}`), []byte(`[{"op":"replace","value":2}]`))
+
+	if !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("missing path: got %v, want ErrInvalidPatch", err)
+	}
+
+	_, err = Apply([]byte(`{}`), []byte(`not json`))
+
+	if !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("malformed patch: got %v, want ErrInvalidPatch", err)
+	}
+}
+
+func TestApplyKeyed(t *testing.T) {
+	keys := map[string]string{"/entries": "id"}
+	doc := `{"entries":[{"id":7,"name":"squat"},{"id":9,"name":"bench"},{"id":12,"name":"row"}],"tags":[{"id":7}]}`
+
+	tests := []struct {
+		name  string
+		patch string
+		want  string
+	}{
+		{
+			name:  "replace a member of an entry",
+			patch: `[{"op":"replace","path":"/entries/id:9/name","value":"press"}]`,
+			want:  `{"entries":[{"id":7,"name":"squat"},{"id":9,"name":"press"},{"id":12,"name":"row"}],"tags":[{"id":7}]}`,
+		},
+		{
+			name: "ids follow entries as others are removed",
+			patch: `[
+				{"op":"remove","path":"/entries/id:7"},
+				{"op":"remove","path":"/entries/id:12"},
+				{"op":"test","path":"/entries/0/id","value":9}
+			]`,
+			want: `{"entries":[{"id":9,"name":"bench"}],"tags":[{"id":7}]}`,
+		},
+		{
+			name:  "move an entry by id",
+			patch: `[{"op":"move","from":"/entries/id:12","path":"/entries/0"}]`,
+			want:  `{"entries":[{"id":12,"name":"row"},{"id":7,"name":"squat"},{"id":9,"name":"bench"}],"tags":[{"id":7}]}`,
+		},
+		{
+			name:  "indexes still work",
+			patch: `[{"op":"remove","path":"/entries/1"}]`,
+			want:  `{"entries":[{"id":7,"name":"squat"},{"id":12,"name":"row"}],"tags":[{"id":7}]}`,
+		},
+		{
+			name:  "unknown id",
+			patch: `[{"op":"remove","path":"/entries/id:8"}]`,
+		},
+		{
+			name:  "arrays without a key",
+			patch: `[{"op":"remove","path":"/tags/id:7"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyKeyed([]byte(doc), []byte(tt.patch), keys)
+
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("got %s, want an error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !jsonEqual(t, got, []byte(tt.want)) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// The examples of RFC 7396, appendix A, and some cases around them.
+var mergePatchTests = []struct {
+	doc   string
+	patch string
+	want  string
+}{
+	{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+	{`{"a":"b"}`, `{"a":null}`, `{}`},
+	{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+	{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+	{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+	{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+	{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+	{`{"a":"b"}`, `["c"]`, `["c"]`},
+	{`{"a":"foo"}`, `null`, `null`},
+	{`{"a":"foo"}`, `"bar"`, `"bar"`},
+	{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+	{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+	{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+
+	// the example of section 3
+	{
+		`{"title":"Goodbye!","author":{"givenName":"John","familyName":"Doe"},"tags":["example","sample"],"content":"This will be unchanged"}`,
+		`{"title":"Hello!","phoneNumber":"+01-123-456-7890","author":{"familyName":null},"tags":["example"]}`,
+		`{"title":"Hello!","author":{"givenName":"John"},"tags":["example"],"content":"This will be unchanged","phoneNumber":"+01-123-456-7890"}`,
+	},
+
+	// null deletes only where it is, and deleting what isn't there is fine
+	{`{"a":{"b":null,"c":1}}`, `{"a":{"c":null}}`, `{"a":{"b":null}}`},
+	{`{"a":1}`, `{"b":null}`, `{"a":1}`},
+	{`{"a":[null,1]}`, `{"a":[null]}`, `{"a":[null]}`},
+	{`{"a":1}`, `{}`, `{"a":1}`},
+}
+
+func TestMergePatch(t *testing.T) {
+	for _, tt := range mergePatchTests {
+		got, err := MergePatch([]byte(tt.doc), []byte(tt.patch))
+
+		if err != nil {
+			t.Errorf("%s + %s: %v", tt.doc, tt.patch, err)
+			continue
+		}
+
+		if !jsonEqual(t, got, []byte(tt.want)) {
+			t.Errorf("%s + %s: got %s, want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+}
+
+func TestMergePatchErrors(t *testing.T) {
+	if _, err := MergePatch([]byte(`{}`), []byte(`{"a":`)); !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("malformed patch: got %v, want ErrInvalidPatch", err)
+	}
+
+	if _, err := MergePatch([]byte(`{"a":`), []byte(`{}`)); err == nil || errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("malformed document: got %v, want a decoding error", err)
+	}
+}
+
+func TestMergePatchKeepsNumbers(t *testing.T) {
+	got, err := MergePatch([]byte(`{"a":12345678901234567890,"b":1.50}`), []byte(`{"c":1}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `{"a":12345678901234567890,"b":1.50,"c":1}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -3,6 +3,7 @@ package routes
 import (
 	"github.com/go-chi/chi"
 	"github.com/rpstvs/fm-goapp/internal/app"
+	"github.com/rpstvs/fm-goapp/internal/tokens"
 )
 
 func SetupRoutes(app *app.Application) *chi.Mux {
@@ -10,15 +11,108 @@ func SetupRoutes(app *app.Application) *chi.Mux {
 
 	r.Group(func(r chi.Router) {
 		r.Use(app.Middleware.Authenticate)
-		r.Get("/workouts/{id}", app.Middleware.RequireUser(app.WorkoutHandler.HandleGetWorkById))
-		r.Post("/workouts", app.Middleware.RequireUser(app.WorkoutHandler.HandleCreateWorkout))
-		r.Put("/workouts/{id}", app.Middleware.RequireUser(app.WorkoutHandler.HandleUpdateWorkoutById))
-		r.Delete("/workouts/{id}", app.Middleware.RequireUser(app.WorkoutHandler.HandleDeleteWorkoutById))
+		r.Use(app.Idempotency.Idempotent)
+		r.Get("/workouts/{id}", app.Middleware.RequireScope(tokens.APIScopeWorkoutsRead, app.WorkoutHandler.HandleGetWorkById))
+		r.Post("/workouts", app.Middleware.RequireScope(tokens.APIScopeWorkoutsWrite, app.WorkoutHandler.HandleCreateWorkout))
+		r.Post("/workouts/batch", app.Middleware.RequireScope(tokens.APIScopeWorkoutsWrite, app.WorkoutHandler.HandleBatchWorkouts))
+		r.Put("/workouts/{id}", app.Middleware.RequireScope(tokens.APIScopeWorkoutsWrite, app.WorkoutHandler.HandleUpdateWorkoutById))
+		r.Patch("/workouts/{id}", app.Middleware.RequireScope(tokens.APIScopeWorkoutsWrite, app.WorkoutHandler.HandlePatchWorkoutById))
+		r.Delete("/workouts/{id}", app.Middleware.RequireScope(tokens.APIScopeWorkoutsWrite, app.WorkoutHandler.HandleDeleteWorkoutById))
+		r.Get("/workouts/trash", app.Middleware.RequireScope(tokens.APIScopeWorkoutsRead, app.WorkoutHandler.HandleGetTrash))
+		r.Post("/workouts/{id}/restore", app.Middleware.RequireScope(tokens.APIScopeWorkoutsWrite, app.WorkoutHandler.HandleRestoreWorkoutById))
+
+		r.Get("/workouts/{id}/revisions", app.Middleware.RequireScope(tokens.APIScopeWorkoutsRead, app.WorkoutHandler.HandleGetWorkoutRevisions))
+		r.Get("/workouts/{id}/revisions/diff", app.Middleware.RequireScope(tokens.APIScopeWorkoutsRead, app.WorkoutHandler.HandleDiffWorkoutRevisions))
+		r.Get("/workouts/{id}/revisions/{revision}", app.Middleware.RequireScope(tokens.APIScopeWorkoutsRead, app.WorkoutHandler.HandleGetWorkoutRevision))
+		r.Post("/workouts/{id}/revisions/{revision}/revert", app.Middleware.RequireScope(tokens.APIScopeWorkoutsWrite, app.WorkoutHandler.HandleRevertWorkout))
+
+		r.Get("/search", app.Middleware.RequireScope(tokens.APIScopeWorkoutsRead, app.WorkoutHandler.HandleSearchWorkouts))
+		// sync returns changes as well as applying them
+		r.Post("/sync", app.Middleware.RequireScope(tokens.APIScopeWorkoutsRead, app.Middleware.RequireScope(tokens.APIScopeWorkoutsWrite, app.SyncHandler.HandleSync)))
+		r.Get("/analytics/weekly", app.Middleware.RequireScope(tokens.APIScopeAnalyticsRead, app.AnalyticsHandler.HandleGetWeeklyStats))
+		r.Get("/events", app.Middleware.AcceptStreamTicket(app.Middleware.RequireUser(app.EventHandler.HandleEvents)))
+		r.Delete("/tokens/current", app.Middleware.RequireUser(app.TokenHandler.HandleLogout))
+		r.Post("/tokens/stream", app.Middleware.RequireUser(app.TokenHandler.HandleCreateStreamTicket))
+		r.Get("/users/me/sessions", app.Middleware.RequireUser(app.TokenHandler.HandleGetSessions))
+		r.Delete("/users/me/sessions/{id}", app.Middleware.RequireUser(app.TokenHandler.HandleRevokeSession))
+		r.Get("/users/me/api-keys", app.Middleware.RequireUser(app.APIKeyHandler.HandleGetAPIKeys))
+		r.Post("/users/me/api-keys", app.Middleware.RequireUser(app.APIKeyHandler.HandleCreateAPIKey))
+		r.Delete("/users/me/api-keys/{id}", app.Middleware.RequireUser(app.APIKeyHandler.HandleDeleteAPIKey))
+		r.Get("/users/me/2fa", app.Middleware.RequireUser(app.MFAHandler.HandleGetMFA))
+		r.Post("/users/me/2fa/totp", app.Middleware.RequireUser(app.MFAHandler.HandleEnrollTOTP))
+		r.Post("/users/me/2fa/totp/confirm", app.Middleware.RequireUser(app.MFAHandler.HandleConfirmTOTP))
+		r.Delete("/users/me/2fa/totp", app.Middleware.RequireUser(app.MFAHandler.HandleDisableTOTP))
+		r.Post("/users/me/2fa/recovery-codes", app.Middleware.RequireUser(app.MFAHandler.HandleRegenerateRecoveryCodes))
+		r.Get("/users/me/passkeys", app.Middleware.RequireUser(app.PasskeyHandler.HandleGetPasskeys))
+		r.Post("/users/me/passkeys/options", app.Middleware.RequireUser(app.PasskeyHandler.HandleBeginRegistration))
+		r.Post("/users/me/passkeys", app.Middleware.RequireUser(app.PasskeyHandler.HandleFinishRegistration))
+		r.Delete("/users/me/passkeys/{id}", app.Middleware.RequireUser(app.PasskeyHandler.HandleDeletePasskey))
+		r.Get("/users/me/identities", app.Middleware.RequireUser(app.SSOHandler.HandleGetIdentities))
+		r.Delete("/users/me/identities/{id}", app.Middleware.RequireUser(app.SSOHandler.HandleDeleteIdentity))
+		r.Get("/oauth/clients", app.Middleware.RequireUser(app.OAuthHandler.HandleGetClients))
+		r.Post("/oauth/clients", app.Middleware.RequireUser(app.OAuthHandler.HandleCreateClient))
+		r.Delete("/oauth/clients/{id}", app.Middleware.RequireUser(app.OAuthHandler.HandleDeleteClient))
+		r.Get("/oauth/requests/{id}", app.Middleware.RequireUser(app.OAuthHandler.HandleGetAuthorizationRequest))
+		r.Post("/oauth/requests/{id}", app.Middleware.RequireUser(app.OAuthHandler.HandleAnswerAuthorizationRequest))
+		r.Get("/oauth/userinfo", app.Middleware.RequireScope(tokens.OAuthScopeOpenID, app.OAuthHandler.HandleUserInfo))
+		r.Post("/users/verify/resend", app.Middleware.RequireUser(app.UserHandler.HandleResendVerification))
+		r.Get("/users/me/email-preferences", app.Middleware.RequireUser(app.EmailHandler.HandleGetPreferences))
+		r.Put("/users/me/email-preferences", app.Middleware.RequireUser(app.EmailHandler.HandleUpdatePreferences))
+
+		r.Post("/sessions", app.Middleware.RequireUser(app.LiveHandler.HandleStartSession))
+		r.Get("/sessions/{id}", app.Middleware.RequireUser(app.LiveHandler.HandleGetSession))
+		r.Get("/sessions/{id}/ws", app.Middleware.AcceptStreamTicket(app.Middleware.RequireUser(app.LiveHandler.HandleSubscribe)))
+		r.Post("/sessions/{id}/viewers", app.Middleware.RequireVerifiedEmail(app.LiveHandler.HandleAddViewer))
+		r.Delete("/sessions/{id}/viewers/{userID}", app.Middleware.RequireUser(app.LiveHandler.HandleRemoveViewer))
+		r.Post("/sessions/{id}/sets", app.Middleware.RequireUser(app.LiveHandler.HandleAddSet))
+		r.Post("/sessions/{id}/rest", app.Middleware.RequireUser(app.LiveHandler.HandleStartRest))
+		r.Delete("/sessions/{id}/rest", app.Middleware.RequireUser(app.LiveHandler.HandleCancelRest))
+		r.Post("/sessions/{id}/finish", app.Middleware.RequireUser(app.LiveHandler.HandleFinishSession))
+
+		r.Get("/webhooks", app.Middleware.RequireAdmin(app.WebhookHandler.HandleGetEndpoints))
+		r.Post("/webhooks", app.Middleware.RequireAdmin(app.WebhookHandler.HandleCreateEndpoint))
+		r.Get("/webhooks/{id}", app.Middleware.RequireAdmin(app.WebhookHandler.HandleGetEndpoint))
+		r.Put("/webhooks/{id}", app.Middleware.RequireAdmin(app.WebhookHandler.HandleUpdateEndpoint))
+		r.Delete("/webhooks/{id}", app.Middleware.RequireAdmin(app.WebhookHandler.HandleDeleteEndpoint))
+		r.Get("/webhooks/{id}/deliveries", app.Middleware.RequireAdmin(app.WebhookHandler.HandleGetDeliveries))
+		r.Get("/webhooks/{id}/deliveries/{deliveryID}", app.Middleware.RequireAdmin(app.WebhookHandler.HandleGetDelivery))
+		r.Post("/webhooks/{id}/deliveries/{deliveryID}/redeliver", app.Middleware.RequireAdmin(app.WebhookHandler.HandleRedeliver))
+
+		r.Get("/admin/jobs", app.Middleware.RequireAdmin(app.JobHandler.HandleGetJobs))
+		r.Get("/admin/jobs/{id}", app.Middleware.RequireAdmin(app.JobHandler.HandleGetJob))
+		r.Post("/admin/jobs/{id}/retry", app.Middleware.RequireAdmin(app.JobHandler.HandleRetryJob))
+		r.Get("/admin/workers", app.Middleware.RequireAdmin(app.JobHandler.HandleGetWorkers))
+		r.Get("/admin/schedules", app.Middleware.RequireAdmin(app.ScheduleHandler.HandleGetSchedules))
+		r.Get("/admin/schedules/{name}/runs", app.Middleware.RequireAdmin(app.ScheduleHandler.HandleGetScheduledRuns))
 	})
 
 	r.Get("/health", app.HealthCheck)
 
 	r.Post("/users", app.UserHandler.HandleRegisterUser)
+	r.Post("/users/verify", app.UserHandler.HandleVerifyEmail)
 	r.Post("/tokens/auth", app.TokenHandler.HandleCreateToken)
+	r.Post("/tokens/mfa", app.TokenHandler.HandleVerifyMFA)
+	r.Post("/tokens/passkey/options", app.PasskeyHandler.HandleBeginLogin)
+	r.Post("/tokens/passkey", app.PasskeyHandler.HandleFinishLogin)
+	r.Post("/tokens/refresh", app.TokenHandler.HandleRefreshToken)
+	r.Post("/tokens/password-reset", app.TokenHandler.HandleRequestPasswordReset)
+	r.Post("/tokens/magic-link", app.TokenHandler.HandleRequestMagicLink)
+	r.Post("/tokens/magic-link/consume", app.TokenHandler.HandleConsumeMagicLink)
+	r.Get("/tokens/sso", app.SSOHandler.HandleGetProviders)
+	r.Post("/tokens/sso/{provider}", app.SSOHandler.HandleBeginLogin)
+	r.Post("/tokens/sso/{provider}/callback", app.SSOHandler.HandleFinishLogin)
+	r.Put("/users/password", app.UserHandler.HandleResetPassword)
+
+	// OAuth clients authenticate to these themselves
+	r.Get("/oauth/authorize", app.OAuthHandler.HandleAuthorize)
+	r.Post("/oauth/token", app.OAuthHandler.HandleToken)
+	r.Post("/oauth/introspect", app.OAuthHandler.HandleIntrospect)
+	r.Post("/oauth/revoke", app.OAuthHandler.HandleRevoke)
+	r.Get("/.well-known/openid-configuration", app.OAuthHandler.HandleDiscovery)
+	r.Get("/.well-known/jwks.json", app.OAuthHandler.HandleJWKS)
+
+	// unsubscribe links authenticate with their own signed token
+	r.Get("/email/unsubscribe", app.EmailHandler.HandleGetUnsubscribe)
+	r.Post("/email/unsubscribe", app.EmailHandler.HandleUnsubscribe)
 	return r
 }
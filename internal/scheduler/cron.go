@@ -0,0 +1,216 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression. Times are matched in UTC.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// as in cron, when both day fields are restricted a day matching
+	// either one counts
+	domAny, dowAny bool
+}
+
+type field struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{min: 0, max: 59}
+	hourField   = field{min: 0, max: 23}
+	domField    = field{min: 1, max: 31}
+	monthField  = field{min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is accepted for Sunday as well as 0
+	dowField = field{min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse reads a standard five field cron expression, "minute hour
+// day-of-month month day-of-week", where each field is *, a value, a range
+// a-b, or a comma separated list of those, optionally stepped with /n.
+// Months and weekdays may be given by their three letter names. The
+// descriptors @yearly, @monthly, @weekly, @daily and @hourly are accepted
+// too.
+func Parse(spec string) (*Schedule, error) {
+	expr := strings.TrimSpace(spec)
+
+	if d, ok := descriptors[strings.ToLower(expr)]; ok {
+		expr = d
+	}
+
+	fields := strings.Fields(expr)
+
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields, got %d", spec, len(fields))
+	}
+
+	s := &Schedule{}
+	var err error
+
+	if s.minute, err = parseField(fields[0], minuteField); err != nil {
+		return nil, fmt.Errorf("cron %q: minute: %w", spec, err)
+	}
+	if s.hour, err = parseField(fields[1], hourField); err != nil {
+		return nil, fmt.Errorf("cron %q: hour: %w", spec, err)
+	}
+	if s.dom, err = parseField(fields[2], domField); err != nil {
+		return nil, fmt.Errorf("cron %q: day of month: %w", spec, err)
+	}
+	if s.month, err = parseField(fields[3], monthField); err != nil {
+		return nil, fmt.Errorf("cron %q: month: %w", spec, err)
+	}
+	if s.dow, err = parseField(fields[4], dowField); err != nil {
+		return nil, fmt.Errorf("cron %q: day of week: %w", spec, err)
+	}
+
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	s.domAny = strings.HasPrefix(fields[2], "*")
+	s.dowAny = strings.HasPrefix(fields[4], "*")
+
+	return s, nil
+}
+
+func parseField(expr string, f field) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, stepExpr, stepped := strings.Cut(part, "/")
+
+		step := 1
+		if stepped {
+			n, err := strconv.Atoi(stepExpr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepExpr)
+			}
+			step = n
+		}
+
+		var lo, hi int
+
+		switch {
+		case rangeExpr == "*":
+			lo, hi = f.min, f.max
+		case strings.Contains(rangeExpr, "-"):
+			a, b, _ := strings.Cut(rangeExpr, "-")
+			var err error
+			if lo, err = parseValue(a, f); err != nil {
+				return 0, err
+			}
+			if hi, err = parseValue(b, f); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rangeExpr)
+			}
+		default:
+			v, err := parseValue(rangeExpr, f)
+			if err != nil {
+				return 0, err
+			}
+			// "5/15" means from 5 to the end in steps of 15
+			lo, hi = v, v
+			if stepped {
+				hi = f.max
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+
+	return set, nil
+}
+
+func parseValue(s string, f field) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %q out of range %d-%d", s, f.min, f.max)
+	}
+
+	return v, nil
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<v) != 0
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := has(s.dom, t.Day())
+	dow := has(s.dow, int(t.Weekday()))
+
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+// Next returns the first time after t that the schedule fires, or the zero
+// time if it never does (e.g. "0 0 30 2 *").
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+
+wrap:
+	for t.Year() <= limit {
+		for !has(s.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			if t.Month() == time.January {
+				continue wrap
+			}
+		}
+
+		for !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			if t.Day() == 1 {
+				continue wrap
+			}
+		}
+
+		for !has(s.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+			if t.Hour() == 0 {
+				continue wrap
+			}
+		}
+
+		for !has(s.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			if t.Minute() == 0 {
+				continue wrap
+			}
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
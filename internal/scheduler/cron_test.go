@@ -0,0 +1,99 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"0 9 * * mon-fri", true},
+		{"*/15 * * * *", true},
+		{"5/20 * * * *", true},
+		{"1-5/2 0,12 1,15 jan-jun,DEC SUN", true},
+		{"0 0 * * 7", true},
+		{"@weekly", true},
+		{" @DAILY ", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * 32 * *", false},
+		{"* * * 0 *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"*/x * * * *", false},
+		{"5-1 * * * *", false},
+		{"* * * foo *", false},
+		{"* * * * monday", false},
+		{"a * * * *", false},
+		{"@fortnightly", false},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.spec)
+
+		if (err == nil) != tt.ok {
+			t.Errorf("Parse(%q): got %v, want ok=%v", tt.spec, err, tt.ok)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, minute, sec int) time.Time {
+		return time.Date(year, month, day, hour, minute, sec, 0, time.UTC)
+	}
+
+	// 2024-01-01 is a Monday
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"every minute", "* * * * *", at(2024, 1, 1, 10, 0, 30), at(2024, 1, 1, 10, 1, 0)},
+		{"strictly after", "0 * * * *", at(2024, 1, 1, 10, 0, 0), at(2024, 1, 1, 11, 0, 0)},
+		{"descriptor", "@hourly", at(2024, 1, 1, 10, 59, 59), at(2024, 1, 1, 11, 0, 0)},
+		{"step", "*/15 * * * *", at(2024, 1, 1, 10, 7, 0), at(2024, 1, 1, 10, 15, 0)},
+		{"step from a value", "5/20 * * * *", at(2024, 1, 1, 10, 26, 0), at(2024, 1, 1, 10, 45, 0)},
+		{"stepped range", "1-5/2 * * * *", at(2024, 1, 1, 10, 3, 0), at(2024, 1, 1, 10, 5, 0)},
+		{"stepped range wraps the hour", "1-5/2 * * * *", at(2024, 1, 1, 10, 5, 0), at(2024, 1, 1, 11, 1, 0)},
+		{"stepped hours", "0 9-17/4 * * *", at(2024, 1, 1, 14, 0, 0), at(2024, 1, 1, 17, 0, 0)},
+		{"weekdays skip the weekend", "30 8 * * mon-fri", at(2024, 1, 5, 9, 0, 0), at(2024, 1, 8, 8, 30, 0)},
+		{"sunday as 7", "0 0 * * 7", at(2024, 1, 1, 0, 0, 0), at(2024, 1, 7, 0, 0, 0)},
+		{"sunday by name", "0 0 * * sun", at(2024, 1, 1, 0, 0, 0), at(2024, 1, 7, 0, 0, 0)},
+		{"day of month only", "0 0 13 * *", at(2024, 1, 1, 0, 0, 0), at(2024, 1, 13, 0, 0, 0)},
+		{"day of week only", "0 0 * * fri", at(2024, 1, 6, 0, 0, 0), at(2024, 1, 12, 0, 0, 0)},
+		{"either day field, weekday first", "0 0 13 * fri", at(2024, 1, 1, 0, 0, 0), at(2024, 1, 5, 0, 0, 0)},
+		{"either day field, next weekday", "0 0 13 * fri", at(2024, 1, 5, 0, 0, 0), at(2024, 1, 12, 0, 0, 0)},
+		{"either day field, day of month", "0 0 13 * fri", at(2024, 1, 12, 0, 0, 0), at(2024, 1, 13, 0, 0, 0)},
+		{"stepped days of month", "0 0 */10 * *", at(2024, 1, 21, 0, 0, 0), at(2024, 1, 31, 0, 0, 0)},
+		{"month names", "0 12 1 mar,sep *", at(2024, 3, 2, 0, 0, 0), at(2024, 9, 1, 12, 0, 0)},
+		{"wraps into the next year", "0 0 1 * *", at(2024, 12, 15, 0, 0, 0), at(2025, 1, 1, 0, 0, 0)},
+		{"skips short months", "0 0 31 * *", at(2024, 4, 1, 0, 0, 0), at(2024, 5, 31, 0, 0, 0)},
+		{"last minute of the year", "59 23 31 12 *", at(2024, 12, 31, 23, 59, 0), at(2025, 12, 31, 23, 59, 0)},
+		{"leap day", "0 0 29 2 *", at(2024, 3, 1, 0, 0, 0), at(2028, 2, 29, 0, 0, 0)},
+		{"never in february", "0 0 30 2 *", at(2024, 1, 1, 0, 0, 0), time.Time{}},
+		{"never in april", "0 0 31 4 *", at(2024, 1, 1, 0, 0, 0), time.Time{}},
+		{"matched in UTC", "0 9 * * *", time.Date(2024, 1, 1, 10, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60)), at(2024, 1, 1, 9, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+
+		if err != nil {
+			t.Fatalf("%s: Parse(%q): %v", tt.name, tt.spec, err)
+		}
+
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s: %q after %v = %v, want %v", tt.name, tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/store"
+)
+
+const defaultLeaderCheck = 15 * time.Second
+
+// Func is the work done by a scheduled job. The string it returns is
+// recorded as the outcome of the run.
+type Func func(ctx context.Context) (string, error)
+
+type entry struct {
+	name     string
+	spec     string
+	schedule *Schedule
+	fn       Func
+	next     time.Time
+	running  atomic.Bool
+}
+
+// EntryStatus describes a registered job for the admin API.
+type EntryStatus struct {
+	Name    string    `json:"name"`
+	Spec    string    `json:"spec"`
+	Next    time.Time `json:"next_run"`
+	Running bool      `json:"running"`
+}
+
+// Scheduler runs jobs on cron schedules. Every replica runs one, but only
+// the one holding the leader lock runs jobs; the others keep trying to
+// take the lock over. Each run is recorded under its scheduled time, so a
+// run is never started twice even when the leader changes in the middle.
+type Scheduler struct {
+	Store  store.ScheduleStore
+	Logger *log.Logger
+	Now    func() time.Time
+	// LeaderCheck is how often a follower tries to become leader and the
+	// leader checks it still is.
+	LeaderCheck time.Duration
+
+	entries []*entry
+	leader  atomic.Bool
+	wg      sync.WaitGroup
+}
+
+func New(scheduleStore store.ScheduleStore, logger *log.Logger) *Scheduler {
+	return &Scheduler{
+		Store:       scheduleStore,
+		Logger:      logger,
+		Now:         time.Now,
+		LeaderCheck: defaultLeaderCheck,
+	}
+}
+
+// Add registers fn to run on the cron schedule spec. It must be called
+// before Run.
+func (s *Scheduler) Add(name, spec string, fn Func) error {
+	schedule, err := Parse(spec)
+
+	if err != nil {
+		return fmt.Errorf("scheduler: %s: %w", name, err)
+	}
+
+	for _, e := range s.entries {
+		if e.name == name {
+			return fmt.Errorf("scheduler: %s is already registered", name)
+		}
+	}
+
+	s.entries = append(s.entries, &entry{name: name, spec: spec, schedule: schedule, fn: fn})
+	return nil
+}
+
+// Leader reports whether this replica is currently running the jobs.
+func (s *Scheduler) Leader() bool {
+	return s.leader.Load()
+}
+
+// Entries lists the registered jobs with their next run time.
+func (s *Scheduler) Entries() []EntryStatus {
+	now := s.Now()
+	entries := make([]EntryStatus, 0, len(s.entries))
+
+	for _, e := range s.entries {
+		entries = append(entries, EntryStatus{
+			Name:    e.name,
+			Spec:    e.spec,
+			Next:    e.schedule.Next(now),
+			Running: e.running.Load(),
+		})
+	}
+
+	return entries
+}
+
+// Run competes for leadership until ctx is cancelled, running jobs while
+// it holds it. It waits for running jobs before returning.
+func (s *Scheduler) Run(ctx context.Context) {
+	defer s.wg.Wait()
+
+	for {
+		lock, err := s.Store.TryLeaderLock(ctx)
+
+		if err != nil && ctx.Err() == nil {
+			s.Logger.Printf("ERROR: scheduler: taking leader lock: %v", err)
+		}
+
+		if lock != nil {
+			s.Logger.Println("scheduler: became leader")
+			s.leader.Store(true)
+			s.lead(ctx, lock)
+			s.leader.Store(false)
+			lock.Release()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.LeaderCheck):
+		}
+	}
+}
+
+// lead runs due jobs until ctx is cancelled or the lock is lost.
+func (s *Scheduler) lead(ctx context.Context, lock *store.AdvisoryLock) {
+	// start from a little in the past so a run that came due while nobody
+	// was leader still happens; the run record stops it from happening
+	// twice if the old leader got to it
+	now := s.Now()
+	for _, e := range s.entries {
+		e.next = e.schedule.Next(now.Add(-2 * s.LeaderCheck))
+	}
+
+	check := time.NewTicker(s.LeaderCheck)
+	defer check.Stop()
+
+	for {
+		now = s.Now()
+
+		for _, e := range s.entries {
+			if e.next.IsZero() || e.next.After(now) {
+				continue
+			}
+
+			slot := e.next
+			// runs missed while this replica was busy are skipped, not
+			// replayed one after another
+			e.next = e.schedule.Next(now)
+
+			if !e.running.CompareAndSwap(false, true) {
+				s.Logger.Printf("scheduler: %s: skipping run at %s, the last run is still going", e.name, slot.Format(time.RFC3339))
+				continue
+			}
+
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer e.running.Store(false)
+				s.run(ctx, e, slot)
+			}()
+		}
+
+		wait := s.LeaderCheck
+		if next := s.nextRun(); !next.IsZero() {
+			wait = min(wait, next.Sub(now))
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-check.C:
+			timer.Stop()
+			if err := lock.Check(ctx); err != nil {
+				s.Logger.Printf("ERROR: scheduler: lost leader lock: %v", err)
+				return
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *Scheduler) nextRun() time.Time {
+	var next time.Time
+
+	for _, e := range s.entries {
+		if !e.next.IsZero() && (next.IsZero() || e.next.Before(next)) {
+			next = e.next
+		}
+	}
+
+	return next
+}
+
+func (s *Scheduler) run(ctx context.Context, e *entry, slot time.Time) {
+	id, started, err := s.Store.StartScheduledRun(e.name, slot)
+
+	if err != nil {
+		s.Logger.Printf("ERROR: scheduler: %s: recording run: %v", e.name, err)
+		return
+	}
+
+	if !started {
+		return
+	}
+
+	result, err := call(ctx, e.fn)
+
+	status := store.ScheduledRunSucceeded
+	if err != nil {
+		status = store.ScheduledRunFailed
+		result = err.Error()
+		s.Logger.Printf("ERROR: scheduler: %s: %v", e.name, err)
+	}
+
+	err = s.Store.FinishScheduledRun(id, status, result)
+
+	if err != nil {
+		s.Logger.Printf("ERROR: scheduler: %s: recording outcome: %v", e.name, err)
+	}
+}
+
+// call runs fn, turning a panic into an error so one bad job can't take the
+// scheduler down.
+func call(ctx context.Context, fn Func) (result string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	return fn(ctx)
+}
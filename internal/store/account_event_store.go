@@ -0,0 +1,234 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/live"
+)
+
+const (
+	EventWorkoutCreated  = "workout.created"
+	EventWorkoutUpdated  = "workout.updated"
+	EventWorkoutDeleted  = "workout.deleted"
+	EventWorkoutRestored = "workout.restored"
+	EventWorkoutPurged   = "workout.purged"
+	EventPRAchieved      = "pr.achieved"
+	EventUserRegistered  = "user.registered"
+	EventUserUpdated     = "user.updated"
+	EventEmailVerified   = "user.email_verified"
+	EventPasswordReset   = "user.password_reset"
+	EventTokenIssued     = "token.issued"
+	EventTokenConsumed   = "token.consumed"
+	EventTokensRevoked   = "tokens.revoked"
+)
+
+const (
+	AggregateWorkout = "workout"
+	AggregateUser    = "user"
+)
+
+// ErrEventLogTruncated is returned when events after the requested point
+// have already been purged, so the client has to reload instead of resume.
+var ErrEventLogTruncated = errors.New("account event log truncated")
+
+type AccountEvent struct {
+	Seq       int64           `json:"seq"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// domainEvent is a change about to be recorded. It is about one aggregate,
+// which orders it in the outbox, and belongs to the account of userID.
+type domainEvent struct {
+	aggregateType string
+	aggregateID   int64
+	userID        int
+	eventType     string
+	data          any
+}
+
+func workoutEvent(eventType string, userID int, workoutID int64, data any) domainEvent {
+	return domainEvent{
+		aggregateType: AggregateWorkout,
+		aggregateID:   workoutID,
+		userID:        userID,
+		eventType:     eventType,
+		data:          data,
+	}
+}
+
+type PostgresAccountEventStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAccountEventStore(db *sql.DB) *PostgresAccountEventStore {
+	return &PostgresAccountEventStore{db: db}
+}
+
+type AccountEventStore interface {
+	GetEventsSince(userID int, after int64, limit int) ([]AccountEvent, error)
+	GetLatestEventSeq(userID int) (int64, error)
+	PurgeAccountEvents(olderThan time.Time) (int64, error)
+}
+
+// recordEvents writes events to the outbox and appends them to their
+// users' account event logs, waking the users' event streams. It must run
+// in the transaction of the change the events describe, so an event exists
+// exactly when its change does.
+func recordEvents(q querier, events ...domainEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	payloads := make([][]byte, len(events))
+
+	for i, e := range events {
+		data, err := json.Marshal(e.data)
+		if err != nil {
+			return err
+		}
+		payloads[i] = data
+	}
+
+	users := make([]int64, 0, len(events))
+	seen := make(map[int]bool)
+
+	for start := 0; start < len(events); start += batchChunkSize {
+		end := min(start+batchChunkSize, len(events))
+		args := make([]any, 0, (end-start)*3)
+
+		for i := start; i < end; i++ {
+			e := events[i]
+			args = append(args, e.userID, e.eventType, payloads[i])
+
+			if !seen[e.userID] {
+				seen[e.userID] = true
+				users = append(users, int64(e.userID))
+			}
+		}
+
+		// the events also go out to every webhook endpoint subscribed to
+		// them; queueing the deliveries here means none is lost or sent
+		// for a change that rolled back
+		query := `
+		WITH ev AS (
+			INSERT INTO account_events (user_id, seq, type, data)
+			SELECT v.user_id, next_sync_seq(v.user_id), v.type, v.data
+			FROM (VALUES ` + valuesList(end-start, 3, 0, []string{"bigint", "varchar", "jsonb"}) + `) AS v(user_id, type, data)
+			RETURNING user_id, seq, type, data, created_at
+		)
+		INSERT INTO webhook_deliveries (endpoint_id, event_type, payload)
+		SELECT e.id, ev.type, jsonb_build_object(
+			'id', 'evt_' || ev.user_id || '_' || ev.seq,
+			'type', ev.type,
+			'user_id', ev.user_id,
+			'created_at', ev.created_at,
+			'data', ev.data)
+		FROM ev
+		INNER JOIN webhook_endpoints e ON e.active AND ev.type = ANY(e.event_types)`
+
+		if _, err := q.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+
+	_, err := q.Exec(`SELECT pg_notify($1, u::text) FROM unnest($2::bigint[]) AS u`, live.EventsChannel, users)
+
+	if err != nil {
+		return err
+	}
+
+	// after the account log, which takes the user's sync counter first
+	// like every other write does
+	return writeOutbox(q, events, payloads)
+}
+
+// GetEventsSince returns up to limit of the user's events that come after
+// seq after, oldest first.
+func (pg *PostgresAccountEventStore) GetEventsSince(userID int, after int64, limit int) ([]AccountEvent, error) {
+	var purgedThrough int64
+
+	err := pg.db.QueryRow(`SELECT events_purged_through FROM sync_counters WHERE user_id = $1`, userID).Scan(&purgedThrough)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if after < purgedThrough {
+		return nil, ErrEventLogTruncated
+	}
+
+	query := `
+	SELECT seq, type, data, created_at
+	FROM account_events
+	WHERE user_id = $1 AND seq > $2
+	ORDER BY seq
+	LIMIT $3`
+
+	rows, err := pg.db.Query(query, userID, after, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	events := []AccountEvent{}
+
+	for rows.Next() {
+		var event AccountEvent
+
+		err = rows.Scan(&event.Seq, &event.Type, &event.Data, &event.CreatedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// GetLatestEventSeq returns a point to start streaming from that skips
+// everything already committed. Writes still in flight hold the user's
+// counter and get a higher seq, so they are not skipped.
+func (pg *PostgresAccountEventStore) GetLatestEventSeq(userID int) (int64, error) {
+	var seq int64
+
+	err := pg.db.QueryRow(`SELECT seq FROM sync_counters WHERE user_id = $1`, userID).Scan(&seq)
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return seq, err
+}
+
+// PurgeAccountEvents deletes events recorded before olderThan and remembers
+// how far each user's log was cut, so streams resuming from before that
+// point can be told to reload.
+func (pg *PostgresAccountEventStore) PurgeAccountEvents(olderThan time.Time) (int64, error) {
+	query := `
+	WITH purged AS (
+		DELETE FROM account_events
+		WHERE created_at < $1
+		RETURNING user_id, seq
+	), marked AS (
+		UPDATE sync_counters c
+		SET events_purged_through = greatest(c.events_purged_through, p.seq)
+		FROM (SELECT user_id, max(seq) AS seq FROM purged GROUP BY user_id) p
+		WHERE c.user_id = p.user_id
+	)
+	SELECT count(*) FROM purged`
+
+	var purged int64
+
+	err := pg.db.QueryRow(query, olderThan).Scan(&purged)
+
+	return purged, err
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// AdvisoryLock is a Postgres session-level advisory lock. It lives as long
+// as the connection it was taken on, so that connection is held until the
+// lock is released.
+type AdvisoryLock struct {
+	conn *sql.Conn
+	key  int64
+}
+
+// tryAdvisoryLock takes the lock on key if nobody else holds it, and
+// returns nil if someone does.
+func tryAdvisoryLock(ctx context.Context, db *sql.DB, key int64) (*AdvisoryLock, error) {
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&locked)
+
+	if err != nil || !locked {
+		conn.Close()
+		return nil, err
+	}
+
+	return &AdvisoryLock{conn: conn, key: key}, nil
+}
+
+// Check fails if the connection holding the lock has gone away, in which
+// case the lock has gone with it.
+func (l *AdvisoryLock) Check(ctx context.Context) error {
+	return l.conn.PingContext(ctx)
+}
+
+func (l *AdvisoryLock) Release() {
+	l.conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, l.key)
+	l.conn.Close()
+}
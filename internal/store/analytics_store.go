@@ -0,0 +1,158 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+const EventWeeklySummary = "summary.weekly"
+
+type WeeklyStats struct {
+	UserID          int       `json:"user_id"`
+	WeekStart       time.Time `json:"week_start"`
+	Workouts        int       `json:"workouts"`
+	DurationMinutes int       `json:"duration_minutes"`
+	CaloriesBurned  int       `json:"calories_burned"`
+}
+
+type PostgresAnalyticsStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAnalyticsStore(db *sql.DB) *PostgresAnalyticsStore {
+	return &PostgresAnalyticsStore{db: db}
+}
+
+type AnalyticsStore interface {
+	RefreshAnalytics() error
+	GetWeeklyStats(userID int, weekStart time.Time) (*WeeklyStats, error)
+	GetActiveUsers(weekStart time.Time) ([]int, error)
+	GetWeeklyStatsHistory(userID int, since time.Time) ([]WeeklyStats, error)
+	RecordWeeklySummary(stats *WeeklyStats) error
+}
+
+// RefreshAnalytics recomputes the analytics views. Concurrent refreshes
+// keep the views readable while they run.
+func (s *PostgresAnalyticsStore) RefreshAnalytics() error {
+	_, err := s.db.Exec(`REFRESH MATERIALIZED VIEW CONCURRENTLY user_weekly_stats`)
+	return err
+}
+
+// GetWeeklyStats returns a user's totals for the week starting on
+// weekStart, a Monday, as of the last refresh. A week without workouts
+// gives zero totals.
+func (s *PostgresAnalyticsStore) GetWeeklyStats(userID int, weekStart time.Time) (*WeeklyStats, error) {
+	stats := &WeeklyStats{UserID: userID, WeekStart: weekStart}
+
+	query := `
+	SELECT workouts, duration_minutes, calories_burned
+	FROM user_weekly_stats
+	WHERE user_id = $1 AND week_start = $2::date`
+
+	err := s.db.QueryRow(query, userID, weekStart.Format(time.DateOnly)).Scan(&stats.Workouts, &stats.DurationMinutes, &stats.CaloriesBurned)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// GetWeeklyStatsHistory returns a user's weekly totals for the weeks they
+// worked out in since since, newest first.
+func (s *PostgresAnalyticsStore) GetWeeklyStatsHistory(userID int, since time.Time) ([]WeeklyStats, error) {
+	query := `
+	SELECT week_start, workouts, duration_minutes, calories_burned
+	FROM user_weekly_stats
+	WHERE user_id = $1 AND week_start >= $2::date
+	ORDER BY week_start DESC`
+
+	rows, err := s.db.Query(query, userID, since.Format(time.DateOnly))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	history := []WeeklyStats{}
+
+	for rows.Next() {
+		stats := WeeklyStats{UserID: userID}
+
+		if err := rows.Scan(&stats.WeekStart, &stats.Workouts, &stats.DurationMinutes, &stats.CaloriesBurned); err != nil {
+			return nil, err
+		}
+
+		history = append(history, stats)
+	}
+
+	return history, rows.Err()
+}
+
+// GetActiveUsers returns the users who logged a workout in the week
+// starting on weekStart.
+func (s *PostgresAnalyticsStore) GetActiveUsers(weekStart time.Time) ([]int, error) {
+	rows, err := s.db.Query(`SELECT user_id FROM user_weekly_stats WHERE week_start = $1::date ORDER BY user_id`, weekStart.Format(time.DateOnly))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var users []int
+
+	for rows.Next() {
+		var userID int
+
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+
+		users = append(users, userID)
+	}
+
+	return users, rows.Err()
+}
+
+// RecordWeeklySummary publishes a user's weekly summary as an account
+// event. Each user's week is only published once; recording it again does
+// nothing.
+func (s *PostgresAnalyticsStore) RecordWeeklySummary(stats *WeeklyStats) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+	INSERT INTO weekly_summaries (user_id, week_start) VALUES ($1, $2)
+	ON CONFLICT DO NOTHING`, stats.UserID, stats.WeekStart)
+
+	if err != nil {
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+
+	if err != nil || inserted == 0 {
+		return err
+	}
+
+	err = recordEvents(tx, domainEvent{
+		aggregateType: AggregateUser,
+		aggregateID:   int64(stats.UserID),
+		userID:        stats.UserID,
+		eventType:     EventWeeklySummary,
+		data:          stats,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/tokens"
+)
+
+const (
+	EventAPIKeyCreated = "api_key.created"
+	EventAPIKeyRevoked = "api_key.revoked"
+)
+
+// APIKey is a key as its owner sees it; the key itself is only shown when
+// it is created.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Hint       string     `json:"hint"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+type PostgresAPIKeyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAPIKeyStore(db *sql.DB) *PostgresAPIKeyStore {
+	return &PostgresAPIKeyStore{db: db}
+}
+
+type APIKeyStore interface {
+	CreateAPIKey(key *APIKey, secret *tokens.APIKey) error
+	GetAPIKeys(userID int) ([]APIKey, error)
+	DeleteAPIKey(userID int, id int64) error
+	GetUserByAPIKey(plaintext string) (*User, *APIKey, error)
+	TouchAPIKey(id int64, usedAt time.Time) error
+}
+
+func apiKeyEvent(eventType string, key *APIKey) domainEvent {
+	return domainEvent{
+		aggregateType: AggregateUser,
+		aggregateID:   int64(key.UserID),
+		userID:        key.UserID,
+		eventType:     eventType,
+		data: map[string]any{
+			"id":     key.ID,
+			"name":   key.Name,
+			"scopes": key.Scopes,
+		},
+	}
+}
+
+func (s *PostgresAPIKeyStore) CreateAPIKey(key *APIKey, secret *tokens.APIKey) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO api_keys (user_id, name, hint, hash, scopes, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`
+
+	key.Hint = secret.Hint
+
+	err = tx.QueryRow(query, key.UserID, key.Name, key.Hint, secret.Hash, key.Scopes, key.ExpiresAt).Scan(&key.ID, &key.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	err = recordEvents(tx, apiKeyEvent(EventAPIKeyCreated, key))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const apiKeyColumns = `k.id, k.user_id, k.name, k.hint, to_json(k.scopes), k.expires_at, k.last_used_at, k.created_at`
+
+func scanAPIKey(row interface{ Scan(...any) error }, key *APIKey, extra ...any) error {
+	var scopes []byte
+
+	dest := append([]any{&key.ID, &key.UserID, &key.Name, &key.Hint, &scopes, &key.ExpiresAt, &key.LastUsedAt, &key.CreatedAt}, extra...)
+
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(scopes, &key.Scopes)
+}
+
+// GetAPIKeys lists a user's keys, including expired ones so the user can
+// see why a script stopped working.
+func (s *PostgresAPIKeyStore) GetAPIKeys(userID int) ([]APIKey, error) {
+	rows, err := s.db.Query(`SELECT `+apiKeyColumns+` FROM api_keys k WHERE k.user_id = $1 ORDER BY k.id`, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		if err := scanAPIKey(rows, &key); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// DeleteAPIKey revokes a key. It returns sql.ErrNoRows if the user has no
+// such key.
+func (s *PostgresAPIKeyStore) DeleteAPIKey(userID int, id int64) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	key := &APIKey{}
+
+	err = scanAPIKey(tx.QueryRow(`DELETE FROM api_keys k WHERE k.id = $1 AND k.user_id = $2 RETURNING `+apiKeyColumns, id, userID), key)
+
+	if err != nil {
+		return err
+	}
+
+	err = recordEvents(tx, apiKeyEvent(EventAPIKeyRevoked, key))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetUserByAPIKey returns the owner of an unexpired key along with the
+// key. It returns nils if the key is unknown or expired.
+func (s *PostgresAPIKeyStore) GetUserByAPIKey(plaintext string) (*User, *APIKey, error) {
+	query := `
+	SELECT ` + apiKeyColumns + `,
+		u.username, u.email, u.password_hash, coalesce(u.bio, ''), u.is_admin, u.email_verified_at, u.created_at, u.updated_at
+	FROM api_keys k
+	INNER JOIN users u ON u.id = k.user_id
+	WHERE k.hash = $1 AND (k.expires_at IS NULL OR k.expires_at > $2)`
+
+	key := &APIKey{}
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	err := scanAPIKey(s.db.QueryRow(query, tokens.HashAPIKey(plaintext), time.Now()), key,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash.hash,
+		&user.Bio,
+		&user.IsAdmin,
+		&user.EmailVerifiedAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user.ID = key.UserID
+
+	return user, key, nil
+}
+
+func (s *PostgresAPIKeyStore) TouchAPIKey(id int64, usedAt time.Time) error {
+	_, err := s.db.Exec(`UPDATE api_keys SET last_used_at = $2 WHERE id = $1`, id, usedAt)
+	return err
+}
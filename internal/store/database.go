@@ -6,7 +6,7 @@ import (
 	"io/fs"
 	"os"
 
-	_ "github.com/jackc/pgx/v5"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/joho/godotenv"
 	"github.com/pressly/goose/v3"
 )
@@ -48,3 +48,11 @@ func Migrate(db *sql.DB, dir string) error {
 	}
 	return nil
 }
+
+// querier is the part of *sql.DB and *sql.Tx the stores use, so a query
+// helper can run either on its own or inside a caller's transaction.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"database/sql"
+)
+
+type PostgresEmailPreferenceStore struct {
+	db *sql.DB
+}
+
+func NewPostgresEmailPreferenceStore(db *sql.DB) *PostgresEmailPreferenceStore {
+	return &PostgresEmailPreferenceStore{db: db}
+}
+
+type EmailPreferenceStore interface {
+	GetEmailOptOuts(userID int) ([]string, error)
+	IsOptedOut(userID int, category string) (bool, error)
+	SetEmailOptOut(userID int, category string, optedOut bool) error
+}
+
+// GetEmailOptOuts returns the categories of email userID has opted out of.
+func (s *PostgresEmailPreferenceStore) GetEmailOptOuts(userID int) ([]string, error) {
+	rows, err := s.db.Query(`SELECT category FROM email_opt_outs WHERE user_id = $1 ORDER BY category`, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	categories := []string{}
+
+	for rows.Next() {
+		var category string
+
+		if err := rows.Scan(&category); err != nil {
+			return nil, err
+		}
+
+		categories = append(categories, category)
+	}
+
+	return categories, rows.Err()
+}
+
+func (s *PostgresEmailPreferenceStore) IsOptedOut(userID int, category string) (bool, error) {
+	var optedOut bool
+
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM email_opt_outs WHERE user_id = $1 AND category = $2)`, userID, category).Scan(&optedOut)
+	return optedOut, err
+}
+
+// SetEmailOptOut opts userID out of or back into a category. Either is a
+// no-op if it is already the case, or if the user no longer exists.
+func (s *PostgresEmailPreferenceStore) SetEmailOptOut(userID int, category string, optedOut bool) error {
+	query := `DELETE FROM email_opt_outs WHERE user_id = $1 AND category = $2`
+
+	if optedOut {
+		query = `
+		INSERT INTO email_opt_outs (user_id, category)
+		SELECT id, $2 FROM users WHERE id = $1
+		ON CONFLICT DO NOTHING`
+	}
+
+	_, err := s.db.Exec(query, userID, category)
+	return err
+}
@@ -0,0 +1,189 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrIdempotencyKeyBusy is returned when a key keeps changing hands while
+// it is being claimed.
+var ErrIdempotencyKeyBusy = errors.New("idempotency key is busy")
+
+// maxIdempotencyClaimAttempts bounds how often a claim is retried when the
+// key is released between the insert and the lookup.
+const maxIdempotencyClaimAttempts = 3
+
+type IdempotencyRecord struct {
+	UserID          int
+	Key             string
+	RequestHash     []byte
+	StatusCode      int
+	ResponseHeaders http.Header
+	ResponseBody    []byte
+	Completed       bool
+	LockedAt        time.Time
+	ExpiresAt       time.Time
+}
+
+type PostgresIdempotencyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresIdempotencyStore(db *sql.DB) *PostgresIdempotencyStore {
+	return &PostgresIdempotencyStore{db: db}
+}
+
+type IdempotencyStore interface {
+	ClaimIdempotencyKey(userID int, key string, requestHash []byte, ttl, lease time.Duration) (*IdempotencyRecord, bool, error)
+	GetIdempotencyKey(userID int, key string) (*IdempotencyRecord, error)
+	CompleteIdempotencyKey(record *IdempotencyRecord, statusCode int, headers http.Header, body []byte) error
+	ReleaseIdempotencyKey(record *IdempotencyRecord) error
+	DeleteExpiredIdempotencyKeys() (int64, error)
+}
+
+// ClaimIdempotencyKey records that a request with this key is in flight.
+// It returns claimed=true when the caller now owns the key and should run
+// the request, along with the record to complete or release it with.
+// Otherwise the existing record is returned, either still in flight or
+// holding the response to replay. An expired record is taken over as if it
+// did not exist, and so is an in-flight claim for the same request that is
+// older than lease, since the request holding it has died.
+func (s *PostgresIdempotencyStore) ClaimIdempotencyKey(userID int, key string, requestHash []byte, ttl, lease time.Duration) (*IdempotencyRecord, bool, error) {
+	query := `
+	INSERT INTO idempotency_keys (user_id, key, request_hash, locked_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (user_id, key) DO UPDATE
+	SET request_hash = EXCLUDED.request_hash,
+		status_code = NULL,
+		response_headers = NULL,
+		response_body = NULL,
+		created_at = CURRENT_TIMESTAMP,
+		completed_at = NULL,
+		locked_at = EXCLUDED.locked_at,
+		expires_at = EXCLUDED.expires_at
+	WHERE idempotency_keys.expires_at < $4
+		OR (idempotency_keys.completed_at IS NULL
+			AND idempotency_keys.request_hash = EXCLUDED.request_hash
+			AND (idempotency_keys.locked_at IS NULL OR idempotency_keys.locked_at < $6))
+	RETURNING locked_at, expires_at
+	`
+
+	for range maxIdempotencyClaimAttempts {
+		now := time.Now()
+		claim := &IdempotencyRecord{UserID: userID, Key: key, RequestHash: requestHash}
+
+		err := s.db.QueryRow(query, userID, key, requestHash, now, now.Add(ttl), now.Add(-lease)).Scan(&claim.LockedAt, &claim.ExpiresAt)
+
+		if err == nil {
+			return claim, true, nil
+		}
+
+		if err != sql.ErrNoRows {
+			return nil, false, err
+		}
+
+		record, err := s.GetIdempotencyKey(userID, key)
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		if record != nil {
+			return record, false, nil
+		}
+
+		// released between our insert and select, claim it again
+	}
+
+	return nil, false, ErrIdempotencyKeyBusy
+}
+
+func (s *PostgresIdempotencyStore) GetIdempotencyKey(userID int, key string) (*IdempotencyRecord, error) {
+	query := `
+	SELECT user_id, key, request_hash, status_code, response_headers, response_body, completed_at IS NOT NULL, locked_at, expires_at
+	FROM idempotency_keys
+	WHERE user_id = $1 AND key = $2
+	`
+
+	record := &IdempotencyRecord{}
+	var statusCode sql.NullInt64
+	var headers []byte
+	var lockedAt sql.NullTime
+
+	err := s.db.QueryRow(query, userID, key).Scan(
+		&record.UserID,
+		&record.Key,
+		&record.RequestHash,
+		&statusCode,
+		&headers,
+		&record.ResponseBody,
+		&record.Completed,
+		&lockedAt,
+		&record.ExpiresAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	record.StatusCode = int(statusCode.Int64)
+	record.LockedAt = lockedAt.Time
+
+	if headers != nil {
+		err = json.Unmarshal(headers, &record.ResponseHeaders)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+// CompleteIdempotencyKey stores the response to replay for a claimed key.
+// A claim that was taken over in the meantime is left to its new owner.
+func (s *PostgresIdempotencyStore) CompleteIdempotencyKey(record *IdempotencyRecord, statusCode int, headers http.Header, body []byte) error {
+	encodedHeaders, err := json.Marshal(headers)
+
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE idempotency_keys
+	SET status_code = $4, response_headers = $5, response_body = $6, completed_at = CURRENT_TIMESTAMP
+	WHERE user_id = $1 AND key = $2 AND locked_at = $3 AND completed_at IS NULL
+	`
+
+	_, err = s.db.Exec(query, record.UserID, record.Key, record.LockedAt, statusCode, encodedHeaders, body)
+	return err
+}
+
+// ReleaseIdempotencyKey drops an in-flight claim so the request can be
+// retried, used when the request failed in a way that should not be
+// replayed.
+func (s *PostgresIdempotencyStore) ReleaseIdempotencyKey(record *IdempotencyRecord) error {
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE user_id = $1 AND key = $2 AND locked_at = $3 AND completed_at IS NULL
+	`
+
+	_, err := s.db.Exec(query, record.UserID, record.Key, record.LockedAt)
+	return err
+}
+
+func (s *PostgresIdempotencyStore) DeleteExpiredIdempotencyKeys() (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at < CURRENT_TIMESTAMP`)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,315 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	EventIdentityLinked   = "identity.linked"
+	EventIdentityUnlinked = "identity.unlinked"
+)
+
+var (
+	// ErrIdentityLinked is returned when linking an identity that is
+	// linked already, or a second one from the same issuer to a user.
+	ErrIdentityLinked = errors.New("identity is already linked")
+	// ErrUserExists is returned when provisioning a user whose username or
+	// email is taken.
+	ErrUserExists = errors.New("username or email is taken")
+)
+
+// Identity links a user to an account at an external OpenID Connect
+// provider they can log in with.
+type Identity struct {
+	ID          int64      `json:"id"`
+	UserID      int        `json:"-"`
+	Provider    string     `json:"provider"`
+	Issuer      string     `json:"-"`
+	Subject     string     `json:"-"`
+	Email       string     `json:"email"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// SSOLogin is a login redirected to a provider, waiting for the user to
+// come back.
+type SSOLogin struct {
+	State        string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+type PostgresIdentityStore struct {
+	db *sql.DB
+}
+
+func NewPostgresIdentityStore(db *sql.DB) *PostgresIdentityStore {
+	return &PostgresIdentityStore{db: db}
+}
+
+type IdentityStore interface {
+	CreateSSOLogin(login *SSOLogin) error
+	ConsumeSSOLogin(state string) (*SSOLogin, error)
+	DeleteExpiredSSOLogins(now time.Time) (int64, error)
+	UseIdentity(issuer, subject, email string, usedAt time.Time) (int, error)
+	LinkIdentity(identity *Identity) error
+	CreateUserWithIdentity(user *User, identity *Identity) error
+	GetIdentities(userID int) ([]Identity, error)
+	DeleteIdentity(userID int, id int64) error
+}
+
+func (s *PostgresIdentityStore) CreateSSOLogin(login *SSOLogin) error {
+	query := `
+	INSERT INTO sso_logins (state, provider, nonce, code_verifier, expires_at)
+	VALUES ($1, $2, $3, $4, $5)`
+
+	_, err := s.db.Exec(query, login.State, login.Provider, login.Nonce, login.CodeVerifier, login.ExpiresAt)
+	return err
+}
+
+// ConsumeSSOLogin deletes an unexpired login so its state can only be used
+// once, and returns it. It returns nil if there was no such login.
+func (s *PostgresIdentityStore) ConsumeSSOLogin(state string) (*SSOLogin, error) {
+	query := `
+	DELETE FROM sso_logins
+	WHERE state = $1 AND expires_at > $2
+	RETURNING state, provider, nonce, code_verifier, expires_at`
+
+	login := &SSOLogin{}
+
+	err := s.db.QueryRow(query, state, time.Now()).Scan(&login.State, &login.Provider, &login.Nonce, &login.CodeVerifier, &login.ExpiresAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return login, nil
+}
+
+// DeleteExpiredSSOLogins removes logins the user never came back from.
+func (s *PostgresIdentityStore) DeleteExpiredSSOLogins(now time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM sso_logins WHERE expires_at < $1`, now)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// UseIdentity records a login with a linked identity, keeping the email
+// the provider has for it current, and returns the user it is linked to.
+// It returns 0 if the identity isn't linked.
+func (s *PostgresIdentityStore) UseIdentity(issuer, subject, email string, usedAt time.Time) (int, error) {
+	query := `
+	UPDATE identities
+	SET email = $3, last_login_at = $4
+	WHERE issuer = $1 AND subject = $2
+	RETURNING user_id`
+
+	var userID int
+
+	err := s.db.QueryRow(query, issuer, subject, email, usedAt).Scan(&userID)
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return userID, err
+}
+
+func identityEvent(eventType string, identity *Identity) domainEvent {
+	return domainEvent{
+		aggregateType: AggregateUser,
+		aggregateID:   int64(identity.UserID),
+		userID:        identity.UserID,
+		eventType:     eventType,
+		data: map[string]any{
+			"id":       identity.ID,
+			"provider": identity.Provider,
+			"email":    identity.Email,
+		},
+	}
+}
+
+func insertIdentity(q querier, identity *Identity) error {
+	query := `
+	INSERT INTO identities (user_id, provider, issuer, subject, email, last_login_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT DO NOTHING
+	RETURNING id, created_at`
+
+	err := q.QueryRow(query,
+		identity.UserID,
+		identity.Provider,
+		identity.Issuer,
+		identity.Subject,
+		identity.Email,
+		identity.LastLoginAt,
+	).Scan(&identity.ID, &identity.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return ErrIdentityLinked
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return recordEvents(q, identityEvent(EventIdentityLinked, identity))
+}
+
+func (s *PostgresIdentityStore) LinkIdentity(identity *Identity) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := insertIdentity(tx, identity); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateUserWithIdentity provisions a user for someone logging in with an
+// identity no user has. The provider vouched for the email, so it starts
+// out verified. It returns ErrUserExists if the username or email is
+// taken.
+func (s *PostgresIdentityStore) CreateUserWithIdentity(user *User, identity *Identity) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO users (username, email, password_hash, bio, email_verified_at)
+	VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+	ON CONFLICT DO NOTHING
+	RETURNING id, email_verified_at, created_at, updated_at`
+
+	err = tx.QueryRow(query, user.Username, user.Email, user.PasswordHash.hash, user.Bio).Scan(&user.ID, &user.EmailVerifiedAt, &user.CreatedAt, &user.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return ErrUserExists
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = recordEvents(tx, domainEvent{
+		aggregateType: AggregateUser,
+		aggregateID:   int64(user.ID),
+		userID:        user.ID,
+		eventType:     EventUserRegistered,
+		data: map[string]any{
+			"id":                user.ID,
+			"username":          user.Username,
+			"email":             user.Email,
+			"provider":          identity.Provider,
+			"email_verified_at": user.EmailVerifiedAt,
+			"created_at":        user.CreatedAt,
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	identity.UserID = user.ID
+
+	if err := insertIdentity(tx, identity); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresIdentityStore) GetIdentities(userID int) ([]Identity, error) {
+	query := `
+	SELECT id, user_id, provider, issuer, subject, email, last_login_at, created_at
+	FROM identities
+	WHERE user_id = $1
+	ORDER BY id`
+
+	rows, err := s.db.Query(query, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	identities := []Identity{}
+
+	for rows.Next() {
+		var identity Identity
+
+		err := rows.Scan(
+			&identity.ID,
+			&identity.UserID,
+			&identity.Provider,
+			&identity.Issuer,
+			&identity.Subject,
+			&identity.Email,
+			&identity.LastLoginAt,
+			&identity.CreatedAt,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+// DeleteIdentity unlinks an identity. It returns sql.ErrNoRows if the user
+// has no such identity.
+func (s *PostgresIdentityStore) DeleteIdentity(userID int, id int64) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	identity := &Identity{ID: id, UserID: userID}
+
+	query := `
+	DELETE FROM identities
+	WHERE id = $1 AND user_id = $2
+	RETURNING provider, email`
+
+	err = tx.QueryRow(query, id, userID).Scan(&identity.Provider, &identity.Email)
+
+	if err != nil {
+		return err
+	}
+
+	err = recordEvents(tx, identityEvent(EventIdentityUnlinked, identity))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,403 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+type Job struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	UniqueKey   *string         `json:"unique_key"`
+	LockedBy    *string         `json:"locked_by"`
+	LockedUntil *time.Time      `json:"locked_until"`
+	LastError   string          `json:"last_error"`
+	CreatedAt   time.Time       `json:"created_at"`
+	FinishedAt  *time.Time      `json:"finished_at"`
+}
+
+type JobWorker struct {
+	ID              string    `json:"id"`
+	Hostname        string    `json:"hostname"`
+	Concurrency     int       `json:"concurrency"`
+	Kinds           []string  `json:"kinds"`
+	Running         int       `json:"running"`
+	StartedAt       time.Time `json:"started_at"`
+	LastHeartbeatAt time.Time `json:"last_heartbeat_at"`
+}
+
+type JobFilter struct {
+	Status string
+	Kind   string
+	Limit  int
+}
+
+type JobCount struct {
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	Count  int64  `json:"count"`
+}
+
+type PostgresJobStore struct {
+	db *sql.DB
+}
+
+func NewPostgresJobStore(db *sql.DB) *PostgresJobStore {
+	return &PostgresJobStore{db: db}
+}
+
+type JobStore interface {
+	InsertJob(job *Job) (bool, error)
+	ClaimJobs(workerID string, kinds []string, limit int, lease time.Duration) ([]Job, error)
+	ExtendJobLeases(workerID string, ids []int64, lease time.Duration) error
+	CompleteJob(id int64, workerID string) error
+	FailJob(id int64, workerID string, message string, retryAt *time.Time) error
+	ReleaseJobs(workerID string, ids []int64) error
+	RequeueExpiredJobs() (int64, error)
+	PurgeFinishedJobs(olderThan time.Time) (int64, error)
+	GetJobs(filter JobFilter) ([]Job, error)
+	GetJob(id int64) (*Job, error)
+	CountJobs() ([]JobCount, error)
+	RetryJob(id int64) error
+	RegisterWorker(worker *JobWorker) error
+	HeartbeatWorker(id string, running int) error
+	RemoveWorker(id string) error
+	GetWorkers() ([]JobWorker, error)
+}
+
+const jobColumns = `id, kind, payload, status, attempts, max_attempts, run_at, unique_key, locked_by, locked_until, last_error, created_at, finished_at`
+
+func scanJob(row interface{ Scan(...any) error }, job *Job) error {
+	return row.Scan(
+		&job.ID,
+		&job.Kind,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.UniqueKey,
+		&job.LockedBy,
+		&job.LockedUntil,
+		&job.LastError,
+		&job.CreatedAt,
+		&job.FinishedAt,
+	)
+}
+
+func scanJobs(rows *sql.Rows) ([]Job, error) {
+	defer rows.Close()
+
+	jobs := []Job{}
+
+	for rows.Next() {
+		var job Job
+
+		if err := scanJob(rows, &job); err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// InsertJob queues job. If it has a unique key that a queued or running
+// job of the same kind already holds, nothing is inserted, job is filled
+// in from the existing one and false is returned.
+func (s *PostgresJobStore) InsertJob(job *Job) (bool, error) {
+	query := `
+	INSERT INTO jobs (kind, payload, max_attempts, run_at, unique_key)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (kind, unique_key) WHERE unique_key IS NOT NULL AND status IN ('queued', 'running') DO NOTHING
+	RETURNING ` + jobColumns
+
+	err := scanJob(s.db.QueryRow(query, job.Kind, job.Payload, job.MaxAttempts, job.RunAt, job.UniqueKey), job)
+
+	if err == nil {
+		return true, nil
+	}
+
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	query = `
+	SELECT ` + jobColumns + `
+	FROM jobs
+	WHERE kind = $1 AND unique_key = $2 AND status IN ('queued', 'running')`
+
+	err = scanJob(s.db.QueryRow(query, job.Kind, job.UniqueKey), job)
+
+	// the holder finished in between; try again
+	if err == sql.ErrNoRows {
+		return s.InsertJob(job)
+	}
+
+	return false, err
+}
+
+// ClaimJobs takes up to limit due jobs of the given kinds for workerID and
+// leases them for lease. Rows other workers are claiming are skipped
+// rather than waited on.
+func (s *PostgresJobStore) ClaimJobs(workerID string, kinds []string, limit int, lease time.Duration) ([]Job, error) {
+	query := `
+	UPDATE jobs
+	SET status = 'running', attempts = attempts + 1, locked_by = $1,
+		locked_until = CURRENT_TIMESTAMP + $4 * interval '1 millisecond'
+	WHERE id IN (
+		SELECT id FROM jobs
+		WHERE status = 'queued' AND run_at <= CURRENT_TIMESTAMP AND kind = ANY($2)
+		ORDER BY run_at, id
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING ` + jobColumns
+
+	rows, err := s.db.Query(query, workerID, kinds, limit, lease.Milliseconds())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanJobs(rows)
+}
+
+func (s *PostgresJobStore) ExtendJobLeases(workerID string, ids []int64, lease time.Duration) error {
+	query := `
+	UPDATE jobs
+	SET locked_until = CURRENT_TIMESTAMP + $3 * interval '1 millisecond'
+	WHERE id = ANY($2) AND locked_by = $1 AND status = 'running'`
+
+	_, err := s.db.Exec(query, workerID, ids, lease.Milliseconds())
+	return err
+}
+
+// CompleteJob and FailJob only touch a job workerID still holds; if its
+// lease ran out and someone else took it over, the late result is dropped.
+func (s *PostgresJobStore) CompleteJob(id int64, workerID string) error {
+	query := `
+	UPDATE jobs
+	SET status = 'succeeded', finished_at = CURRENT_TIMESTAMP, locked_by = NULL, locked_until = NULL
+	WHERE id = $1 AND locked_by = $2 AND status = 'running'`
+
+	_, err := s.db.Exec(query, id, workerID)
+	return err
+}
+
+// FailJob records a failed attempt. With retryAt the job is queued again
+// for then, otherwise it is marked failed for good.
+func (s *PostgresJobStore) FailJob(id int64, workerID string, message string, retryAt *time.Time) error {
+	query := `
+	UPDATE jobs
+	SET status = CASE WHEN $4::timestamptz IS NULL THEN 'failed' ELSE 'queued' END,
+		run_at = coalesce($4, run_at),
+		finished_at = CASE WHEN $4::timestamptz IS NULL THEN CURRENT_TIMESTAMP END,
+		last_error = $3, locked_by = NULL, locked_until = NULL
+	WHERE id = $1 AND locked_by = $2 AND status = 'running'`
+
+	_, err := s.db.Exec(query, id, workerID, message, retryAt)
+	return err
+}
+
+// ReleaseJobs puts jobs a stopping worker did not get to finish back in the
+// queue without counting the interrupted attempt.
+func (s *PostgresJobStore) ReleaseJobs(workerID string, ids []int64) error {
+	query := `
+	UPDATE jobs
+	SET status = 'queued', attempts = greatest(attempts - 1, 0), locked_by = NULL, locked_until = NULL
+	WHERE id = ANY($2) AND locked_by = $1 AND status = 'running'`
+
+	_, err := s.db.Exec(query, workerID, ids)
+	return err
+}
+
+// RequeueExpiredJobs recovers jobs whose worker stopped renewing its lease,
+// most likely because it died. They count as a failed attempt.
+func (s *PostgresJobStore) RequeueExpiredJobs() (int64, error) {
+	query := `
+	UPDATE jobs
+	SET status = CASE WHEN attempts >= max_attempts THEN 'failed' ELSE 'queued' END,
+		finished_at = CASE WHEN attempts >= max_attempts THEN CURRENT_TIMESTAMP END,
+		last_error = 'lease expired on worker ' || locked_by,
+		locked_by = NULL, locked_until = NULL
+	WHERE status = 'running' AND locked_until < CURRENT_TIMESTAMP`
+
+	result, err := s.db.Exec(query)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (s *PostgresJobStore) PurgeFinishedJobs(olderThan time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM jobs WHERE finished_at < $1`, olderThan)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (s *PostgresJobStore) GetJobs(filter JobFilter) ([]Job, error) {
+	query := `
+	SELECT ` + jobColumns + `
+	FROM jobs
+	WHERE ($1 = '' OR status = $1) AND ($2 = '' OR kind = $2)
+	ORDER BY id DESC
+	LIMIT $3`
+
+	rows, err := s.db.Query(query, filter.Status, filter.Kind, filter.Limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanJobs(rows)
+}
+
+func (s *PostgresJobStore) GetJob(id int64) (*Job, error) {
+	job := &Job{}
+
+	err := scanJob(s.db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = $1`, id), job)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+func (s *PostgresJobStore) CountJobs() ([]JobCount, error) {
+	rows, err := s.db.Query(`SELECT kind, status, count(*) FROM jobs GROUP BY kind, status ORDER BY kind, status`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	counts := []JobCount{}
+
+	for rows.Next() {
+		var count JobCount
+
+		if err := rows.Scan(&count.Kind, &count.Status, &count.Count); err != nil {
+			return nil, err
+		}
+
+		counts = append(counts, count)
+	}
+
+	return counts, rows.Err()
+}
+
+// RetryJob queues a failed job to run now with a fresh set of attempts.
+func (s *PostgresJobStore) RetryJob(id int64) error {
+	query := `
+	UPDATE jobs
+	SET status = 'queued', attempts = 0, run_at = CURRENT_TIMESTAMP, finished_at = NULL
+	WHERE id = $1 AND status = 'failed'`
+
+	result, err := s.db.Exec(query, id)
+
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (s *PostgresJobStore) RegisterWorker(worker *JobWorker) error {
+	query := `
+	INSERT INTO job_workers (id, hostname, concurrency, kinds)
+	VALUES ($1, $2, $3, $4)
+	RETURNING started_at, last_heartbeat_at`
+
+	return s.db.QueryRow(query, worker.ID, worker.Hostname, worker.Concurrency, worker.Kinds).Scan(&worker.StartedAt, &worker.LastHeartbeatAt)
+}
+
+// HeartbeatWorker records that a worker is alive and how busy it is, and
+// forgets workers that have not been heard from in an hour.
+func (s *PostgresJobStore) HeartbeatWorker(id string, running int) error {
+	_, err := s.db.Exec(`UPDATE job_workers SET running = $2, last_heartbeat_at = CURRENT_TIMESTAMP WHERE id = $1`, id, running)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`DELETE FROM job_workers WHERE last_heartbeat_at < CURRENT_TIMESTAMP - interval '1 hour'`)
+	return err
+}
+
+func (s *PostgresJobStore) RemoveWorker(id string) error {
+	_, err := s.db.Exec(`DELETE FROM job_workers WHERE id = $1`, id)
+	return err
+}
+
+func (s *PostgresJobStore) GetWorkers() ([]JobWorker, error) {
+	query := `
+	SELECT id, hostname, concurrency, to_json(kinds), running, started_at, last_heartbeat_at
+	FROM job_workers
+	ORDER BY started_at`
+
+	rows, err := s.db.Query(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	workers := []JobWorker{}
+
+	for rows.Next() {
+		var worker JobWorker
+		var kinds []byte
+
+		err = rows.Scan(&worker.ID, &worker.Hostname, &worker.Concurrency, &kinds, &worker.Running, &worker.StartedAt, &worker.LastHeartbeatAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(kinds, &worker.Kinds); err != nil {
+			return nil, err
+		}
+
+		workers = append(workers, worker)
+	}
+
+	return workers, rows.Err()
+}
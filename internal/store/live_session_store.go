@@ -0,0 +1,350 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/live"
+)
+
+const (
+	LiveEventSetCompleted    = "set_completed"
+	LiveEventRestStarted     = "rest_started"
+	LiveEventRestCancelled   = "rest_cancelled"
+	LiveEventSessionFinished = "session_finished"
+	LiveEventViewerRemoved   = live.EventViewerRemoved
+)
+
+type LiveSession struct {
+	ID         int64            `json:"id"`
+	UserID     int              `json:"user_id"`
+	Title      string           `json:"title"`
+	RestEndsAt *time.Time       `json:"rest_ends_at"`
+	WorkoutID  *int64           `json:"workout_id"`
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt *time.Time       `json:"finished_at"`
+	Sets       []LiveSessionSet `json:"sets"`
+}
+
+type LiveSessionSet struct {
+	ID              int64     `json:"id"`
+	ExerciseName    string    `json:"exercise_name"`
+	Reps            *int      `json:"reps"`
+	DurationSeconds *int      `json:"duration_seconds"`
+	Weight          *float64  `json:"weight"`
+	Notes           string    `json:"notes"`
+	CompletedAt     time.Time `json:"completed_at"`
+}
+
+type LiveSessionEvent struct {
+	Type      string `json:"type"`
+	SessionID int64  `json:"session_id"`
+	Data      any    `json:"data,omitempty"`
+}
+
+type PostgresLiveSessionStore struct {
+	db *sql.DB
+}
+
+func NewPostgresLiveSessionStore(db *sql.DB) *PostgresLiveSessionStore {
+	return &PostgresLiveSessionStore{db: db}
+}
+
+type LiveSessionStore interface {
+	CreateSession(session *LiveSession) error
+	GetSession(id int64) (*LiveSession, error)
+	CanViewSession(sessionID int64, userID int) (bool, error)
+	AddViewer(sessionID int64, userID int) error
+	RemoveViewer(sessionID int64, userID int) error
+	AddSet(sessionID int64, set *LiveSessionSet) error
+	SetRestTimer(sessionID int64, endsAt *time.Time) error
+	FinishSession(sessionID int64, toWorkout func(*LiveSession, time.Time) *Workout) (*Workout, error)
+}
+
+// notifyLive queues a session event on the live channel. Postgres only
+// delivers it if tx commits, so viewers never see a change that was rolled
+// back.
+func notifyLive(tx *sql.Tx, event LiveSessionEvent) error {
+	payload, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`SELECT pg_notify($1, $2)`, live.Channel, string(payload))
+	return err
+}
+
+func (s *PostgresLiveSessionStore) CreateSession(session *LiveSession) error {
+	query := `
+	INSERT INTO live_sessions (user_id, title)
+	VALUES ($1, $2)
+	RETURNING id, started_at
+	`
+
+	return s.db.QueryRow(query, session.UserID, session.Title).Scan(&session.ID, &session.StartedAt)
+}
+
+func (s *PostgresLiveSessionStore) GetSession(id int64) (*LiveSession, error) {
+	return getSession(s.db, id)
+}
+
+func getSession(q querier, id int64) (*LiveSession, error) {
+	session := &LiveSession{Sets: []LiveSessionSet{}}
+
+	query := `
+	SELECT id, user_id, title, rest_ends_at, workout_id, started_at, finished_at
+	FROM live_sessions
+	WHERE id = $1
+	`
+
+	err := q.QueryRow(query, id).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.Title,
+		&session.RestEndsAt,
+		&session.WorkoutID,
+		&session.StartedAt,
+		&session.FinishedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	setQuery := `
+	SELECT id, exercise_name, reps, duration_seconds, weight, notes, completed_at
+	FROM live_session_sets
+	WHERE session_id = $1
+	ORDER BY id
+	`
+
+	rows, err := q.Query(setQuery, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var set LiveSessionSet
+
+		err = rows.Scan(&set.ID, &set.ExerciseName, &set.Reps, &set.DurationSeconds, &set.Weight, &set.Notes, &set.CompletedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		session.Sets = append(session.Sets, set)
+	}
+
+	return session, rows.Err()
+}
+
+func (s *PostgresLiveSessionStore) CanViewSession(sessionID int64, userID int) (bool, error) {
+	query := `
+	SELECT EXISTS (
+		SELECT 1 FROM live_sessions WHERE id = $1 AND user_id = $2
+		UNION ALL
+		SELECT 1 FROM live_session_viewers WHERE session_id = $1 AND user_id = $2
+	)
+	`
+
+	var allowed bool
+	err := s.db.QueryRow(query, sessionID, userID).Scan(&allowed)
+	return allowed, err
+}
+
+func (s *PostgresLiveSessionStore) AddViewer(sessionID int64, userID int) error {
+	query := `
+	INSERT INTO live_session_viewers (session_id, user_id)
+	VALUES ($1, $2)
+	ON CONFLICT DO NOTHING
+	`
+
+	_, err := s.db.Exec(query, sessionID, userID)
+	return err
+}
+
+// RemoveViewer revokes a viewer's access and tells every instance to close
+// the streams they already have open.
+func (s *PostgresLiveSessionStore) RemoveViewer(sessionID int64, userID int) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM live_session_viewers WHERE session_id = $1 AND user_id = $2`, sessionID, userID)
+
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	err = notifyLive(tx, LiveSessionEvent{Type: LiveEventViewerRemoved, SessionID: sessionID, Data: map[string]int{"user_id": userID}})
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresLiveSessionStore) AddSet(sessionID int64, set *LiveSessionSet) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// completing a set ends any rest that was running
+	query := `
+	WITH session AS (
+		UPDATE live_sessions SET rest_ends_at = NULL
+		WHERE id = $1 AND finished_at IS NULL
+		RETURNING id
+	)
+	INSERT INTO live_session_sets (session_id, exercise_name, reps, duration_seconds, weight, notes)
+	SELECT id, $2, $3, $4, $5, $6 FROM session
+	RETURNING id, completed_at
+	`
+
+	err = tx.QueryRow(query, sessionID, set.ExerciseName, set.Reps, set.DurationSeconds, set.Weight, set.Notes).Scan(&set.ID, &set.CompletedAt)
+
+	if err != nil {
+		return err
+	}
+
+	err = notifyLive(tx, LiveSessionEvent{Type: LiveEventSetCompleted, SessionID: sessionID, Data: set})
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetRestTimer starts the shared rest timer, or cancels it when endsAt is
+// nil. Viewers get the end time and count down locally.
+func (s *PostgresLiveSessionStore) SetRestTimer(sessionID int64, endsAt *time.Time) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE live_sessions SET rest_ends_at = $2 WHERE id = $1 AND finished_at IS NULL`, sessionID, endsAt)
+
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	event := LiveSessionEvent{Type: LiveEventRestCancelled, SessionID: sessionID}
+	if endsAt != nil {
+		event = LiveSessionEvent{Type: LiveEventRestStarted, SessionID: sessionID, Data: map[string]time.Time{"ends_at": *endsAt}}
+	}
+
+	err = notifyLive(tx, event)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FinishSession closes a session and saves it as the workout toWorkout
+// builds from it, in one transaction. The session is claimed before
+// anything else, so of two concurrent finishes only one saves a workout,
+// and no set can be added after the workout was built. It returns
+// sql.ErrNoRows if the session was already finished.
+func (s *PostgresLiveSessionStore) FinishSession(sessionID int64, toWorkout func(*LiveSession, time.Time) *Workout) (*Workout, error) {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	UPDATE live_sessions
+	SET finished_at = CURRENT_TIMESTAMP, rest_ends_at = NULL
+	WHERE id = $1 AND finished_at IS NULL
+	RETURNING finished_at
+	`
+
+	var finishedAt time.Time
+
+	err = tx.QueryRow(query, sessionID).Scan(&finishedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := getSession(tx, sessionID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	workout := toWorkout(session, finishedAt)
+
+	err = insertWorkouts(tx, []*Workout{workout})
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`UPDATE live_sessions SET workout_id = $2 WHERE id = $1`, sessionID, workout.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = notifyLive(tx, LiveSessionEvent{Type: LiveEventSessionFinished, SessionID: sessionID, Data: map[string]int{"workout_id": workout.ID}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return workout, nil
+}
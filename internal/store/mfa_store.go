@@ -0,0 +1,347 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/tokens"
+)
+
+const (
+	EventMFAEnabled  = "user.mfa_enabled"
+	EventMFADisabled = "user.mfa_disabled"
+)
+
+// ErrTOTPEnabled is returned when enrolling a user who already has a
+// confirmed authenticator.
+var ErrTOTPEnabled = errors.New("totp is already enabled")
+
+// TOTP is a user's authenticator enrollment.
+type TOTP struct {
+	UserID       int
+	Secret       string
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+// Enabled reports whether the enrollment was confirmed, which is when
+// logins start asking for a code.
+func (t *TOTP) Enabled() bool {
+	return t != nil && t.ConfirmedAt != nil
+}
+
+type PostgresMFAStore struct {
+	db *sql.DB
+}
+
+func NewPostgresMFAStore(db *sql.DB) *PostgresMFAStore {
+	return &PostgresMFAStore{db: db}
+}
+
+type MFAStore interface {
+	GetTOTP(userID int) (*TOTP, error)
+	StartTOTPEnrollment(userID int, secret string) error
+	ConfirmTOTP(userID int, step int64, recoveryCodes []string) error
+	DisableTOTP(userID int) error
+	UseTOTPStep(userID int, step int64) (bool, error)
+	UseRecoveryCode(userID int, code string) (bool, error)
+	ReplaceRecoveryCodes(userID int, recoveryCodes []string) error
+	CountRecoveryCodes(userID int) (int, error)
+	RecordMFAFailure(userID int, limit int) (bool, error)
+}
+
+// GetTOTP returns the user's enrollment, confirmed or not, or nil if they
+// have none.
+func (s *PostgresMFAStore) GetTOTP(userID int) (*TOTP, error) {
+	query := `
+	SELECT user_id, secret, confirmed_at, last_used_step, created_at
+	FROM user_totp
+	WHERE user_id = $1`
+
+	t := &TOTP{}
+
+	err := s.db.QueryRow(query, userID).Scan(&t.UserID, &t.Secret, &t.ConfirmedAt, &t.LastUsedStep, &t.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// StartTOTPEnrollment stores a new, unconfirmed secret for the user,
+// replacing any earlier enrollment they didn't confirm.
+func (s *PostgresMFAStore) StartTOTPEnrollment(userID int, secret string) error {
+	query := `
+	INSERT INTO user_totp (user_id, secret)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET secret = EXCLUDED.secret, last_used_step = 0, failed_attempts = 0, created_at = CURRENT_TIMESTAMP
+	WHERE user_totp.confirmed_at IS NULL`
+
+	result, err := s.db.Exec(query, userID, secret)
+
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrTOTPEnabled
+	}
+
+	return nil
+}
+
+// ConfirmTOTP turns on the user's pending enrollment once they have sent a
+// code from step, and gives them recoveryCodes in place of any they had.
+// It returns sql.ErrNoRows if there is no pending enrollment.
+func (s *PostgresMFAStore) ConfirmTOTP(userID int, step int64, recoveryCodes []string) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	UPDATE user_totp
+	SET confirmed_at = CURRENT_TIMESTAMP, last_used_step = $2
+	WHERE user_id = $1 AND confirmed_at IS NULL AND last_used_step < $2`
+
+	result, err := tx.Exec(query, userID, step)
+
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	err = replaceRecoveryCodes(tx, userID, recoveryCodes)
+
+	if err != nil {
+		return err
+	}
+
+	err = recordEvents(tx, tokenEvent(EventMFAEnabled, userID, map[string]any{
+		"user_id": userID,
+		"method":  "totp",
+	}))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP removes the user's enrollment and recovery codes, along with
+// any login waiting on a second factor. It returns sql.ErrNoRows if the
+// user has no enrollment.
+func (s *PostgresMFAStore) DisableTOTP(userID int) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var confirmed bool
+
+	err = tx.QueryRow(`DELETE FROM user_totp WHERE user_id = $1 RETURNING confirmed_at IS NOT NULL`, userID).Scan(&confirmed)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+
+	if err != nil {
+		return err
+	}
+
+	err = deleteAllTokensForUser(tx, userID, tokens.ScopeMFAPending)
+
+	if err != nil {
+		return err
+	}
+
+	// dropping an enrollment that was never confirmed changes nothing
+	if confirmed {
+		err = recordEvents(tx, tokenEvent(EventMFADisabled, userID, map[string]any{
+			"user_id": userID,
+			"method":  "totp",
+		}))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a code from step was accepted. It reports false
+// if a code from that step or a later one was already used, so the same
+// code can't log in twice.
+func (s *PostgresMFAStore) UseTOTPStep(userID int, step int64) (bool, error) {
+	query := `
+	UPDATE user_totp
+	SET last_used_step = $2, failed_attempts = 0
+	WHERE user_id = $1 AND confirmed_at IS NOT NULL AND last_used_step < $2`
+
+	result, err := s.db.Exec(query, userID, step)
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return n == 1, err
+}
+
+// UseRecoveryCode spends one of the user's recovery codes. It reports
+// false if the code is wrong or was already used.
+func (s *PostgresMFAStore) UseRecoveryCode(userID int, code string) (bool, error) {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	UPDATE recovery_codes
+	SET used_at = CURRENT_TIMESTAMP
+	WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+
+	result, err := tx.Exec(query, userID, tokens.HashRecoveryCode(code))
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`UPDATE user_totp SET failed_attempts = 0 WHERE user_id = $1`, userID)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// ReplaceRecoveryCodes gives the user a fresh set of recovery codes; the
+// old ones stop working.
+func (s *PostgresMFAStore) ReplaceRecoveryCodes(userID int, recoveryCodes []string) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = replaceRecoveryCodes(tx, userID, recoveryCodes)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(q querier, userID int, recoveryCodes []string) error {
+	_, err := q.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = q.Exec(`INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, tokens.HashRecoveryCode(code))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CountRecoveryCodes is how many unused recovery codes the user has left.
+func (s *PostgresMFAStore) CountRecoveryCodes(userID int) (int, error) {
+	var n int
+
+	err := s.db.QueryRow(`SELECT count(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL`, userID).Scan(&n)
+
+	return n, err
+}
+
+// RecordMFAFailure counts a wrong second factor. Once the user reaches
+// limit failures in a row, every login waiting on a second factor is
+// revoked, so guessing has to start over from the password, and it
+// reports true.
+func (s *PostgresMFAStore) RecordMFAFailure(userID int, limit int) (bool, error) {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	var failures int
+
+	err = tx.QueryRow(`UPDATE user_totp SET failed_attempts = failed_attempts + 1 WHERE user_id = $1 RETURNING failed_attempts`, userID).Scan(&failures)
+
+	if err != nil {
+		return false, err
+	}
+
+	if failures < limit {
+		return false, tx.Commit()
+	}
+
+	_, err = tx.Exec(`UPDATE user_totp SET failed_attempts = 0 WHERE user_id = $1`, userID)
+
+	if err != nil {
+		return false, err
+	}
+
+	err = deleteAllTokensForUser(tx, userID, tokens.ScopeMFAPending)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
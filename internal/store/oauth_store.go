@@ -0,0 +1,703 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/tokens"
+)
+
+const (
+	EventOAuthClientCreated = "oauth_client.created"
+	EventOAuthClientDeleted = "oauth_client.deleted"
+	EventOAuthAuthorized    = "oauth.authorized"
+	EventOAuthRevoked       = "oauth.revoked"
+)
+
+// Kinds of token the OAuth server issues.
+const (
+	OAuthAccessToken  = "access"
+	OAuthRefreshToken = "refresh"
+)
+
+var (
+	// ErrAuthorizationCodeReused is returned when a code is redeemed a
+	// second time. Whoever has it may have stolen it, so the tokens the
+	// first redemption issued are revoked.
+	ErrAuthorizationCodeReused = errors.New("authorization code reused")
+	// ErrInvalidScope is returned when a refresh asks for scopes the
+	// grant doesn't have.
+	ErrInvalidScope = errors.New("invalid scope")
+)
+
+// OAuthClient is a third party app registered to use the OAuth server.
+type OAuthClient struct {
+	ID           int64     `json:"id"`
+	ClientID     string    `json:"client_id"`
+	UserID       int       `json:"-"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	Confidential bool      `json:"confidential"`
+	SecretHash   []byte    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// HasRedirectURI reports whether uri is one the client registered. Only
+// exact matches count.
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+// AllowsScopes reports whether the client may ask for every one of scopes.
+func (c *OAuthClient) AllowsScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !slices.Contains(c.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// OAuthRequest is an authorization request waiting for the user's consent.
+type OAuthRequest struct {
+	ID            string
+	ClientID      string
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+	Nonce         string
+	ExpiresAt     time.Time
+}
+
+// AuthorizationCode is what a user consented to, until the client trades
+// it for tokens. Its id is the id of the grant those tokens belong to.
+type AuthorizationCode struct {
+	ID            int64
+	ClientID      string
+	UserID        int
+	RedirectURI   string
+	Scopes        []string
+	CodeChallenge string
+	Nonce         string
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+}
+
+// OAuthToken is an access or refresh token issued to a client.
+type OAuthToken struct {
+	ID        int64
+	Kind      string
+	GrantID   int64
+	ClientID  string
+	UserID    int
+	Scopes    []string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+func (t *OAuthToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// OAuthTokenPair is what the token endpoint hands a client.
+type OAuthTokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	AccessExpiry time.Time
+	GrantID      int64
+	UserID       int
+	Scopes       []string
+}
+
+type PostgresOAuthStore struct {
+	db *sql.DB
+}
+
+func NewPostgresOAuthStore(db *sql.DB) *PostgresOAuthStore {
+	return &PostgresOAuthStore{db: db}
+}
+
+type OAuthStore interface {
+	CreateOAuthClient(client *OAuthClient) error
+	GetOAuthClients(userID int) ([]OAuthClient, error)
+	GetOAuthClient(clientID string) (*OAuthClient, error)
+	DeleteOAuthClient(userID int, id int64) error
+	CreateOAuthRequest(req *OAuthRequest) error
+	GetOAuthRequest(id string) (*OAuthRequest, error)
+	ConsumeOAuthRequest(id string) (*OAuthRequest, error)
+	CreateAuthorizationCode(code *AuthorizationCode, hash []byte) error
+	RedeemAuthorizationCode(hash []byte) (*AuthorizationCode, error)
+	IssueOAuthTokens(code *AuthorizationCode, accessTTL, refreshTTL time.Duration) (*OAuthTokenPair, error)
+	RefreshOAuthTokens(refreshPlainText, clientID string, scopes []string, accessTTL, refreshTTL time.Duration) (*OAuthTokenPair, error)
+	GetOAuthToken(plaintext string) (*OAuthToken, error)
+	GetUserByOAuthToken(plaintext string) (*User, *OAuthToken, error)
+	RevokeOAuthToken(plaintext, clientID string) error
+	PurgeExpiredOAuth(now time.Time) (int64, error)
+}
+
+func oauthClientEvent(eventType string, client *OAuthClient) domainEvent {
+	return domainEvent{
+		aggregateType: AggregateUser,
+		aggregateID:   int64(client.UserID),
+		userID:        client.UserID,
+		eventType:     eventType,
+		data: map[string]any{
+			"id":        client.ID,
+			"client_id": client.ClientID,
+			"name":      client.Name,
+		},
+	}
+}
+
+func (s *PostgresOAuthStore) CreateOAuthClient(client *OAuthClient) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO oauth_clients (client_id, secret_hash, user_id, name, redirect_uris, scopes)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`
+
+	err = tx.QueryRow(query, client.ClientID, client.SecretHash, client.UserID, client.Name, client.RedirectURIs, client.Scopes).Scan(&client.ID, &client.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	client.Confidential = client.SecretHash != nil
+
+	err = recordEvents(tx, oauthClientEvent(EventOAuthClientCreated, client))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const oauthClientColumns = `id, client_id, user_id, name, to_json(redirect_uris), to_json(scopes), secret_hash, created_at`
+
+func scanOAuthClient(row interface{ Scan(...any) error }, client *OAuthClient) error {
+	var redirectURIs, scopes []byte
+
+	err := row.Scan(&client.ID, &client.ClientID, &client.UserID, &client.Name, &redirectURIs, &scopes, &client.SecretHash, &client.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	client.Confidential = client.SecretHash != nil
+
+	if err := json.Unmarshal(redirectURIs, &client.RedirectURIs); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(scopes, &client.Scopes)
+}
+
+func (s *PostgresOAuthStore) GetOAuthClients(userID int) ([]OAuthClient, error) {
+	rows, err := s.db.Query(`SELECT `+oauthClientColumns+` FROM oauth_clients WHERE user_id = $1 ORDER BY id`, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	clients := []OAuthClient{}
+
+	for rows.Next() {
+		var client OAuthClient
+
+		if err := scanOAuthClient(rows, &client); err != nil {
+			return nil, err
+		}
+
+		clients = append(clients, client)
+	}
+
+	return clients, rows.Err()
+}
+
+func (s *PostgresOAuthStore) GetOAuthClient(clientID string) (*OAuthClient, error) {
+	client := &OAuthClient{}
+
+	err := scanOAuthClient(s.db.QueryRow(`SELECT `+oauthClientColumns+` FROM oauth_clients WHERE client_id = $1`, clientID), client)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// DeleteOAuthClient removes a client along with every token issued to it.
+// It returns sql.ErrNoRows if the user has no such client.
+func (s *PostgresOAuthStore) DeleteOAuthClient(userID int, id int64) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	client := &OAuthClient{}
+
+	err = scanOAuthClient(tx.QueryRow(`DELETE FROM oauth_clients WHERE id = $1 AND user_id = $2 RETURNING `+oauthClientColumns, id, userID), client)
+
+	if err != nil {
+		return err
+	}
+
+	err = recordEvents(tx, oauthClientEvent(EventOAuthClientDeleted, client))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresOAuthStore) CreateOAuthRequest(req *OAuthRequest) error {
+	query := `
+	INSERT INTO oauth_requests (id, client_id, redirect_uri, scopes, state, code_challenge, nonce, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	_, err := s.db.Exec(query, req.ID, req.ClientID, req.RedirectURI, req.Scopes, req.State, req.CodeChallenge, req.Nonce, req.ExpiresAt)
+	return err
+}
+
+const oauthRequestColumns = `id, client_id, redirect_uri, to_json(scopes), state, code_challenge, nonce, expires_at`
+
+func scanOAuthRequest(row *sql.Row) (*OAuthRequest, error) {
+	req := &OAuthRequest{}
+	var scopes []byte
+
+	err := row.Scan(&req.ID, &req.ClientID, &req.RedirectURI, &scopes, &req.State, &req.CodeChallenge, &req.Nonce, &req.ExpiresAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return req, json.Unmarshal(scopes, &req.Scopes)
+}
+
+// GetOAuthRequest returns an unexpired authorization request, or nil.
+func (s *PostgresOAuthStore) GetOAuthRequest(id string) (*OAuthRequest, error) {
+	return scanOAuthRequest(s.db.QueryRow(`SELECT `+oauthRequestColumns+` FROM oauth_requests WHERE id = $1 AND expires_at > $2`, id, time.Now()))
+}
+
+// ConsumeOAuthRequest deletes an unexpired authorization request so the
+// user can only answer it once, and returns it. It returns nil if there
+// was no such request.
+func (s *PostgresOAuthStore) ConsumeOAuthRequest(id string) (*OAuthRequest, error) {
+	return scanOAuthRequest(s.db.QueryRow(`DELETE FROM oauth_requests WHERE id = $1 AND expires_at > $2 RETURNING `+oauthRequestColumns, id, time.Now()))
+}
+
+func (s *PostgresOAuthStore) CreateAuthorizationCode(code *AuthorizationCode, hash []byte) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, nonce, auth_time, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	RETURNING id`
+
+	err = tx.QueryRow(query, hash, code.ClientID, code.UserID, code.RedirectURI, code.Scopes, code.CodeChallenge, code.Nonce, code.AuthTime, code.ExpiresAt).Scan(&code.ID)
+
+	if err != nil {
+		return err
+	}
+
+	err = recordEvents(tx, tokenEvent(EventOAuthAuthorized, code.UserID, map[string]any{
+		"user_id":   code.UserID,
+		"client_id": code.ClientID,
+		"scopes":    code.Scopes,
+		"grant_id":  code.ID,
+	}))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RedeemAuthorizationCode marks an unexpired code used and returns it. It
+// returns nil if the code is unknown or expired, and
+// ErrAuthorizationCodeReused, after revoking the grant, if it was used
+// before.
+func (s *PostgresOAuthStore) RedeemAuthorizationCode(hash []byte) (*AuthorizationCode, error) {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	SELECT id, client_id, user_id, redirect_uri, to_json(scopes), code_challenge, nonce, auth_time, expires_at, used_at IS NOT NULL
+	FROM oauth_codes
+	WHERE hash = $1 AND expires_at > $2
+	FOR UPDATE`
+
+	code := &AuthorizationCode{}
+	var scopes []byte
+	var used bool
+
+	err = tx.QueryRow(query, hash, time.Now()).Scan(
+		&code.ID,
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		&scopes,
+		&code.CodeChallenge,
+		&code.Nonce,
+		&code.AuthTime,
+		&code.ExpiresAt,
+		&used,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if used {
+		err = revokeOAuthGrant(tx, code.UserID, code.ClientID, code.ID, "authorization_code_reused")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+
+		return nil, ErrAuthorizationCodeReused
+	}
+
+	_, err = tx.Exec(`UPDATE oauth_codes SET used_at = CURRENT_TIMESTAMP WHERE id = $1`, code.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(scopes, &code.Scopes); err != nil {
+		return nil, err
+	}
+
+	return code, tx.Commit()
+}
+
+// revokeOAuthGrant deletes every token issued through one authorization.
+func revokeOAuthGrant(q querier, userID int, clientID string, grantID int64, reason string) error {
+	result, err := q.Exec(`DELETE FROM oauth_tokens WHERE grant_id = $1`, grantID)
+
+	if err != nil {
+		return err
+	}
+
+	revoked, err := result.RowsAffected()
+
+	if err != nil || revoked == 0 {
+		return err
+	}
+
+	return recordEvents(q, tokenEvent(EventOAuthRevoked, userID, map[string]any{
+		"user_id":   userID,
+		"client_id": clientID,
+		"grant_id":  grantID,
+		"count":     revoked,
+		"reason":    reason,
+	}))
+}
+
+func insertOAuthTokens(q querier, grantID int64, clientID string, userID int, scopes []string, accessTTL, refreshTTL time.Duration) (*OAuthTokenPair, error) {
+	pair := &OAuthTokenPair{
+		AccessExpiry: time.Now().Add(accessTTL),
+		GrantID:      grantID,
+		UserID:       userID,
+		Scopes:       scopes,
+	}
+
+	query := `
+	INSERT INTO oauth_tokens (hash, kind, grant_id, client_id, user_id, scopes, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	tokensToIssue := []struct {
+		kind      string
+		prefix    string
+		expiry    time.Time
+		plaintext *string
+	}{
+		{OAuthAccessToken, tokens.OAuthAccessTokenPrefix, pair.AccessExpiry, &pair.AccessToken},
+		{OAuthRefreshToken, tokens.OAuthRefreshTokenPrefix, time.Now().Add(refreshTTL), &pair.RefreshToken},
+	}
+
+	for _, t := range tokensToIssue {
+		plaintext, hash, err := tokens.GenerateOAuthSecret(t.prefix)
+
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = q.Exec(query, hash, t.kind, grantID, clientID, userID, scopes, t.expiry)
+
+		if err != nil {
+			return nil, err
+		}
+
+		*t.plaintext = plaintext
+	}
+
+	return pair, nil
+}
+
+// IssueOAuthTokens issues the first access and refresh token of the grant
+// code started.
+func (s *PostgresOAuthStore) IssueOAuthTokens(code *AuthorizationCode, accessTTL, refreshTTL time.Duration) (*OAuthTokenPair, error) {
+	return insertOAuthTokens(s.db, code.ID, code.ClientID, code.UserID, code.Scopes, accessTTL, refreshTTL)
+}
+
+// RefreshOAuthTokens trades a client's refresh token for a new pair. The
+// new tokens have scopes, which must be a subset of the grant's, or the
+// grant's own if scopes is empty. A refresh token works once: using it
+// again revokes the grant, as with login refresh tokens.
+func (s *PostgresOAuthStore) RefreshOAuthTokens(refreshPlainText, clientID string, scopes []string, accessTTL, refreshTTL time.Duration) (*OAuthTokenPair, error) {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	SELECT id, grant_id, user_id, to_json(scopes), used_at IS NOT NULL
+	FROM oauth_tokens
+	WHERE hash = $1 AND kind = $2 AND client_id = $3 AND expires_at > $4
+	FOR UPDATE`
+
+	var id, grantID int64
+	var userID int
+	var grantScopes []byte
+	var used bool
+
+	err = tx.QueryRow(query, tokens.HashOAuthSecret(refreshPlainText), OAuthRefreshToken, clientID, time.Now()).Scan(&id, &grantID, &userID, &grantScopes, &used)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if used {
+		err = revokeOAuthGrant(tx, userID, clientID, grantID, "refresh_token_reused")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+
+		return nil, ErrRefreshTokenReused
+	}
+
+	var granted []string
+
+	if err := json.Unmarshal(grantScopes, &granted); err != nil {
+		return nil, err
+	}
+
+	if len(scopes) == 0 {
+		scopes = granted
+	}
+
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			return nil, ErrInvalidScope
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE oauth_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = $1`, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := insertOAuthTokens(tx, grantID, clientID, userID, scopes, accessTTL, refreshTTL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pair, tx.Commit()
+}
+
+const oauthTokenColumns = `t.id, t.kind, t.grant_id, t.client_id, t.user_id, to_json(t.scopes), t.expires_at, t.created_at`
+
+func scanOAuthToken(row interface{ Scan(...any) error }, token *OAuthToken, extra ...any) error {
+	var scopes []byte
+
+	dest := append([]any{&token.ID, &token.Kind, &token.GrantID, &token.ClientID, &token.UserID, &scopes, &token.ExpiresAt, &token.CreatedAt}, extra...)
+
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(scopes, &token.Scopes)
+}
+
+// GetOAuthToken returns an access token or unused refresh token that
+// hasn't expired, or nil.
+func (s *PostgresOAuthStore) GetOAuthToken(plaintext string) (*OAuthToken, error) {
+	query := `SELECT ` + oauthTokenColumns + ` FROM oauth_tokens t WHERE t.hash = $1 AND t.expires_at > $2 AND t.used_at IS NULL`
+
+	token := &OAuthToken{}
+
+	err := scanOAuthToken(s.db.QueryRow(query, tokens.HashOAuthSecret(plaintext), time.Now()), token)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// GetUserByOAuthToken returns the user an unexpired access token acts for,
+// along with the token. It returns nils for anything else.
+func (s *PostgresOAuthStore) GetUserByOAuthToken(plaintext string) (*User, *OAuthToken, error) {
+	query := `
+	SELECT ` + oauthTokenColumns + `,
+		u.username, u.email, u.password_hash, coalesce(u.bio, ''), u.is_admin, u.email_verified_at, u.created_at, u.updated_at
+	FROM oauth_tokens t
+	INNER JOIN users u ON u.id = t.user_id
+	WHERE t.hash = $1 AND t.kind = $2 AND t.expires_at > $3`
+
+	token := &OAuthToken{}
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	err := scanOAuthToken(s.db.QueryRow(query, tokens.HashOAuthSecret(plaintext), OAuthAccessToken, time.Now()), token,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash.hash,
+		&user.Bio,
+		&user.IsAdmin,
+		&user.EmailVerifiedAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user.ID = token.UserID
+
+	return user, token, nil
+}
+
+// RevokeOAuthToken revokes one of a client's tokens. Revoking a refresh
+// token revokes its whole grant; revoking an access token only that
+// token. Unknown tokens are ignored, as RFC 7009 asks.
+func (s *PostgresOAuthStore) RevokeOAuthToken(plaintext, clientID string) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	token := &OAuthToken{}
+
+	err = scanOAuthToken(tx.QueryRow(`SELECT `+oauthTokenColumns+` FROM oauth_tokens t WHERE t.hash = $1 AND t.client_id = $2`, tokens.HashOAuthSecret(plaintext), clientID), token)
+
+	if err == sql.ErrNoRows {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if token.Kind == OAuthRefreshToken {
+		err = revokeOAuthGrant(tx, token.UserID, clientID, token.GrantID, "revoked")
+	} else {
+		_, err = tx.Exec(`DELETE FROM oauth_tokens WHERE id = $1`, token.ID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeExpiredOAuth deletes expired authorization requests, codes and
+// tokens. They stopped working when they expired, so no event is
+// recorded.
+func (s *PostgresOAuthStore) PurgeExpiredOAuth(now time.Time) (int64, error) {
+	var purged int64
+
+	for _, table := range []string{"oauth_requests", "oauth_codes", "oauth_tokens"} {
+		result, err := s.db.Exec(`DELETE FROM `+table+` WHERE expires_at < $1`, now)
+
+		if err != nil {
+			return purged, err
+		}
+
+		n, err := result.RowsAffected()
+
+		if err != nil {
+			return purged, err
+		}
+
+		purged += n
+	}
+
+	return purged, nil
+}
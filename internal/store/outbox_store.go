@@ -0,0 +1,290 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// outboxRelayLock is the advisory lock held while publishing, so only one
+// relay across all instances publishes at a time and events of an
+// aggregate go out in order.
+const outboxRelayLock int64 = 0x6f7574626f78
+
+// DomainEvent is a committed change waiting in, or published from, the
+// outbox. Seq numbers the events of one aggregate from 1 in commit order.
+type DomainEvent struct {
+	ID            int64           `json:"id"`
+	AggregateType string          `json:"aggregate_type"`
+	AggregateID   int64           `json:"aggregate_id"`
+	Seq           int64           `json:"seq"`
+	Type          string          `json:"type"`
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     time.Time       `json:"created_at"`
+	// Attempts counts the earlier failed attempts to publish the event.
+	Attempts int `json:"-"`
+}
+
+type PostgresOutboxStore struct {
+	db *sql.DB
+}
+
+func NewPostgresOutboxStore(db *sql.DB) *PostgresOutboxStore {
+	return &PostgresOutboxStore{db: db}
+}
+
+type OutboxStore interface {
+	PublishOutbox(limit int, publish func(DomainEvent) error, retry func(attempts int) (time.Duration, bool)) (int, error)
+	PurgePublishedOutbox(olderThan time.Time) (int64, error)
+}
+
+type aggregateKey struct {
+	aggregateType string
+	aggregateID   int64
+}
+
+// writeOutbox inserts events into the outbox. The aggregates' counters are
+// locked, in a fixed order, before any outbox id is drawn, so a later
+// transaction on the same aggregate always gets both a higher seq and a
+// higher id and cannot commit first.
+func writeOutbox(q querier, events []domainEvent, payloads [][]byte) error {
+	keys := make([]aggregateKey, 0, len(events))
+	seen := make(map[aggregateKey]bool)
+
+	for _, e := range events {
+		key := aggregateKey{e.aggregateType, e.aggregateID}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].aggregateType != keys[j].aggregateType {
+			return keys[i].aggregateType < keys[j].aggregateType
+		}
+		return keys[i].aggregateID < keys[j].aggregateID
+	})
+
+	// one seq per event, taken in key order
+	counts := make(map[aggregateKey]int64)
+	for _, e := range events {
+		counts[aggregateKey{e.aggregateType, e.aggregateID}]++
+	}
+
+	last := make(map[aggregateKey]int64, len(keys))
+
+	for start := 0; start < len(keys); start += batchChunkSize {
+		chunk := keys[start:min(start+batchChunkSize, len(keys))]
+		args := make([]any, 0, len(chunk)*3)
+
+		for _, key := range chunk {
+			args = append(args, key.aggregateType, key.aggregateID, counts[key])
+		}
+
+		// the subquery fixes the order the counters are locked in
+		query := `
+		SELECT k.aggregate_type, k.aggregate_id, next_outbox_seq(k.aggregate_type, k.aggregate_id)
+		FROM (
+			SELECT v.aggregate_type, v.aggregate_id
+			FROM (VALUES ` + valuesList(len(chunk), 3, 0, []string{"varchar", "bigint", "bigint"}) + `) AS v(aggregate_type, aggregate_id, n)
+			CROSS JOIN generate_series(1, v.n)
+			ORDER BY v.aggregate_type, v.aggregate_id
+		) k`
+
+		rows, err := q.Query(query, args...)
+
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var key aggregateKey
+			var seq int64
+
+			if err := rows.Scan(&key.aggregateType, &key.aggregateID, &seq); err != nil {
+				rows.Close()
+				return err
+			}
+
+			last[key] = max(last[key], seq)
+		}
+
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	// hand the reserved seqs out to the events in the order they happened
+	next := make(map[aggregateKey]int64, len(keys))
+	for key, seq := range last {
+		next[key] = seq - counts[key] + 1
+	}
+
+	for start := 0; start < len(events); start += batchChunkSize {
+		end := min(start+batchChunkSize, len(events))
+		args := make([]any, 0, (end-start)*5)
+
+		for i := start; i < end; i++ {
+			e := events[i]
+			key := aggregateKey{e.aggregateType, e.aggregateID}
+			args = append(args, e.aggregateType, e.aggregateID, next[key], e.eventType, payloads[i])
+			next[key]++
+		}
+
+		query := `
+		INSERT INTO outbox (aggregate_type, aggregate_id, seq, event_type, payload)
+		VALUES ` + valuesList(end-start, 5, 0, nil)
+
+		if _, err := q.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PublishOutbox hands up to limit unpublished events to publish, oldest
+// first, marks the ones it accepted as published and returns how many
+// that was. Once publish fails for an event, later events of the same
+// aggregate are held back until it succeeds. retry is asked, with the
+// number of failed attempts so far, how long to wait before trying the
+// event again; when it gives up the event is dead-lettered and the
+// aggregate's later events go ahead without it. publish runs inside the
+// relay's transaction, so an event is only marked once publish has
+// returned and a crash in between means it is published again. If another
+// relay is busy, nothing is published.
+func (s *PostgresOutboxStore) PublishOutbox(limit int, publish func(DomainEvent) error, retry func(attempts int) (time.Duration, bool)) (int, error) {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	var locked bool
+
+	err = tx.QueryRow(`SELECT pg_try_advisory_xact_lock($1)`, outboxRelayLock).Scan(&locked)
+
+	if err != nil || !locked {
+		return 0, err
+	}
+
+	// events waiting out a retry hold back their aggregate's later events
+	// without taking up the batch
+	query := `
+	SELECT o.id, o.aggregate_type, o.aggregate_id, o.seq, o.event_type, o.payload, o.created_at, o.attempts
+	FROM outbox o
+	WHERE o.published_at IS NULL AND o.dead_at IS NULL
+	AND NOT EXISTS (
+		SELECT 1 FROM outbox w
+		WHERE w.aggregate_type = o.aggregate_type AND w.aggregate_id = o.aggregate_id
+		AND w.published_at IS NULL AND w.dead_at IS NULL
+		AND w.next_attempt_at > CURRENT_TIMESTAMP
+		AND w.id <= o.id
+	)
+	ORDER BY o.id
+	LIMIT $1`
+
+	rows, err := tx.Query(query, limit)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var events []DomainEvent
+
+	for rows.Next() {
+		var event DomainEvent
+
+		err = rows.Scan(&event.ID, &event.AggregateType, &event.AggregateID, &event.Seq, &event.Type, &event.Payload, &event.CreatedAt, &event.Attempts)
+
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		events = append(events, event)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	blocked := make(map[aggregateKey]bool)
+	published := make([]int64, 0, len(events))
+
+	for _, event := range events {
+		key := aggregateKey{event.AggregateType, event.AggregateID}
+
+		if blocked[key] {
+			continue
+		}
+
+		if publishErr := publish(event); publishErr != nil {
+			blocked[key] = true
+
+			err = failOutboxEvent(tx, event, publishErr, retry)
+
+			if err != nil {
+				return 0, err
+			}
+
+			continue
+		}
+
+		published = append(published, event.ID)
+	}
+
+	if len(published) > 0 {
+		_, err = tx.Exec(`UPDATE outbox SET published_at = CURRENT_TIMESTAMP WHERE id = ANY($1)`, published)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return 0, fmt.Errorf("outbox: marking published: %w", err)
+	}
+
+	return len(published), nil
+}
+
+// failOutboxEvent records a failed attempt to publish event and schedules
+// the next one, or dead-letters the event when retry gives up on it.
+func failOutboxEvent(tx *sql.Tx, event DomainEvent, publishErr error, retry func(attempts int) (time.Duration, bool)) error {
+	wait, ok := retry(event.Attempts + 1)
+
+	if !ok {
+		_, err := tx.Exec(`UPDATE outbox SET attempts = attempts + 1, last_error = $2, dead_at = CURRENT_TIMESTAMP WHERE id = $1`, event.ID, publishErr.Error())
+		return err
+	}
+
+	query := `
+	UPDATE outbox
+	SET attempts = attempts + 1, last_error = $2, next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $3)
+	WHERE id = $1`
+
+	_, err := tx.Exec(query, event.ID, publishErr.Error(), wait.Seconds())
+	return err
+}
+
+func (s *PostgresOutboxStore) PurgePublishedOutbox(olderThan time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM outbox WHERE published_at < $1`, olderThan)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
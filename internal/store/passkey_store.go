@@ -0,0 +1,286 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	EventPasskeyAdded   = "passkey.added"
+	EventPasskeyRemoved = "passkey.removed"
+)
+
+// Ceremonies a WebAuthn challenge can be issued for.
+const (
+	CeremonyRegistration   = "registration"
+	CeremonyAuthentication = "authentication"
+)
+
+// ErrPasskeyExists is returned when registering a credential that is
+// already registered.
+var ErrPasskeyExists = errors.New("passkey is already registered")
+
+// Passkey is a WebAuthn credential registered to a user.
+type Passkey struct {
+	ID                int64      `json:"id"`
+	UserID            int        `json:"-"`
+	Name              string     `json:"name"`
+	CredentialID      []byte     `json:"-"`
+	PublicKey         []byte     `json:"-"`
+	SignCount         uint32     `json:"-"`
+	AAGUID            []byte     `json:"-"`
+	AttestationFormat string     `json:"attestation_format"`
+	Transports        []string   `json:"transports"`
+	LastUsedAt        *time.Time `json:"last_used_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+type PostgresPasskeyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresPasskeyStore(db *sql.DB) *PostgresPasskeyStore {
+	return &PostgresPasskeyStore{db: db}
+}
+
+type PasskeyStore interface {
+	CreateChallenge(challenge []byte, ceremony string, userID int, ttl time.Duration) error
+	ConsumeChallenge(challenge []byte, ceremony string) (int, bool, error)
+	DeleteExpiredChallenges(now time.Time) (int64, error)
+	CreatePasskey(passkey *Passkey) error
+	GetPasskeys(userID int) ([]Passkey, error)
+	GetPasskeyByCredentialID(credentialID []byte) (*Passkey, error)
+	UsePasskey(id int64, oldSignCount, newSignCount uint32, usedAt time.Time) (bool, error)
+	DeletePasskey(userID int, id int64) error
+}
+
+// CreateChallenge stores a challenge for one ceremony. userID is 0 for a
+// login, where the user isn't known until the response comes back.
+func (s *PostgresPasskeyStore) CreateChallenge(challenge []byte, ceremony string, userID int, ttl time.Duration) error {
+	query := `
+	INSERT INTO webauthn_challenges (challenge, ceremony, user_id, expires_at)
+	VALUES ($1, $2, $3, $4)`
+
+	var user sql.NullInt64
+	if userID != 0 {
+		user = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+
+	_, err := s.db.Exec(query, challenge, ceremony, user, time.Now().Add(ttl))
+	return err
+}
+
+// ConsumeChallenge deletes an unexpired challenge so it can only be
+// answered once, and returns the user it was issued to. It reports false
+// if there was no such challenge.
+func (s *PostgresPasskeyStore) ConsumeChallenge(challenge []byte, ceremony string) (int, bool, error) {
+	query := `
+	DELETE FROM webauthn_challenges
+	WHERE challenge = $1 AND ceremony = $2 AND expires_at > $3
+	RETURNING user_id`
+
+	var userID sql.NullInt64
+
+	err := s.db.QueryRow(query, challenge, ceremony, time.Now()).Scan(&userID)
+
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	return int(userID.Int64), true, nil
+}
+
+// DeleteExpiredChallenges removes challenges from ceremonies that were
+// never finished.
+func (s *PostgresPasskeyStore) DeleteExpiredChallenges(now time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM webauthn_challenges WHERE expires_at < $1`, now)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func passkeyEvent(eventType string, passkey *Passkey) domainEvent {
+	return domainEvent{
+		aggregateType: AggregateUser,
+		aggregateID:   int64(passkey.UserID),
+		userID:        passkey.UserID,
+		eventType:     eventType,
+		data: map[string]any{
+			"id":   passkey.ID,
+			"name": passkey.Name,
+		},
+	}
+}
+
+func (s *PostgresPasskeyStore) CreatePasskey(passkey *Passkey) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO credentials (user_id, name, credential_id, public_key, sign_count, aaguid, attestation_format, transports)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (credential_id) DO NOTHING
+	RETURNING id, created_at`
+
+	if passkey.Transports == nil {
+		passkey.Transports = []string{}
+	}
+
+	err = tx.QueryRow(query,
+		passkey.UserID,
+		passkey.Name,
+		passkey.CredentialID,
+		passkey.PublicKey,
+		int64(passkey.SignCount),
+		passkey.AAGUID,
+		passkey.AttestationFormat,
+		passkey.Transports,
+	).Scan(&passkey.ID, &passkey.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return ErrPasskeyExists
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = recordEvents(tx, passkeyEvent(EventPasskeyAdded, passkey))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const passkeyColumns = `id, user_id, name, credential_id, public_key, sign_count, aaguid, attestation_format, to_json(transports), last_used_at, created_at`
+
+func scanPasskey(row interface{ Scan(...any) error }, passkey *Passkey) error {
+	var signCount int64
+	var transports []byte
+
+	err := row.Scan(
+		&passkey.ID,
+		&passkey.UserID,
+		&passkey.Name,
+		&passkey.CredentialID,
+		&passkey.PublicKey,
+		&signCount,
+		&passkey.AAGUID,
+		&passkey.AttestationFormat,
+		&transports,
+		&passkey.LastUsedAt,
+		&passkey.CreatedAt,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	passkey.SignCount = uint32(signCount)
+
+	return json.Unmarshal(transports, &passkey.Transports)
+}
+
+func (s *PostgresPasskeyStore) GetPasskeys(userID int) ([]Passkey, error) {
+	rows, err := s.db.Query(`SELECT `+passkeyColumns+` FROM credentials WHERE user_id = $1 ORDER BY id`, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+
+	for rows.Next() {
+		var passkey Passkey
+
+		if err := scanPasskey(rows, &passkey); err != nil {
+			return nil, err
+		}
+
+		passkeys = append(passkeys, passkey)
+	}
+
+	return passkeys, rows.Err()
+}
+
+func (s *PostgresPasskeyStore) GetPasskeyByCredentialID(credentialID []byte) (*Passkey, error) {
+	passkey := &Passkey{}
+
+	err := scanPasskey(s.db.QueryRow(`SELECT `+passkeyColumns+` FROM credentials WHERE credential_id = $1`, credentialID), passkey)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return passkey, nil
+}
+
+// UsePasskey records a login with a passkey and the sign count it came
+// with. It reports false if another login with the passkey got in first,
+// since only one of them can have the next count.
+func (s *PostgresPasskeyStore) UsePasskey(id int64, oldSignCount, newSignCount uint32, usedAt time.Time) (bool, error) {
+	query := `
+	UPDATE credentials
+	SET sign_count = $3, last_used_at = $4
+	WHERE id = $1 AND sign_count = $2`
+
+	result, err := s.db.Exec(query, id, int64(oldSignCount), int64(newSignCount), usedAt)
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return n == 1, err
+}
+
+// DeletePasskey removes a passkey. It returns sql.ErrNoRows if the user
+// has no such passkey.
+func (s *PostgresPasskeyStore) DeletePasskey(userID int, id int64) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	passkey := &Passkey{}
+
+	err = scanPasskey(tx.QueryRow(`DELETE FROM credentials WHERE id = $1 AND user_id = $2 RETURNING `+passkeyColumns, id, userID), passkey)
+
+	if err != nil {
+		return err
+	}
+
+	err = recordEvents(tx, passkeyEvent(EventPasskeyRemoved, passkey))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
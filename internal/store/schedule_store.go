@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	ScheduledRunRunning   = "running"
+	ScheduledRunSucceeded = "succeeded"
+	ScheduledRunFailed    = "failed"
+
+	// schedulerLeaderLock is held by the one replica that runs scheduled
+	// jobs
+	schedulerLeaderLock int64 = 0x7363686564756c65
+)
+
+type ScheduledRun struct {
+	ID           int64      `json:"id"`
+	Name         string     `json:"name"`
+	ScheduledFor time.Time  `json:"scheduled_for"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at"`
+	Status       string     `json:"status"`
+	Result       string     `json:"result"`
+}
+
+type PostgresScheduleStore struct {
+	db *sql.DB
+}
+
+func NewPostgresScheduleStore(db *sql.DB) *PostgresScheduleStore {
+	return &PostgresScheduleStore{db: db}
+}
+
+type ScheduleStore interface {
+	TryLeaderLock(ctx context.Context) (*AdvisoryLock, error)
+	StartScheduledRun(name string, scheduledFor time.Time) (int64, bool, error)
+	FinishScheduledRun(id int64, status, result string) error
+	GetScheduledRuns(name string, limit int) ([]ScheduledRun, error)
+	GetLatestScheduledRuns() ([]ScheduledRun, error)
+	PurgeScheduledRuns(olderThan time.Time) (int64, error)
+}
+
+// TryLeaderLock makes this replica the scheduler leader if there is none,
+// returning nil otherwise.
+func (s *PostgresScheduleStore) TryLeaderLock(ctx context.Context) (*AdvisoryLock, error) {
+	return tryAdvisoryLock(ctx, s.db, schedulerLeaderLock)
+}
+
+// StartScheduledRun records that the run of name due at scheduledFor has
+// started. It returns false if that run was already started, by this or
+// an earlier leader.
+func (s *PostgresScheduleStore) StartScheduledRun(name string, scheduledFor time.Time) (int64, bool, error) {
+	query := `
+	INSERT INTO scheduled_runs (name, scheduled_for)
+	VALUES ($1, $2)
+	ON CONFLICT (name, scheduled_for) DO NOTHING
+	RETURNING id`
+
+	var id int64
+
+	err := s.db.QueryRow(query, name, scheduledFor).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	return id, true, nil
+}
+
+func (s *PostgresScheduleStore) FinishScheduledRun(id int64, status, result string) error {
+	query := `
+	UPDATE scheduled_runs
+	SET status = $2, result = $3, finished_at = CURRENT_TIMESTAMP
+	WHERE id = $1`
+
+	_, err := s.db.Exec(query, id, status, result)
+	return err
+}
+
+const scheduledRunColumns = `id, name, scheduled_for, started_at, finished_at, status, result`
+
+func scanScheduledRuns(rows *sql.Rows) ([]ScheduledRun, error) {
+	defer rows.Close()
+
+	runs := []ScheduledRun{}
+
+	for rows.Next() {
+		var run ScheduledRun
+
+		err := rows.Scan(&run.ID, &run.Name, &run.ScheduledFor, &run.StartedAt, &run.FinishedAt, &run.Status, &run.Result)
+
+		if err != nil {
+			return nil, err
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+func (s *PostgresScheduleStore) GetScheduledRuns(name string, limit int) ([]ScheduledRun, error) {
+	query := `
+	SELECT ` + scheduledRunColumns + `
+	FROM scheduled_runs
+	WHERE name = $1
+	ORDER BY scheduled_for DESC
+	LIMIT $2`
+
+	rows, err := s.db.Query(query, name, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanScheduledRuns(rows)
+}
+
+// GetLatestScheduledRuns returns the most recent run of every job.
+func (s *PostgresScheduleStore) GetLatestScheduledRuns() ([]ScheduledRun, error) {
+	query := `
+	SELECT DISTINCT ON (name) ` + scheduledRunColumns + `
+	FROM scheduled_runs
+	ORDER BY name, scheduled_for DESC`
+
+	rows, err := s.db.Query(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanScheduledRuns(rows)
+}
+
+func (s *PostgresScheduleStore) PurgeScheduledRuns(olderThan time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM scheduled_runs WHERE scheduled_for < $1`, olderThan)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SigningKey is a key the OAuth server signs ID tokens with.
+type SigningKey struct {
+	KID       string
+	Key       *rsa.PrivateKey
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type PostgresSigningKeyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresSigningKeyStore(db *sql.DB) *PostgresSigningKeyStore {
+	return &PostgresSigningKeyStore{db: db}
+}
+
+type SigningKeyStore interface {
+	CreateSigningKey(key *SigningKey) error
+	GetSigningKeys(now time.Time) ([]SigningKey, error)
+	DeleteExpiredSigningKeys(now time.Time) (int64, error)
+}
+
+func (s *PostgresSigningKeyStore) CreateSigningKey(key *SigningKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Key)
+
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO signing_keys (kid, private_key, expires_at)
+	VALUES ($1, $2, $3)
+	RETURNING created_at`
+
+	return s.db.QueryRow(query, key.KID, der, key.ExpiresAt).Scan(&key.CreatedAt)
+}
+
+// GetSigningKeys returns the keys that haven't expired, newest first.
+func (s *PostgresSigningKeyStore) GetSigningKeys(now time.Time) ([]SigningKey, error) {
+	rows, err := s.db.Query(`SELECT kid, private_key, created_at, expires_at FROM signing_keys WHERE expires_at > $1 ORDER BY created_at DESC`, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []SigningKey{}
+
+	for rows.Next() {
+		var key SigningKey
+		var der []byte
+
+		if err := rows.Scan(&key.KID, &der, &key.CreatedAt, &key.ExpiresAt); err != nil {
+			return nil, err
+		}
+
+		parsed, err := x509.ParsePKCS8PrivateKey(der)
+
+		if err != nil {
+			return nil, fmt.Errorf("signing key %s: %w", key.KID, err)
+		}
+
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+
+		if !ok {
+			return nil, fmt.Errorf("signing key %s: not an RSA key", key.KID)
+		}
+
+		key.Key = rsaKey
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *PostgresSigningKeyStore) DeleteExpiredSigningKeys(now time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM signing_keys WHERE expires_at < $1`, now)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,965 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	SyncEntityWorkout = "workout"
+	SyncEntityEntry   = "entry"
+
+	SyncOpUpsert = "upsert"
+	SyncOpDelete = "delete"
+
+	SyncReasonConcurrentUpdate = "concurrent_update"
+	SyncReasonDeleted          = "deleted"
+	SyncReasonNotFound         = "not_found"
+
+	SyncResolutionClientWins = "client_wins"
+	SyncResolutionServerWins = "server_wins"
+)
+
+var (
+	ErrInvalidMutation = errors.New("invalid sync mutation")
+	// ErrFutureChangeToken is returned for a change token past anything
+	// the server has issued, which means the client has state we never
+	// gave it.
+	ErrFutureChangeToken = errors.New("change token is ahead of the server")
+)
+
+type SyncWorkout struct {
+	ID              int    `json:"id"`
+	Title           string `json:"title"`
+	Description     string `json:"description"`
+	DurationMinutes int    `json:"duration_minutes"`
+	CaloriesBurned  int    `json:"calories_burned"`
+	Version         int    `json:"version"`
+	Seq             int64  `json:"seq"`
+}
+
+type SyncEntry struct {
+	WorkoutEntry
+	WorkoutID int   `json:"workout_id"`
+	Seq       int64 `json:"seq"`
+}
+
+type SyncTombstone struct {
+	Entity    string `json:"entity"`
+	ID        int    `json:"id"`
+	WorkoutID int    `json:"workout_id"`
+	Seq       int64  `json:"seq"`
+}
+
+type SyncChanges struct {
+	Seq      int64           `json:"-"`
+	Workouts []SyncWorkout   `json:"workouts"`
+	Entries  []SyncEntry     `json:"entries"`
+	Deleted  []SyncTombstone `json:"deleted"`
+}
+
+// SyncMutation is a change the client made while offline. Records that
+// only exist on the client are sent without an ID and with a ClientID,
+// which the server maps to the ID it assigns. Entries of such a workout
+// point at it through WorkoutClientID.
+type SyncMutation struct {
+	Op              string                     `json:"op"`
+	Entity          string                     `json:"entity"`
+	ID              int                        `json:"id,omitempty"`
+	ClientID        string                     `json:"client_id,omitempty"`
+	WorkoutID       int                        `json:"workout_id,omitempty"`
+	WorkoutClientID string                     `json:"workout_client_id,omitempty"`
+	Fields          map[string]json.RawMessage `json:"fields,omitempty"`
+}
+
+type SyncConflict struct {
+	Entity      string          `json:"entity"`
+	ID          int             `json:"id,omitempty"`
+	ClientID    string          `json:"client_id,omitempty"`
+	Field       string          `json:"field,omitempty"`
+	Reason      string          `json:"reason"`
+	ServerValue json.RawMessage `json:"server_value,omitempty"`
+	ClientValue json.RawMessage `json:"client_value,omitempty"`
+	ServerSeq   int64           `json:"server_seq,omitempty"`
+	Resolution  string          `json:"resolution"`
+}
+
+type SyncIDMapping struct {
+	Entity   string `json:"entity"`
+	ClientID string `json:"client_id"`
+	ID       int    `json:"id"`
+}
+
+type SyncResult struct {
+	Conflicts []SyncConflict  `json:"conflicts"`
+	IDs       []SyncIDMapping `json:"ids"`
+}
+
+type PostgresSyncStore struct {
+	db *sql.DB
+}
+
+func NewPostgresSyncStore(db *sql.DB) *PostgresSyncStore {
+	return &PostgresSyncStore{db: db}
+}
+
+type SyncStore interface {
+	GetChangesSince(userID int, since int64) (*SyncChanges, error)
+	ApplyMutations(userID int, since int64, mutations []SyncMutation, validate func(*Workout) error) (*SyncResult, error)
+}
+
+type fieldDecoder func(json.RawMessage) (any, error)
+
+func decodeString(raw json.RawMessage) (any, error) {
+	var v *string
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return "", nil
+	}
+	return *v, nil
+}
+
+func decodeInt(raw json.RawMessage) (any, error) {
+	var v int
+	err := json.Unmarshal(raw, &v)
+	return v, err
+}
+
+func decodeNullableInt(raw json.RawMessage) (any, error) {
+	var v *int
+	err := json.Unmarshal(raw, &v)
+	return v, err
+}
+
+func decodeNullableFloat(raw json.RawMessage) (any, error) {
+	var v *float64
+	err := json.Unmarshal(raw, &v)
+	return v, err
+}
+
+// the fields a client may sync, keyed by column name
+var workoutSyncFields = map[string]fieldDecoder{
+	"title":            decodeString,
+	"description":      decodeString,
+	"duration_minutes": decodeInt,
+	"calories_burned":  decodeInt,
+}
+
+var entrySyncFields = map[string]fieldDecoder{
+	"exercise_name":    decodeString,
+	"sets":             decodeInt,
+	"reps":             decodeNullableInt,
+	"duration_seconds": decodeNullableInt,
+	"weight":           decodeNullableFloat,
+	"notes":            decodeString,
+	"order_index":      decodeInt,
+}
+
+var requiredWorkoutFields = []string{"title", "duration_minutes"}
+var requiredEntryFields = []string{"exercise_name", "sets", "order_index"}
+
+func decodeFields(entity string, fields map[string]json.RawMessage, decoders map[string]fieldDecoder) (map[string]any, error) {
+	values := make(map[string]any, len(fields))
+
+	for name, raw := range fields {
+		decode, ok := decoders[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown %s field %q", ErrInvalidMutation, entity, name)
+		}
+
+		value, err := decode(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s field %q: %v", ErrInvalidMutation, entity, name, err)
+		}
+
+		values[name] = value
+	}
+
+	return values, nil
+}
+
+func (s *PostgresSyncStore) GetChangesSince(userID int, since int64) (*SyncChanges, error) {
+	// a single snapshot keeps the token consistent with the rows returned
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	changes := &SyncChanges{
+		Workouts: []SyncWorkout{},
+		Entries:  []SyncEntry{},
+		Deleted:  []SyncTombstone{},
+	}
+
+	err = tx.QueryRow(`SELECT coalesce((SELECT seq FROM sync_counters WHERE user_id = $1), 0)`, userID).Scan(&changes.Seq)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if since > changes.Seq {
+		return nil, ErrFutureChangeToken
+	}
+
+	if since == changes.Seq {
+		return changes, tx.Commit()
+	}
+
+	workoutQuery := `
+	SELECT id, title, coalesce(description, ''), duration_minutes, coalesce(calories_burned, 0), version, sync_seq
+	FROM workouts
+	WHERE user_id = $1 AND sync_seq > $2 AND deleted_at IS NULL
+	ORDER BY sync_seq
+	`
+
+	rows, err := tx.Query(workoutQuery, userID, since)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var w SyncWorkout
+
+		err = rows.Scan(&w.ID, &w.Title, &w.Description, &w.DurationMinutes, &w.CaloriesBurned, &w.Version, &w.Seq)
+
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		changes.Workouts = append(changes.Workouts, w)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// a changed workout brings all of its entries along, which covers a
+	// workout coming back out of the trash with entries the client dropped
+	entryQuery := `
+	SELECT e.id, e.workout_id, e.exercise_name, e.sets, e.reps, e.duration_seconds, e.weight, coalesce(e.notes, ''), e.order_index, e.sync_seq
+	FROM workout_entries e
+	INNER JOIN workouts w ON w.id = e.workout_id
+	WHERE w.user_id = $1 AND w.deleted_at IS NULL AND (e.sync_seq > $2 OR w.sync_seq > $2)
+	ORDER BY e.sync_seq
+	`
+
+	rows, err = tx.Query(entryQuery, userID, since)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var e SyncEntry
+
+		err = rows.Scan(&e.ID, &e.WorkoutID, &e.ExerciseName, &e.Sets, &e.Reps, &e.DurationSeconds, &e.Weight, &e.Notes, &e.OrderIndex, &e.Seq)
+
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		changes.Entries = append(changes.Entries, e)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// a client starting from scratch has nothing to delete
+	if since == 0 {
+		return changes, tx.Commit()
+	}
+
+	deletedQuery := `
+	SELECT entity, entity_id, workout_id, seq
+	FROM sync_tombstones
+	WHERE user_id = $1 AND seq > $2
+	UNION ALL
+	SELECT 'workout', id, id, sync_seq
+	FROM workouts
+	WHERE user_id = $1 AND deleted_at IS NOT NULL AND sync_seq > $2
+	ORDER BY 4
+	`
+
+	rows, err = tx.Query(deletedQuery, userID, since)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var t SyncTombstone
+
+		err = rows.Scan(&t.Entity, &t.ID, &t.WorkoutID, &t.Seq)
+
+		if err != nil {
+			return nil, err
+		}
+
+		changes.Deleted = append(changes.Deleted, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, tx.Commit()
+}
+
+// syncApplier carries the state of one ApplyMutations call.
+type syncApplier struct {
+	tx       *sql.Tx
+	userID   int
+	since    int64
+	result   *SyncResult
+	validate func(*Workout) error
+
+	// client ids of workouts created in this batch
+	workoutIDs map[string]int
+	// workouts whose version and revision history need a bump at the end
+	touched map[int]bool
+	created map[int]bool
+	// records holds what each touched workout's personal records were
+	// before this sync
+	records map[int][]PersonalRecord
+}
+
+// ApplyMutations applies offline changes in one transaction. Conflicts are
+// settled per field by last writer wins in server sequence order: the
+// mutations arrive after anything already stored, so the client's value is
+// kept and every field the server changed since the client's token is
+// reported with the value that was overwritten. Changes to workouts that
+// are in the trash are refused, since a delete is only undone by restoring.
+// Every upsert is checked with validate against the workout as it would
+// leave it, before anything is written, and one it rejects fails the whole
+// call with ErrInvalidMutation.
+// Nothing is applied for a token from the future.
+func (s *PostgresSyncStore) ApplyMutations(userID int, since int64, mutations []SyncMutation, validate func(*Workout) error) (*SyncResult, error) {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	// locking the counter keeps other writers from moving it until we're
+	// done
+	var seq int64
+
+	err = tx.QueryRow(`SELECT seq FROM sync_counters WHERE user_id = $1 FOR UPDATE`, userID).Scan(&seq)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if since > seq {
+		return nil, ErrFutureChangeToken
+	}
+
+	a := &syncApplier{
+		tx:     tx,
+		userID: userID,
+		since:  since,
+		result: &SyncResult{
+			Conflicts: []SyncConflict{},
+			IDs:       []SyncIDMapping{},
+		},
+		validate:   validate,
+		workoutIDs: make(map[string]int),
+		touched:    make(map[int]bool),
+		created:    make(map[int]bool),
+		records:    make(map[int][]PersonalRecord),
+	}
+
+	for i, m := range mutations {
+		switch {
+		case m.Entity == SyncEntityWorkout && m.Op == SyncOpUpsert:
+			err = a.upsertWorkout(m)
+		case m.Entity == SyncEntityWorkout && m.Op == SyncOpDelete:
+			err = a.deleteWorkout(m)
+		case m.Entity == SyncEntityEntry && m.Op == SyncOpUpsert:
+			err = a.upsertEntry(m)
+		case m.Entity == SyncEntityEntry && m.Op == SyncOpDelete:
+			err = a.deleteEntry(m)
+		default:
+			err = fmt.Errorf("%w: unsupported %s %q", ErrInvalidMutation, m.Entity, m.Op)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("mutation %d: %w", i, err)
+		}
+	}
+
+	ids := make([]int, 0, len(a.touched))
+	for id := range a.touched {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if !a.created[id] {
+			_, err = tx.Exec(`UPDATE workouts SET version = version + 1 WHERE id = $1 AND deleted_at IS NULL`, id)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		workout, err := getWorkout(tx, int64(id))
+		if err != nil {
+			return nil, err
+		}
+
+		if workout == nil {
+			continue
+		}
+
+		err = insertWorkoutRevision(tx, workout)
+		if err != nil {
+			return nil, err
+		}
+
+		eventType := EventWorkoutUpdated
+		if a.created[id] {
+			eventType = EventWorkoutCreated
+		}
+
+		err = recordEvents(tx, workoutEvent(eventType, userID, int64(id), workout))
+		if err != nil {
+			return nil, err
+		}
+
+		err = recordPersonalRecords(tx, userID, int64(id), a.records[id])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return a.result, nil
+}
+
+// lockRow loads a row as JSON together with its per-field sequence numbers
+// and keeps it locked for the rest of the transaction.
+func (a *syncApplier) lockRow(query string, id int) (map[string]json.RawMessage, map[string]int64, error) {
+	var row []byte
+
+	err := a.tx.QueryRow(query, id, a.userID).Scan(&row)
+
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var columns map[string]json.RawMessage
+
+	err = json.Unmarshal(row, &columns)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var seqs map[string]int64
+
+	err = json.Unmarshal(columns["field_seqs"], &seqs)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return columns, seqs, nil
+}
+
+// check validates a workout as it will be once change is written, so a
+// mutation the API would refuse is turned away before it reaches the
+// database.
+func (a *syncApplier) check(workoutID int, change func(*Workout)) error {
+	workout, err := getWorkout(a.tx, int64(workoutID))
+
+	if err != nil {
+		return err
+	}
+
+	if workout == nil {
+		return nil
+	}
+
+	change(workout)
+
+	if err := a.validate(workout); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMutation, err)
+	}
+
+	return nil
+}
+
+// setWorkoutFields copies decoded workout fields onto w.
+func setWorkoutFields(w *Workout, values map[string]any) {
+	for name, value := range values {
+		switch name {
+		case "title":
+			w.Title = value.(string)
+		case "description":
+			w.Description = value.(string)
+		case "duration_minutes":
+			w.DurationMinutes = value.(int)
+		case "calories_burned":
+			w.CaloriesBurned = value.(int)
+		}
+	}
+}
+
+// setEntryFields copies decoded entry fields onto e.
+func setEntryFields(e *WorkoutEntry, values map[string]any) {
+	for name, value := range values {
+		switch name {
+		case "exercise_name":
+			e.ExerciseName = value.(string)
+		case "sets":
+			e.Sets = value.(int)
+		case "reps":
+			e.Reps = value.(*int)
+		case "duration_seconds":
+			e.DurationSeconds = value.(*int)
+		case "weight":
+			e.Weight = value.(*float64)
+		case "notes":
+			e.Notes = value.(string)
+		case "order_index":
+			e.OrderIndex = value.(int)
+		}
+	}
+}
+
+func (a *syncApplier) conflicts(entity string, id int, fields map[string]json.RawMessage, values map[string]any, columns map[string]json.RawMessage, seqs map[string]int64, decoders map[string]fieldDecoder) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		seq := seqs[name]
+		if seq <= a.since {
+			continue
+		}
+
+		serverValue, err := decoders[name](columns[name])
+		if err != nil {
+			return err
+		}
+
+		if reflect.DeepEqual(serverValue, values[name]) {
+			continue
+		}
+
+		a.result.Conflicts = append(a.result.Conflicts, SyncConflict{
+			Entity:      entity,
+			ID:          id,
+			Field:       name,
+			Reason:      SyncReasonConcurrentUpdate,
+			ServerValue: columns[name],
+			ClientValue: fields[name],
+			ServerSeq:   seq,
+			Resolution:  SyncResolutionClientWins,
+		})
+	}
+
+	return nil
+}
+
+func (a *syncApplier) update(table string, id int, values map[string]any) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sets := make([]string, len(names))
+	args := make([]any, 0, len(names)+1)
+
+	// column names come from the sync field whitelists, never from input
+	for i, name := range names {
+		sets[i] = fmt.Sprintf("%s = $%d", name, i+1)
+		args = append(args, values[name])
+	}
+	args = append(args, id)
+
+	query := fmt.Sprintf(`UPDATE %s SET %s, updated_at = CURRENT_TIMESTAMP WHERE id = $%d`, table, strings.Join(sets, ", "), len(args))
+
+	_, err := a.tx.Exec(query, args...)
+	return err
+}
+
+func (a *syncApplier) insert(table string, values map[string]any, extra map[string]any) (int, error) {
+	names := make([]string, 0, len(values)+len(extra))
+	args := make([]any, 0, len(values)+len(extra))
+
+	for _, m := range []map[string]any{values, extra} {
+		keys := make([]string, 0, len(m))
+		for name := range m {
+			keys = append(keys, name)
+		}
+		sort.Strings(keys)
+
+		for _, name := range keys {
+			names = append(names, name)
+			args = append(args, m[name])
+		}
+	}
+
+	placeholders := make([]string, len(names))
+	for i := range names {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	query := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) RETURNING id`, table, strings.Join(names, ", "), strings.Join(placeholders, ", "))
+
+	var id int
+	err := a.tx.QueryRow(query, args...).Scan(&id)
+	return id, err
+}
+
+func requireFields(entity string, values map[string]any, required []string) error {
+	for _, name := range required {
+		if _, ok := values[name]; !ok {
+			return fmt.Errorf("%w: new %s needs %q", ErrInvalidMutation, entity, name)
+		}
+	}
+	return nil
+}
+
+const lockWorkoutQuery = `
+SELECT to_jsonb(w) - 'search_vector'
+FROM workouts w
+WHERE id = $1 AND user_id = $2
+FOR UPDATE
+`
+
+func (a *syncApplier) upsertWorkout(m SyncMutation) error {
+	values, err := decodeFields(SyncEntityWorkout, m.Fields, workoutSyncFields)
+
+	if err != nil {
+		return err
+	}
+
+	if m.ID == 0 {
+		if m.ClientID == "" {
+			return fmt.Errorf("%w: new workout needs a client_id", ErrInvalidMutation)
+		}
+
+		if err := requireFields(SyncEntityWorkout, values, requiredWorkoutFields); err != nil {
+			return err
+		}
+
+		workout := &Workout{UserID: a.userID, Entries: []WorkoutEntry{}}
+		setWorkoutFields(workout, values)
+
+		if err := a.validate(workout); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidMutation, err)
+		}
+
+		id, err := a.insert("workouts", values, map[string]any{"user_id": a.userID})
+
+		if err != nil {
+			return err
+		}
+
+		a.workoutIDs[m.ClientID] = id
+		a.touched[id] = true
+		a.created[id] = true
+		a.result.IDs = append(a.result.IDs, SyncIDMapping{Entity: SyncEntityWorkout, ClientID: m.ClientID, ID: id})
+		return nil
+	}
+
+	columns, seqs, err := a.lockRow(lockWorkoutQuery, m.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if columns == nil {
+		a.reject(SyncEntityWorkout, m, SyncReasonNotFound)
+		return nil
+	}
+
+	if string(columns["deleted_at"]) != "null" {
+		a.reject(SyncEntityWorkout, m, SyncReasonDeleted)
+		return nil
+	}
+
+	err = a.conflicts(SyncEntityWorkout, m.ID, m.Fields, values, columns, seqs, workoutSyncFields)
+
+	if err != nil {
+		return err
+	}
+
+	err = a.check(m.ID, func(w *Workout) { setWorkoutFields(w, values) })
+
+	if err != nil {
+		return err
+	}
+
+	err = a.touch(m.ID)
+
+	if err != nil {
+		return err
+	}
+
+	return a.update("workouts", m.ID, values)
+}
+
+func (a *syncApplier) deleteWorkout(m SyncMutation) error {
+	columns, seqs, err := a.lockRow(lockWorkoutQuery, m.ID)
+
+	if err != nil {
+		return err
+	}
+
+	// already gone is what the client wanted
+	if columns == nil || string(columns["deleted_at"]) != "null" {
+		return nil
+	}
+
+	for _, seq := range seqs {
+		if seq > a.since {
+			a.result.Conflicts = append(a.result.Conflicts, SyncConflict{
+				Entity:     SyncEntityWorkout,
+				ID:         m.ID,
+				Reason:     SyncReasonConcurrentUpdate,
+				ServerSeq:  seq,
+				Resolution: SyncResolutionClientWins,
+			})
+			break
+		}
+	}
+
+	_, err = a.tx.Exec(`UPDATE workouts SET deleted_at = CURRENT_TIMESTAMP, version = version + 1 WHERE id = $1`, m.ID)
+
+	if err != nil {
+		return err
+	}
+
+	return recordEvents(a.tx, workoutEvent(EventWorkoutDeleted, a.userID, int64(m.ID), map[string]int{"id": m.ID}))
+}
+
+const lockEntryQuery = `
+SELECT to_jsonb(e) - 'search_vector' || jsonb_build_object('workout_deleted', w.deleted_at IS NOT NULL)
+FROM workout_entries e
+INNER JOIN workouts w ON w.id = e.workout_id
+WHERE e.id = $1 AND w.user_id = $2
+FOR UPDATE OF e
+`
+
+func (a *syncApplier) upsertEntry(m SyncMutation) error {
+	values, err := decodeFields(SyncEntityEntry, m.Fields, entrySyncFields)
+
+	if err != nil {
+		return err
+	}
+
+	if m.ID == 0 {
+		if m.ClientID == "" {
+			return fmt.Errorf("%w: new entry needs a client_id", ErrInvalidMutation)
+		}
+
+		if err := requireFields(SyncEntityEntry, values, requiredEntryFields); err != nil {
+			return err
+		}
+
+		workoutID := m.WorkoutID
+		if m.WorkoutClientID != "" {
+			id, ok := a.workoutIDs[m.WorkoutClientID]
+			if !ok {
+				return fmt.Errorf("%w: unknown workout_client_id %q", ErrInvalidMutation, m.WorkoutClientID)
+			}
+			workoutID = id
+		}
+
+		var deleted bool
+		err := a.tx.QueryRow(`SELECT deleted_at IS NOT NULL FROM workouts WHERE id = $1 AND user_id = $2 FOR UPDATE`, workoutID, a.userID).Scan(&deleted)
+
+		if err == sql.ErrNoRows {
+			a.reject(SyncEntityEntry, m, SyncReasonNotFound)
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if deleted {
+			a.reject(SyncEntityEntry, m, SyncReasonDeleted)
+			return nil
+		}
+
+		err = a.check(workoutID, func(w *Workout) {
+			var entry WorkoutEntry
+			setEntryFields(&entry, values)
+			w.Entries = append(w.Entries, entry)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		err = a.touch(workoutID)
+
+		if err != nil {
+			return err
+		}
+
+		id, err := a.insert("workout_entries", values, map[string]any{"workout_id": workoutID})
+
+		if err != nil {
+			return err
+		}
+
+		a.result.IDs = append(a.result.IDs, SyncIDMapping{Entity: SyncEntityEntry, ClientID: m.ClientID, ID: id})
+		return nil
+	}
+
+	columns, seqs, err := a.lockRow(lockEntryQuery, m.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if columns == nil {
+		a.reject(SyncEntityEntry, m, SyncReasonNotFound)
+		return nil
+	}
+
+	if string(columns["workout_deleted"]) == "true" {
+		a.reject(SyncEntityEntry, m, SyncReasonDeleted)
+		return nil
+	}
+
+	err = a.conflicts(SyncEntityEntry, m.ID, m.Fields, values, columns, seqs, entrySyncFields)
+
+	if err != nil {
+		return err
+	}
+
+	var workoutID int
+	err = json.Unmarshal(columns["workout_id"], &workoutID)
+
+	if err != nil {
+		return err
+	}
+
+	err = a.check(workoutID, func(w *Workout) {
+		for i := range w.Entries {
+			if w.Entries[i].ID == m.ID {
+				setEntryFields(&w.Entries[i], values)
+			}
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = a.touch(workoutID)
+
+	if err != nil {
+		return err
+	}
+
+	return a.update("workout_entries", m.ID, values)
+}
+
+func (a *syncApplier) deleteEntry(m SyncMutation) error {
+	columns, _, err := a.lockRow(lockEntryQuery, m.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if columns == nil {
+		return nil
+	}
+
+	if string(columns["workout_deleted"]) == "true" {
+		a.reject(SyncEntityEntry, m, SyncReasonDeleted)
+		return nil
+	}
+
+	var workoutID int
+	err = json.Unmarshal(columns["workout_id"], &workoutID)
+
+	if err != nil {
+		return err
+	}
+
+	err = a.touch(workoutID)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = a.tx.Exec(`DELETE FROM workout_entries WHERE id = $1`, m.ID)
+
+	return err
+}
+
+// touch marks a workout as changed by this sync. It has to be called
+// before the change, so the first time it can note the personal records
+// the workout held and only new ones are announced.
+func (a *syncApplier) touch(workoutID int) error {
+	if a.touched[workoutID] {
+		return nil
+	}
+
+	records, err := getPersonalRecords(a.tx, int64(workoutID))
+
+	if err != nil {
+		return err
+	}
+
+	a.touched[workoutID] = true
+	a.records[workoutID] = records
+	return nil
+}
+
+func (a *syncApplier) reject(entity string, m SyncMutation, reason string) {
+	a.result.Conflicts = append(a.result.Conflicts, SyncConflict{
+		Entity:     entity,
+		ID:         m.ID,
+		ClientID:   m.ClientID,
+		Reason:     reason,
+		Resolution: SyncResolutionServerWins,
+	})
+}
@@ -1,12 +1,37 @@
 package store
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/rpstvs/fm-goapp/internal/tokens"
 )
 
+var (
+	// ErrInvalidRefreshToken is returned for a refresh token that is
+	// unknown, expired or revoked.
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token that was
+	// already exchanged is presented again. Either the client or someone
+	// who stole the token is replaying it, so the whole family is revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// Session is a login as its owner sees it: the family of auth and refresh
+// tokens issued at login and by every refresh since, without the tokens.
+type Session struct {
+	ID         int64      `json:"id"`
+	TokenID    int64      `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current"`
+}
+
 type PostgresTokenStore struct {
 	db *sql.DB
 }
@@ -21,6 +46,16 @@ type TokenStore interface {
 	Insert(token *tokens.Token) error
 	CreateNewToken(userId int, ttl time.Duration, scope string) (*tokens.Token, error)
 	DeleteAllTokensForUser(userId int, scope string) error
+	DeleteExpiredTokens(now time.Time) (int64, error)
+	GetRecentTokens(userId int, scope string, ttl, window time.Duration) (int, time.Time, error)
+	CreateSession(userId int, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*tokens.Token, *tokens.Token, error)
+	RefreshSession(refreshPlainText string, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*tokens.Token, *tokens.Token, error)
+	GetSessions(userId int) ([]Session, error)
+	DeleteSession(userId int, id int64) error
+	TouchSession(id int64, usedAt time.Time) error
+	ConsumeToken(scope, tokenPlainText string) (bool, error)
+	ConsumeMagicLink(tokenPlainText, nonce string) (int, error)
+	ConsumeTicket(scope, tokenPlainText string) (int, error)
 }
 
 func (t *PostgresTokenStore) CreateNewToken(userId int, ttl time.Duration, scope string) (*tokens.Token, error) {
@@ -35,21 +70,418 @@ func (t *PostgresTokenStore) CreateNewToken(userId int, ttl time.Duration, scope
 }
 
 func (t *PostgresTokenStore) Insert(token *tokens.Token) error {
+	tx, err := t.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = insertToken(tx, token)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertToken(q querier, token *tokens.Token) error {
 	query := `
-	INSERT INTO tokens (hash, user_id, expiry, scope)
-	VALUES($1,$2,$3,$4)
+	INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, family_id, nonce_hash)
+	VALUES($1,$2,$3,$4,$5,$6,NULLIF($7, 0),$8)
 	`
-	_, err := t.db.Exec(query, token.Hash, token.UserID, token.Expiry, token.Scope)
-	return err
+	_, err := q.Exec(query, token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP, token.FamilyID, token.NonceHash)
+
+	if err != nil {
+		return err
+	}
+
+	return recordEvents(q, tokenEvent(EventTokenIssued, token.UserID, map[string]any{
+		"user_id": token.UserID,
+		"scope":   token.Scope,
+		"expiry":  token.Expiry,
+	}))
+}
+
+// insertTokenPair issues an access and a refresh token in family.
+func insertTokenPair(q querier, userId int, family int64, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*tokens.Token, *tokens.Token, error) {
+	access, err := tokens.GenerateToken(userId, accessTTL, tokens.ScopeAuth)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refresh, err := tokens.GenerateToken(userId, refreshTTL, tokens.ScopeRefresh)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, token := range []*tokens.Token{access, refresh} {
+		token.UserAgent = userAgent
+		token.IP = ip
+		token.FamilyID = family
+
+		if err := insertToken(q, token); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return access, refresh, nil
+}
+
+// CreateSession logs a user in with a short-lived access token and a
+// long-lived refresh token, in a new family.
+func (t *PostgresTokenStore) CreateSession(userId int, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*tokens.Token, *tokens.Token, error) {
+	tx, err := t.db.Begin()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer tx.Rollback()
+
+	// families are numbered from the token ids so they can't clash with
+	// the families of tokens issued before there were refresh tokens,
+	// which are named by their own id
+	var family int64
+
+	err = tx.QueryRow(`SELECT nextval(pg_get_serial_sequence('tokens', 'id'))`).Scan(&family)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, refresh, err := insertTokenPair(tx, userId, family, accessTTL, refreshTTL, userAgent, ip)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, tx.Commit()
+}
+
+// RefreshSession exchanges a refresh token for a new access and refresh
+// token in the same family. The old refresh token is marked used rather
+// than deleted, so if it turns up again ErrRefreshTokenReused is returned
+// and the whole family is revoked.
+func (t *PostgresTokenStore) RefreshSession(refreshPlainText string, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*tokens.Token, *tokens.Token, error) {
+	tokenHash := sha256.Sum256([]byte(refreshPlainText))
+
+	tx, err := t.db.Begin()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	SELECT id, user_id, family_id, used_at IS NOT NULL
+	FROM tokens
+	WHERE hash = $1 AND scope = $2 AND expiry > $3
+	FOR UPDATE
+	`
+
+	var id, family int64
+	var userId int
+	var used bool
+
+	err = tx.QueryRow(query, tokenHash[:], tokens.ScopeRefresh, time.Now()).Scan(&id, &userId, &family, &used)
+
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if used {
+		err = deleteTokenFamily(tx, userId, family, "refresh_token_reused")
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+
+		return nil, nil, ErrRefreshTokenReused
+	}
+
+	_, err = tx.Exec(`UPDATE tokens SET used_at = CURRENT_TIMESTAMP, last_used_at = CURRENT_TIMESTAMP WHERE id = $1`, id)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, refresh, err := insertTokenPair(tx, userId, family, accessTTL, refreshTTL, userAgent, ip)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, tx.Commit()
+}
+
+// deleteTokenFamily revokes every token of one login.
+func deleteTokenFamily(q querier, userId int, family int64, reason string) error {
+	result, err := q.Exec(`DELETE FROM tokens WHERE coalesce(family_id, id) = $1 AND user_id = $2 AND scope IN ($3, $4)`, family, userId, tokens.ScopeAuth, tokens.ScopeRefresh)
+
+	if err != nil {
+		return err
+	}
+
+	revoked, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if revoked == 0 {
+		return sql.ErrNoRows
+	}
+
+	return recordEvents(q, tokenEvent(EventTokensRevoked, userId, map[string]any{
+		"user_id":    userId,
+		"session_id": family,
+		"count":      revoked,
+		"reason":     reason,
+	}))
 }
 
 func (t *PostgresTokenStore) DeleteAllTokensForUser(userId int, scope string) error {
+	tx, err := t.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = deleteAllTokensForUser(tx, userId, scope)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteAllTokensForUser revokes a user's tokens of one scope as part of a
+// larger change.
+func deleteAllTokensForUser(q querier, userId int, scope string) error {
 	query := `
 	DELETE from tokens
 	WHERE scope =$1 AND user_id = $2
 	`
 
-	_, err := t.db.Exec(query, scope, userId)
+	result, err := q.Exec(query, scope, userId)
+
+	if err != nil {
+		return err
+	}
+
+	revoked, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if revoked == 0 {
+		return nil
+	}
+
+	return recordEvents(q, tokenEvent(EventTokensRevoked, userId, map[string]any{
+		"user_id": userId,
+		"scope":   scope,
+		"count":   revoked,
+	}))
+}
+
+// DeleteExpiredTokens removes tokens that expired before now. They already
+// stopped working when they expired, so no event is recorded.
+func (t *PostgresTokenStore) DeleteExpiredTokens(now time.Time) (int64, error) {
+	result, err := t.db.Exec(`DELETE FROM tokens WHERE expiry < $1`, now)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// GetRecentTokens counts the unexpired tokens of a scope issued to a user
+// within window and returns when the latest was issued. Tokens don't
+// record when they were issued, so it is worked out from their expiry and
+// ttl, the lifetime every token of the scope is issued with.
+func (t *PostgresTokenStore) GetRecentTokens(userId int, scope string, ttl, window time.Duration) (int, time.Time, error) {
+	query := `
+	SELECT count(*), max(expiry)
+	FROM tokens
+	WHERE user_id = $1 AND scope = $2 AND expiry > $3
+	`
+
+	var count int
+	var latestExpiry sql.NullTime
+
+	err := t.db.QueryRow(query, userId, scope, time.Now().Add(ttl-window)).Scan(&count, &latestExpiry)
+
+	if err != nil || !latestExpiry.Valid {
+		return 0, time.Time{}, err
+	}
+
+	return count, latestExpiry.Time.Add(-ttl), nil
+}
+
+// GetSessions lists a user's logins that still have an unexpired token,
+// most recently used first.
+func (t *PostgresTokenStore) GetSessions(userId int) ([]Session, error) {
+	query := `
+	SELECT coalesce(family_id, id), min(created_at), max(last_used_at), max(expiry),
+		(array_agg(user_agent ORDER BY id DESC))[1], (array_agg(ip ORDER BY id DESC))[1]
+	FROM tokens
+	WHERE user_id = $1 AND scope IN ($2, $3) AND expiry > $4 AND used_at IS NULL
+	GROUP BY coalesce(family_id, id)
+	ORDER BY coalesce(max(last_used_at), min(created_at)) DESC
+	`
+
+	rows, err := t.db.Query(query, userId, tokens.ScopeAuth, tokens.ScopeRefresh, time.Now())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sessions := []Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err = rows.Scan(&session.ID, &session.CreatedAt, &session.LastUsedAt, &session.Expiry, &session.UserAgent, &session.IP)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
 
+	return sessions, rows.Err()
+}
+
+// DeleteSession revokes every token of one of a user's logins. It returns
+// sql.ErrNoRows if the user has no such session.
+func (t *PostgresTokenStore) DeleteSession(userId int, id int64) error {
+	tx, err := t.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = deleteTokenFamily(tx, userId, id, "revoked")
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TouchSession records that a token was used.
+func (t *PostgresTokenStore) TouchSession(id int64, usedAt time.Time) error {
+	_, err := t.db.Exec(`UPDATE tokens SET last_used_at = $2 WHERE id = $1`, id, usedAt)
 	return err
 }
+
+// ConsumeToken deletes an unexpired token so it can't be used again. It
+// reports false if the token was unknown, expired or already used.
+func (t *PostgresTokenStore) ConsumeToken(scope, tokenPlainText string) (bool, error) {
+	userID, err := t.ConsumeTicket(scope, tokenPlainText)
+	return userID != 0, err
+}
+
+// ConsumeMagicLink deletes an unexpired magic link so it can't be used
+// again and returns the user it logs in. A link bound to a browser only
+// matches with the nonce from that browser. It returns 0 if nothing
+// matched, and a link used with the wrong nonce stays usable.
+func (t *PostgresTokenStore) ConsumeMagicLink(tokenPlainText, nonce string) (int, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	var nonceHash []byte
+	if nonce != "" {
+		nonceHash = tokens.HashNonce(nonce)
+	}
+
+	query := `
+	DELETE FROM tokens
+	WHERE hash = $1 AND scope = $2 AND expiry > $3 AND (nonce_hash IS NULL OR nonce_hash = $4)
+	RETURNING user_id`
+
+	return consumeToken(t.db, tokens.ScopeMagicLink, query, tokenHash[:], tokens.ScopeMagicLink, time.Now(), nonceHash)
+}
+
+// ConsumeTicket deletes an unexpired single-use token so it can't be used
+// again and returns the user it was issued to, or 0 if nothing matched.
+func (t *PostgresTokenStore) ConsumeTicket(scope, tokenPlainText string) (int, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	query := `DELETE FROM tokens WHERE hash = $1 AND scope = $2 AND expiry > $3 RETURNING user_id`
+
+	return consumeToken(t.db, scope, query, tokenHash[:], scope, time.Now())
+}
+
+// consumeToken runs query, a DELETE of at most one token of scope that
+// returns its user_id, and records the token as consumed. It returns 0
+// when nothing was deleted.
+func consumeToken(db *sql.DB, scope, query string, args ...any) (int, error) {
+	tx, err := db.Begin()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	var userID int
+
+	err = tx.QueryRow(query, args...).Scan(&userID)
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = recordEvents(tx, tokenEvent(EventTokenConsumed, userID, map[string]any{
+		"user_id": userID,
+		"scope":   scope,
+	}))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// tokenEvent describes a change to a user's tokens. Tokens have no id of
+// their own to order by, so their events belong to the user.
+func tokenEvent(eventType string, userID int, data any) domainEvent {
+	return domainEvent{
+		aggregateType: AggregateUser,
+		aggregateID:   int64(userID),
+		userID:        userID,
+		eventType:     eventType,
+		data:          data,
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"time"
 
+	"github.com/rpstvs/fm-goapp/internal/tokens"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -46,8 +47,12 @@ type User struct {
 	Email        string
 	PasswordHash password
 	Bio          string
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	IsAdmin      bool
+	// EmailVerifiedAt is nil until the user proves they own Email, and
+	// again after they change it.
+	EmailVerifiedAt *time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
 }
 
 var AnonymousUser = &User{}
@@ -56,6 +61,10 @@ func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
 type PostgresUserStore struct {
 	db *sql.DB
 }
@@ -69,8 +78,13 @@ func NewPostgresUserStore(db *sql.DB) *PostgresUserStore {
 type UserStore interface {
 	CreateUser(*User) error
 	GetUserByUsername(username string) (*User, error)
+	GetUserByID(id int) (*User, error)
+	GetUserByEmail(email string) (*User, error)
 	UpdateUser(*User) error
 	GetUserToken(scope, tokenPlainText string) (*User, error)
+	GetUserSession(tokenPlainText string) (*User, *Session, error)
+	VerifyEmail(tokenPlainText string) (*User, error)
+	ResetPassword(tokenPlainText, newPassword string) (*User, error)
 }
 
 func (s *PostgresUserStore) CreateUser(user *User) error {
@@ -80,13 +94,38 @@ func (s *PostgresUserStore) CreateUser(user *User) error {
 	RETURNING id,created_at, updated_at
 	`
 
-	err := s.db.QueryRow(query, user.Username, user.Email, user.PasswordHash.hash, user.Bio).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	tx, err := s.db.Begin()
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	defer tx.Rollback()
+
+	err = tx.QueryRow(query, user.Username, user.Email, user.PasswordHash.hash, user.Bio).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	err = recordEvents(tx, domainEvent{
+		aggregateType: AggregateUser,
+		aggregateID:   int64(user.ID),
+		userID:        user.ID,
+		eventType:     EventUserRegistered,
+		data: map[string]any{
+			"id":         user.ID,
+			"username":   user.Username,
+			"email":      user.Email,
+			"created_at": user.CreatedAt,
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
@@ -95,7 +134,8 @@ func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
 	}
 
 	query := `
-	SELECT id, username, email, password_hash, bio, created_at, updated_at
+	SELECT id, username, email, password_hash, coalesce(bio, ''), is_admin, email_verified_at, created_at, updated_at
+	FROM users
 	WHERE username = $1`
 
 	err := s.db.QueryRow(query, username).Scan(
@@ -104,15 +144,84 @@ func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
 		&user.Email,
 		&user.PasswordHash.hash,
 		&user.Bio,
+		&user.IsAdmin,
+		&user.EmailVerifiedAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
 
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
 	if err != nil {
-		return &User{}, err
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *PostgresUserStore) GetUserByID(id int) (*User, error) {
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	query := `
+	SELECT id, username, email, password_hash, coalesce(bio, ''), is_admin, email_verified_at, created_at, updated_at
+	FROM users
+	WHERE id = $1`
+
+	err := s.db.QueryRow(query, id).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash.hash,
+		&user.Bio,
+		&user.IsAdmin,
+		&user.EmailVerifiedAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// GetUserByEmail looks a user up by email, ignoring case.
+func (s *PostgresUserStore) GetUserByEmail(email string) (*User, error) {
+	user := &User{
+		PasswordHash: password{},
 	}
 
+	query := `
+	SELECT id, username, email, password_hash, coalesce(bio, ''), is_admin, email_verified_at, created_at, updated_at
+	FROM users
+	WHERE lower(email) = lower($1)`
+
+	err := s.db.QueryRow(query, email).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash.hash,
+		&user.Bio,
+		&user.IsAdmin,
+		&user.EmailVerifiedAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+
 	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
 		return nil, err
 	}
 
@@ -120,36 +229,68 @@ func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
 }
 
 func (s *PostgresUserStore) UpdateUser(user *User) error {
+	// a new email address has to be verified again
 	query := `
-	UPDATE users
-	SET username = $1, email =$2, bio =$3, updated_at = CURRENT_TIMESTAMP
-	WHERE id = $4
-	RETURNING updated_at`
+	WITH old AS (
+		SELECT email FROM users WHERE id = $4 FOR UPDATE
+	)
+	UPDATE users u
+	SET username = $1, email =$2, bio =$3, updated_at = CURRENT_TIMESTAMP,
+		email_verified_at = CASE WHEN old.email = $2 THEN u.email_verified_at END
+	FROM old
+	WHERE u.id = $4
+	RETURNING u.updated_at, u.email_verified_at, old.email <> $2`
 
-	result, err := s.db.Exec(query, user.Username, user.Email, user.Bio, user.ID)
+	tx, err := s.db.Begin()
 
 	if err != nil {
 		return err
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	defer tx.Rollback()
+
+	var emailChanged bool
+
+	err = tx.QueryRow(query, user.Username, user.Email, user.Bio, user.ID).Scan(&user.UpdatedAt, &user.EmailVerifiedAt, &emailChanged)
 
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
+	// links sent to the old address must not verify the new one
+	if emailChanged {
+		_, err = tx.Exec(`DELETE FROM tokens WHERE user_id = $1 AND scope = $2`, user.ID, tokens.ScopeEmailVerification)
+
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	err = recordEvents(tx, domainEvent{
+		aggregateType: AggregateUser,
+		aggregateID:   int64(user.ID),
+		userID:        user.ID,
+		eventType:     EventUserUpdated,
+		data: map[string]any{
+			"id":       user.ID,
+			"username": user.Username,
+			"email":    user.Email,
+			"bio":      user.Bio,
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (s *PostgresTokenStore) GetUserToken(scope, plainTextPassword string) (*User, error) {
+func (s *PostgresUserStore) GetUserToken(scope, plainTextPassword string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(plainTextPassword))
 
 	query := `
-	SELECT u.id, u.username, u.email, u.password_hash, u.bio, u.created_at, u.updated_at
+	SELECT u.id, u.username, u.email, u.password_hash, coalesce(u.bio, ''), u.is_admin, u.email_verified_at, u.created_at, u.updated_at
 	FROM users u
 	INNER JOIN tokens t ON t.user_id = u.id
 	WHERE t.hash = $1 AND t.scope = $2 and t.expiry > $3
@@ -158,18 +299,20 @@ func (s *PostgresTokenStore) GetUserToken(scope, plainTextPassword string) (*Use
 		PasswordHash: password{},
 	}
 
-	err := s.db.QueryRow(query, tokenHash, scope, time.Now()).Scan(
+	err := s.db.QueryRow(query, tokenHash[:], scope, time.Now()).Scan(
 		&user.ID,
 		&user.Username,
 		&user.Email,
 		&user.PasswordHash.hash,
 		&user.Bio,
+		&user.IsAdmin,
+		&user.EmailVerifiedAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
 
 	if err == sql.ErrNoRows {
-		return nil, err
+		return nil, nil
 	}
 
 	if err != nil {
@@ -177,3 +320,206 @@ func (s *PostgresTokenStore) GetUserToken(scope, plainTextPassword string) (*Use
 	}
 	return user, nil
 }
+
+// GetUserSession returns the user an auth token belongs to along with the
+// session it opened. It returns nils if the token is unknown or expired.
+func (s *PostgresUserStore) GetUserSession(tokenPlainText string) (*User, *Session, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	query := `
+	SELECT u.id, u.username, u.email, u.password_hash, coalesce(u.bio, ''), u.is_admin, u.email_verified_at, u.created_at, u.updated_at,
+		t.id, coalesce(t.family_id, t.id), t.created_at, t.last_used_at, t.expiry, t.user_agent, t.ip
+	FROM users u
+	INNER JOIN tokens t ON t.user_id = u.id
+	WHERE t.hash = $1 AND t.scope = $2 and t.expiry > $3
+	`
+	user := &User{
+		PasswordHash: password{},
+	}
+	session := &Session{Current: true}
+
+	err := s.db.QueryRow(query, tokenHash[:], tokens.ScopeAuth, time.Now()).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash.hash,
+		&user.Bio,
+		&user.IsAdmin,
+		&user.EmailVerifiedAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&session.TokenID,
+		&session.ID,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.Expiry,
+		&session.UserAgent,
+		&session.IP,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, session, nil
+}
+
+// VerifyEmail marks the email of the user an email verification token was
+// sent to as verified and uses up the user's verification tokens. It
+// returns nil if the token is unknown or expired.
+func (s *PostgresUserStore) VerifyEmail(tokenPlainText string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	UPDATE users u
+	SET email_verified_at = coalesce(u.email_verified_at, CURRENT_TIMESTAMP)
+	FROM tokens t
+	WHERE t.user_id = u.id AND t.hash = $1 AND t.scope = $2 AND t.expiry > $3
+	RETURNING u.id, u.username, u.email, u.password_hash, coalesce(u.bio, ''), u.is_admin, u.email_verified_at, u.created_at, u.updated_at`
+
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	err = tx.QueryRow(query, tokenHash[:], tokens.ScopeEmailVerification, time.Now()).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash.hash,
+		&user.Bio,
+		&user.IsAdmin,
+		&user.EmailVerifiedAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM tokens WHERE user_id = $1 AND scope = $2`, user.ID, tokens.ScopeEmailVerification)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = recordEvents(tx, domainEvent{
+		aggregateType: AggregateUser,
+		aggregateID:   int64(user.ID),
+		userID:        user.ID,
+		eventType:     EventEmailVerified,
+		data: map[string]any{
+			"id":                user.ID,
+			"email":             user.Email,
+			"email_verified_at": user.EmailVerifiedAt,
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, tx.Commit()
+}
+
+// ResetPassword sets a new password for the user a password reset token
+// was issued to. The token is used up, along with every other reset token
+// and every auth token of the user, so sessions opened with the old
+// password end. It returns nil if the token is unknown, expired or already
+// used.
+func (s *PostgresUserStore) ResetPassword(tokenPlainText, newPassword string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	var hash password
+
+	err := hash.Set(newPassword)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	// deleting the token claims it, so two requests racing with the same
+	// token can't both succeed
+	var userID int
+
+	err = tx.QueryRow(`DELETE FROM tokens WHERE hash = $1 AND scope = $2 AND expiry > $3 RETURNING user_id`, tokenHash[:], tokens.ScopePasswordReset, time.Now()).Scan(&userID)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+	UPDATE users
+	SET password_hash = $2, updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1
+	RETURNING id, username, email, coalesce(bio, ''), is_admin, email_verified_at, created_at, updated_at`
+
+	user := &User{
+		PasswordHash: hash,
+	}
+
+	err = tx.QueryRow(query, userID, hash.hash).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.Bio,
+		&user.IsAdmin,
+		&user.EmailVerifiedAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, scope := range []string{tokens.ScopePasswordReset, tokens.ScopeAuth, tokens.ScopeRefresh, tokens.ScopeMFAPending, tokens.ScopeMagicLink} {
+		err = deleteAllTokensForUser(tx, user.ID, scope)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = recordEvents(tx, domainEvent{
+		aggregateType: AggregateUser,
+		aggregateID:   int64(user.ID),
+		userID:        user.ID,
+		eventType:     EventPasswordReset,
+		data:          map[string]any{"id": user.ID},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, tx.Commit()
+}
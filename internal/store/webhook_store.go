@@ -0,0 +1,394 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const (
+	WebhookPending   = "pending"
+	WebhookSucceeded = "succeeded"
+	WebhookDead      = "dead"
+)
+
+// WebhookEventTypes are the events an endpoint can subscribe to.
+var WebhookEventTypes = []string{
+	EventWorkoutCreated,
+	EventWorkoutUpdated,
+	EventWorkoutDeleted,
+	EventWorkoutRestored,
+	EventPRAchieved,
+	EventUserRegistered,
+	EventEmailVerified,
+}
+
+type WebhookEndpoint struct {
+	ID          int64     `json:"id"`
+	URL         string    `json:"url"`
+	Description string    `json:"description"`
+	Secret      string    `json:"-"`
+	EventTypes  []string  `json:"event_types"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type WebhookDelivery struct {
+	ID            int64                    `json:"id"`
+	EndpointID    int64                    `json:"endpoint_id"`
+	EventType     string                   `json:"event_type"`
+	Payload       json.RawMessage          `json:"payload"`
+	Status        string                   `json:"status"`
+	Attempts      int                      `json:"attempts"`
+	NextAttemptAt time.Time                `json:"next_attempt_at"`
+	LastAttemptAt *time.Time               `json:"last_attempt_at"`
+	CreatedAt     time.Time                `json:"created_at"`
+	AttemptLog    []WebhookDeliveryAttempt `json:"attempt_log,omitempty"`
+}
+
+type WebhookDeliveryAttempt struct {
+	AttemptedAt    time.Time `json:"attempted_at"`
+	DurationMS     int       `json:"duration_ms"`
+	ResponseStatus *int      `json:"response_status"`
+	ResponseBody   string    `json:"response_body"`
+	Error          string    `json:"error"`
+}
+
+// WebhookJob is a claimed delivery together with where it goes.
+type WebhookJob struct {
+	DeliveryID int64
+	URL        string
+	Secret     string
+	EventType  string
+	Payload    []byte
+	Attempts   int
+}
+
+type PostgresWebhookStore struct {
+	db *sql.DB
+}
+
+func NewPostgresWebhookStore(db *sql.DB) *PostgresWebhookStore {
+	return &PostgresWebhookStore{db: db}
+}
+
+type WebhookStore interface {
+	CreateEndpoint(*WebhookEndpoint) error
+	GetEndpoints() ([]WebhookEndpoint, error)
+	GetEndpoint(id int64) (*WebhookEndpoint, error)
+	UpdateEndpoint(*WebhookEndpoint) error
+	DeleteEndpoint(id int64) error
+	GetDeliveries(endpointID int64, status string, limit int) ([]WebhookDelivery, error)
+	GetDelivery(endpointID, id int64) (*WebhookDelivery, error)
+	Redeliver(endpointID, id int64) error
+	ClaimDueDeliveries(limit int, lease time.Duration) ([]WebhookJob, error)
+	RecordAttempt(deliveryID int64, attempt WebhookDeliveryAttempt, status string, nextAttemptAt time.Time) error
+}
+
+const endpointColumns = `id, url, description, secret, to_json(event_types), active, created_at, updated_at`
+
+func scanEndpoint(row interface{ Scan(...any) error }, endpoint *WebhookEndpoint) error {
+	var eventTypes []byte
+
+	err := row.Scan(
+		&endpoint.ID,
+		&endpoint.URL,
+		&endpoint.Description,
+		&endpoint.Secret,
+		&eventTypes,
+		&endpoint.Active,
+		&endpoint.CreatedAt,
+		&endpoint.UpdatedAt,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(eventTypes, &endpoint.EventTypes)
+}
+
+func (s *PostgresWebhookStore) CreateEndpoint(endpoint *WebhookEndpoint) error {
+	query := `
+	INSERT INTO webhook_endpoints (url, description, secret, event_types, active)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at, updated_at`
+
+	return s.db.QueryRow(query, endpoint.URL, endpoint.Description, endpoint.Secret, endpoint.EventTypes, endpoint.Active).
+		Scan(&endpoint.ID, &endpoint.CreatedAt, &endpoint.UpdatedAt)
+}
+
+func (s *PostgresWebhookStore) GetEndpoints() ([]WebhookEndpoint, error) {
+	rows, err := s.db.Query(`SELECT ` + endpointColumns + ` FROM webhook_endpoints ORDER BY id`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	endpoints := []WebhookEndpoint{}
+
+	for rows.Next() {
+		var endpoint WebhookEndpoint
+
+		if err := scanEndpoint(rows, &endpoint); err != nil {
+			return nil, err
+		}
+
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints, rows.Err()
+}
+
+func (s *PostgresWebhookStore) GetEndpoint(id int64) (*WebhookEndpoint, error) {
+	endpoint := &WebhookEndpoint{}
+
+	err := scanEndpoint(s.db.QueryRow(`SELECT `+endpointColumns+` FROM webhook_endpoints WHERE id = $1`, id), endpoint)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoint, nil
+}
+
+func (s *PostgresWebhookStore) UpdateEndpoint(endpoint *WebhookEndpoint) error {
+	query := `
+	UPDATE webhook_endpoints
+	SET url = $1, description = $2, event_types = $3, active = $4, updated_at = CURRENT_TIMESTAMP
+	WHERE id = $5
+	RETURNING updated_at`
+
+	return s.db.QueryRow(query, endpoint.URL, endpoint.Description, endpoint.EventTypes, endpoint.Active, endpoint.ID).Scan(&endpoint.UpdatedAt)
+}
+
+func (s *PostgresWebhookStore) DeleteEndpoint(id int64) error {
+	result, err := s.db.Exec(`DELETE FROM webhook_endpoints WHERE id = $1`, id)
+
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+const deliveryColumns = `id, endpoint_id, event_type, payload, status, attempts, next_attempt_at, last_attempt_at, created_at`
+
+func scanDelivery(row interface{ Scan(...any) error }, delivery *WebhookDelivery) error {
+	return row.Scan(
+		&delivery.ID,
+		&delivery.EndpointID,
+		&delivery.EventType,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.LastAttemptAt,
+		&delivery.CreatedAt,
+	)
+}
+
+// GetDeliveries lists an endpoint's deliveries, newest first. An empty
+// status lists all of them.
+func (s *PostgresWebhookStore) GetDeliveries(endpointID int64, status string, limit int) ([]WebhookDelivery, error) {
+	query := `
+	SELECT ` + deliveryColumns + `
+	FROM webhook_deliveries
+	WHERE endpoint_id = $1 AND ($2 = '' OR status = $2)
+	ORDER BY id DESC
+	LIMIT $3`
+
+	rows, err := s.db.Query(query, endpointID, status, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+
+		if err := scanDelivery(rows, &delivery); err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// GetDelivery returns a delivery with the log of every attempt made.
+func (s *PostgresWebhookStore) GetDelivery(endpointID, id int64) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{}
+
+	query := `SELECT ` + deliveryColumns + ` FROM webhook_deliveries WHERE id = $1 AND endpoint_id = $2`
+
+	err := scanDelivery(s.db.QueryRow(query, id, endpointID), delivery)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	attemptQuery := `
+	SELECT attempted_at, duration_ms, response_status, response_body, error
+	FROM webhook_delivery_attempts
+	WHERE delivery_id = $1
+	ORDER BY id`
+
+	rows, err := s.db.Query(attemptQuery, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	delivery.AttemptLog = []WebhookDeliveryAttempt{}
+
+	for rows.Next() {
+		var attempt WebhookDeliveryAttempt
+
+		err = rows.Scan(&attempt.AttemptedAt, &attempt.DurationMS, &attempt.ResponseStatus, &attempt.ResponseBody, &attempt.Error)
+
+		if err != nil {
+			return nil, err
+		}
+
+		delivery.AttemptLog = append(delivery.AttemptLog, attempt)
+	}
+
+	return delivery, rows.Err()
+}
+
+// Redeliver queues a delivery to be sent again straight away with a fresh
+// set of retries, whatever state it is in. Earlier attempts stay logged.
+func (s *PostgresWebhookStore) Redeliver(endpointID, id int64) error {
+	query := `
+	UPDATE webhook_deliveries
+	SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND endpoint_id = $2`
+
+	result, err := s.db.Exec(query, id, endpointID)
+
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ClaimDueDeliveries takes up to limit pending deliveries that are due and
+// pushes their next attempt out by lease, so no other worker picks them up
+// while they are being sent. A worker that dies mid-send leaves the
+// delivery to be retried once the lease runs out.
+func (s *PostgresWebhookStore) ClaimDueDeliveries(limit int, lease time.Duration) ([]WebhookJob, error) {
+	query := `
+	WITH due AS (
+		SELECT d.id
+		FROM webhook_deliveries d
+		INNER JOIN webhook_endpoints e ON e.id = d.endpoint_id
+		WHERE d.status = 'pending' AND d.next_attempt_at <= CURRENT_TIMESTAMP AND e.active
+		ORDER BY d.next_attempt_at
+		LIMIT $1
+		FOR UPDATE OF d SKIP LOCKED
+	)
+	UPDATE webhook_deliveries d
+	SET attempts = d.attempts + 1, next_attempt_at = CURRENT_TIMESTAMP + $2 * interval '1 millisecond'
+	FROM due, webhook_endpoints e
+	WHERE d.id = due.id AND e.id = d.endpoint_id
+	RETURNING d.id, e.url, e.secret, d.event_type, d.payload, d.attempts`
+
+	rows, err := s.db.Query(query, limit, lease.Milliseconds())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var jobs []WebhookJob
+
+	for rows.Next() {
+		var job WebhookJob
+
+		err = rows.Scan(&job.DeliveryID, &job.URL, &job.Secret, &job.EventType, &job.Payload, &job.Attempts)
+
+		if err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// RecordAttempt logs an attempt and moves the delivery to status; a
+// pending delivery is retried at nextAttemptAt.
+func (s *PostgresWebhookStore) RecordAttempt(deliveryID int64, attempt WebhookDeliveryAttempt, status string, nextAttemptAt time.Time) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO webhook_delivery_attempts (delivery_id, attempted_at, duration_ms, response_status, response_body, error)
+	VALUES ($1, $2, $3, $4, $5, $6)`
+
+	_, err = tx.Exec(query, deliveryID, attempt.AttemptedAt, attempt.DurationMS, attempt.ResponseStatus, attempt.ResponseBody, attempt.Error)
+
+	if err != nil {
+		return err
+	}
+
+	query = `
+	UPDATE webhook_deliveries
+	SET status = $2, next_attempt_at = $3, last_attempt_at = $4
+	WHERE id = $1`
+
+	_, err = tx.Exec(query, deliveryID, status, nextAttemptAt, attempt.AttemptedAt)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
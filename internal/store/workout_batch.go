@@ -0,0 +1,438 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+
+	// keeps multi-row statements well under Postgres' 65535 parameter limit
+	batchChunkSize = 500
+)
+
+var ErrBatchAborted = errors.New("batch aborted")
+
+type WorkoutBatchOp struct {
+	Op      string
+	Workout *Workout
+	ID      int64
+	Version int
+}
+
+// valuesList builds "($1,$2),($3,$4)..." for rows of the given width,
+// with optional casts for the first row so Postgres can type a VALUES list.
+func valuesList(rows, width, offset int, casts []string) string {
+	var b strings.Builder
+
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("(")
+		for c := 0; c < width; c++ {
+			if c > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "$%d", offset+r*width+c+1)
+			if casts != nil {
+				b.WriteString("::" + casts[c])
+			}
+		}
+		b.WriteString(")")
+	}
+
+	return b.String()
+}
+
+// nextIDs reserves n ids from a table's serial sequence in one round trip,
+// so rows inserted together can be linked up without relying on the order
+// of RETURNING.
+func nextIDs(tx *sql.Tx, table string, n int) ([]int, error) {
+	ids := make([]int, 0, n)
+
+	if n == 0 {
+		return ids, nil
+	}
+
+	rows, err := tx.Query(`SELECT nextval(pg_get_serial_sequence($1, 'id')) FROM generate_series(1, $2)`, table, n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// insertWorkouts creates workouts, their entries and their first revision
+// with a handful of multi-row statements regardless of how many workouts
+// and entries there are.
+func insertWorkouts(tx *sql.Tx, workouts []*Workout) error {
+	ids, err := nextIDs(tx, "workouts", len(workouts))
+
+	if err != nil {
+		return err
+	}
+
+	for i, w := range workouts {
+		w.ID = ids[i]
+		w.Version = 1
+	}
+
+	for start := 0; start < len(workouts); start += batchChunkSize {
+		chunk := workouts[start:min(start+batchChunkSize, len(workouts))]
+		args := make([]any, 0, len(chunk)*6)
+
+		for _, w := range chunk {
+			args = append(args, w.ID, w.UserID, w.Title, w.Description, w.DurationMinutes, w.CaloriesBurned)
+		}
+
+		query := `INSERT INTO workouts (id, user_id, title, description, duration_minutes, calories_burned) VALUES ` + valuesList(len(chunk), 6, 0, nil)
+
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+
+	var entries []*WorkoutEntry
+	var entryWorkouts []int
+
+	for _, w := range workouts {
+		for i := range w.Entries {
+			entries = append(entries, &w.Entries[i])
+			entryWorkouts = append(entryWorkouts, w.ID)
+		}
+	}
+
+	err = insertEntries(tx, entries, entryWorkouts)
+
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(workouts); start += batchChunkSize {
+		chunk := workouts[start:min(start+batchChunkSize, len(workouts))]
+		args := make([]any, 0, len(chunk)*2)
+
+		for _, w := range chunk {
+			snapshot, err := json.Marshal(w)
+			if err != nil {
+				return err
+			}
+			args = append(args, w.ID, snapshot)
+		}
+
+		query := `
+		INSERT INTO workout_revisions (workout_id, revision, snapshot)
+		SELECT v.workout_id, 1, v.snapshot
+		FROM (VALUES ` + valuesList(len(chunk), 2, 0, []string{"bigint", "jsonb"}) + `) AS v(workout_id, snapshot)`
+
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+
+	events := make([]domainEvent, len(workouts))
+	for i, w := range workouts {
+		events[i] = workoutEvent(EventWorkoutCreated, w.UserID, int64(w.ID), w)
+	}
+
+	err = recordEvents(tx, events...)
+
+	if err != nil {
+		return err
+	}
+
+	for _, w := range workouts {
+		err = recordPersonalRecords(tx, w.UserID, int64(w.ID), nil)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertEntries inserts entries, entries[i] belonging to workoutIDs[i], and
+// fills in their new ids.
+func insertEntries(tx *sql.Tx, entries []*WorkoutEntry, workoutIDs []int) error {
+	ids, err := nextIDs(tx, "workout_entries", len(entries))
+
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(entries); start += batchChunkSize {
+		end := min(start+batchChunkSize, len(entries))
+		args := make([]any, 0, (end-start)*9)
+
+		for i := start; i < end; i++ {
+			e := entries[i]
+			e.ID = ids[i]
+			args = append(args, e.ID, workoutIDs[i], e.ExerciseName, e.Sets, e.Reps, e.DurationSeconds, e.Weight, e.Notes, e.OrderIndex)
+		}
+
+		query := `
+		INSERT INTO workout_entries (id, workout_id, exercise_name, sets, reps, duration_seconds, weight, notes, order_index)
+		VALUES ` + valuesList(end-start, 9, 0, nil)
+
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncWorkoutEntries brings the stored entries in line with workout.Entries.
+// Entries that carry the id of an existing entry are updated in place, the
+// rest are inserted, and stored entries that are no longer listed are
+// deleted, so unchanged entries keep their ids across updates. Each of the
+// three steps is a single statement however many entries there are. A nil
+// Entries slice leaves the stored entries alone.
+func syncWorkoutEntries(tx *sql.Tx, workout *Workout) error {
+	if workout.Entries == nil {
+		current, err := getWorkout(tx, int64(workout.ID))
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			workout.Entries = current.Entries
+		}
+		return nil
+	}
+
+	rows, err := tx.Query(`SELECT id FROM workout_entries WHERE workout_id = $1`, workout.ID)
+
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[int]bool)
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[id] = true
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var updates, inserts []*WorkoutEntry
+
+	for i := range workout.Entries {
+		entry := &workout.Entries[i]
+
+		if existing[entry.ID] {
+			updates = append(updates, entry)
+			delete(existing, entry.ID)
+			continue
+		}
+
+		inserts = append(inserts, entry)
+	}
+
+	for start := 0; start < len(updates); start += batchChunkSize {
+		chunk := updates[start:min(start+batchChunkSize, len(updates))]
+		args := make([]any, 0, len(chunk)*8+1)
+
+		for _, e := range chunk {
+			args = append(args, e.ID, e.ExerciseName, e.Sets, e.Reps, e.DurationSeconds, e.Weight, e.Notes, e.OrderIndex)
+		}
+		args = append(args, workout.ID)
+
+		casts := []string{"bigint", "varchar", "integer", "integer", "integer", "numeric", "text", "integer"}
+		query := `
+		UPDATE workout_entries AS e
+		SET exercise_name = v.exercise_name, sets = v.sets, reps = v.reps, duration_seconds = v.duration_seconds,
+			weight = v.weight, notes = v.notes, order_index = v.order_index, updated_at = CURRENT_TIMESTAMP
+		FROM (VALUES ` + valuesList(len(chunk), 8, 0, casts) + `)
+			AS v(id, exercise_name, sets, reps, duration_seconds, weight, notes, order_index)
+		WHERE e.id = v.id AND e.workout_id = $` + fmt.Sprint(len(args)) + `
+			AND (e.exercise_name, e.sets, e.reps, e.duration_seconds, e.weight, e.notes, e.order_index)
+				IS DISTINCT FROM (v.exercise_name, v.sets, v.reps, v.duration_seconds, v.weight, v.notes, v.order_index)`
+
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+
+	workoutIDs := make([]int, len(inserts))
+	for i := range workoutIDs {
+		workoutIDs[i] = workout.ID
+	}
+
+	err = insertEntries(tx, inserts, workoutIDs)
+
+	if err != nil {
+		return err
+	}
+
+	// whatever is left in existing was not listed in the update
+	if len(existing) > 0 {
+		stale := make([]int64, 0, len(existing))
+		for id := range existing {
+			stale = append(stale, int64(id))
+		}
+
+		_, err := tx.Exec(`DELETE FROM workout_entries WHERE workout_id = $1 AND id = ANY($2)`, workout.ID, stale)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pg *PostgresWorkoutStore) GetWorkoutOwners(ids []int64) (map[int64]int, error) {
+	owners := make(map[int64]int, len(ids))
+
+	if len(ids) == 0 {
+		return owners, nil
+	}
+
+	rows, err := pg.db.Query(`SELECT id, user_id FROM workouts WHERE id = ANY($1) AND deleted_at IS NULL`, ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var userID int
+
+		if err := rows.Scan(&id, &userID); err != nil {
+			return nil, err
+		}
+
+		owners[id] = userID
+	}
+
+	return owners, rows.Err()
+}
+
+// withSavepoint runs fn so that a failure only undoes fn's own work and
+// leaves the surrounding transaction usable. The first error is fn's, the
+// second means the transaction itself is broken.
+func withSavepoint(tx *sql.Tx, fn func() error) (error, error) {
+	if _, err := tx.Exec(`SAVEPOINT batch_op`); err != nil {
+		return nil, err
+	}
+
+	if opErr := fn(); opErr != nil {
+		if _, err := tx.Exec(`ROLLBACK TO SAVEPOINT batch_op`); err != nil {
+			return nil, err
+		}
+		return opErr, nil
+	}
+
+	_, err := tx.Exec(`RELEASE SAVEPOINT batch_op`)
+	return nil, err
+}
+
+func applyBatchOp(tx *sql.Tx, op WorkoutBatchOp) error {
+	switch op.Op {
+	case BatchCreate:
+		return insertWorkouts(tx, []*Workout{op.Workout})
+	case BatchUpdate:
+		return updateWorkout(tx, op.Workout)
+	case BatchDelete:
+		return deleteWorkout(tx, op.ID, op.Version)
+	}
+	return fmt.Errorf("unknown batch operation %q", op.Op)
+}
+
+// ApplyWorkoutBatch runs ops in order in a single transaction and returns
+// one error slot per op. Consecutive creates go in together through
+// insertWorkouts; if that fails, they are retried one by one so the error
+// lands on the op that caused it.
+//
+// Every op runs under its own savepoint so a failure only affects that
+// op. With atomic set, the first failing op is recorded, everything is
+// rolled back and ErrBatchAborted is returned.
+func (pg *PostgresWorkoutStore) ApplyWorkoutBatch(ops []WorkoutBatchOp, atomic bool) ([]error, error) {
+	results := make([]error, len(ops))
+
+	tx, err := pg.db.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	for start := 0; start < len(ops); {
+		end := start + 1
+
+		for ops[start].Op == BatchCreate && end < len(ops) && ops[end].Op == BatchCreate {
+			end++
+		}
+
+		if end-start > 1 {
+			workouts := make([]*Workout, 0, end-start)
+			for _, op := range ops[start:end] {
+				workouts = append(workouts, op.Workout)
+			}
+
+			opErr, err := withSavepoint(tx, func() error { return insertWorkouts(tx, workouts) })
+
+			if err != nil {
+				return nil, err
+			}
+
+			if opErr == nil {
+				start = end
+				continue
+			}
+		}
+
+		for i := start; i < end; i++ {
+			results[i], err = withSavepoint(tx, func() error { return applyBatchOp(tx, ops[i]) })
+
+			if err != nil {
+				return nil, err
+			}
+
+			if atomic && results[i] != nil {
+				return results, ErrBatchAborted
+			}
+		}
+
+		start = end
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,227 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+type WorkoutRevision struct {
+	WorkoutID int       `json:"workout_id"`
+	Revision  int       `json:"revision"`
+	Snapshot  *Workout  `json:"snapshot,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+const (
+	EntryAdded   = "added"
+	EntryRemoved = "removed"
+	EntryChanged = "changed"
+)
+
+type EntryChange struct {
+	Change  string        `json:"change"`
+	EntryID int           `json:"entry_id"`
+	From    *WorkoutEntry `json:"from,omitempty"`
+	To      *WorkoutEntry `json:"to,omitempty"`
+	Fields  []FieldChange `json:"fields,omitempty"`
+}
+
+type WorkoutDiff struct {
+	FromRevision int           `json:"from_revision"`
+	ToRevision   int           `json:"to_revision"`
+	Fields       []FieldChange `json:"fields"`
+	Entries      []EntryChange `json:"entries"`
+}
+
+// insertWorkoutRevision records the state of workout as its next revision.
+// It must run in the same transaction as the change it records; the UPDATE
+// or INSERT on workouts holds the row lock that keeps revision numbers in
+// sequence.
+func insertWorkoutRevision(tx *sql.Tx, workout *Workout) error {
+	snapshot, err := json.Marshal(workout)
+
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO workout_revisions (workout_id, revision, snapshot)
+	SELECT $1, coalesce(max(revision), 0) + 1, $2
+	FROM workout_revisions
+	WHERE workout_id = $1
+	`
+
+	_, err = tx.Exec(query, workout.ID, snapshot)
+	return err
+}
+
+func (pg *PostgresWorkoutStore) GetWorkoutRevisions(workoutID int64) ([]WorkoutRevision, error) {
+	query := `
+	SELECT workout_id, revision, created_at
+	FROM workout_revisions
+	WHERE workout_id = $1
+	ORDER BY revision DESC
+	`
+
+	rows, err := pg.db.Query(query, workoutID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	revisions := []WorkoutRevision{}
+
+	for rows.Next() {
+		var revision WorkoutRevision
+
+		err = rows.Scan(&revision.WorkoutID, &revision.Revision, &revision.CreatedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (pg *PostgresWorkoutStore) GetWorkoutRevision(workoutID int64, revision int) (*WorkoutRevision, error) {
+	query := `
+	SELECT workout_id, revision, snapshot, created_at
+	FROM workout_revisions
+	WHERE workout_id = $1 AND revision = $2
+	`
+
+	rev := &WorkoutRevision{}
+	var snapshot []byte
+
+	err := pg.db.QueryRow(query, workoutID, revision).Scan(&rev.WorkoutID, &rev.Revision, &snapshot, &rev.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(snapshot, &rev.Snapshot)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rev, nil
+}
+
+// DiffWorkoutRevisions compares two revisions field by field. Entries are
+// paired by id first; entries whose id only exists on one side are then
+// paired by order_index, so a re-saved entry shows up as changed rather
+// than as a removal and an addition.
+func DiffWorkoutRevisions(from, to *WorkoutRevision) *WorkoutDiff {
+	diff := &WorkoutDiff{
+		FromRevision: from.Revision,
+		ToRevision:   to.Revision,
+		Fields:       []FieldChange{},
+		Entries:      []EntryChange{},
+	}
+
+	a, b := from.Snapshot, to.Snapshot
+
+	diff.Fields = appendChange(diff.Fields, "title", a.Title, b.Title)
+	diff.Fields = appendChange(diff.Fields, "description", a.Description, b.Description)
+	diff.Fields = appendChange(diff.Fields, "duration_minutes", a.DurationMinutes, b.DurationMinutes)
+	diff.Fields = appendChange(diff.Fields, "calories_burned", a.CaloriesBurned, b.CaloriesBurned)
+
+	toByID := make(map[int]*WorkoutEntry, len(b.Entries))
+	for i := range b.Entries {
+		toByID[b.Entries[i].ID] = &b.Entries[i]
+	}
+
+	matched := make(map[*WorkoutEntry]bool)
+	var unmatchedFrom []*WorkoutEntry
+
+	for i := range a.Entries {
+		old := &a.Entries[i]
+		if cur, ok := toByID[old.ID]; ok {
+			matched[cur] = true
+			diff.Entries = appendEntryChange(diff.Entries, old, cur)
+			continue
+		}
+		unmatchedFrom = append(unmatchedFrom, old)
+	}
+
+	toByOrder := make(map[int]*WorkoutEntry)
+	for i := range b.Entries {
+		if cur := &b.Entries[i]; !matched[cur] {
+			toByOrder[cur.OrderIndex] = cur
+		}
+	}
+
+	for _, old := range unmatchedFrom {
+		if cur, ok := toByOrder[old.OrderIndex]; ok {
+			matched[cur] = true
+			delete(toByOrder, old.OrderIndex)
+			diff.Entries = appendEntryChange(diff.Entries, old, cur)
+			continue
+		}
+		diff.Entries = append(diff.Entries, EntryChange{Change: EntryRemoved, EntryID: old.ID, From: old})
+	}
+
+	for i := range b.Entries {
+		if cur := &b.Entries[i]; !matched[cur] {
+			diff.Entries = append(diff.Entries, EntryChange{Change: EntryAdded, EntryID: cur.ID, To: cur})
+		}
+	}
+
+	return diff
+}
+
+func appendEntryChange(changes []EntryChange, from, to *WorkoutEntry) []EntryChange {
+	var fields []FieldChange
+
+	fields = appendChange(fields, "exercise_name", from.ExerciseName, to.ExerciseName)
+	fields = appendChange(fields, "sets", from.Sets, to.Sets)
+	fields = appendChange(fields, "reps", derefInt(from.Reps), derefInt(to.Reps))
+	fields = appendChange(fields, "duration_seconds", derefInt(from.DurationSeconds), derefInt(to.DurationSeconds))
+	fields = appendChange(fields, "weight", derefFloat(from.Weight), derefFloat(to.Weight))
+	fields = appendChange(fields, "notes", from.Notes, to.Notes)
+	fields = appendChange(fields, "order_index", from.OrderIndex, to.OrderIndex)
+
+	if len(fields) == 0 {
+		return changes
+	}
+
+	return append(changes, EntryChange{Change: EntryChanged, EntryID: to.ID, From: from, To: to, Fields: fields})
+}
+
+func appendChange(changes []FieldChange, field string, from, to interface{}) []FieldChange {
+	if from == to {
+		return changes
+	}
+	return append(changes, FieldChange{Field: field, From: from, To: to})
+}
+
+func derefInt(v *int) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func derefFloat(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
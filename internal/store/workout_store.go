@@ -2,6 +2,10 @@ package store
 
 import (
 	"database/sql"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
 )
 
 type Workout struct {
@@ -11,9 +15,14 @@ type Workout struct {
 	Description     string         `json:"description"`
 	DurationMinutes int            `json:"duration_minutes"`
 	CaloriesBurned  int            `json:"calories_burned"`
+	Version         int            `json:"version"`
 	Entries         []WorkoutEntry `json:"entries"`
 }
 
+// ErrVersionConflict is returned when a write names a workout version that
+// is no longer the current one.
+var ErrVersionConflict = errors.New("workout version conflict")
+
 type WorkoutEntry struct {
 	ID              int      `json:"id"`
 	ExerciseName    string   `json:"exercise_name"`
@@ -25,6 +34,39 @@ type WorkoutEntry struct {
 	OrderIndex      int      `json:"order_index"`
 }
 
+// PersonalRecord is an exercise in a workout lifted heavier than in any of
+// the user's earlier workouts.
+type PersonalRecord struct {
+	ExerciseName string  `json:"exercise_name"`
+	Weight       float64 `json:"weight"`
+	Previous     float64 `json:"previous"`
+}
+
+type TrashedWorkout struct {
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type WorkoutSearchParams struct {
+	Query string
+	From  *time.Time
+	To    *time.Time
+	Limit int
+}
+
+// WorkoutSearchResult is a workout matching a search. Snippet is plain
+// text; Highlights are the [start, end) offsets, in characters, of the
+// matched terms in it.
+type WorkoutSearchResult struct {
+	WorkoutID  int       `json:"workout_id"`
+	Title      string    `json:"title"`
+	Rank       float64   `json:"rank"`
+	Snippet    string    `json:"snippet"`
+	Highlights [][2]int  `json:"highlights"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
 type PostgresWorkoutStore struct {
 	db *sql.DB
 }
@@ -37,43 +79,32 @@ type WorkoutStore interface {
 	CreateWorkout(*Workout) (*Workout, error)
 	GetWorkoutById(id int64) (*Workout, error)
 	UpdateWorkout(*Workout) error
-	DeleteWorkout(id int64) error
+	DeleteWorkout(id int64, version int) error
+	RestoreWorkout(id int64, userID int) error
+	GetTrashedWorkouts(userID int) ([]TrashedWorkout, error)
+	PurgeTrashedWorkouts(olderThan time.Time) (int64, error)
 	GetWorkoutOwner(id int64) (int, error)
+	GetWorkoutOwners(ids []int64) (map[int64]int, error)
+	ApplyWorkoutBatch(ops []WorkoutBatchOp, atomic bool) ([]error, error)
+	SearchWorkouts(userID int, params WorkoutSearchParams) ([]WorkoutSearchResult, error)
+	GetWorkoutRevisions(workoutID int64) ([]WorkoutRevision, error)
+	GetWorkoutRevision(workoutID int64, revision int) (*WorkoutRevision, error)
+	GetPersonalRecords(workoutID int64) ([]PersonalRecord, error)
 }
 
 func (pg *PostgresWorkoutStore) CreateWorkout(workout *Workout) (*Workout, error) {
 	tx, err := pg.db.Begin()
-	defer tx.Rollback()
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	query :=
-		`INSERT INTO workouts (user_id,title, description, duration_minutes, calories_burned)
-	VALUES($1,$2,$3,$4, $5)
-	RETURNING id
-	`
-
-	err = tx.QueryRow(query, workout.UserID, workout.Title, workout.Description, workout.DurationMinutes, workout.CaloriesBurned).Scan(&workout.ID)
+	err = insertWorkouts(tx, []*Workout{workout})
 
 	if err != nil {
 		return nil, err
 	}
 
-	for _, entry := range workout.Entries {
-		query := `
-		INSERT INTO workout_entries (workout_id, exercise_name, sets, reps, duration_seconds, weight, notes, order_index)
-		VALUES($1,$2,$3,$4,$5,$6,$7,$8)
-		RETURNING id
-		`
-		err = tx.QueryRow(query, workout.ID, entry.ExerciseName, entry.Sets, entry.Reps, entry.DurationSeconds, entry.Weight, entry.Notes, entry.OrderIndex).Scan(&entry.ID)
-
-		if err != nil {
-			return nil, err
-		}
-
-	}
-
 	err = tx.Commit()
 
 	if err != nil {
@@ -84,12 +115,16 @@ func (pg *PostgresWorkoutStore) CreateWorkout(workout *Workout) (*Workout, error
 }
 
 func (pg *PostgresWorkoutStore) GetWorkoutById(id int64) (*Workout, error) {
+	return getWorkout(pg.db, id)
+}
+
+func getWorkout(q querier, id int64) (*Workout, error) {
 	workout := &Workout{}
-	query := `SELECT id, title, description, duration_minutes, calories_burned
+	query := `SELECT id, user_id, title, description, duration_minutes, calories_burned, version
 	FROM workouts
-	WHERE id = $1`
+	WHERE id = $1 AND deleted_at IS NULL`
 
-	err := pg.db.QueryRow(query, id).Scan(&workout.ID, &workout.Title, &workout.Description, &workout.DurationMinutes, &workout.CaloriesBurned)
+	err := q.QueryRow(query, id).Scan(&workout.ID, &workout.UserID, &workout.Title, &workout.Description, &workout.DurationMinutes, &workout.CaloriesBurned, &workout.Version)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -108,7 +143,7 @@ func (pg *PostgresWorkoutStore) GetWorkoutById(id int64) (*Workout, error) {
 	ORDER BY order_index
 	`
 
-	rows, err := pg.db.Query(entryQuery, id)
+	rows, err := q.Query(entryQuery, id)
 
 	if err != nil {
 		return nil, err
@@ -123,6 +158,7 @@ func (pg *PostgresWorkoutStore) GetWorkoutById(id int64) (*Workout, error) {
 			&entry.ID,
 			&entry.ExerciseName,
 			&entry.Sets,
+			&entry.Reps,
 			&entry.DurationSeconds,
 			&entry.Weight,
 			&entry.Notes,
@@ -139,6 +175,9 @@ func (pg *PostgresWorkoutStore) GetWorkoutById(id int64) (*Workout, error) {
 	return workout, nil
 }
 
+// UpdateWorkout saves workout only if its stored version still equals
+// workout.Version, and bumps the version on success. A stale version gives
+// ErrVersionConflict, a missing workout sql.ErrNoRows.
 func (pg *PostgresWorkoutStore) UpdateWorkout(workout *Workout) error {
 	tx, err := pg.db.Begin()
 
@@ -148,61 +187,132 @@ func (pg *PostgresWorkoutStore) UpdateWorkout(workout *Workout) error {
 
 	defer tx.Rollback()
 
+	err = updateWorkout(tx, workout)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func updateWorkout(tx *sql.Tx, workout *Workout) error {
+	before, err := getPersonalRecords(tx, int64(workout.ID))
+
+	if err != nil {
+		return err
+	}
+
 	query := `
 	UPDATE workouts 
-	SET title =$1, description = $2, duration_minutes =$3, calories_burned = $4
-	WHERE id = $5`
+	SET title =$1, description = $2, duration_minutes =$3, calories_burned = $4, version = version + 1
+	WHERE id = $5 AND version = $6 AND deleted_at IS NULL
+	RETURNING version, user_id`
 
-	result, err := tx.Exec(query, workout.Title, workout.Description, workout.DurationMinutes, workout.CaloriesBurned, workout.ID)
+	err = tx.QueryRow(query, workout.Title, workout.Description, workout.DurationMinutes, workout.CaloriesBurned, workout.ID, workout.Version).Scan(&workout.Version, &workout.UserID)
+
+	if err == sql.ErrNoRows {
+		return versionMismatch(tx, int64(workout.ID))
+	}
 
 	if err != nil {
 		return err
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	err = syncWorkoutEntries(tx, workout)
 
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
+	err = insertWorkoutRevision(tx, workout)
+
+	if err != nil {
+		return err
 	}
 
-	_, err = tx.Exec(`DELETE FROM workouts_entries WHERE workout_id = $1`, workout.ID)
+	err = recordEvents(tx, workoutEvent(EventWorkoutUpdated, workout.UserID, int64(workout.ID), workout))
 
 	if err != nil {
 		return err
 	}
 
-	for _, entry := range workout.Entries {
-		query := `
-		INSERT INTO workout_entries (workout_id, exercise_name, sets,reps,duration_seconds, weight, notes,order_index)
-		VALUES ($1,$2,$3,$4,$5,$6,$7,$7)`
+	return recordPersonalRecords(tx, workout.UserID, int64(workout.ID), before)
+}
 
-		_, err := tx.Exec(query,
-			workout.ID,
-			entry.ExerciseName,
-			entry.Sets,
-			entry.Reps,
-			entry.DurationSeconds,
-			entry.Weight,
-			entry.Notes,
-			entry.OrderIndex)
+func (pg *PostgresWorkoutStore) DeleteWorkout(id int64, version int) error {
+	tx, err := pg.db.Begin()
 
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = deleteWorkout(tx, id, version)
+
+	if err != nil {
+		return err
 	}
+
 	return tx.Commit()
 }
 
-func (pg *PostgresWorkoutStore) DeleteWorkout(id int64) error {
+func deleteWorkout(q querier, id int64, version int) error {
 	query := `
-	DELETE from workouts
-	WHERE id =$1`
+	UPDATE workouts
+	SET deleted_at = CURRENT_TIMESTAMP, version = version + 1
+	WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+	RETURNING user_id`
 
-	result, err := pg.db.Exec(query, id)
+	var userID int
+
+	err := q.QueryRow(query, id, version).Scan(&userID)
+
+	if err == sql.ErrNoRows {
+		return versionMismatch(q, id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return recordEvents(q, workoutEvent(EventWorkoutDeleted, userID, id, map[string]int64{"id": id}))
+}
+
+// versionMismatch works out why a versioned write touched no rows: either
+// the workout is gone or someone else got there first.
+func versionMismatch(q querier, id int64) error {
+	var exists bool
+
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM workouts WHERE id = $1 AND deleted_at IS NULL)`, id).Scan(&exists)
+
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return sql.ErrNoRows
+	}
+
+	return ErrVersionConflict
+}
+
+func (pg *PostgresWorkoutStore) RestoreWorkout(id int64, userID int) error {
+	tx, err := pg.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	UPDATE workouts
+	SET deleted_at = NULL, version = version + 1
+	WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL`
+
+	result, err := tx.Exec(query, id, userID)
 
 	if err != nil {
 		return err
@@ -218,7 +328,103 @@ func (pg *PostgresWorkoutStore) DeleteWorkout(id int64) error {
 		return sql.ErrNoRows
 	}
 
-	return nil
+	// clients dropped the workout when it was deleted, so send all of it
+	workout, err := getWorkout(tx, id)
+
+	if err != nil {
+		return err
+	}
+
+	err = recordEvents(tx, workoutEvent(EventWorkoutRestored, userID, id, workout))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (pg *PostgresWorkoutStore) GetTrashedWorkouts(userID int) ([]TrashedWorkout, error) {
+	query := `
+	SELECT id, title, deleted_at
+	FROM workouts
+	WHERE user_id = $1 AND deleted_at IS NOT NULL
+	ORDER BY deleted_at DESC`
+
+	rows, err := pg.db.Query(query, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	trashed := []TrashedWorkout{}
+
+	for rows.Next() {
+		var workout TrashedWorkout
+
+		err = rows.Scan(&workout.ID, &workout.Title, &workout.DeletedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		trashed = append(trashed, workout)
+	}
+
+	return trashed, rows.Err()
+}
+
+// PurgeTrashedWorkouts permanently removes workouts that were moved to the
+// trash before olderThan. Their entries go with them via ON DELETE CASCADE.
+func (pg *PostgresWorkoutStore) PurgeTrashedWorkouts(olderThan time.Time) (int64, error) {
+	tx, err := pg.db.Begin()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+	DELETE FROM workouts
+	WHERE deleted_at IS NOT NULL AND deleted_at < $1
+	RETURNING id, user_id`
+
+	rows, err := tx.Query(query, olderThan)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var events []domainEvent
+
+	for rows.Next() {
+		var id int64
+		var userID int
+
+		if err := rows.Scan(&id, &userID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		events = append(events, workoutEvent(EventWorkoutPurged, userID, id, map[string]int64{"id": id}))
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	err = recordEvents(tx, events...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(events)), tx.Commit()
 }
 
 func (pg *PostgresWorkoutStore) GetWorkoutOwner(id int64) (int, error) {
@@ -227,7 +433,7 @@ func (pg *PostgresWorkoutStore) GetWorkoutOwner(id int64) (int, error) {
 	query := `
 	SELECT user_id
 	FROM workouts
-	WHERE id =$1
+	WHERE id =$1 AND deleted_at IS NULL
 	`
 	err := pg.db.QueryRow(query, id).Scan(&userID)
 
@@ -237,3 +443,196 @@ func (pg *PostgresWorkoutStore) GetWorkoutOwner(id int64) (int, error) {
 
 	return userID, nil
 }
+
+// prefixQuery turns free text into a tsquery where every term is matched as
+// a prefix, e.g. "bench pre" becomes "bench:* & pre:*".
+func prefixQuery(q string) string {
+	terms := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for i, term := range terms {
+		terms[i] = strings.ToLower(term) + ":*"
+	}
+
+	return strings.Join(terms, " & ")
+}
+
+// Search snippets mark matches with control characters rather than HTML,
+// which would be mixed into the user's unescaped text. They're removed from
+// the text first so a workout can't fake a match.
+const (
+	highlightStart = '\x02'
+	highlightStop  = '\x03'
+)
+
+// splitHighlights removes the match markers from a snippet and returns the
+// plain text with where the matches are in it.
+func splitHighlights(snippet string) (string, [][2]int) {
+	var text strings.Builder
+	highlights := [][2]int{}
+	n, start := 0, -1
+
+	for _, r := range snippet {
+		switch r {
+		case highlightStart:
+			start = n
+		case highlightStop:
+			if start >= 0 && n > start {
+				highlights = append(highlights, [2]int{start, n})
+			}
+			start = -1
+		default:
+			text.WriteRune(r)
+			n++
+		}
+	}
+
+	return text.String(), highlights
+}
+
+func (pg *PostgresWorkoutStore) SearchWorkouts(userID int, params WorkoutSearchParams) ([]WorkoutSearchResult, error) {
+	results := []WorkoutSearchResult{}
+
+	tsQuery := prefixQuery(params.Query)
+	if tsQuery == "" {
+		return results, nil
+	}
+
+	query := `
+	WITH q AS (SELECT to_tsquery('english', $2) AS query)
+	SELECT w.id, w.title, w.created_at,
+		ts_rank(w.search_vector, q.query) + coalesce(e.rank, 0) AS rank,
+		ts_headline('english',
+			translate(concat_ws(' ', w.title, w.description, e.body), $6::text || $7::text, ''),
+			q.query,
+			'StartSel=' || $6::text || ', StopSel=' || $7::text || ', MaxFragments=2, MaxWords=20, MinWords=5') AS snippet
+	FROM workouts w
+	CROSS JOIN q
+	LEFT JOIN LATERAL (
+		SELECT max(ts_rank(we.search_vector, q.query)) AS rank,
+			string_agg(concat_ws(' ', we.exercise_name, we.notes), ' ' ORDER BY we.order_index) AS body
+		FROM workout_entries we
+		WHERE we.workout_id = w.id
+	) e ON true
+	WHERE w.user_id = $1
+		AND w.deleted_at IS NULL
+		AND ($3::timestamptz IS NULL OR w.created_at >= $3)
+		AND ($4::timestamptz IS NULL OR w.created_at < $4)
+		AND (
+			w.search_vector @@ q.query
+			OR EXISTS (
+				SELECT 1 FROM workout_entries we
+				WHERE we.workout_id = w.id AND we.search_vector @@ q.query
+			)
+		)
+	ORDER BY rank DESC, w.created_at DESC
+	LIMIT $5
+	`
+
+	rows, err := pg.db.Query(query, userID, tsQuery, params.From, params.To, params.Limit, string(highlightStart), string(highlightStop))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var result WorkoutSearchResult
+
+		err = rows.Scan(&result.WorkoutID, &result.Title, &result.CreatedAt, &result.Rank, &result.Snippet)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result.Snippet, result.Highlights = splitHighlights(result.Snippet)
+
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// GetPersonalRecords returns the exercises in a workout whose weight beats
+// the user's best in earlier workouts. An exercise done for the first time
+// is not a record.
+func (pg *PostgresWorkoutStore) GetPersonalRecords(workoutID int64) ([]PersonalRecord, error) {
+	return getPersonalRecords(pg.db, workoutID)
+}
+
+func getPersonalRecords(q querier, workoutID int64) ([]PersonalRecord, error) {
+	query := `
+	SELECT e.exercise_name, max(e.weight), prev.best
+	FROM workout_entries e
+	JOIN workouts w ON w.id = e.workout_id
+	CROSS JOIN LATERAL (
+		SELECT max(pe.weight) AS best
+		FROM workout_entries pe
+		JOIN workouts pw ON pw.id = pe.workout_id
+		WHERE pw.user_id = w.user_id
+		AND pw.deleted_at IS NULL
+		AND pw.created_at < w.created_at
+		AND lower(pe.exercise_name) = lower(e.exercise_name)
+	) prev
+	WHERE e.workout_id = $1 AND e.weight IS NOT NULL AND w.deleted_at IS NULL
+	GROUP BY e.exercise_name, prev.best
+	HAVING max(e.weight) > prev.best
+	ORDER BY e.exercise_name`
+
+	rows, err := q.Query(query, workoutID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var records []PersonalRecord
+
+	for rows.Next() {
+		var record PersonalRecord
+
+		if err := rows.Scan(&record.ExerciseName, &record.Weight, &record.Previous); err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// recordPersonalRecords records a pr.achieved event for the records a
+// workout holds now that it didn't hold in before, what it held before
+// the change. A title change doesn't announce the same records again.
+func recordPersonalRecords(q querier, userID int, workoutID int64, before []PersonalRecord) error {
+	records, err := getPersonalRecords(q, workoutID)
+
+	if err != nil {
+		return err
+	}
+
+	held := make(map[string]float64, len(before))
+	for _, r := range before {
+		held[strings.ToLower(r.ExerciseName)] = r.Weight
+	}
+
+	var achieved []PersonalRecord
+
+	for _, r := range records {
+		if weight, ok := held[strings.ToLower(r.ExerciseName)]; !ok || r.Weight > weight {
+			achieved = append(achieved, r)
+		}
+	}
+
+	if len(achieved) == 0 {
+		return nil
+	}
+
+	return recordEvents(q, workoutEvent(EventPRAchieved, userID, workoutID, map[string]any{
+		"workout_id": workoutID,
+		"records":    achieved,
+	}))
+}
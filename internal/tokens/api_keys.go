@@ -0,0 +1,59 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+)
+
+// APIKeyPrefix starts every API key, so secret scanners can recognise a
+// leaked one.
+const APIKeyPrefix = "fmk_"
+
+// Scopes an API key can be granted. Login sessions can do everything.
+const (
+	APIScopeWorkoutsRead  = "workouts:read"
+	APIScopeWorkoutsWrite = "workouts:write"
+	APIScopeAnalyticsRead = "analytics:read"
+)
+
+var APIScopes = []string{APIScopeWorkoutsRead, APIScopeWorkoutsWrite, APIScopeAnalyticsRead}
+
+const apiKeyHintLength = len(APIKeyPrefix) + 6
+
+type APIKey struct {
+	Plaintext string
+	Hash      []byte
+	// Hint is the start of the key, kept to tell keys apart.
+	Hint string
+}
+
+func GenerateAPIKey() (*APIKey, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := APIKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+
+	return &APIKey{
+		Plaintext: plaintext,
+		Hash:      HashAPIKey(plaintext),
+		Hint:      plaintext[:apiKeyHintLength],
+	}, nil
+}
+
+func HashAPIKey(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
+// IsAPIKey tells an API key from a login token, which never has the
+// prefix.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
@@ -0,0 +1,98 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"strings"
+)
+
+// Prefixes of the tokens the OAuth server issues, so an access token can
+// be told from a login token or an API key, and a leaked one recognised.
+const (
+	OAuthAccessTokenPrefix  = "fmo_"
+	OAuthRefreshTokenPrefix = "fmr_"
+	OAuthClientSecretPrefix = "fmcs_"
+)
+
+// Scopes a third party app can ask for on top of the API scopes.
+const (
+	OAuthScopeOpenID  = "openid"
+	OAuthScopeProfile = "profile"
+	OAuthScopeEmail   = "email"
+)
+
+var OAuthScopes = append([]string{OAuthScopeOpenID, OAuthScopeProfile, OAuthScopeEmail}, APIScopes...)
+
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)), nil
+}
+
+// GenerateOAuthSecret returns a random secret starting with prefix, and
+// its hash, for OAuth tokens, codes and client secrets.
+func GenerateOAuthSecret(prefix string) (string, []byte, error) {
+	s, err := randomString(32)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	plaintext := prefix + s
+
+	return plaintext, HashOAuthSecret(plaintext), nil
+}
+
+func HashOAuthSecret(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
+// GenerateClientID returns an id for a newly registered OAuth client. It
+// isn't secret.
+func GenerateClientID() (string, error) {
+	return randomString(10)
+}
+
+// IsOAuthAccessToken tells an OAuth access token from the other kinds of
+// bearer token.
+func IsOAuthAccessToken(token string) bool {
+	return strings.HasPrefix(token, OAuthAccessTokenPrefix)
+}
+
+// VerifyPKCE checks a PKCE code verifier against the S256 code challenge
+// the authorization request was made with (RFC 7636).
+func VerifyPKCE(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	for _, c := range verifier {
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.ContainsRune("-._~", c)) {
+			return false
+		}
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// GenerateOAuthRequestID returns an id for an authorization request
+// waiting on the user's consent.
+func GenerateOAuthRequestID() (string, error) {
+	return randomString(20)
+}
+
+// VerifyOAuthSecret checks a client secret against its stored hash.
+func VerifyOAuthSecret(plaintext string, hash []byte) bool {
+	return len(hash) > 0 && subtle.ConstantTimeCompare(HashOAuthSecret(plaintext), hash) == 1
+}
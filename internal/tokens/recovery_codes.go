@@ -0,0 +1,40 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+)
+
+// RecoveryCodeCount is how many recovery codes a user gets at a time.
+const RecoveryCodeCount = 10
+
+// GenerateRecoveryCodes returns n one-time codes a user can log in with in
+// place of an authenticator code, formatted like "abcde-fghij".
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+
+	for i := range codes {
+		b := make([]byte, 7)
+
+		_, err := rand.Read(b)
+
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	return codes, nil
+}
+
+// HashRecoveryCode hashes a code as typed, ignoring case, spaces and the
+// dash.
+func HashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
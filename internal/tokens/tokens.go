@@ -8,15 +8,32 @@ import (
 )
 
 const (
-	ScopeAuth = "authentication"
+	ScopeAuth              = "authentication"
+	ScopeEmailVerification = "email_verification"
+	ScopePasswordReset     = "password_reset"
+	ScopeRefresh           = "refresh"
+	// ScopeMFAPending is held between the password and the second factor
+	// of a login; it can only be exchanged for an auth token.
+	ScopeMFAPending = "mfa_pending"
+	ScopeMagicLink  = "magic_link"
+	// ScopeStreamTicket opens one WebSocket or event stream from a browser,
+	// which can't set the Authorization header on either.
+	ScopeStreamTicket = "stream_ticket"
 )
 
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
-	UserID    int       `json"-"`
+	UserID    int       `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// UserAgent and IP describe the client an auth token was issued to.
+	UserAgent string `json:"-"`
+	IP        string `json:"-"`
+	// FamilyID groups the auth and refresh tokens of one login.
+	FamilyID int64 `json:"-"`
+	// NonceHash binds a magic link to the browser that asked for it.
+	NonceHash []byte `json:"-"`
 }
 
 func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
@@ -41,3 +58,24 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 	token.Hash = hash[:]
 	return token, nil
 }
+
+// GenerateNonce returns a random value to keep on a client, and the hash
+// to keep on the server to check it against.
+func GenerateNonce() (string, []byte, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+
+	return nonce, HashNonce(nonce), nil
+}
+
+func HashNonce(nonce string) []byte {
+	hash := sha256.Sum256([]byte(nonce))
+	return hash[:]
+}
@@ -0,0 +1,121 @@
+// Package totp implements time-based one-time passwords (RFC 6238) as
+// used by authenticator apps: HMAC-SHA1, six digits, 30 second steps.
+// Every function takes the time to use, so callers control the clock.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 * time.Second
+
+	secretSize = 20
+)
+
+var ErrInvalidSecret = errors.New("totp: invalid secret")
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random secret, base32 encoded the way
+// authenticator apps expect.
+func GenerateSecret() (string, error) {
+	b := make([]byte, secretSize)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+
+	return key, nil
+}
+
+// Step is the time step t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// hotp is the HOTP value (RFC 4226) of key at counter, with digits digits.
+func hotp(key []byte, counter int64, digits int) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range digits {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// Code returns the code for secret at t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hotp(key, Step(t), Digits), nil
+}
+
+// Validate checks code against secret at t, accepting codes up to skew
+// steps either side to allow for clock drift. It returns the step the code
+// belongs to, which callers should remember so a code can't be used twice.
+func Validate(secret, code string, t time.Time, skew int) (int64, bool) {
+	key, err := decodeSecret(secret)
+	code = strings.ReplaceAll(code, " ", "")
+
+	if err != nil || len(code) != Digits {
+		return 0, false
+	}
+
+	now := Step(t)
+
+	for i := -int64(skew); i <= int64(skew); i++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, now+i, Digits)), []byte(code)) == 1 {
+			return now + i, true
+		}
+	}
+
+	return 0, false
+}
+
+// URI is the otpauth:// URI authenticator apps read from a QR code.
+func URI(secret, issuer, account string) string {
+	label := url.PathEscape(issuer + ":" + account)
+
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(int(Period / time.Second))},
+	}
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
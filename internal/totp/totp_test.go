@@ -0,0 +1,176 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// the SHA-1 seed from RFC 6238 Appendix B, base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// rfcVectors are the SHA-1 test vectors from RFC 6238 Appendix B.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+func TestHOTPMatchesRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	for _, v := range rfcVectors {
+		got := hotp(key, Step(time.Unix(v.unix, 0)), 8)
+
+		if got != v.code {
+			t.Errorf("at %d: got %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestCodeIsLastSixDigits(t *testing.T) {
+	for _, v := range rfcVectors {
+		got, err := Code(rfcSecret, time.Unix(v.unix, 0))
+
+		if err != nil {
+			t.Fatalf("at %d: %v", v.unix, err)
+		}
+
+		if want := v.code[2:]; got != want {
+			t.Errorf("at %d: got %s, want %s", v.unix, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, err := Code(rfcSecret, now)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		code string
+		at   time.Time
+		skew int
+		ok   bool
+		step int64
+	}{
+		{"same step", code, now, 0, true, Step(now)},
+		{"spaces are ignored", code[:3] + " " + code[3:], now, 0, true, Step(now)},
+		{"one step late within skew", code, now.Add(Period), 1, true, Step(now)},
+		{"one step early within skew", code, now.Add(-Period), 1, true, Step(now)},
+		{"one step late without skew", code, now.Add(Period), 0, false, 0},
+		{"two steps late", code, now.Add(2 * Period), 1, false, 0},
+		{"wrong code", "000000", now, 1, false, 0},
+		{"too short", code[:5], now, 1, false, 0},
+		{"too long", code + "0", now, 1, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, tt.code, tt.at, tt.skew)
+
+			if ok != tt.ok || step != tt.step {
+				t.Errorf("got (%d, %v), want (%d, %v)", step, ok, tt.step, tt.ok)
+			}
+		})
+	}
+}
+
+// Callers stop replays by refusing a step at or before the last one used,
+// which only works if a code reports the step it was issued for wherever
+// in the skew window it is checked.
+func TestValidateReportsStepForReplayCheck(t *testing.T) {
+	issued := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, issued)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastUsed := int64(-1)
+	use := func(code string, at time.Time) bool {
+		step, ok := Validate(rfcSecret, code, at, 1)
+		if !ok || step <= lastUsed {
+			return false
+		}
+		lastUsed = step
+		return true
+	}
+
+	if !use(code, issued) {
+		t.Fatal("first use was rejected")
+	}
+
+	if use(code, issued) {
+		t.Error("same code was accepted twice in its step")
+	}
+
+	if use(code, issued.Add(Period)) {
+		t.Error("same code was accepted again in the next step")
+	}
+
+	next, err := Code(rfcSecret, issued.Add(Period))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !use(next, issued.Add(Period)) {
+		t.Error("next step's code was rejected")
+	}
+
+	if use(code, issued.Add(Period)) {
+		t.Error("an older code was accepted after a newer one")
+	}
+}
+
+func TestInvalidSecret(t *testing.T) {
+	for _, secret := range []string{"", "not base32!", "1"} {
+		if _, err := Code(secret, time.Unix(59, 0)); err != ErrInvalidSecret {
+			t.Errorf("Code(%q): got %v, want ErrInvalidSecret", secret, err)
+		}
+
+		if _, ok := Validate(secret, "123456", time.Unix(59, 0), 1); ok {
+			t.Errorf("Validate(%q) accepted a code", secret)
+		}
+	}
+}
+
+func TestLowercaseAndPaddedSecrets(t *testing.T) {
+	want, err := Code(rfcSecret, time.Unix(59, 0))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ===="} {
+		got, err := Code(secret, time.Unix(59, 0))
+
+		if err != nil || got != want {
+			t.Errorf("Code(%q) = %q, %v; want %q", secret, got, err, want)
+		}
+	}
+}
+
+func TestGenerateSecretRoundTrips(t *testing.T) {
+	secret, err := GenerateSecret()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := decodeSecret(secret)
+
+	if err != nil || len(key) != secretSize {
+		t.Fatalf("decoded %d bytes, %v; want %d", len(key), err, secretSize)
+	}
+}
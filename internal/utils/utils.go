@@ -3,8 +3,10 @@ package utils
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi"
 )
@@ -38,3 +40,34 @@ func ReadIDParams(r *http.Request) (int64, error) {
 	}
 	return id, nil
 }
+
+// ETag formats a resource version as a strong entity tag.
+func ETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// MatchETag reports whether etag is listed in an If-Match header value,
+// using the strong comparison If-Match calls for: a weak tag never
+// matches. "*" matches any current representation.
+func MatchETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchETagWeak reports whether etag is listed in an If-None-Match header
+// value, using weak comparison, which ignores the W/ prefix.
+func MatchETagWeak(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The CBOR (RFC 8949) decoder here covers what authenticators send:
+// integers, byte and text strings, arrays, maps and simple values. Tags,
+// floats and indefinite lengths never appear in attestation objects or
+// COSE keys, so they are rejected.
+
+var errCBOR = errors.New("webauthn: malformed cbor")
+
+const maxCBORDepth = 16
+
+// decodeCBOR decodes the first item in data and returns it with the bytes
+// that follow it. Unsigned integers decode to uint64, negative ones to
+// int64, strings to []byte or string, arrays to []any and maps to
+// map[any]any.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth || len(data) == 0 {
+		return nil, nil, errCBOR
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		return nil, nil, fmt.Errorf("%w: unsupported simple value %d", errCBOR, info)
+	}
+
+	n, data, err := cborArgument(info, data)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		return n, data, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(n), data, nil
+	case 2, 3:
+		if n > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		b := data[:n]
+		if major == 3 {
+			return string(b), data[n:], nil
+		}
+		return append([]byte(nil), b...), data[n:], nil
+	case 4:
+		if n > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i], data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, data, nil
+	case 5:
+		if n > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		m := make(map[any]any, n)
+		for range n {
+			var k, v any
+			k, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			if _, ok := k.([]any); ok {
+				return nil, nil, errCBOR
+			}
+			if _, ok := k.(map[any]any); ok {
+				return nil, nil, errCBOR
+			}
+			if _, ok := k.([]byte); ok {
+				return nil, nil, errCBOR
+			}
+			v, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, data, nil
+	}
+
+	return nil, nil, fmt.Errorf("%w: unsupported major type %d", errCBOR, major)
+}
+
+func cborArgument(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	}
+
+	return 0, nil, errCBOR
+}
+
+// cborInt reads an integer map key or value, whichever major type it was
+// encoded with.
+func cborInt(v any) (int64, bool) {
+	switch n := v.(type) {
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// cborIntKey looks up an integer key in a map decoded from CBOR.
+func cborIntKey(m map[any]any, key int64) any {
+	if key >= 0 {
+		return m[uint64(key)]
+	}
+	return m[key]
+}
@@ -0,0 +1,159 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers (RFC 9053) for the signatures passkeys use.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// SupportedAlgorithms are offered to authenticators at registration, most
+// preferred first.
+var SupportedAlgorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+const (
+	coseKty = 1
+	coseAlg = 3
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrv = -1
+	coseX   = -2
+	coseY   = -3
+	coseN   = -1
+	coseE   = -2
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+var ErrUnsupportedKey = errors.New("webauthn: unsupported public key")
+
+// PublicKey is a credential public key decoded from its COSE encoding.
+type PublicKey struct {
+	Alg int64
+	key crypto.PublicKey
+}
+
+// ParsePublicKey decodes a COSE_Key.
+func ParsePublicKey(cose []byte) (*PublicKey, error) {
+	v, rest, err := decodeCBOR(cose)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing bytes after key", errCBOR)
+	}
+
+	return publicKeyFromCOSE(v)
+}
+
+func publicKeyFromCOSE(v any) (*PublicKey, error) {
+	m, ok := v.(map[any]any)
+
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+
+	kty, _ := cborInt(cborIntKey(m, coseKty))
+	alg, ok := cborInt(cborIntKey(m, coseAlg))
+
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256:
+		crv, _ := cborInt(cborIntKey(m, coseCrv))
+		x, _ := cborIntKey(m, coseX).([]byte)
+		y, _ := cborIntKey(m, coseY).([]byte)
+
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, ErrUnsupportedKey
+		}
+
+		uncompressed := append(append([]byte{4}, x...), y...)
+
+		// ecdh checks the point is on the curve
+		if _, err := ecdh.P256().NewPublicKey(uncompressed); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupportedKey, err)
+		}
+
+		return &PublicKey{Alg: alg, key: &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}}, nil
+
+	case kty == coseKtyOKP && alg == AlgEdDSA:
+		crv, _ := cborInt(cborIntKey(m, coseCrv))
+		x, _ := cborIntKey(m, coseX).([]byte)
+
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, ErrUnsupportedKey
+		}
+
+		return &PublicKey{Alg: alg, key: ed25519.PublicKey(x)}, nil
+
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := cborIntKey(m, coseN).([]byte)
+		e, _ := cborIntKey(m, coseE).([]byte)
+
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrUnsupportedKey
+		}
+
+		return &PublicKey{Alg: alg, key: &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}}, nil
+	}
+
+	return nil, ErrUnsupportedKey
+}
+
+// Verify checks sig is the key's signature over data.
+func (k *PublicKey) Verify(data, sig []byte) bool {
+	return verifySignature(k.key, k.Alg, data, sig)
+}
+
+func verifySignature(key crypto.PublicKey, alg int64, data, sig []byte) bool {
+	switch alg {
+	case AlgES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub, digest[:], sig)
+	case AlgEdDSA:
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, data, sig)
+	case AlgRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	}
+
+	return false
+}
@@ -0,0 +1,136 @@
+package webauthn
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Timeout is how long the browser gives the user to finish a ceremony.
+const Timeout = 5 * time.Minute
+
+// Bytes is binary data as WebAuthn's JSON encodes it, in base64url.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(Encoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	decoded, err := Encoding.DecodeString(strings.TrimRight(s, "="))
+
+	if err != nil {
+		return err
+	}
+
+	*b = decoded
+	return nil
+}
+
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type User struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         Bytes    `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions is PublicKeyCredentialCreationOptionsJSON, what the
+// browser passes to navigator.credentials.create().
+type CreationOptions struct {
+	Challenge              Bytes                  `json:"challenge"`
+	RP                     RelyingParty           `json:"rp"`
+	User                   User                   `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions is PublicKeyCredentialRequestOptionsJSON, what the
+// browser passes to navigator.credentials.get().
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+func (c *Config) userVerification() string {
+	if c.RequireUserVerification {
+		return "required"
+	}
+	return "preferred"
+}
+
+// CreationOptions asks for a passkey for user, one the authenticator
+// keeps so it can be used without typing a username. exclude are the
+// credentials the user already has, so the same authenticator isn't
+// registered twice.
+func (c *Config) CreationOptions(challenge []byte, user User, exclude []CredentialDescriptor) *CreationOptions {
+	params := make([]CredentialParameter, len(SupportedAlgorithms))
+	for i, alg := range SupportedAlgorithms {
+		params[i] = CredentialParameter{Type: "public-key", Alg: alg}
+	}
+
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+
+	return &CreationOptions{
+		Challenge:          challenge,
+		RP:                 RelyingParty{ID: c.RPID, Name: c.RPName},
+		User:               user,
+		PubKeyCredParams:   params,
+		Timeout:            Timeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   c.userVerification(),
+		},
+		// the statement is checked and its format kept, but who made
+		// the authenticator doesn't decide whether it is accepted
+		Attestation: "direct",
+	}
+}
+
+// RequestOptions asks for any passkey the user has for this site; the
+// response says which it was.
+func (c *Config) RequestOptions(challenge []byte) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          Timeout.Milliseconds(),
+		RPID:             c.RPID,
+		AllowCredentials: []CredentialDescriptor{},
+		UserVerification: c.userVerification(),
+	}
+}
@@ -0,0 +1,82 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"slices"
+)
+
+// idFIDOGenCeAAGUID is the certificate extension holding the AAGUID of the
+// authenticator model the certificate was issued to.
+var idFIDOGenCeAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// verifyPacked checks a packed attestation statement (WebAuthn §8.2). With
+// a certificate chain it is basic attestation, signed by a key the
+// authenticator's maker certified; without one it is self attestation,
+// signed by the credential key itself.
+func verifyPacked(attStmt map[any]any, authData, clientDataHash []byte, credentialKey *PublicKey) error {
+	alg, ok := cborInt(attStmt["alg"])
+	sig, _ := attStmt["sig"].([]byte)
+
+	if !ok || sig == nil {
+		return fmt.Errorf("%w: packed statement missing alg or sig", ErrAttestation)
+	}
+
+	signed := append(bytes.Clone(authData), clientDataHash...)
+
+	x5c, hasCerts := attStmt["x5c"].([]any)
+
+	if !hasCerts {
+		if alg != credentialKey.Alg {
+			return fmt.Errorf("%w: self attestation alg differs from the credential's", ErrAttestation)
+		}
+
+		if !credentialKey.Verify(signed, sig) {
+			return fmt.Errorf("%w: self attestation signature", ErrAttestation)
+		}
+
+		return nil
+	}
+
+	if len(x5c) == 0 {
+		return fmt.Errorf("%w: empty certificate chain", ErrAttestation)
+	}
+
+	der, _ := x5c[0].([]byte)
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return fmt.Errorf("%w: attestation certificate: %v", ErrAttestation, err)
+	}
+
+	if !verifySignature(cert.PublicKey, alg, signed, sig) {
+		return fmt.Errorf("%w: attestation signature", ErrAttestation)
+	}
+
+	// the certificate requirements of §8.2.1
+	if cert.Version != 3 || cert.IsCA || !slices.Contains(cert.Subject.OrganizationalUnit, "Authenticator Attestation") {
+		return fmt.Errorf("%w: attestation certificate doesn't meet the packed requirements", ErrAttestation)
+	}
+
+	ad, err := parseAuthenticatorData(authData)
+
+	if err != nil {
+		return err
+	}
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idFIDOGenCeAAGUID) {
+			continue
+		}
+
+		var aaguid []byte
+
+		if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil || ext.Critical || !bytes.Equal(aaguid, ad.AAGUID) {
+			return fmt.Errorf("%w: attestation certificate is for another authenticator", ErrAttestation)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,336 @@
+// Package webauthn implements the relying party side of WebAuthn Level 2
+// for passkeys: checking the response to navigator.credentials.create()
+// when a passkey is registered, and to navigator.credentials.get() when
+// one is used to log in.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	ChallengeSize = 32
+
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+
+	typeCreate = "webauthn.create"
+	typeGet    = "webauthn.get"
+)
+
+var (
+	ErrInvalidResponse  = errors.New("webauthn: invalid response")
+	ErrChallenge        = errors.New("webauthn: challenge mismatch")
+	ErrOrigin           = errors.New("webauthn: origin not allowed")
+	ErrRPID             = errors.New("webauthn: relying party id mismatch")
+	ErrUserNotPresent   = errors.New("webauthn: user not present")
+	ErrUserNotVerified  = errors.New("webauthn: user not verified")
+	ErrSignature        = errors.New("webauthn: invalid signature")
+	ErrAttestation      = errors.New("webauthn: invalid attestation")
+	ErrAttestationFmt   = errors.New("webauthn: unsupported attestation format")
+	ErrSignCountRegress = errors.New("webauthn: sign count went backwards, the authenticator may be cloned")
+)
+
+// Encoding is how binary values travel in the JSON the browser sends and
+// receives: unpadded base64url.
+var Encoding = base64.RawURLEncoding
+
+// Config identifies the relying party.
+type Config struct {
+	// RPID is the domain credentials are scoped to.
+	RPID   string
+	RPName string
+	// Origins are the origins ceremonies may come from.
+	Origins []string
+	// RequireUserVerification makes a ceremony fail unless the
+	// authenticator checked a PIN or biometric, not just a touch.
+	RequireUserVerification bool
+}
+
+// NewChallenge returns a random challenge for one ceremony.
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+// clientData is the part of the CollectedClientData the relying party
+// checks.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// ChallengeOf returns the challenge a response was made for, so the
+// ceremony it belongs to can be looked up before the response is checked.
+func ChallengeOf(clientDataJSON []byte) ([]byte, error) {
+	var cd clientData
+
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrInvalidResponse, err)
+	}
+
+	challenge, err := Encoding.DecodeString(cd.Challenge)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data challenge: %v", ErrInvalidResponse, err)
+	}
+
+	return challenge, nil
+}
+
+func (c *Config) checkClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	var cd clientData
+
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return fmt.Errorf("%w: client data: %v", ErrInvalidResponse, err)
+	}
+
+	if cd.Type != ceremony {
+		return fmt.Errorf("%w: client data type %q", ErrInvalidResponse, cd.Type)
+	}
+
+	got, err := Encoding.DecodeString(cd.Challenge)
+
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return ErrChallenge
+	}
+
+	if !slices.Contains(c.Origins, cd.Origin) {
+		return fmt.Errorf("%w: %s", ErrOrigin, cd.Origin)
+	}
+
+	return nil
+}
+
+// authenticatorData is the binary structure the authenticator signs.
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	// set at registration only
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidResponse)
+	}
+
+	ad := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if ad.Flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+
+	rest := data[37:]
+
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidResponse)
+	}
+
+	ad.AAGUID = rest[:16]
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+
+	if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+		return nil, fmt.Errorf("%w: credential id length", ErrInvalidResponse)
+	}
+
+	ad.CredentialID = rest[:idLen]
+	rest = rest[idLen:]
+
+	// the key is followed by extensions, if any, so its length is only
+	// known by decoding it
+	_, after, err := decodeCBOR(rest)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: credential public key: %v", ErrInvalidResponse, err)
+	}
+
+	ad.PublicKey = rest[:len(rest)-len(after)]
+
+	return ad, nil
+}
+
+func (c *Config) checkAuthenticatorData(ad *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return ErrRPID
+	}
+
+	if ad.Flags&flagUserPresent == 0 {
+		return ErrUserNotPresent
+	}
+
+	if c.RequireUserVerification && ad.Flags&flagUserVerified == 0 {
+		return ErrUserNotVerified
+	}
+
+	return nil
+}
+
+// AttestationResponse is the response to navigator.credentials.create(),
+// with its binary fields decoded.
+type AttestationResponse struct {
+	ClientDataJSON    []byte
+	AttestationObject []byte
+}
+
+// Credential is a newly registered passkey, as the relying party keeps it.
+type Credential struct {
+	ID        []byte
+	PublicKey []byte
+	Alg       int64
+	SignCount uint32
+	AAGUID    []byte
+	// AttestationFormat is "none" or "packed". Packed statements are
+	// checked for a valid signature, but their certificates aren't
+	// checked against a list of trusted authenticator makers.
+	AttestationFormat string
+	UserVerified      bool
+}
+
+// VerifyRegistration checks a registration response made for challenge
+// and returns the new credential.
+func (c *Config) VerifyRegistration(challenge []byte, resp *AttestationResponse) (*Credential, error) {
+	if err := c.checkClientData(resp.ClientDataJSON, typeCreate, challenge); err != nil {
+		return nil, err
+	}
+
+	v, rest, err := decodeCBOR(resp.AttestationObject)
+
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: attestation object", ErrInvalidResponse)
+	}
+
+	obj, ok := v.(map[any]any)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: attestation object", ErrInvalidResponse)
+	}
+
+	format, _ := obj["fmt"].(string)
+	authData, _ := obj["authData"].([]byte)
+	attStmt, _ := obj["attStmt"].(map[any]any)
+
+	if authData == nil || attStmt == nil {
+		return nil, fmt.Errorf("%w: attestation object", ErrInvalidResponse)
+	}
+
+	ad, err := parseAuthenticatorData(authData)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.checkAuthenticatorData(ad); err != nil {
+		return nil, err
+	}
+
+	if ad.CredentialID == nil {
+		return nil, fmt.Errorf("%w: no attested credential data", ErrInvalidResponse)
+	}
+
+	key, err := ParsePublicKey(ad.PublicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(resp.ClientDataJSON)
+
+	switch format {
+	case "none":
+		if len(attStmt) != 0 {
+			return nil, fmt.Errorf("%w: none attestation with a statement", ErrAttestation)
+		}
+	case "packed":
+		if err := verifyPacked(attStmt, authData, clientDataHash[:], key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrAttestationFmt, format)
+	}
+
+	return &Credential{
+		ID:                bytes.Clone(ad.CredentialID),
+		PublicKey:         bytes.Clone(ad.PublicKey),
+		Alg:               key.Alg,
+		SignCount:         ad.SignCount,
+		AAGUID:            bytes.Clone(ad.AAGUID),
+		AttestationFormat: format,
+		UserVerified:      ad.Flags&flagUserVerified != 0,
+	}, nil
+}
+
+// AssertionResponse is the response to navigator.credentials.get(), with
+// its binary fields decoded.
+type AssertionResponse struct {
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+	UserHandle        []byte
+}
+
+// VerifyAssertion checks a login response made for challenge with the
+// stored credential, whose public key is publicKey and whose last sign
+// count is signCount. It returns the new sign count to store.
+func (c *Config) VerifyAssertion(challenge []byte, publicKey []byte, signCount uint32, resp *AssertionResponse) (uint32, error) {
+	if err := c.checkClientData(resp.ClientDataJSON, typeGet, challenge); err != nil {
+		return 0, err
+	}
+
+	ad, err := parseAuthenticatorData(resp.AuthenticatorData)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.checkAuthenticatorData(ad); err != nil {
+		return 0, err
+	}
+
+	key, err := ParsePublicKey(publicKey)
+
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(resp.ClientDataJSON)
+	signed := append(bytes.Clone(resp.AuthenticatorData), clientDataHash[:]...)
+
+	if !key.Verify(signed, resp.Signature) {
+		return 0, ErrSignature
+	}
+
+	// authenticators that don't count always send zero; the rest must
+	// count up, or two copies of the key are in use
+	if (ad.SignCount != 0 || signCount != 0) && ad.SignCount <= signCount {
+		return 0, ErrSignCountRegress
+	}
+
+	return ad.SignCount, nil
+}
@@ -0,0 +1,696 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// cborMap is a CBOR map whose keys are encoded in the order given.
+type cborMap [][2]any
+
+// encodeCBOR is just enough of an encoder to build what authenticators
+// send.
+func encodeCBOR(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		case n <= 0xffffffff:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []any:
+		out := head(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	case cborMap:
+		out := head(5, uint64(len(v)))
+		for _, kv := range v {
+			out = append(out, encodeCBOR(kv[0])...)
+			out = append(out, encodeCBOR(kv[1])...)
+		}
+		return out
+	}
+	panic("encodeCBOR: unsupported type")
+}
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+var testConfig = &Config{
+	RPID:    testRPID,
+	RPName:  "Example",
+	Origins: []string{testOrigin},
+}
+
+// authenticator is a software authenticator holding one credential.
+type authenticator struct {
+	alg  int64
+	ec   *ecdsa.PrivateKey
+	ed   ed25519.PrivateKey
+	id   []byte
+	rpID string
+}
+
+func newAuthenticator(t *testing.T, alg int64) *authenticator {
+	t.Helper()
+
+	a := &authenticator{alg: alg, id: []byte("credential-1"), rpID: testRPID}
+
+	var err error
+
+	switch alg {
+	case AlgES256:
+		a.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, a.ed, err = ed25519.GenerateKey(rand.Reader)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func (a *authenticator) coseKey() []byte {
+	if a.alg == AlgEdDSA {
+		return encodeCBOR(cborMap{
+			{coseKty, coseKtyOKP},
+			{coseAlg, AlgEdDSA},
+			{coseCrv, coseCrvEd25519},
+			{coseX, []byte(a.ed.Public().(ed25519.PublicKey))},
+		})
+	}
+
+	return encodeCBOR(cborMap{
+		{coseKty, coseKtyEC2},
+		{coseAlg, AlgES256},
+		{coseCrv, coseCrvP256},
+		{coseX, a.ec.X.FillBytes(make([]byte, 32))},
+		{coseY, a.ec.Y.FillBytes(make([]byte, 32))},
+	})
+}
+
+func (a *authenticator) sign(data []byte) []byte {
+	if a.alg == AlgEdDSA {
+		return ed25519.Sign(a.ed, data)
+	}
+
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, a.ec, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+var testAAGUID = bytes.Repeat([]byte{0xaa}, 16)
+
+func (a *authenticator) authData(flags byte, signCount uint32, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, signCount)
+
+	if attested {
+		data = append(data, testAAGUID...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, a.coseKey()...)
+	}
+
+	return data
+}
+
+func clientDataJSON(ceremony string, challenge []byte, origin string) []byte {
+	b, _ := json.Marshal(clientData{
+		Type:      ceremony,
+		Challenge: Encoding.EncodeToString(challenge),
+		Origin:    origin,
+	})
+	return b
+}
+
+func attestationObject(format string, authData []byte, attStmt cborMap) []byte {
+	return encodeCBOR(cborMap{
+		{"fmt", format},
+		{"attStmt", attStmt},
+		{"authData", authData},
+	})
+}
+
+// register makes a registration response with a packed self attestation.
+func (a *authenticator) register(challenge []byte) *AttestationResponse {
+	cd := clientDataJSON(typeCreate, challenge, testOrigin)
+	authData := a.authData(flagUserPresent|flagUserVerified|flagAttestedData, 0, true)
+	cdHash := sha256.Sum256(cd)
+
+	return &AttestationResponse{
+		ClientDataJSON: cd,
+		AttestationObject: attestationObject("packed", authData, cborMap{
+			{"alg", int(a.alg)},
+			{"sig", a.sign(append(bytes.Clone(authData), cdHash[:]...))},
+		}),
+	}
+}
+
+func (a *authenticator) assert(challenge []byte, signCount uint32) *AssertionResponse {
+	cd := clientDataJSON(typeGet, challenge, testOrigin)
+	authData := a.authData(flagUserPresent|flagUserVerified, signCount, false)
+	cdHash := sha256.Sum256(cd)
+
+	return &AssertionResponse{
+		ClientDataJSON:    cd,
+		AuthenticatorData: authData,
+		Signature:         a.sign(append(bytes.Clone(authData), cdHash[:]...)),
+	}
+}
+
+func challenge(t *testing.T) []byte {
+	t.Helper()
+
+	c, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRegisterAndLogIn(t *testing.T) {
+	for _, alg := range []int64{AlgES256, AlgEdDSA} {
+		a := newAuthenticator(t, alg)
+		c := challenge(t)
+
+		cred, err := testConfig.VerifyRegistration(c, a.register(c))
+
+		if err != nil {
+			t.Fatalf("alg %d: registration: %v", alg, err)
+		}
+
+		if !bytes.Equal(cred.ID, a.id) || cred.Alg != alg || cred.AttestationFormat != "packed" || !cred.UserVerified || !bytes.Equal(cred.AAGUID, testAAGUID) {
+			t.Errorf("alg %d: unexpected credential %+v", alg, cred)
+		}
+
+		c = challenge(t)
+		count, err := testConfig.VerifyAssertion(c, cred.PublicKey, 4, a.assert(c, 5))
+
+		if err != nil {
+			t.Fatalf("alg %d: assertion: %v", alg, err)
+		}
+
+		if count != 5 {
+			t.Errorf("alg %d: sign count %d, want 5", alg, count)
+		}
+	}
+}
+
+func TestNoneAttestation(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	c := challenge(t)
+	cd := clientDataJSON(typeCreate, c, testOrigin)
+	authData := a.authData(flagUserPresent|flagAttestedData, 0, true)
+
+	cred, err := testConfig.VerifyRegistration(c, &AttestationResponse{
+		ClientDataJSON:    cd,
+		AttestationObject: attestationObject("none", authData, cborMap{}),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cred.AttestationFormat != "none" || cred.UserVerified {
+		t.Errorf("unexpected credential %+v", cred)
+	}
+
+	_, err = testConfig.VerifyRegistration(c, &AttestationResponse{
+		ClientDataJSON:    cd,
+		AttestationObject: attestationObject("none", authData, cborMap{{"sig", []byte{1}}}),
+	})
+
+	if !errors.Is(err, ErrAttestation) {
+		t.Errorf("none with a statement: got %v, want ErrAttestation", err)
+	}
+
+	_, err = testConfig.VerifyRegistration(c, &AttestationResponse{
+		ClientDataJSON:    cd,
+		AttestationObject: attestationObject("tpm", authData, cborMap{}),
+	})
+
+	if !errors.Is(err, ErrAttestationFmt) {
+		t.Errorf("unknown format: got %v, want ErrAttestationFmt", err)
+	}
+}
+
+// attestationCert makes a certificate for a packed basic attestation key,
+// with the AAGUID extension set to aaguid.
+func attestationCert(t *testing.T, key *ecdsa.PrivateKey, ou string, aaguid []byte) []byte {
+	t.Helper()
+
+	ext, err := asn1.Marshal(aaguid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Country:            []string{"US"},
+			Organization:       []string{"Example Authenticators"},
+			OrganizationalUnit: []string{ou},
+			CommonName:         "Example Authenticator",
+		},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: idFIDOGenCeAAGUID, Value: ext}},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+func TestPackedBasicAttestation(t *testing.T) {
+	a := newAuthenticator(t, AlgEdDSA)
+	attKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := challenge(t)
+	cd := clientDataJSON(typeCreate, c, testOrigin)
+	authData := a.authData(flagUserPresent|flagAttestedData, 0, true)
+	cdHash := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(bytes.Clone(authData), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, attKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cert []byte
+		sig  []byte
+		want error
+	}{
+		{"valid", attestationCert(t, attKey, "Authenticator Attestation", testAAGUID), sig, nil},
+		{"bad signature", attestationCert(t, attKey, "Authenticator Attestation", testAAGUID), append(bytes.Clone(sig[:len(sig)-1]), sig[len(sig)-1]^1), ErrAttestation},
+		{"wrong subject", attestationCert(t, attKey, "Other", testAAGUID), sig, ErrAttestation},
+		{"other authenticator", attestationCert(t, attKey, "Authenticator Attestation", bytes.Repeat([]byte{0xbb}, 16)), sig, ErrAttestation},
+		{"not a certificate", []byte("garbage"), sig, ErrAttestation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testConfig.VerifyRegistration(c, &AttestationResponse{
+				ClientDataJSON: cd,
+				AttestationObject: attestationObject("packed", authData, cborMap{
+					{"alg", AlgES256},
+					{"sig", tt.sig},
+					{"x5c", []any{tt.cert}},
+				}),
+			})
+
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistrationRejects(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	c := challenge(t)
+
+	tests := []struct {
+		name   string
+		mutate func(resp *AttestationResponse)
+		config *Config
+		want   error
+	}{
+		{
+			name: "bad self attestation signature",
+			mutate: func(resp *AttestationResponse) {
+				// signed by another key than the credential's
+				other := newAuthenticator(t, AlgES256)
+				authData := a.authData(flagUserPresent|flagUserVerified|flagAttestedData, 0, true)
+				cdHash := sha256.Sum256(resp.ClientDataJSON)
+				sig := other.sign(append(bytes.Clone(authData), cdHash[:]...))
+				resp.AttestationObject = attestationObject("packed", authData, cborMap{{"alg", AlgES256}, {"sig", sig}})
+			},
+			want: ErrAttestation,
+		},
+		{
+			name: "self attestation alg differs",
+			mutate: func(resp *AttestationResponse) {
+				v, _, _ := decodeCBOR(resp.AttestationObject)
+				obj := v.(map[any]any)
+				sig := obj["attStmt"].(map[any]any)["sig"].([]byte)
+				resp.AttestationObject = attestationObject("packed", obj["authData"].([]byte), cborMap{{"alg", AlgEdDSA}, {"sig", sig}})
+			},
+			want: ErrAttestation,
+		},
+		{
+			name: "wrong challenge",
+			mutate: func(resp *AttestationResponse) {
+				resp.ClientDataJSON = clientDataJSON(typeCreate, []byte("other"), testOrigin)
+			},
+			want: ErrChallenge,
+		},
+		{
+			name: "wrong origin",
+			mutate: func(resp *AttestationResponse) {
+				resp.ClientDataJSON = clientDataJSON(typeCreate, c, "https://evil.example")
+			},
+			want: ErrOrigin,
+		},
+		{
+			name:   "assertion client data",
+			mutate: func(resp *AttestationResponse) { resp.ClientDataJSON = clientDataJSON(typeGet, c, testOrigin) },
+			want:   ErrInvalidResponse,
+		},
+		{
+			name:   "rp id hash mismatch",
+			mutate: func(resp *AttestationResponse) {},
+			config: &Config{RPID: "other.example", Origins: []string{testOrigin}},
+			want:   ErrRPID,
+		},
+		{
+			name:   "user verification required and given",
+			mutate: func(resp *AttestationResponse) {},
+			config: &Config{RPID: testRPID, Origins: []string{testOrigin}, RequireUserVerification: true},
+			want:   nil,
+		},
+		{
+			name:   "trailing bytes",
+			mutate: func(resp *AttestationResponse) { resp.AttestationObject = append(resp.AttestationObject, 0) },
+			want:   ErrInvalidResponse,
+		},
+		{
+			name:   "not a map",
+			mutate: func(resp *AttestationResponse) { resp.AttestationObject = encodeCBOR([]any{1}) },
+			want:   ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := a.register(c)
+			tt.mutate(resp)
+
+			config := tt.config
+			if config == nil {
+				config = testConfig
+			}
+
+			_, err := config.VerifyRegistration(c, resp)
+
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssertionRejects(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	c := challenge(t)
+
+	cred, err := testConfig.VerifyRegistration(c, a.register(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("bad signature", func(t *testing.T) {
+		resp := a.assert(c, 1)
+		resp.Signature[len(resp.Signature)-1] ^= 1
+
+		if _, err := testConfig.VerifyAssertion(c, cred.PublicKey, 0, resp); !errors.Is(err, ErrSignature) {
+			t.Errorf("got %v, want ErrSignature", err)
+		}
+	})
+
+	t.Run("signed by another key", func(t *testing.T) {
+		other := newAuthenticator(t, AlgES256)
+
+		if _, err := testConfig.VerifyAssertion(c, cred.PublicKey, 0, other.assert(c, 1)); !errors.Is(err, ErrSignature) {
+			t.Errorf("got %v, want ErrSignature", err)
+		}
+	})
+
+	t.Run("tampered authenticator data", func(t *testing.T) {
+		resp := a.assert(c, 1)
+		resp.AuthenticatorData[36] = 9
+
+		if _, err := testConfig.VerifyAssertion(c, cred.PublicKey, 0, resp); !errors.Is(err, ErrSignature) {
+			t.Errorf("got %v, want ErrSignature", err)
+		}
+	})
+
+	t.Run("rp id hash mismatch", func(t *testing.T) {
+		other := *a
+		other.rpID = "evil.example"
+
+		if _, err := testConfig.VerifyAssertion(c, cred.PublicKey, 0, other.assert(c, 1)); !errors.Is(err, ErrRPID) {
+			t.Errorf("got %v, want ErrRPID", err)
+		}
+	})
+
+	t.Run("user not present", func(t *testing.T) {
+		cd := clientDataJSON(typeGet, c, testOrigin)
+		authData := a.authData(0, 1, false)
+		cdHash := sha256.Sum256(cd)
+		resp := &AssertionResponse{
+			ClientDataJSON:    cd,
+			AuthenticatorData: authData,
+			Signature:         a.sign(append(bytes.Clone(authData), cdHash[:]...)),
+		}
+
+		if _, err := testConfig.VerifyAssertion(c, cred.PublicKey, 0, resp); !errors.Is(err, ErrUserNotPresent) {
+			t.Errorf("got %v, want ErrUserNotPresent", err)
+		}
+	})
+
+	t.Run("registration client data", func(t *testing.T) {
+		resp := a.assert(c, 1)
+		resp.ClientDataJSON = clientDataJSON(typeCreate, c, testOrigin)
+
+		if _, err := testConfig.VerifyAssertion(c, cred.PublicKey, 0, resp); !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("got %v, want ErrInvalidResponse", err)
+		}
+	})
+
+	t.Run("short authenticator data", func(t *testing.T) {
+		resp := a.assert(c, 1)
+		resp.AuthenticatorData = resp.AuthenticatorData[:36]
+
+		if _, err := testConfig.VerifyAssertion(c, cred.PublicKey, 0, resp); !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("got %v, want ErrInvalidResponse", err)
+		}
+	})
+}
+
+func TestSignCount(t *testing.T) {
+	a := newAuthenticator(t, AlgEdDSA)
+	c := challenge(t)
+
+	cred, err := testConfig.VerifyRegistration(c, a.register(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		stored  uint32
+		sent    uint32
+		want    uint32
+		wantErr error
+	}{
+		{"counts up", 5, 6, 6, nil},
+		{"authenticator doesn't count", 0, 0, 0, nil},
+		{"first count", 0, 1, 1, nil},
+		{"repeated", 5, 5, 0, ErrSignCountRegress},
+		{"went backwards", 5, 4, 0, ErrSignCountRegress},
+		{"reset to zero", 5, 0, 0, ErrSignCountRegress},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testConfig.VerifyAssertion(c, cred.PublicKey, tt.stored, a.assert(c, tt.sent))
+
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) || got != tt.want {
+				t.Errorf("got (%d, %v), want (%d, %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	v, rest, err := decodeCBOR(append(encodeCBOR(cborMap{
+		{1, 2},
+		{-1, -300},
+		{"k", []any{[]byte{1, 2}, "s", 70000}},
+	}), 0xff))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(rest, []byte{0xff}) {
+		t.Errorf("rest = %x, want ff", rest)
+	}
+
+	m := v.(map[any]any)
+
+	if m[uint64(1)] != uint64(2) || m[int64(-1)] != int64(-300) {
+		t.Errorf("integers decoded as %#v", m)
+	}
+
+	list := m["k"].([]any)
+
+	if !bytes.Equal(list[0].([]byte), []byte{1, 2}) || list[1] != "s" || list[2] != uint64(70000) {
+		t.Errorf("array decoded as %#v", list)
+	}
+
+	for _, simple := range []struct {
+		in   byte
+		want any
+	}{{0xf4, false}, {0xf5, true}, {0xf6, nil}} {
+		if v, _, err := decodeCBOR([]byte{simple.in}); err != nil || v != simple.want {
+			t.Errorf("%x: got %v, %v", simple.in, v, err)
+		}
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	deep := bytes.Repeat([]byte{0x81}, maxCBORDepth+2)
+	deep = append(deep, 0x00)
+
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"truncated argument", []byte{0x19, 0x01}},
+		{"truncated byte string", []byte{0x45, 1, 2}},
+		{"truncated text string", []byte{0x63, 'a'}},
+		{"array longer than input", []byte{0x9a, 0xff, 0xff, 0xff, 0xff}},
+		{"map longer than input", []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"truncated array", []byte{0x82, 0x01}},
+		{"map missing value", []byte{0xa1, 0x01}},
+		{"indefinite length", []byte{0x9f, 0x01, 0xff}},
+		{"reserved argument", []byte{0x1c}},
+		{"tag", []byte{0xc0, 0x00}},
+		{"float", []byte{0xfa, 0, 0, 0, 0}},
+		{"undefined simple value", []byte{0xe0}},
+		{"negative overflow", []byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"array key", []byte{0xa1, 0x80, 0x00}},
+		{"map key", []byte{0xa1, 0xa0, 0x00}},
+		{"byte string key", []byte{0xa1, 0x40, 0x00}},
+		{"too deep", deep},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if v, _, err := decodeCBOR(tt.in); !errors.Is(err, errCBOR) {
+				t.Errorf("got (%#v, %v), want errCBOR", v, err)
+			}
+		})
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	ec := newAuthenticator(t, AlgES256)
+	x := ec.ec.X.FillBytes(make([]byte, 32))
+	y := ec.ec.Y.FillBytes(make([]byte, 32))
+	offCurve := bytes.Clone(y)
+	offCurve[31] ^= 1
+
+	ed := newAuthenticator(t, AlgEdDSA)
+	edX := []byte(ed.ed.Public().(ed25519.PublicKey))
+
+	tests := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"es256", ec.coseKey(), nil},
+		{"eddsa", ed.coseKey(), nil},
+		{"trailing bytes", append(ec.coseKey(), 0), errCBOR},
+		{"malformed", []byte{0xa5, 0x01}, errCBOR},
+		{"not a map", encodeCBOR([]any{1}), ErrUnsupportedKey},
+		{"missing alg", encodeCBOR(cborMap{{coseKty, coseKtyEC2}, {coseCrv, coseCrvP256}, {coseX, x}, {coseY, y}}), ErrUnsupportedKey},
+		{"alg of another key type", encodeCBOR(cborMap{{coseKty, coseKtyEC2}, {coseAlg, AlgEdDSA}, {coseCrv, coseCrvP256}, {coseX, x}, {coseY, y}}), ErrUnsupportedKey},
+		{"other curve", encodeCBOR(cborMap{{coseKty, coseKtyEC2}, {coseAlg, AlgES256}, {coseCrv, 2}, {coseX, x}, {coseY, y}}), ErrUnsupportedKey},
+		{"short coordinate", encodeCBOR(cborMap{{coseKty, coseKtyEC2}, {coseAlg, AlgES256}, {coseCrv, coseCrvP256}, {coseX, x[1:]}, {coseY, y}}), ErrUnsupportedKey},
+		{"point off the curve", encodeCBOR(cborMap{{coseKty, coseKtyEC2}, {coseAlg, AlgES256}, {coseCrv, coseCrvP256}, {coseX, x}, {coseY, offCurve}}), ErrUnsupportedKey},
+		{"ed448", encodeCBOR(cborMap{{coseKty, coseKtyOKP}, {coseAlg, AlgEdDSA}, {coseCrv, 7}, {coseX, edX}}), ErrUnsupportedKey},
+		{"short rsa modulus", encodeCBOR(cborMap{{coseKty, coseKtyRSA}, {coseAlg, AlgRS256}, {coseN, make([]byte, 128)}, {coseE, []byte{1, 0, 1}}}), ErrUnsupportedKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePublicKey(tt.in)
+
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureRejectsMismatchedKey(t *testing.T) {
+	ec := newAuthenticator(t, AlgES256)
+	data := []byte("data")
+	sig := ec.sign(data)
+
+	if !verifySignature(&ec.ec.PublicKey, AlgES256, data, sig) {
+		t.Fatal("valid signature rejected")
+	}
+
+	// the same key under another algorithm must not verify
+	var pub crypto.PublicKey = &ec.ec.PublicKey
+
+	for _, alg := range []int64{AlgEdDSA, AlgRS256, 0} {
+		if verifySignature(pub, alg, data, sig) {
+			t.Errorf("alg %d accepted an ES256 signature", alg)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/store"
+)
+
+const (
+	defaultPollInterval = 2 * time.Second
+	defaultBatchSize    = 20
+	defaultMaxAttempts  = 10
+	defaultTimeout      = 10 * time.Second
+
+	// a claimed delivery is left alone for this long; it has to outlast
+	// the request timeout
+	claimLease = time.Minute
+
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 6 * time.Hour
+
+	maxLoggedBody = 1024
+)
+
+// Dispatcher sends due deliveries. Any number of dispatchers can run
+// against the same database; claims keep them from sending the same
+// delivery twice at once.
+type Dispatcher struct {
+	Store        store.WebhookStore
+	Client       *http.Client
+	Logger       *log.Logger
+	Now          func() time.Time
+	PollInterval time.Duration
+	BatchSize    int
+	MaxAttempts  int
+}
+
+func NewDispatcher(webhookStore store.WebhookStore, logger *log.Logger) *Dispatcher {
+	return &Dispatcher{
+		Store: webhookStore,
+		Client: &http.Client{
+			Timeout: defaultTimeout,
+			// a redirect is a misconfigured endpoint, not a delivery
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		Logger:       logger,
+		Now:          time.Now,
+		PollInterval: defaultPollInterval,
+		BatchSize:    defaultBatchSize,
+		MaxAttempts:  defaultMaxAttempts,
+	}
+}
+
+// Backoff is the wait before retrying after the given number of failed
+// attempts: 30s doubling each time up to 6h, with some jitter so a flaky
+// endpoint isn't hit by every retry at once.
+func Backoff(attempts int) time.Duration {
+	d := maxBackoff
+	if attempts < 1 {
+		d = baseBackoff
+	} else if attempts < 20 {
+		d = min(baseBackoff<<(attempts-1), maxBackoff)
+	}
+
+	jitter := time.Duration(rand.Int64N(int64(d) / 5))
+	return d - d/10 + jitter
+}
+
+// Run sends due deliveries until ctx is cancelled and waits for the ones
+// in flight before returning.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			sent, err := d.DispatchDue(ctx)
+
+			if err != nil {
+				d.Logger.Printf("ERROR: webhooks: %v", err)
+			}
+
+			// a full batch means there is probably more waiting
+			if err != nil || sent < d.BatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DispatchDue claims one batch of due deliveries, sends them concurrently
+// and records the outcome of each. It returns how many were claimed.
+func (d *Dispatcher) DispatchDue(ctx context.Context) (int, error) {
+	jobs, err := d.Store.ClaimDueDeliveries(d.BatchSize, claimLease)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+
+	for _, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.deliver(ctx, job)
+		}()
+	}
+
+	wg.Wait()
+
+	return len(jobs), nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, job store.WebhookJob) {
+	started := d.Now()
+	attempt := store.WebhookDeliveryAttempt{AttemptedAt: started}
+
+	// a shutdown shouldn't cut a request short; the client timeout bounds it
+	status, body, err := d.send(context.WithoutCancel(ctx), job, started)
+
+	attempt.DurationMS = int(d.Now().Sub(started).Milliseconds())
+	attempt.ResponseBody = body
+
+	if status != 0 {
+		attempt.ResponseStatus = &status
+	}
+
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	outcome, next := store.WebhookSucceeded, started
+
+	if err != nil {
+		outcome = store.WebhookPending
+		next = started.Add(Backoff(job.Attempts))
+
+		if job.Attempts >= d.MaxAttempts {
+			outcome = store.WebhookDead
+			d.Logger.Printf("webhooks: delivery %d dead after %d attempts: %v", job.DeliveryID, job.Attempts, err)
+		}
+	}
+
+	if err := d.Store.RecordAttempt(job.DeliveryID, attempt, outcome, next); err != nil {
+		// the claim lease runs out and the delivery is retried
+		d.Logger.Printf("ERROR: webhooks: recording attempt for delivery %d: %v", job.DeliveryID, err)
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, job store.WebhookJob, now time.Time) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.URL, bytes.NewReader(job.Payload))
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "fm-goapp-webhooks/1")
+	req.Header.Set(HeaderEvent, job.EventType)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(job.DeliveryID, 10))
+	req.Header.Set(HeaderSignature, Sign(job.Secret, now, job.Payload))
+
+	resp, err := d.Client.Do(req)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxLoggedBody))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, string(body), errors.New(resp.Status)
+	}
+
+	return resp.StatusCode, string(body), nil
+}
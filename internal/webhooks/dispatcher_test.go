@@ -0,0 +1,228 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rpstvs/fm-goapp/internal/store"
+)
+
+// fakeWebhookStore hands out jobs once and records the attempts made on
+// them.
+type fakeWebhookStore struct {
+	store.WebhookStore
+
+	mu       sync.Mutex
+	jobs     []store.WebhookJob
+	recorded map[int64]recordedAttempt
+}
+
+type recordedAttempt struct {
+	attempt store.WebhookDeliveryAttempt
+	status  string
+	next    time.Time
+}
+
+func (s *fakeWebhookStore) ClaimDueDeliveries(limit int, lease time.Duration) ([]store.WebhookJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := min(limit, len(s.jobs))
+	jobs := s.jobs[:n]
+	s.jobs = s.jobs[n:]
+
+	return jobs, nil
+}
+
+func (s *fakeWebhookStore) RecordAttempt(deliveryID int64, attempt store.WebhookDeliveryAttempt, status string, nextAttemptAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recorded[deliveryID] = recordedAttempt{attempt, status, nextAttemptAt}
+
+	return nil
+}
+
+var testNow = time.Unix(1700000000, 0)
+
+// dispatch runs one round of the dispatcher over jobs and returns what it
+// recorded for each.
+func dispatch(t *testing.T, maxAttempts int, jobs ...store.WebhookJob) map[int64]recordedAttempt {
+	t.Helper()
+
+	fake := &fakeWebhookStore{jobs: jobs, recorded: make(map[int64]recordedAttempt)}
+
+	d := NewDispatcher(fake, log.New(io.Discard, "", 0))
+	d.Now = func() time.Time { return testNow }
+	d.MaxAttempts = maxAttempts
+
+	sent, err := d.DispatchDue(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != len(jobs) {
+		t.Fatalf("sent %d, want %d", sent, len(jobs))
+	}
+
+	return fake.recorded
+}
+
+func TestDispatchSignsDelivery(t *testing.T) {
+	const secret = "whsec_test"
+	payload := []byte(`{"type":"workout.created","data":{"id":1}}`)
+
+	var got *http.Request
+	var body []byte
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.Write([]byte("thanks"))
+	}))
+	defer srv.Close()
+
+	recorded := dispatch(t, 3, store.WebhookJob{DeliveryID: 1, URL: srv.URL, Secret: secret, EventType: "workout.created", Payload: payload, Attempts: 1})
+
+	if got == nil {
+		t.Fatal("endpoint wasn't called")
+	}
+
+	if err := Verify(secret, got.Header.Get(HeaderSignature), body, time.Minute, testNow); err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+
+	if got.Header.Get(HeaderEvent) != "workout.created" || got.Header.Get(HeaderDelivery) != "1" || got.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected headers %v", got.Header)
+	}
+
+	if string(body) != string(payload) {
+		t.Errorf("got body %s, want %s", body, payload)
+	}
+
+	r := recorded[1]
+
+	if r.status != store.WebhookSucceeded || r.attempt.ResponseStatus == nil || *r.attempt.ResponseStatus != http.StatusOK || r.attempt.ResponseBody != "thanks" || r.attempt.Error != "" {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestDispatchRetriesAndDeadLetters(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	const maxAttempts = 5
+
+	recorded := dispatch(t, maxAttempts,
+		store.WebhookJob{DeliveryID: 1, URL: srv.URL, Attempts: 1},
+		store.WebhookJob{DeliveryID: 2, URL: srv.URL, Attempts: maxAttempts - 1},
+		store.WebhookJob{DeliveryID: 3, URL: srv.URL, Attempts: maxAttempts},
+	)
+
+	for id, attempts := range map[int64]int{1: 1, 2: maxAttempts - 1} {
+		r := recorded[id]
+
+		if r.status != store.WebhookPending {
+			t.Errorf("delivery %d: status %q, want pending", id, r.status)
+		}
+
+		wait := baseBackoff << (attempts - 1)
+
+		if d := r.next.Sub(testNow); d < wait-wait/10 || d > wait+wait/10 {
+			t.Errorf("delivery %d: retried after %v, want about %v", id, d, wait)
+		}
+
+		if r.attempt.ResponseStatus == nil || *r.attempt.ResponseStatus != http.StatusServiceUnavailable || r.attempt.ResponseBody != "down for maintenance\n" || r.attempt.Error == "" {
+			t.Errorf("delivery %d: unexpected attempt %+v", id, r.attempt)
+		}
+	}
+
+	if r := recorded[3]; r.status != store.WebhookDead {
+		t.Errorf("delivery 3: status %q after %d attempts, want dead", r.status, maxAttempts)
+	}
+}
+
+func TestDispatchDoesNotFollowRedirects(t *testing.T) {
+	var followed atomic.Bool
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed.Store(true)
+	}))
+	defer target.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+
+	recorded := dispatch(t, 3, store.WebhookJob{DeliveryID: 1, URL: srv.URL, Attempts: 1})
+
+	if followed.Load() {
+		t.Error("redirect was followed")
+	}
+
+	r := recorded[1]
+
+	if r.status != store.WebhookPending || r.attempt.ResponseStatus == nil || *r.attempt.ResponseStatus != http.StatusTemporaryRedirect {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestDispatchUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	r := dispatch(t, 3, store.WebhookJob{DeliveryID: 1, URL: url, Attempts: 1})[1]
+
+	if r.status != store.WebhookPending || r.attempt.ResponseStatus != nil || r.attempt.Error == "" {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestDispatchTruncatesResponseBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 4*maxLoggedBody))
+	}))
+	defer srv.Close()
+
+	r := dispatch(t, 3, store.WebhookJob{DeliveryID: 1, URL: srv.URL, Attempts: 1})[1]
+
+	if len(r.attempt.ResponseBody) != maxLoggedBody {
+		t.Errorf("logged %d bytes of the body, want %d", len(r.attempt.ResponseBody), maxLoggedBody)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, baseBackoff},
+		{1, baseBackoff},
+		{2, 2 * baseBackoff},
+		{3, 4 * baseBackoff},
+		{10, baseBackoff << 9},
+		{11, maxBackoff},
+		{19, maxBackoff},
+		{1000, maxBackoff},
+	}
+
+	for _, tt := range tests {
+		for range 100 {
+			if d := Backoff(tt.attempts); d < tt.want-tt.want/10 || d >= tt.want+tt.want/10 {
+				t.Fatalf("Backoff(%d) = %v, want within 10%% of %v", tt.attempts, d, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	secret := "whsec_test"
+	body := []byte(`{"type":"workout.created"}`)
+	at := time.Unix(1700000000, 0)
+
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte("1700000000."))
+	h.Write(body)
+	want := "t=1700000000,v1=" + hex.EncodeToString(h.Sum(nil))
+
+	if got := Sign(secret, at, body); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret := "whsec_test"
+	body := []byte(`{"type":"workout.created"}`)
+	signedAt := time.Unix(1700000000, 0)
+	header := Sign(secret, signedAt, body)
+	tolerance := 5 * time.Minute
+
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		body   []byte
+		now    time.Time
+		ok     bool
+	}{
+		{"valid", secret, header, body, signedAt, true},
+		{"within tolerance", secret, header, body, signedAt.Add(tolerance), true},
+		{"slightly in the future", secret, header, body, signedAt.Add(-time.Minute), true},
+		{"rotated secret listed second", secret, Sign("whsec_old", signedAt, body) + "," + strings.Split(header, ",")[1], body, signedAt, true},
+		{"spaces after commas", secret, strings.ReplaceAll(header, ",", ", "), body, signedAt, true},
+		{"wrong secret", "whsec_other", header, body, signedAt, false},
+		{"tampered body", secret, header, []byte(`{"type":"workout.deleted"}`), signedAt, false},
+		{"replayed too late", secret, header, body, signedAt.Add(tolerance + time.Second), false},
+		{"too far in the future", secret, header, body, signedAt.Add(-tolerance - time.Second), false},
+		{"timestamp changed", secret, strings.Replace(header, "t=1700000000", "t=1700000060", 1), body, signedAt, false},
+		{"no timestamp", secret, strings.Split(header, ",")[1], body, signedAt, false},
+		{"no signature", secret, "t=1700000000", body, signedAt, false},
+		{"bad timestamp", secret, "t=soon," + strings.Split(header, ",")[1], body, signedAt, false},
+		{"bad hex", secret, "t=1700000000,v1=zz", body, signedAt, false},
+		{"empty", secret, "", body, signedAt, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.header, tt.body, tolerance, tt.now)
+
+			if tt.ok && err != nil {
+				t.Errorf("got %v, want ok", err)
+			}
+
+			if !tt.ok && !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("got %v, want ErrInvalidSignature", err)
+			}
+		})
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewSecret()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(a, secretPrefix) || len(a) != len(secretPrefix)+43 {
+		t.Errorf("unexpected secret %q", a)
+	}
+
+	if a == b {
+		t.Errorf("two secrets are the same")
+	}
+}
+
+func ExampleVerify() {
+	body := []byte(`{"type":"workout.created"}`)
+	now := time.Now()
+	header := Sign("whsec_test", now, body)
+
+	fmt.Println(Verify("whsec_test", header, body, 5*time.Minute, now))
+	// Output: <nil>
+}
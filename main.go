@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/rpstvs/fm-goapp/internal/app"
 	"github.com/rpstvs/fm-goapp/internal/routes"
 )
 
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 
 	var port int
@@ -24,6 +32,20 @@ func main() {
 	defer app.DB.Close()
 	app.Logger.Println("we Are running!")
 
+	app.StartScheduler()
+	app.StartLiveHub()
+	app.StartWebhookDispatcher()
+	app.StartOutboxRelay()
+
+	err = app.Jobs.Start()
+	if err != nil {
+		app.Logger.Fatal(err)
+	}
+
+	// long-lived streams watch this context so a shutdown ends them
+	// instead of waiting for them
+	streams, closeStreams := context.WithCancel(context.Background())
+
 	r := routes.SetupRoutes(app)
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
@@ -31,11 +53,35 @@ func main() {
 		IdleTimeout:  30 * time.Second,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return streams },
 	}
+	server.RegisterOnShutdown(closeStreams)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	err = server.ListenAndServe()
+	go func() {
+		err := server.ListenAndServe()
 
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.Logger.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	app.Logger.Println("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(shutdownCtx)
 	if err != nil {
-		app.Logger.Fatal(err)
+		app.Logger.Printf("ERROR: shutting down server: %v", err)
+	}
+
+	// let running jobs finish, or hand them back to the queue
+	err = app.Jobs.Shutdown(shutdownCtx)
+	if err != nil {
+		app.Logger.Printf("ERROR: draining jobs: %v", err)
 	}
 }
@@ -7,9 +7,10 @@ CREATE TABLE IF NOT EXISTS users (
     password_hash VARCHAR(255) NOT NULL,
     bio TEXT,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-) -- +goose StatementEnd
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+-- +goose StatementEnd
 -- +goose Down
 -- +goose StatementBegin
 DROP TABLE users;
--- +goose StatementEnd
\ No newline at end of file
+-- +goose StatementEnd
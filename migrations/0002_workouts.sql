@@ -8,9 +8,10 @@ CREATE TABLE IF NOT EXISTS workouts (
     duration_minutes INTEGER NOT NULL,
     calories_burned INTEGER,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-) -- +goose StatementEnd
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+-- +goose StatementEnd
 -- +goose Down
 -- +goose StatementBegin
 DROP TABLE workouts;
--- +goose StatementEnd
\ No newline at end of file
+-- +goose StatementEnd
@@ -3,7 +3,7 @@
 CREATE TABLE IF NOT EXISTS workout_entries (
     id BIGSERIAL PRIMARY KEY,
     workout_id BIGINT NOT NULL REFERENCES workouts(id) ON DELETE CASCADE,
-    excercise_name VARCHAR(255) NOT NULL,
+    exercise_name VARCHAR(255) NOT NULL,
     sets INTEGER NOT NULL,
     reps INTEGER,
     duration_seconds INTEGER,
@@ -22,8 +22,9 @@ CREATE TABLE IF NOT EXISTS workout_entries (
             OR duration_seconds IS NULL
         )
     )
-) -- +goose StatementEnd
+);
+-- +goose StatementEnd
 -- +goose Down
 -- +goose StatementBegin
 DROP TABLE workout_entries;
--- +goose StatementEnd
\ No newline at end of file
+-- +goose StatementEnd
@@ -0,0 +1,51 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE workouts ADD COLUMN search_vector tsvector;
+ALTER TABLE workout_entries ADD COLUMN search_vector tsvector;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE FUNCTION workouts_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('english', coalesce(NEW.title, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce(NEW.description, '')), 'B');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE FUNCTION workout_entries_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('english', coalesce(NEW.exercise_name, '')), 'C') ||
+        setweight(to_tsvector('english', coalesce(NEW.notes, '')), 'D');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER workouts_search_vector_trigger
+    BEFORE INSERT OR UPDATE OF title, description ON workouts
+    FOR EACH ROW EXECUTE FUNCTION workouts_search_vector_update();
+
+CREATE TRIGGER workout_entries_search_vector_trigger
+    BEFORE INSERT OR UPDATE OF exercise_name, notes ON workout_entries
+    FOR EACH ROW EXECUTE FUNCTION workout_entries_search_vector_update();
+
+UPDATE workouts SET title = title;
+UPDATE workout_entries SET exercise_name = exercise_name;
+
+CREATE INDEX workouts_search_vector_idx ON workouts USING GIN (search_vector);
+CREATE INDEX workout_entries_search_vector_idx ON workout_entries USING GIN (search_vector);
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS workout_entries_search_vector_idx;
+DROP INDEX IF EXISTS workouts_search_vector_idx;
+DROP TRIGGER IF EXISTS workout_entries_search_vector_trigger ON workout_entries;
+DROP TRIGGER IF EXISTS workouts_search_vector_trigger ON workouts;
+DROP FUNCTION IF EXISTS workout_entries_search_vector_update();
+DROP FUNCTION IF EXISTS workouts_search_vector_update();
+ALTER TABLE workout_entries DROP COLUMN search_vector;
+ALTER TABLE workouts DROP COLUMN search_vector;
+-- +goose StatementEnd
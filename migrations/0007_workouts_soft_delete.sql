@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE workouts ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX workouts_deleted_at_idx ON workouts (deleted_at) WHERE deleted_at IS NOT NULL;
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS workouts_deleted_at_idx;
+ALTER TABLE workouts DROP COLUMN deleted_at;
+-- +goose StatementEnd
@@ -0,0 +1,40 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS workout_revisions (
+    id BIGSERIAL PRIMARY KEY,
+    workout_id BIGINT NOT NULL REFERENCES workouts(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    snapshot JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (workout_id, revision)
+);
+
+INSERT INTO workout_revisions (workout_id, revision, snapshot)
+SELECT w.id, 1, jsonb_build_object(
+    'id', w.id,
+    'UserID', w.user_id,
+    'title', w.title,
+    'description', coalesce(w.description, ''),
+    'duration_minutes', w.duration_minutes,
+    'calories_burned', coalesce(w.calories_burned, 0),
+    'entries', coalesce((
+        SELECT jsonb_agg(jsonb_build_object(
+            'id', e.id,
+            'exercise_name', e.exercise_name,
+            'sets', e.sets,
+            'reps', e.reps,
+            'duration_seconds', e.duration_seconds,
+            'weight', e.weight,
+            'notes', coalesce(e.notes, ''),
+            'order_index', e.order_index
+        ) ORDER BY e.order_index)
+        FROM workout_entries e
+        WHERE e.workout_id = w.id
+    ), '[]'::jsonb)
+)
+FROM workouts w;
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE workout_revisions;
+-- +goose StatementEnd
@@ -0,0 +1,8 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE workouts ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE workouts DROP COLUMN version;
+-- +goose StatementEnd
@@ -0,0 +1,185 @@
+-- +goose Up
+-- +goose StatementBegin
+-- one counter per user, taken with a row lock by every write so sequence
+-- numbers are handed out in commit order for that user
+CREATE TABLE IF NOT EXISTS sync_counters (
+    user_id BIGINT PRIMARY KEY,
+    seq BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS sync_tombstones (
+    user_id BIGINT NOT NULL,
+    seq BIGINT NOT NULL,
+    entity VARCHAR(20) NOT NULL,
+    entity_id BIGINT NOT NULL,
+    workout_id BIGINT NOT NULL,
+    deleted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, seq)
+);
+
+ALTER TABLE workouts ADD COLUMN sync_seq BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE workouts ADD COLUMN field_seqs JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE workout_entries ADD COLUMN sync_seq BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE workout_entries ADD COLUMN field_seqs JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX workouts_user_sync_seq_idx ON workouts (user_id, sync_seq);
+CREATE INDEX workout_entries_sync_seq_idx ON workout_entries (workout_id, sync_seq);
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE FUNCTION next_sync_seq(uid BIGINT) RETURNS BIGINT AS $$
+    INSERT INTO sync_counters (user_id, seq) VALUES (uid, 1)
+    ON CONFLICT (user_id) DO UPDATE SET seq = sync_counters.seq + 1
+    RETURNING seq;
+$$ LANGUAGE sql;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE FUNCTION workouts_sync_update() RETURNS trigger AS $$
+DECLARE
+    s BIGINT;
+BEGIN
+    s := next_sync_seq(NEW.user_id);
+    NEW.sync_seq := s;
+
+    IF TG_OP = 'INSERT' THEN
+        NEW.field_seqs := jsonb_build_object(
+            'title', s,
+            'description', s,
+            'duration_minutes', s,
+            'calories_burned', s
+        );
+        RETURN NEW;
+    END IF;
+
+    IF NEW.title IS DISTINCT FROM OLD.title THEN
+        NEW.field_seqs := NEW.field_seqs || jsonb_build_object('title', s);
+    END IF;
+    IF NEW.description IS DISTINCT FROM OLD.description THEN
+        NEW.field_seqs := NEW.field_seqs || jsonb_build_object('description', s);
+    END IF;
+    IF NEW.duration_minutes IS DISTINCT FROM OLD.duration_minutes THEN
+        NEW.field_seqs := NEW.field_seqs || jsonb_build_object('duration_minutes', s);
+    END IF;
+    IF NEW.calories_burned IS DISTINCT FROM OLD.calories_burned THEN
+        NEW.field_seqs := NEW.field_seqs || jsonb_build_object('calories_burned', s);
+    END IF;
+
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE FUNCTION workout_entries_sync_update() RETURNS trigger AS $$
+DECLARE
+    s BIGINT;
+    uid BIGINT;
+BEGIN
+    SELECT user_id INTO uid FROM workouts WHERE id = NEW.workout_id;
+    s := next_sync_seq(uid);
+    NEW.sync_seq := s;
+
+    IF TG_OP = 'INSERT' THEN
+        NEW.field_seqs := jsonb_build_object(
+            'exercise_name', s,
+            'sets', s,
+            'reps', s,
+            'duration_seconds', s,
+            'weight', s,
+            'notes', s,
+            'order_index', s
+        );
+        RETURN NEW;
+    END IF;
+
+    IF NEW.exercise_name IS DISTINCT FROM OLD.exercise_name THEN
+        NEW.field_seqs := NEW.field_seqs || jsonb_build_object('exercise_name', s);
+    END IF;
+    IF NEW.sets IS DISTINCT FROM OLD.sets THEN
+        NEW.field_seqs := NEW.field_seqs || jsonb_build_object('sets', s);
+    END IF;
+    IF NEW.reps IS DISTINCT FROM OLD.reps THEN
+        NEW.field_seqs := NEW.field_seqs || jsonb_build_object('reps', s);
+    END IF;
+    IF NEW.duration_seconds IS DISTINCT FROM OLD.duration_seconds THEN
+        NEW.field_seqs := NEW.field_seqs || jsonb_build_object('duration_seconds', s);
+    END IF;
+    IF NEW.weight IS DISTINCT FROM OLD.weight THEN
+        NEW.field_seqs := NEW.field_seqs || jsonb_build_object('weight', s);
+    END IF;
+    IF NEW.notes IS DISTINCT FROM OLD.notes THEN
+        NEW.field_seqs := NEW.field_seqs || jsonb_build_object('notes', s);
+    END IF;
+    IF NEW.order_index IS DISTINCT FROM OLD.order_index THEN
+        NEW.field_seqs := NEW.field_seqs || jsonb_build_object('order_index', s);
+    END IF;
+
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE FUNCTION workouts_sync_tombstone() RETURNS trigger AS $$
+BEGIN
+    -- nothing to sync when the whole account is being removed
+    IF NOT EXISTS (SELECT 1 FROM users WHERE id = OLD.user_id) THEN
+        RETURN OLD;
+    END IF;
+
+    INSERT INTO sync_tombstones (user_id, seq, entity, entity_id, workout_id)
+    VALUES (OLD.user_id, next_sync_seq(OLD.user_id), 'workout', OLD.id, OLD.id);
+    RETURN OLD;
+END
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE FUNCTION workout_entries_sync_tombstone() RETURNS trigger AS $$
+DECLARE
+    uid BIGINT;
+BEGIN
+    -- entries removed along with their workout are covered by the
+    -- workout's own tombstone
+    SELECT user_id INTO uid FROM workouts WHERE id = OLD.workout_id;
+    IF uid IS NULL THEN
+        RETURN OLD;
+    END IF;
+
+    INSERT INTO sync_tombstones (user_id, seq, entity, entity_id, workout_id)
+    VALUES (uid, next_sync_seq(uid), 'entry', OLD.id, OLD.workout_id);
+    RETURN OLD;
+END
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER workouts_sync_trigger
+    BEFORE INSERT OR UPDATE ON workouts
+    FOR EACH ROW EXECUTE FUNCTION workouts_sync_update();
+
+CREATE TRIGGER workout_entries_sync_trigger
+    BEFORE INSERT OR UPDATE ON workout_entries
+    FOR EACH ROW EXECUTE FUNCTION workout_entries_sync_update();
+
+CREATE TRIGGER workouts_sync_tombstone_trigger
+    AFTER DELETE ON workouts
+    FOR EACH ROW EXECUTE FUNCTION workouts_sync_tombstone();
+
+CREATE TRIGGER workout_entries_sync_tombstone_trigger
+    AFTER DELETE ON workout_entries
+    FOR EACH ROW EXECUTE FUNCTION workout_entries_sync_tombstone();
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS workout_entries_sync_tombstone_trigger ON workout_entries;
+DROP TRIGGER IF EXISTS workouts_sync_tombstone_trigger ON workouts;
+DROP TRIGGER IF EXISTS workout_entries_sync_trigger ON workout_entries;
+DROP TRIGGER IF EXISTS workouts_sync_trigger ON workouts;
+DROP FUNCTION IF EXISTS workout_entries_sync_tombstone();
+DROP FUNCTION IF EXISTS workouts_sync_tombstone();
+DROP FUNCTION IF EXISTS workout_entries_sync_update();
+DROP FUNCTION IF EXISTS workouts_sync_update();
+DROP FUNCTION IF EXISTS next_sync_seq(BIGINT);
+ALTER TABLE workout_entries DROP COLUMN field_seqs;
+ALTER TABLE workout_entries DROP COLUMN sync_seq;
+ALTER TABLE workouts DROP COLUMN field_seqs;
+ALTER TABLE workouts DROP COLUMN sync_seq;
+DROP TABLE sync_tombstones;
+DROP TABLE sync_counters;
+-- +goose StatementEnd
@@ -0,0 +1,48 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS live_sessions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    title VARCHAR(255) NOT NULL,
+    rest_ends_at TIMESTAMP WITH TIME ZONE,
+    workout_id BIGINT REFERENCES workouts(id) ON DELETE SET NULL,
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE IF NOT EXISTS live_session_viewers (
+    session_id BIGINT NOT NULL REFERENCES live_sessions(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (session_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS live_session_sets (
+    id BIGSERIAL PRIMARY KEY,
+    session_id BIGINT NOT NULL REFERENCES live_sessions(id) ON DELETE CASCADE,
+    exercise_name VARCHAR(255) NOT NULL,
+    reps INTEGER,
+    duration_seconds INTEGER,
+    weight DECIMAL(5, 2),
+    notes TEXT NOT NULL DEFAULT '',
+    completed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT valid_live_session_set CHECK (
+        (
+            reps IS NOT NULL
+            OR duration_seconds IS NOT NULL
+        )
+        AND (
+            reps IS NULL
+            OR duration_seconds IS NULL
+        )
+    )
+);
+
+CREATE INDEX live_session_sets_session_id_idx ON live_session_sets (session_id, id);
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE live_session_sets;
+DROP TABLE live_session_viewers;
+DROP TABLE live_sessions;
+-- +goose StatementEnd
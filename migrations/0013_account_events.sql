@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+-- seq comes from next_sync_seq, so a user's events are numbered in commit
+-- order and a stream can resume from the last one it saw
+CREATE TABLE IF NOT EXISTS account_events (
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    seq BIGINT NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    data JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, seq)
+);
+
+CREATE INDEX account_events_created_at_idx ON account_events (created_at);
+
+-- the newest seq removed by the retention purge; a stream resuming from
+-- before it has missed events
+ALTER TABLE sync_counters ADD COLUMN events_purged_through BIGINT NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE sync_counters DROP COLUMN events_purged_through;
+DROP TABLE account_events;
+-- +goose StatementEnd
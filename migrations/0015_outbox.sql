@@ -0,0 +1,40 @@
+-- +goose Up
+-- +goose StatementBegin
+-- one row per aggregate, locked by every transaction that writes an event
+-- about it so its events are numbered, and get outbox ids, in commit order
+CREATE TABLE IF NOT EXISTS outbox_aggregates (
+    aggregate_type VARCHAR(50) NOT NULL,
+    aggregate_id BIGINT NOT NULL,
+    seq BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (aggregate_type, aggregate_id)
+);
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    aggregate_type VARCHAR(50) NOT NULL,
+    aggregate_id BIGINT NOT NULL,
+    seq BIGINT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMP WITH TIME ZONE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX outbox_unpublished_idx ON outbox (id) WHERE published_at IS NULL;
+CREATE INDEX outbox_published_at_idx ON outbox (published_at) WHERE published_at IS NOT NULL;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE FUNCTION next_outbox_seq(atype VARCHAR, aid BIGINT) RETURNS BIGINT AS $$
+    INSERT INTO outbox_aggregates (aggregate_type, aggregate_id, seq) VALUES (atype, aid, 1)
+    ON CONFLICT (aggregate_type, aggregate_id) DO UPDATE SET seq = outbox_aggregates.seq + 1
+    RETURNING seq;
+$$ LANGUAGE sql;
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP FUNCTION IF EXISTS next_outbox_seq(VARCHAR, BIGINT);
+DROP TABLE outbox;
+DROP TABLE outbox_aggregates;
+-- +goose StatementEnd
@@ -0,0 +1,42 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS jobs (
+    id BIGSERIAL PRIMARY KEY,
+    kind VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'succeeded', 'failed')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL,
+    run_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    unique_key VARCHAR(255),
+    locked_by VARCHAR(100),
+    locked_until TIMESTAMP WITH TIME ZONE,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX jobs_ready_idx ON jobs (run_at, id) WHERE status = 'queued';
+CREATE INDEX jobs_lease_idx ON jobs (locked_until) WHERE status = 'running';
+CREATE INDEX jobs_finished_at_idx ON jobs (finished_at) WHERE finished_at IS NOT NULL;
+
+-- a unique key only holds while the job is waiting or running, so the
+-- same work can be queued again once it is done
+CREATE UNIQUE INDEX jobs_unique_key_idx ON jobs (kind, unique_key)
+    WHERE unique_key IS NOT NULL AND status IN ('queued', 'running');
+
+CREATE TABLE IF NOT EXISTS job_workers (
+    id VARCHAR(100) PRIMARY KEY,
+    hostname VARCHAR(255) NOT NULL,
+    concurrency INTEGER NOT NULL,
+    kinds TEXT[] NOT NULL,
+    running INTEGER NOT NULL DEFAULT 0,
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    last_heartbeat_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE job_workers;
+DROP TABLE jobs;
+-- +goose StatementEnd
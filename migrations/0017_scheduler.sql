@@ -0,0 +1,40 @@
+-- +goose Up
+-- +goose StatementBegin
+-- one row per run of a scheduled job; the unique slot keeps a run from
+-- happening twice when leadership moves between replicas
+CREATE TABLE IF NOT EXISTS scheduled_runs (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    scheduled_for TIMESTAMP WITH TIME ZONE NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP WITH TIME ZONE,
+    status VARCHAR(20) NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'succeeded', 'failed')),
+    result TEXT NOT NULL DEFAULT '',
+    UNIQUE (name, scheduled_for)
+);
+
+CREATE INDEX scheduled_runs_name_idx ON scheduled_runs (name, scheduled_for DESC);
+
+CREATE INDEX tokens_expiry_idx ON tokens (expiry);
+
+-- per user and ISO week (weeks start on Monday, in UTC)
+CREATE MATERIALIZED VIEW user_weekly_stats AS
+SELECT
+    user_id,
+    date_trunc('week', created_at AT TIME ZONE 'UTC')::date AS week_start,
+    count(*) AS workouts,
+    coalesce(sum(duration_minutes), 0) AS duration_minutes,
+    coalesce(sum(calories_burned), 0) AS calories_burned
+FROM workouts
+WHERE deleted_at IS NULL
+GROUP BY user_id, week_start;
+
+-- needed to refresh the view concurrently
+CREATE UNIQUE INDEX user_weekly_stats_idx ON user_weekly_stats (user_id, week_start);
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP MATERIALIZED VIEW user_weekly_stats;
+DROP INDEX IF EXISTS tokens_expiry_idx;
+DROP TABLE scheduled_runs;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- a row per category of email a user has opted out of; no row means the
+-- user gets it
+CREATE TABLE IF NOT EXISTS email_opt_outs (
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    category VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, category)
+);
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE email_opt_outs;
+-- +goose StatementEnd
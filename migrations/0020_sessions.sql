@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- an id lets a session be named without its token, and the rest
+-- describes where it was opened and when it was last used
+ALTER TABLE tokens
+    ADD COLUMN id BIGSERIAL UNIQUE,
+    ADD COLUMN created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN last_used_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN ip VARCHAR(64) NOT NULL DEFAULT '';
+
+CREATE INDEX tokens_user_scope_idx ON tokens (user_id, scope);
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS tokens_user_scope_idx;
+ALTER TABLE tokens
+    DROP COLUMN id,
+    DROP COLUMN created_at,
+    DROP COLUMN last_used_at,
+    DROP COLUMN user_agent,
+    DROP COLUMN ip;
+-- +goose StatementEnd
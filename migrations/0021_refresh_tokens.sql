@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the tokens issued at one login and by every refresh after it share a
+-- family, named by the id of the first; a refresh token is kept after use,
+-- marked used_at, so presenting it again can be caught
+ALTER TABLE tokens
+    ADD COLUMN family_id BIGINT,
+    ADD COLUMN used_at TIMESTAMP WITH TIME ZONE;
+
+UPDATE tokens SET family_id = id WHERE scope = 'authentication';
+
+CREATE INDEX tokens_family_idx ON tokens (family_id) WHERE family_id IS NOT NULL;
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS tokens_family_idx;
+ALTER TABLE tokens
+    DROP COLUMN family_id,
+    DROP COLUMN used_at;
+-- +goose StatementEnd
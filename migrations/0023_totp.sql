@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    -- NULL until the user proves their authenticator has the secret
+    confirmed_at TIMESTAMP WITH TIME ZONE,
+    -- the time step of the last code accepted, so a code can't be replayed
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    failed_attempts INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    hash BYTEA NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (user_id, hash)
+);
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE recovery_codes;
+DROP TABLE user_totp;
+-- +goose StatementEnd
@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS credentials (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    credential_id BYTEA UNIQUE NOT NULL,
+    -- COSE encoded
+    public_key BYTEA NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    aaguid BYTEA NOT NULL,
+    attestation_format VARCHAR(20) NOT NULL,
+    transports TEXT[] NOT NULL DEFAULT '{}',
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX credentials_user_idx ON credentials (user_id);
+
+-- a challenge lives from the start of a registration or login until the
+-- response to it comes back; logins don't know the user yet
+CREATE TABLE IF NOT EXISTS webauthn_challenges (
+    challenge BYTEA PRIMARY KEY,
+    ceremony VARCHAR(20) NOT NULL,
+    user_id BIGINT REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE webauthn_challenges;
+DROP TABLE credentials;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- a magic link bound to the browser that asked for it only works with the
+-- nonce from that browser's cookie
+ALTER TABLE tokens ADD COLUMN nonce_hash BYTEA;
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE tokens DROP COLUMN nonce_hash;
+-- +goose StatementEnd
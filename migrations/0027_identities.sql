@@ -0,0 +1,32 @@
+-- +goose Up
+-- +goose StatementBegin
+-- an account at an external OpenID Connect provider a user logs in with;
+-- providers promise a subject is unique and stable within their issuer
+CREATE TABLE IF NOT EXISTS identities (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    issuer TEXT NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    last_login_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (issuer, subject),
+    UNIQUE (user_id, issuer)
+);
+
+-- a login lives from the redirect to the provider until the user comes
+-- back with a code
+CREATE TABLE IF NOT EXISTS sso_logins (
+    state VARCHAR(64) PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE sso_logins;
+DROP TABLE identities;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- when the request holding an in-flight key claimed it; a claim older than
+-- the lease is taken to belong to a request that died
+ALTER TABLE idempotency_keys
+    ADD COLUMN locked_at TIMESTAMP WITH TIME ZONE;
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE idempotency_keys
+    DROP COLUMN locked_at;
+-- +goose StatementEnd
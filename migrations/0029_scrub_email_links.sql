@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- verification, password reset and login links used to be queued inside
+-- send_email jobs; drop them from the jobs that are still kept. Emails that
+-- haven't gone out yet would arrive without their link, so they are failed
+-- and the user has to ask for a new one.
+UPDATE jobs
+SET status = CASE WHEN status = 'queued' THEN 'failed' ELSE status END,
+    finished_at = CASE WHEN status = 'queued' THEN CURRENT_TIMESTAMP ELSE finished_at END,
+    last_error = CASE WHEN status = 'queued' THEN 'link removed from the queue' ELSE last_error END,
+    payload = payload - 'data'
+WHERE kind = 'send_email'
+    AND payload ->> 'template' IN ('verify_email', 'password_reset', 'magic_link')
+    AND payload ? 'data';
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+SELECT 1;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+-- a failed event waits until next_attempt_at before it, and the later
+-- events of its aggregate, are tried again; one that keeps failing is
+-- given up on at dead_at so the events after it can go out
+ALTER TABLE outbox
+    ADD COLUMN next_attempt_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN dead_at TIMESTAMP WITH TIME ZONE;
+
+DROP INDEX outbox_unpublished_idx;
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE published_at IS NULL AND dead_at IS NULL;
+CREATE INDEX outbox_waiting_idx ON outbox (aggregate_type, aggregate_id, id)
+    WHERE published_at IS NULL AND dead_at IS NULL AND next_attempt_at IS NOT NULL;
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX outbox_waiting_idx;
+DROP INDEX outbox_pending_idx;
+CREATE INDEX outbox_unpublished_idx ON outbox (id) WHERE published_at IS NULL;
+
+ALTER TABLE outbox
+    DROP COLUMN dead_at,
+    DROP COLUMN next_attempt_at;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the weeks each user has been sent a summary for, so rerunning the
+-- weekly job doesn't send another
+CREATE TABLE IF NOT EXISTS weekly_summaries (
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    week_start DATE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, week_start)
+);
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE weekly_summaries;
+-- +goose StatementEnd